@@ -1,7 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +20,184 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// ensureTempDir creates the temp directory if needed and verifies that it's
+// writable, so a misconfigured host fails at startup rather than mid-upload.
+func (cfg apiConfig) ensureTempDir() error {
+	if err := os.MkdirAll(cfg.tempDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(cfg.tempDir, "tubely-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// cleanupStaleTempFiles removes the temp files (and HLS directories) that
+// crashed uploads and processing runs left in tempDir. Only entries older
+// than maxAge are touched, so another instance sharing the directory keeps
+// the files it's working on. Uploads saved for a processing job are kept so
+// the job can resume, as are the files of tus uploads that haven't expired.
+// It returns the number of entries removed.
+func (cfg apiConfig) cleanupStaleTempFiles(ctx context.Context, maxAge time.Duration) (int, error) {
+	jobs, err := cfg.db.GetProcessingJobs()
+	if err != nil {
+		return 0, err
+	}
+	inUse := map[string]bool{}
+	for _, job := range jobs {
+		inUse[filepath.Clean(job.Path)] = true
+	}
+	for _, path := range cfg.tusUploads.paths() {
+		inUse[filepath.Clean(path)] = true
+	}
+
+	entries, err := os.ReadDir(cfg.tempDir)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "tubely-") {
+			continue
+		}
+		p := filepath.Join(cfg.tempDir, entry.Name())
+		if inUse[p] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			slog.ErrorContext(ctx, "couldn't remove stale temp file", "path", p, "error", err.Error())
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// tempDirCleanupInterval is how often idle tus uploads and stale temp files
+// are swept up while the server runs.
+const tempDirCleanupInterval = 10 * time.Minute
+
+// cleanupTempDir expires idle tus uploads and then removes stale temp files.
+func (cfg *apiConfig) cleanupTempDir(ctx context.Context) {
+	if expired := cfg.expireTusUploads(ctx); expired > 0 {
+		slog.InfoContext(ctx, "expired idle tus uploads", "count", expired)
+	}
+	if cfg.staleTempFileAge <= 0 {
+		return
+	}
+	removed, err := cfg.cleanupStaleTempFiles(ctx, cfg.staleTempFileAge)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't clean up temp directory", "error", err.Error())
+	} else if removed > 0 {
+		slog.InfoContext(ctx, "removed stale temp files", "count", removed, "dir", cfg.tempDir)
+	}
+}
+
+func (cfg apiConfig) getAssetURL(name string) string {
+	return cfg.publicBaseURL + "/assets/" + name
+}
+
+// assetName returns the name of the file under assetsRoot that assetURL
+// points at. Only the path is looked at, since assets saved before
+// PUBLIC_BASE_URL was set have localhost URLs.
+func assetName(assetURL string) (string, bool) {
+	_, name, found := strings.Cut(assetURL, "/assets/")
+	if !found || name == "" {
+		return "", false
+	}
+	return filepath.Base(name), true
+}
+
+// deleteThumbnailFile removes a thumbnail stored under assetsRoot. URLs that
+// point anywhere else are left alone.
+func (cfg apiConfig) deleteThumbnailFile(thumbnailURL string) error {
+	name, ok := assetName(thumbnailURL)
+	if !ok {
+		return nil
+	}
+	err := os.Remove(filepath.Join(cfg.assetsRoot, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// randomName returns 32 random bytes, URL-safe base64 encoded.
+func randomName() (string, error) {
+	base := make([]byte, 32)
+	if _, err := rand.Read(base); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(base), nil
+}
+
+// uniqueKeyAttempts is how many keys getUniqueKey generates before giving up.
+const uniqueKeyAttempts = 3
+
+// getUniqueKey returns a key made by newKey, making another if the backend
+// already has an object there. Backends that can't check get the first key.
+func getUniqueKey(ctx context.Context, storage StorageBackend, newKey func() (string, error)) (string, error) {
+	checker, canCheck := storage.(objectChecker)
+	for range uniqueKeyAttempts {
+		key, err := newKey()
+		if err != nil {
+			return "", err
+		}
+		if !canCheck {
+			return key, nil
+		}
+		exists, err := checker.Exists(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("couldn't generate an unused key after %d attempts", uniqueKeyAttempts)
+}
+
+// mediaTypeExtension returns a file extension, including the dot, for a
+// media type such as "video/mp4; codecs=avc1". Known types use the system
+// MIME table, preferring the extension that matches the subtype (".jpeg"
+// over ".jfif"). Unknown types fall back to the subtype with anything that
+// isn't a letter or digit removed.
+func mediaTypeExtension(mediaType string) string {
+	if parsed, _, err := mime.ParseMediaType(mediaType); err == nil {
+		mediaType = parsed
+	}
+	_, subtype, _ := strings.Cut(mediaType, "/")
+
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		for _, ext := range exts {
+			if ext == "."+subtype {
+				return ext
+			}
+		}
+		return exts[0]
+	}
+
+	// Drop structured-syntax suffixes like "+xml" and vendor prefixes
+	subtype, _, _ = strings.Cut(subtype, "+")
+	if i := strings.LastIndex(subtype, "."); i >= 0 {
+		subtype = subtype[i+1:]
+	}
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, strings.ToLower(subtype))
+	if sanitized == "" {
+		return ".bin"
+	}
+	return "." + sanitized
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestMediaTypeExtension(t *testing.T) {
+	tests := []struct {
+		mediaType string
+		want      string
+	}{
+		{"image/jpeg", ".jpeg"},
+		{"image/png", ".png"},
+		{"video/mp4", ".mp4"},
+		{"video/mp4; codecs=\"avc1.42E01E\"", ".mp4"},
+		{"application/vnd.tubely.clip", ".clip"},
+		{"application/x-tubely+json", ".xtubely"},
+		{"video/!!!", ".bin"},
+	}
+	for _, tt := range tests {
+		if got := mediaTypeExtension(tt.mediaType); got != tt.want {
+			t.Errorf("mediaTypeExtension(%q) = %q, want %q", tt.mediaType, got, tt.want)
+		}
+	}
+}
+
+func TestCleanupStaleTempFiles(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Queued")
+
+	old := time.Now().Add(-2 * time.Hour)
+	plant := func(name string, modTime time.Time) string {
+		t.Helper()
+		p := filepath.Join(cfg.tempDir, name)
+		writeTestFile(t, p, "data", 0o644)
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	plant("tubely-stale.mp4", old)
+	plant("tubely-fresh.mp4", time.Now())
+	plant("other-stale.mp4", old)
+	// Old, but a queued job and a tus upload are still going to use these
+	jobPath := plant("tubely-queued.mp4", old)
+	tusPath := plant("tubely-tus.mp4", old)
+	if _, err := cfg.db.CreateProcessingJob(database.ProcessingJob{VideoID: video.ID, Path: jobPath, MediaType: "video/mp4"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg.tusUploads.add(&tusUpload{id: uuid.New(), userID: user.ID, videoID: video.ID, path: tusPath, expiresAt: time.Now().Add(time.Hour)})
+
+	removed, err := cfg.cleanupStaleTempFiles(t.Context(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d files, want 1", removed)
+	}
+
+	entries, err := os.ReadDir(cfg.tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	want := []string{"other-stale.mp4", "tubely-fresh.mp4", "tubely-queued.mp4", "tubely-tus.mp4"}
+	if !slices.Equal(left, want) {
+		t.Errorf("temp dir holds %v, want %v", left, want)
+	}
+}
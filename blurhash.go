@@ -0,0 +1,122 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// BlurHash (https://blurha.sh) encodes a tiny blurred preview of an image in
+// a short string that clients decode into a placeholder while the real
+// thumbnail loads.
+
+const (
+	blurHashXComponents = 4
+	blurHashYComponents = 3
+	// blurHashSampleWidth is the width images are scaled down to first; the
+	// hash only keeps a handful of frequencies, so more pixels don't help
+	blurHashSampleWidth = 64
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash returns the BlurHash of img.
+func blurHash(img image.Image) string {
+	img = scaleToWidth(img, blurHashSampleWidth)
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+
+	// Linear RGB of every pixel, so each isn't converted once per component
+	pixels := make([][3]float64, w*h)
+	for y := range h {
+		for x := range w {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			pixels[y*w+x] = [3]float64{sRGBToLinear(r >> 8), sRGBToLinear(g >> 8), sRGBToLinear(bl >> 8)}
+		}
+	}
+
+	factors := make([][3]float64, 0, blurHashXComponents*blurHashYComponents)
+	for j := range blurHashYComponents {
+		for i := range blurHashXComponents {
+			var factor [3]float64
+			for y := range h {
+				for x := range w {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					p := pixels[y*w+x]
+					factor[0] += basis * p[0]
+					factor[1] += basis * p[1]
+					factor[2] += basis * p[2]
+				}
+			}
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			scale := normalisation / float64(w*h)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	sizeFlag := (blurHashXComponents - 1) + (blurHashYComponents-1)*9
+	hash.WriteString(encodeBase83(sizeFlag, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		quantise := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2))
+	}
+	return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+	out := make([]byte, length)
+	for i := range length {
+		digit := value
+		for range length - i - 1 {
+			digit /= 83
+		}
+		out[i] = base83Chars[digit%83]
+	}
+	return string(out)
+}
+
+func sRGBToLinear(v uint32) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// decodeBase83 reverses encodeBase83.
+func decodeBase83(s string) int {
+	value := 0
+	for _, c := range s {
+		value = value*83 + strings.IndexRune(base83Chars, c)
+	}
+	return value
+}
+
+// solidImage returns a width x height image filled with c.
+func solidImage(width, height int, c color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestBlurHashSolidColor(t *testing.T) {
+	hash := blurHash(solidImage(40, 30, color.RGBA{0x33, 0x66, 0xcc, 255}))
+
+	if want := 6 + 2*(blurHashXComponents*blurHashYComponents-1); len(hash) != want {
+		t.Fatalf("hash %q is %d characters, want %d", hash, len(hash), want)
+	}
+	if got := decodeBase83(hash[:1]); got != (blurHashXComponents-1)+(blurHashYComponents-1)*9 {
+		t.Errorf("size flag = %d", got)
+	}
+	if got := decodeBase83(hash[2:6]); got != 0x3366cc {
+		t.Errorf("average color = %06x, want 3366cc", got)
+	}
+}
+
+func TestBlurHashStable(t *testing.T) {
+	img, _, err := image.Decode(bytes.NewReader(testImage(t, 160, 90, "image/png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "L#HLk#2Y$5Sgl}WWjtf7gJfjfQfj"
+	for range 2 {
+		if got := blurHash(img); got != want {
+			t.Errorf("blurHash = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestHandlerUploadThumbnailBlurHash(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+	data := testImage(t, 160, 90, "image/png")
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", data))
+	var resp database.Video
+	decodeResponse(t, rec, http.StatusOK, &resp)
+	if resp.BlurHash == "" || resp.BlurHash != blurHash(img) {
+		t.Errorf("blur_hash = %q, want %q", resp.BlurHash, blurHash(img))
+	}
+	if got := getTestVideo(t, cfg, video.ID); got.BlurHash != resp.BlurHash {
+		t.Errorf("stored blur hash = %q, want %q", got.BlurHash, resp.BlurHash)
+	}
+}
@@ -1,10 +1,150 @@
 package main
 
-import "net/http"
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
 
-func cacheMiddleware(next http.Handler) http.Handler {
+// bodyLimitMiddleware caps request bodies at limit bytes. Bodies declared
+// larger are turned away up front; the rest are cut off by
+// http.MaxBytesReader, which handlers report with respondWithDecodeError or
+// respondWithMultipartError.
+func bodyLimitMiddleware(limit int64, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "max-age=3600")
+		if r.ContentLength > limit {
+			respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the %d byte limit", limit), nil)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
 		next.ServeHTTP(w, r)
 	})
 }
+
+// assetCacheMiddleware sets caching headers for files served from root.
+// Asset names change whenever their content does, so they can be cached
+// forever. The ETag is a hash of the file, which lets http.FileServer answer
+// If-None-Match with a 304.
+func assetCacheMiddleware(root string, next http.Handler) http.Handler {
+	etags := newETagCache(maxETagCacheEntries)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filePath := filepath.Join(root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		if etag, err := etags.get(filePath); err == nil {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxETagCacheEntries bounds how many file hashes assetCacheMiddleware
+// keeps. Thumbnails are added for every upload, so the least recently served
+// are dropped once there are this many.
+const maxETagCacheEntries = 10_000
+
+// etagCache remembers file hashes so a file is only hashed again after it
+// changes. It holds at most limit entries, evicting the least recently used.
+type etagCache struct {
+	limit int
+
+	mu      sync.Mutex
+	order   *list.List               // front is most recently used
+	entries map[string]*list.Element // path -> element holding an etagEntry
+}
+
+type etagEntry struct {
+	path    string
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+func newETagCache(limit int) *etagCache {
+	return &etagCache{limit: limit, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *etagCache) get(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		c.remove(filePath)
+		return "", err
+	}
+	if info.IsDir() {
+		return "", errors.New("not a file")
+	}
+	if etag, ok := c.lookup(filePath, info); ok {
+		return etag, nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	c.store(etagEntry{path: filePath, modTime: info.ModTime(), size: info.Size(), etag: etag})
+	return etag, nil
+}
+
+// lookup returns the cached hash of filePath if the file hasn't changed
+// since it was taken. A stale entry is dropped.
+func (c *etagCache) lookup(filePath string, info os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[filePath]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(etagEntry)
+	if !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+		c.order.Remove(elem)
+		delete(c.entries, filePath)
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return entry.etag, true
+}
+
+func (c *etagCache) store(entry etagEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.path]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.path] = c.order.PushFront(entry)
+	for c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(etagEntry).path)
+	}
+}
+
+func (c *etagCache) remove(filePath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[filePath]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, filePath)
+	}
+}
+
+func (c *etagCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
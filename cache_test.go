@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.maxJSONBodyBytes = 1 << 10
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	jsonRoute := bodyLimitMiddleware(cfg.maxJSONBodyBytes, http.HandlerFunc(cfg.handlerVideoMetaCreate))
+
+	small := map[string]string{"title": "Small", "description": "fits"}
+	large := map[string]string{"title": "Large", "description": strings.Repeat("x", 2<<10)}
+	tests := []struct {
+		name    string
+		body    any
+		chunked bool
+		want    int
+	}{
+		{"within limit", small, false, http.StatusCreated},
+		{"declared too large", large, false, http.StatusRequestEntityTooLarge},
+		// Without a Content-Length the limit is only hit while decoding
+		{"streamed too large", large, true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newJSONRequest(t, http.MethodPost, "/api/videos", token, tt.body)
+			if tt.chunked {
+				req.ContentLength = -1
+				req.Body = io.NopCloser(req.Body)
+			}
+			rec := httptest.NewRecorder()
+			jsonRoute.ServeHTTP(rec, req)
+			var resp struct {
+				Error string `json:"error"`
+			}
+			decodeResponse(t, rec, tt.want, &resp)
+			if want := fmt.Sprintf("Request body exceeds the %d byte limit", cfg.maxJSONBodyBytes); tt.want == http.StatusRequestEntityTooLarge && resp.Error != want {
+				t.Errorf("error = %q, want %q", resp.Error, want)
+			}
+		})
+	}
+
+	// Uploads have their own, much larger, limit
+	t.Run("upload route", func(t *testing.T) {
+		video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+		req := newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 320, 180, "image/png"))
+		if req.ContentLength <= cfg.maxJSONBodyBytes {
+			t.Fatalf("upload is only %d bytes, want more than the JSON limit", req.ContentLength)
+		}
+		rec := httptest.NewRecorder()
+		bodyLimitMiddleware(cfg.maxThumbnailUploadBytes, http.HandlerFunc(cfg.handlerUploadThumbnail)).ServeHTTP(rec, req)
+		decodeResponse(t, rec, http.StatusOK, nil)
+	})
+}
+
+func TestAssetCacheMiddleware(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "thumb.png"), "first version", 0o644)
+	handler := http.StripPrefix("/assets", assetCacheMiddleware(root, http.FileServer(http.Dir(root))))
+	get := func(target, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/assets/thumb.png", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	etag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || len(etag) < 3 {
+		t.Errorf("ETag = %q, want a strong quoted tag", etag)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "public, max-age=31536000, immutable" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	if again := get("/assets/thumb.png", "").Header().Get("ETag"); again != etag {
+		t.Errorf("ETag changed from %q to %q for the same file", etag, again)
+	}
+
+	rec = get("/assets/thumb.png", etag)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("conditional status = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	if rec.Body.Len() > 0 {
+		t.Errorf("304 had a %d byte body", rec.Body.Len())
+	}
+
+	// New contents get a new ETag, so the old one no longer matches
+	writeTestFile(t, filepath.Join(root, "thumb.png"), "second version, longer", 0o644)
+	rec = get("/assets/thumb.png", etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("after a change got %d with ETag %q, want 200 and a new ETag", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	rec = get("/assets/missing.png", "")
+	if rec.Code != http.StatusNotFound || rec.Header().Get("ETag") != "" || rec.Header().Get("Cache-Control") != "" {
+		t.Errorf("missing file got %d, ETag %q, Cache-Control %q", rec.Code, rec.Header().Get("ETag"), rec.Header().Get("Cache-Control"))
+	}
+}
+
+func TestETagCacheBounded(t *testing.T) {
+	root := t.TempDir()
+	cache := newETagCache(2)
+	path := func(name string) string { return filepath.Join(root, name) }
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		writeTestFile(t, path(name), name, 0o644)
+	}
+	get := func(name string) string {
+		t.Helper()
+		etag, err := cache.get(path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return etag
+	}
+
+	get("a.png")
+	get("b.png")
+	// Serving a again makes b the least recently used
+	get("a.png")
+	get("c.png")
+	if got := cache.len(); got != 2 {
+		t.Fatalf("cache holds %d entries, want 2", got)
+	}
+	cache.mu.Lock()
+	_, hasA := cache.entries[path("a.png")]
+	_, hasB := cache.entries[path("b.png")]
+	cache.mu.Unlock()
+	if !hasA || hasB {
+		t.Errorf("cached a = %v, b = %v; want b evicted", hasA, hasB)
+	}
+
+	// A deleted file's entry goes with it
+	if err := os.Remove(path("c.png")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.get(path("c.png")); err == nil {
+		t.Error("expected an error for a deleted file")
+	}
+	if got := cache.len(); got != 1 {
+		t.Errorf("cache holds %d entries after a deletion, want 1", got)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// contentSHA256Header lets clients send the hex SHA-256 of the file they
+// upload, so corruption on the way is caught before the video is processed.
+const contentSHA256Header = "X-Content-SHA256"
+
+var errChecksumMismatch = errors.New("checksum doesn't match the uploaded file")
+
+// copyWithSHA256 copies src to dst and returns the number of bytes written
+// along with the hex SHA-256 of what was copied.
+func copyWithSHA256(dst io.Writer, src io.Reader) (int64, string, error) {
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(dst, h), src)
+	return written, hex.EncodeToString(h.Sum(nil)), err
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, sum, err := copyWithSHA256(io.Discard, f)
+	return sum, err
+}
+
+// verifyContentSHA256 checks sum against the checksum the client sent, if
+// any.
+func verifyContentSHA256(r *http.Request, sum string) error {
+	return verifySHA256(r.Header.Get(contentSHA256Header), sum)
+}
+
+// verifySHA256 checks sum against an expected hex checksum. An empty
+// expected checksum matches anything.
+func verifySHA256(expected, sum string) error {
+	expected = strings.TrimSpace(expected)
+	if expected == "" || strings.EqualFold(expected, sum) {
+		return nil
+	}
+	return errChecksumMismatch
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerUploadVideoChecksum(t *testing.T) {
+	data := testMP4(256)
+	sum := sha256.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"absent", "", http.StatusAccepted},
+		{"matching", want, http.StatusAccepted},
+		{"matching in upper case", strings.ToUpper(want), http.StatusAccepted},
+		{"mismatched", strings.Repeat("0", 64), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Checksum")
+
+			req := newUploadRequest(t, video.ID, token, "video/mp4", data)
+			if tt.header != "" {
+				req.Header.Set(contentSHA256Header, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, req)
+			var resp struct {
+				Error string `json:"error"`
+			}
+			decodeResponse(t, rec, tt.status, &resp)
+
+			if tt.status != http.StatusAccepted {
+				if resp.Error != "X-Content-SHA256 doesn't match the uploaded file" {
+					t.Errorf("error = %q", resp.Error)
+				}
+				got := getTestVideo(t, cfg, video.ID)
+				if got.ContentSHA256 != "" || got.VideoURL != nil {
+					t.Errorf("rejected upload saved checksum %q, URL %v", got.ContentSHA256, got.VideoURL)
+				}
+				return
+			}
+			ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+			if ready.ContentSHA256 != want {
+				t.Errorf("stored checksum = %q, want %q", ready.ContentSHA256, want)
+			}
+		})
+	}
+}
+
+func TestFileSHA256(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	writeTestFile(t, path, "abc", 0o644)
+	// echo -n abc | sha256sum
+	const want = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if got, err := fileSHA256(path); err != nil || got != want {
+		t.Errorf("fileSHA256 = %q, %v; want %q", got, err, want)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// writePEM writes a PEM block to a temp file and returns its path.
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestCloudFrontSigner(t *testing.T, domain string) (*cloudFrontSigner, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newCloudFrontSigner(domain, "KTESTKEYPAIR", writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, key
+}
+
+// checkCloudFrontURL verifies that signed is a canned-policy URL for
+// resource that expires at the given time and is signed by key.
+func checkCloudFrontURL(t *testing.T, signed, resource string, expires int64, key *rsa.PrivateKey) {
+	t.Helper()
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// CloudFront's own parameters come last; anything before them is part
+	// of the signed resource
+	query := u.Query()
+	base, _, _ := strings.Cut(signed, "Expires=")
+	if got := strings.TrimRight(base, "?&"); got != resource {
+		t.Errorf("resource = %q, want %q", got, resource)
+	}
+	if got := query.Get("Expires"); got != strconv.FormatInt(expires, 10) {
+		t.Errorf("Expires = %s, want %d", got, expires)
+	}
+	if got := query.Get("Key-Pair-Id"); got != "KTESTKEYPAIR" {
+		t.Errorf("Key-Pair-Id = %q, want KTESTKEYPAIR", got)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(query.Get("Signature")))
+	if err != nil {
+		t.Fatalf("signature isn't CloudFront base64: %v", err)
+	}
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, resource, expires)
+	hash := sha1.Sum([]byte(policy))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, hash[:], signature); err != nil {
+		t.Errorf("signature doesn't match the canned policy: %v", err)
+	}
+}
+
+func TestCloudFrontSign(t *testing.T) {
+	signer, key := newTestCloudFrontSigner(t, "d111111abcdef8.cloudfront.net/")
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	signed, err := signer.sign("portrait/2024/01/02/a b.mp4", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCloudFrontURL(t, signed, "https://d111111abcdef8.cloudfront.net/portrait/2024/01/02/a%20b.mp4", expires.Unix(), key)
+}
+
+func TestNewCloudFrontSignerKeyFormats(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newCloudFrontSigner("cdn.example.com", "K", writePEM(t, "PRIVATE KEY", pkcs8)); err != nil {
+		t.Errorf("PKCS #8 RSA key: %v", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newCloudFrontSigner("cdn.example.com", "K", writePEM(t, "PRIVATE KEY", ecPKCS8)); err == nil {
+		t.Error("accepted an ECDSA key")
+	}
+	if _, err := newCloudFrontSigner("cdn.example.com", "K", writePEM(t, "CERTIFICATE", []byte("x"))); err == nil {
+		t.Error("accepted a certificate")
+	}
+}
+
+func TestDBVideoToSignedVideoCloudFront(t *testing.T) {
+	cfg := newTestConfig(t)
+	signer, key := newTestCloudFrontSigner(t, "https://cdn.example.com")
+	cfg.cloudFront = signer
+
+	storedURL := testBucket + ",landscape/a.mp4"
+	before := time.Now()
+	video, err := cfg.dbVideoToSignedVideo(database.Video{VideoURL: &storedURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(*video.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("Expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The default hour-long expiry, give or take the clock ticking over
+	if want := before.Add(cfg.presignExpiry).Unix(); expires < want || expires > want+5 {
+		t.Errorf("Expires = %d, want about %d", expires, want)
+	}
+	checkCloudFrontURL(t, *video.VideoURL, "https://cdn.example.com/landscape/a.mp4", expires, key)
+}
+
+func TestSignDownloadURLCloudFront(t *testing.T) {
+	cfg := newTestConfig(t)
+	signer, key := newTestCloudFrontSigner(t, "https://cdn.example.com")
+	cfg.cloudFront = signer
+
+	tests := []struct {
+		name        string
+		filename    string
+		disposition string
+	}{
+		{"plain", "Boots.mp4", `attachment; filename=Boots.mp4`},
+		{"spaces", "Boots: the movie.mp4", `attachment; filename="Boots: the movie.mp4"`},
+		{"unicode", "Café tour.mp4", `attachment; filename*=utf-8''Caf%C3%A9%20tour.mp4`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now()
+			signed, err := cfg.signDownloadURL(testBucket+",landscape/a.mp4", tt.filename, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.Query().Get("response-content-disposition"); got != tt.disposition {
+				t.Errorf("disposition = %q, want %q", got, tt.disposition)
+			}
+			expires, err := strconv.ParseInt(u.Query().Get("Expires"), 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := before.Add(time.Hour).Unix(); expires < want || expires > want+5 {
+				t.Errorf("Expires = %d, want about %d", expires, want)
+			}
+			params := url.Values{"response-content-disposition": {tt.disposition}}
+			checkCloudFrontURL(t, signed, "https://cdn.example.com/landscape/a.mp4?"+params.Encode(), expires, key)
+		})
+	}
+}
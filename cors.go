@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsExposedHeaders are response headers browser clients need to read, e.g.
+// to resume a tus upload, back off after a 429 or page through videos.
+var corsExposedHeaders = []string{"Location", "Retry-After", "X-Request-ID", "Upload-Offset", "Upload-Length", "Tus-Resumable", "X-Total-Count", "Link", idempotentReplayedHeader}
+
+type corsConfig struct {
+	// allowedOrigins may contain "*" for any origin. Empty allows none, so
+	// only same-origin requests work.
+	allowedOrigins []string
+	allowedMethods []string
+	allowedHeaders []string
+}
+
+func (c corsConfig) allowsOrigin(origin string) bool {
+	return slices.Contains(c.allowedOrigins, "*") || slices.Contains(c.allowedOrigins, origin)
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers their
+// preflight requests. Requests from other origins get no CORS headers, so
+// browsers block them.
+func corsMiddleware(cfg corsConfig, next http.Handler) http.Handler {
+	methods := strings.Join(cfg.allowedMethods, ", ")
+	headers := strings.Join(cfg.allowedHeaders, ", ")
+	exposed := strings.Join(corsExposedHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(cfg.allowedOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The response depends on the origin, so caches mustn't share it
+		w.Header().Add("Vary", "Origin")
+		if !cfg.allowsOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", exposed)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
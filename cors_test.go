@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	cors := corsConfig{
+		allowedOrigins: []string{"https://app.example.com"},
+		allowedMethods: []string{"GET", "PUT"},
+		allowedHeaders: []string{"Authorization", "Content-Type"},
+	}
+	var reached bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		cors       corsConfig
+		method     string
+		origin     string
+		preflight  bool
+		wantStatus int
+		wantOrigin string
+		wantVary   bool
+		wantNext   bool
+	}{
+		{"allowed origin", cors, http.MethodGet, "https://app.example.com", false, http.StatusOK, "https://app.example.com", true, true},
+		{"disallowed origin", cors, http.MethodGet, "https://evil.example.com", false, http.StatusOK, "", true, true},
+		{"same origin", cors, http.MethodGet, "", false, http.StatusOK, "", false, true},
+		{"preflight", cors, http.MethodOptions, "https://app.example.com", true, http.StatusNoContent, "https://app.example.com", true, false},
+		// Preflights from other origins fall through and get no CORS headers
+		{"disallowed preflight", cors, http.MethodOptions, "https://evil.example.com", true, http.StatusOK, "", true, true},
+		{"any origin", corsConfig{allowedOrigins: []string{"*"}}, http.MethodGet, "https://other.example.com", false, http.StatusOK, "https://other.example.com", true, true},
+		// The default allows no other origins
+		{"default", corsConfig{}, http.MethodGet, "https://app.example.com", false, http.StatusOK, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached = false
+			req := httptest.NewRequest(tt.method, "/api/videos", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+				req.Header.Set("Access-Control-Request-Headers", "authorization")
+			}
+			rec := httptest.NewRecorder()
+			corsMiddleware(tt.cors, next).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if reached != tt.wantNext {
+				t.Errorf("handler reached = %v, want %v", reached, tt.wantNext)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := rec.Header().Get("Vary") == "Origin"; got != tt.wantVary {
+				t.Errorf("Vary = %q", rec.Header().Get("Vary"))
+			}
+			if tt.wantOrigin == "" && rec.Header().Get("Access-Control-Allow-Methods") != "" {
+				t.Error("CORS methods sent to an origin that isn't allowed")
+			}
+		})
+	}
+}
+
+func TestCORSMiddlewarePreflightHeaders(t *testing.T) {
+	cors := corsConfig{
+		allowedOrigins: []string{"https://app.example.com"},
+		allowedMethods: []string{"GET", "PUT"},
+		allowedHeaders: []string{"Authorization", "Content-Type"},
+	}
+	req := httptest.NewRequest(http.MethodOptions, "/api/video_upload_url/1", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	rec := httptest.NewRecorder()
+	corsMiddleware(cors, http.NotFoundHandler()).ServeHTTP(rec, req)
+
+	want := map[string]string{
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type",
+		"Access-Control-Max-Age":       "600",
+	}
+	for header, value := range want {
+		if got := rec.Header().Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+	// Clients can read the headers they need to retry and resume uploads
+	exposed := rec.Header().Get("Access-Control-Expose-Headers")
+	for _, header := range []string{"Retry-After", "Upload-Offset", "X-Request-ID"} {
+		if !containsToken(exposed, header) {
+			t.Errorf("Access-Control-Expose-Headers = %q, missing %s", exposed, header)
+		}
+	}
+}
+
+// containsToken reports whether the comma separated list has token.
+func containsToken(list, token string) bool {
+	for item := range strings.SplitSeq(list, ",") {
+		if strings.TrimSpace(item) == token {
+			return true
+		}
+	}
+	return false
+}
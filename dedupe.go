@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// reuseDuplicateVideo points video at the stored files of another of the
+// owner's videos that was uploaded with the same checksum, so the upload
+// doesn't have to be processed and stored again. It reports whether a
+// duplicate was found. Nothing happens unless deduplication is enabled.
+func (cfg *apiConfig) reuseDuplicateVideo(video database.Video) (database.Video, bool, error) {
+	if !cfg.dedupeUploads || video.ContentSHA256 == "" {
+		return video, false, nil
+	}
+	existing, err := cfg.db.GetVideoByContentSHA256(video.UserID, video.ContentSHA256, video.ID)
+	if err != nil || existing.VideoURL == nil {
+		return video, false, err
+	}
+
+	video.VideoURL = existing.VideoURL
+	video.HLSURL = existing.HLSURL
+	video.Width = existing.Width
+	video.Height = existing.Height
+	video.AspectRatio = existing.AspectRatio
+	video.Duration = existing.Duration
+	video.VideoCodec = existing.VideoCodec
+	video.AudioCodec = existing.AudioCodec
+	video.Container = existing.Container
+	// The sizes describe the shared objects; storage usage counts each
+	// stored object once however many videos point at it
+	video.SizeBytes = existing.SizeBytes
+	video.HLSSizeBytes = existing.HLSSizeBytes
+	video.Status = database.VideoStatusReady
+	video.Progress = 100
+	video.ProcessingError = nil
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		return video, false, err
+	}
+	return video, true, nil
+}
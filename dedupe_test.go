@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerUploadVideoDedupe(t *testing.T) {
+	tests := []struct {
+		name        string
+		enabled     bool
+		sameOwner   bool
+		wantObjects int
+	}{
+		{"same bytes twice", true, true, 1},
+		{"disabled", false, true, 2},
+		// Another user's identical file isn't theirs to share
+		{"other user", true, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.dedupeUploads = tt.enabled
+			owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+			second, secondToken := owner, ownerToken
+			if !tt.sameOwner {
+				second, secondToken = createTestUser(t, cfg, "other@example.com")
+			}
+			data := testMP4(512)
+
+			first := createTestVideo(t, cfg, owner.ID, "First")
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, first.ID, ownerToken, "video/mp4", data))
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+			first = waitForStatus(t, cfg, first.ID, database.VideoStatusReady)
+
+			// A duplicate is ready straight away, so there's nothing to accept
+			deduped := tt.wantObjects == 1
+			wantStatus := http.StatusAccepted
+			if deduped {
+				wantStatus = http.StatusOK
+			}
+			again := createTestVideo(t, cfg, second.ID, "Again")
+			rec = httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, again.ID, secondToken, "video/mp4", data))
+			decodeResponse(t, rec, wantStatus, nil)
+			again = waitForStatus(t, cfg, again.ID, database.VideoStatusReady)
+			drainProcessing(t, cfg)
+
+			if keys := storedKeys(t, cfg); len(keys) != tt.wantObjects {
+				t.Errorf("stored objects = %v, want %d", keys, tt.wantObjects)
+			}
+			if sameURL := *again.VideoURL == *first.VideoURL; sameURL != deduped {
+				t.Errorf("second video URL %q, first %q; want shared = %v", *again.VideoURL, *first.VideoURL, deduped)
+			}
+			if deduped && (again.Width != first.Width || again.Duration != first.Duration || again.SizeBytes != first.SizeBytes) {
+				t.Errorf("deduplicated video = %+v, want the first one's metadata", again)
+			}
+		})
+	}
+}
+
+// The shared object stays until the last video using it is purged.
+func TestPurgeVideoKeepsDedupedObject(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.dedupeUploads = true
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	var videos []database.Video
+	for _, title := range []string{"First", "Again"} {
+		video := createTestVideo(t, cfg, user.ID, title)
+		rec := httptest.NewRecorder()
+		cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(512)))
+		if rec.Code != http.StatusOK && rec.Code != http.StatusAccepted {
+			t.Fatalf("upload status = %d; body: %s", rec.Code, rec.Body)
+		}
+		videos = append(videos, waitForStatus(t, cfg, video.ID, database.VideoStatusReady))
+	}
+	drainProcessing(t, cfg)
+
+	if err := cfg.purgeVideo(t.Context(), videos[0]); err != nil {
+		t.Fatal(err)
+	}
+	if keys := storedKeys(t, cfg); len(keys) != 1 {
+		t.Fatalf("after purging one video, objects = %v, want the shared one kept", keys)
+	}
+	if err := cfg.purgeVideo(t.Context(), videos[1]); err != nil {
+		t.Fatal(err)
+	}
+	if keys := storedKeys(t, cfg); len(keys) != 0 {
+		t.Errorf("after purging both videos, objects = %v, want none", keys)
+	}
+}
+
+// A row that still holds the legacy "bucket,key" form counts as a reference.
+func TestPurgeVideoKeepsObjectWithLegacyReference(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	const key = "landscape/2024/01/02/shared.mp4"
+	current := storeTestVideo(t, cfg, createTestVideo(t, cfg, user.ID, "Current"), key, testMP4(64))
+	legacy := createTestVideo(t, cfg, user.ID, "Legacy")
+	legacyURL := cfg.s3Bucket + "," + key
+	setStoredURLs(t, cfg, legacy, &legacyURL, nil)
+
+	if err := cfg.purgeVideo(t.Context(), current); err != nil {
+		t.Fatal(err)
+	}
+	if keys := storedKeys(t, cfg); !slices.Equal(keys, []string{key}) {
+		t.Fatalf("objects = %q, want %q kept for the legacy reference", keys, key)
+	}
+	if err := cfg.purgeVideo(t.Context(), getTestVideo(t, cfg, legacy.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if keys := storedKeys(t, cfg); len(keys) != 0 {
+		t.Errorf("after purging both videos, objects = %q, want none", keys)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEnvDuration(t *testing.T) {
+	t.Setenv("TEST_PRESIGN_EXPIRY", "")
+	if got := envDuration("TEST_PRESIGN_EXPIRY", time.Hour); got != time.Hour {
+		t.Errorf("unset: got %v, want the 1h default", got)
+	}
+	t.Setenv("TEST_PRESIGN_EXPIRY", "15m")
+	if got := envDuration("TEST_PRESIGN_EXPIRY", time.Hour); got != 15*time.Minute {
+		t.Errorf("set to 15m: got %v", got)
+	}
+}
+
+func TestEnvInt(t *testing.T) {
+	t.Setenv("TEST_WORKERS", "")
+	if got := envInt("TEST_WORKERS", 2); got != 2 {
+		t.Errorf("unset: got %d, want the default 2", got)
+	}
+	t.Setenv("TEST_WORKERS", "8")
+	if got := envInt("TEST_WORKERS", 2); got != 8 {
+		t.Errorf("set to 8: got %d", got)
+	}
+}
+
+func TestEnvList(t *testing.T) {
+	t.Setenv("TEST_ORIGINS", " https://a.example, ,https://b.example ")
+	want := []string{"https://a.example", "https://b.example"}
+	if got := envList("TEST_ORIGINS", nil); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// markedJPEG encodes a white 64x32 JPEG with a red square in its top left
+// corner, so it's easy to tell where that corner ended up.
+func markedJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for y := range 32 {
+		for x := range 64 {
+			c := color.RGBA{255, 255, 255, 255}
+			if x < 16 && y < 16 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withOrientation inserts an EXIF segment holding orientation right after
+// the JPEG's start of image marker.
+func withOrientation(data []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112) // orientation
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)      // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0) // padding and no next IFD
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	out := append([]byte{}, data[:2]...)
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+// isRed reports whether c is close to pure red, allowing for JPEG artifacts.
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r>>8 > 200 && g>>8 < 60 && b>>8 < 60
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	data := markedJPEG(t)
+	if got := jpegOrientation(bytes.NewReader(data)); got != 1 {
+		t.Errorf("orientation without EXIF = %d, want 1", got)
+	}
+	for orientation := range uint16(8) {
+		orientation++
+		if got := jpegOrientation(bytes.NewReader(withOrientation(data, orientation))); got != int(orientation) {
+			t.Errorf("orientation = %d, want %d", got, orientation)
+		}
+	}
+}
+
+func TestHandlerUploadThumbnailOrientation(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	tests := []struct {
+		name          string
+		orientation   uint16
+		width, height int
+		// where the red corner should be once the image is upright
+		redX, redY int
+	}{
+		{"upright", 1, 64, 32, 4, 4},
+		{"turned clockwise", 6, 32, 64, 27, 4},
+		{"turned counter-clockwise", 8, 32, 64, 4, 59},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video := createTestVideo(t, cfg, user.ID, tt.name)
+			data := withOrientation(markedJPEG(t), tt.orientation)
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/jpeg", data))
+			decodeResponse(t, rec, http.StatusOK, nil)
+
+			got := getTestVideo(t, cfg, video.ID)
+			stored, err := os.ReadFile(filepath.Join(cfg.assetsRoot, path.Base(*got.ThumbnailURL)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(stored, []byte("Exif\x00\x00")) {
+				t.Error("stored thumbnail still has EXIF data")
+			}
+			img, err := jpeg.Decode(bytes.NewReader(stored))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := img.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Fatalf("thumbnail is %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+			if c := img.At(tt.redX, tt.redY); !isRed(c) {
+				t.Errorf("pixel at %d,%d = %v, want the red corner", tt.redX, tt.redY, c)
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+type FFProbeResponse struct {
+	Streams []FFProbeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+}
+
+type FFProbeStream struct {
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Tags      struct {
+		Rotate string `json:"rotate"`
+	} `json:"tags"`
+	SideDataList []struct {
+		SideDataType string `json:"side_data_type"`
+		Rotation     int    `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// rotation returns the clockwise display rotation of the stream in degrees,
+// normalized to 0, 90, 180 or 270. Older ffmpeg builds report it as a
+// "rotate" tag, newer ones as display matrix side data.
+func (s FFProbeStream) rotation() int {
+	degrees := 0
+	if s.Tags.Rotate != "" {
+		if r, err := strconv.Atoi(s.Tags.Rotate); err == nil {
+			degrees = r
+		}
+	}
+	for _, sd := range s.SideDataList {
+		if sd.SideDataType == "Display Matrix" {
+			// The display matrix rotation is counter-clockwise
+			degrees = -sd.Rotation
+			break
+		}
+	}
+	return ((degrees % 360) + 360) % 360
+}
+
+// duration returns the container duration in seconds.
+func (r FFProbeResponse) duration() (float64, error) {
+	if r.Format.Duration == "" {
+		return 0, errors.New("duration not reported")
+	}
+	return strconv.ParseFloat(r.Format.Duration, 64)
+}
+
+// codecPolicy decides what happens to MP4 uploads whose video isn't H.264,
+// such as HEVC or AV1, which many browsers can't play.
+type codecPolicy string
+
+const (
+	codecPolicyTranscode codecPolicy = "transcode"
+	codecPolicyReject    codecPolicy = "reject"
+)
+
+// mediaInfo describes the codecs and container of a video file.
+type mediaInfo struct {
+	videoCodec string
+	audioCodec string
+	container  string
+}
+
+// mediaInfo returns the codec of the first video and audio streams and the
+// container format. Codecs are empty when there is no such stream.
+func (r FFProbeResponse) mediaInfo() mediaInfo {
+	info := mediaInfo{container: r.Format.FormatName}
+	for _, stream := range r.Streams {
+		switch {
+		case stream.CodecType == "video" && info.videoCodec == "":
+			info.videoCodec = stream.CodecName
+		case stream.CodecType == "audio" && info.audioCodec == "":
+			info.audioCodec = stream.CodecName
+		}
+	}
+	return info
+}
+
+func probeVideo(ctx context.Context, ffprobePath, filePath string) (FFProbeResponse, error) {
+	cmd := exec.CommandContext(ctx, ffprobePath, "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filePath)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return FFProbeResponse{}, fmt.Errorf("ffprobe was stopped: %w", ctx.Err())
+		}
+		return FFProbeResponse{}, fmt.Errorf("ffprobe error: %v", err)
+	}
+	return parseProbeOutput(out.Bytes())
+}
+
+// parseProbeOutput parses the JSON printed by ffprobe.
+func parseProbeOutput(data []byte) (FFProbeResponse, error) {
+	var response FFProbeResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return FFProbeResponse{}, fmt.Errorf("could not parse ffprobe output: %v", err)
+	}
+	return response, nil
+}
+
+func getVideoDuration(ctx context.Context, ffprobePath, filePath string) (float64, error) {
+	response, err := probeVideo(ctx, ffprobePath, filePath)
+	if err != nil {
+		return 0, err
+	}
+	return response.duration()
+}
+
+func getMediaInfo(ctx context.Context, ffprobePath, filePath string) (mediaInfo, error) {
+	response, err := probeVideo(ctx, ffprobePath, filePath)
+	if err != nil {
+		return mediaInfo{}, err
+	}
+	return response.mediaInfo(), nil
+}
+
+// errInvalidDimensions is returned when the video stream reports a zero
+// width or height.
+var errInvalidDimensions = errors.New("video stream has invalid dimensions")
+
+// errNoVideoStream is returned for files without any video stream, such as
+// audio-only MP4s.
+var errNoVideoStream = errors.New("file contains no video stream")
+
+// aspectRatio returns the aspect ratio category of the probed video along
+// with its displayed width and height.
+func (r FFProbeResponse) aspectRatio() (string, int, int, error) {
+	width, height, err := r.dimensions()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return aspectRatioCategory(width, height), width, height, nil
+}
+
+// dimensions returns the displayed width and height of the probed video.
+func (r FFProbeResponse) dimensions() (int, int, error) {
+	// Audio or data streams may be listed before the video stream, so look
+	// for the first stream that actually carries video
+	for _, stream := range r.Streams {
+		if stream.CodecType != "video" {
+			continue
+		}
+		// A corrupt file can list a video stream without dimensions, which
+		// would otherwise be silently classified as "other"
+		if stream.Width <= 0 || stream.Height <= 0 {
+			return 0, 0, fmt.Errorf("%w: %dx%d", errInvalidDimensions, stream.Width, stream.Height)
+		}
+		width, height := stream.Width, stream.Height
+		// Phones often store portrait video as landscape frames plus a
+		// rotation, so swap to get the displayed dimensions
+		if r := stream.rotation(); r == 90 || r == 270 {
+			width, height = height, width
+		}
+		return width, height, nil
+	}
+	return 0, 0, errNoVideoStream
+}
+
+// exactAspectRatio returns the dimensions reduced to lowest terms, e.g.
+// "64:27" for 2560x1080.
+func exactAspectRatio(width, height int) string {
+	if width <= 0 || height <= 0 {
+		return ""
+	}
+	a, b := width, height
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return fmt.Sprintf("%d:%d", width/a, height/a)
+}
+
+// aspectRatioCategories are the named aspect ratios, checked in order.
+// "21:9" is a marketing name; ultrawide video is really 64:27 (2560x1080,
+// 5120x2160), so that's what it's matched against.
+var aspectRatioCategories = []struct {
+	name  string
+	ratio float64
+}{
+	{"16:9", 16.0 / 9.0},
+	{"9:16", 9.0 / 16.0},
+	{"4:3", 4.0 / 3.0},
+	{"21:9", 64.0 / 27.0},
+}
+
+// aspectRatioCategory buckets displayed dimensions into one of
+// aspectRatioCategories, or "other".
+func aspectRatioCategory(width, height int) string {
+	if width <= 0 || height <= 0 {
+		return "other"
+	}
+	ratio := float64(width) / float64(height)
+
+	const tolerance = 0.01
+	for _, category := range aspectRatioCategories {
+		if math.Abs(ratio-category.ratio) < tolerance {
+			return category.name
+		}
+	}
+	return "other"
+}
+
+// hasFastStart reports whether the MP4 at filePath already has its moov atom
+// ahead of the media data, so players can start before the whole file has
+// downloaded. It only walks the top-level box headers.
+func hasFastStart(filePath string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var offset int64
+	header := make([]byte, 16)
+	for {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+			return false, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:8]) {
+		case "moov":
+			return true, nil
+		case "mdat":
+			return false, nil
+		}
+
+		switch size {
+		case 0:
+			// The box runs to the end of the file
+			return false, nil
+		case 1:
+			// A 64-bit size follows the type
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return false, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if size < 8 {
+			return false, fmt.Errorf("invalid MP4 box size %d at offset %d", size, offset)
+		}
+		offset += size
+	}
+}
+
+// processVideoForFastStart rewrites the video with its moov atom at the front,
+// returning the output path. onProgress, if set, is called with the seconds
+// of output written so far.
+func processVideoForFastStart(ctx context.Context, ffmpegPath, filePath string, onProgress func(seconds float64)) (string, error) {
+	outputPath := filePath + ".processed"
+	args, progress := withProgress([]string{"-y", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputPath}, onProgress)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	if progress != nil {
+		cmd.Stdout = progress
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// ffmpeg may have written part of the output before failing
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("ffmpeg was stopped: %w", ctx.Err())
+		}
+		return "", fmt.Errorf("ffmpeg error: %v: %s", err, stderr.String())
+	}
+	return outputPath, nil
+}
+
+// transcodeToMP4 re-encodes a video in another container (e.g. QuickTime or
+// WebM) to H.264/AAC in an MP4 container, returning the output path.
+func transcodeToMP4(ctx context.Context, ffmpegPath, inputPath string, onProgress func(seconds float64)) (string, error) {
+	outputPath := inputPath + ".transcoded.mp4"
+	args, progress := withProgress([]string{
+		"-y",
+		"-i", inputPath,
+		"-c:v", "libx264",
+		"-c:a", "aac",
+		"-f", "mp4",
+		outputPath,
+	}, onProgress)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	if progress != nil {
+		cmd.Stdout = progress
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("ffmpeg was stopped: %w", ctx.Err())
+		}
+		return "", fmt.Errorf("ffmpeg error: %v: %s", err, stderr.String())
+	}
+	return outputPath, nil
+}
+
+// packageHLS splits a video into MPEG-TS segments of roughly segmentSeconds
+// each and writes a media playlist plus a master playlist (master.m3u8) to
+// outDir. Streams are copied, not re-encoded.
+func packageHLS(ctx context.Context, ffmpegPath, inputPath, outDir string, segmentSeconds int, onProgress func(seconds float64)) error {
+	args, progress := withProgress([]string{
+		"-y",
+		"-i", inputPath,
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outDir, "segment_%03d.ts"),
+		"-master_pl_name", "master.m3u8",
+		filepath.Join(outDir, "index.m3u8"),
+	}, onProgress)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	if progress != nil {
+		cmd.Stdout = progress
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("ffmpeg was stopped: %w", ctx.Err())
+		}
+		return fmt.Errorf("ffmpeg error: %v: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// encodeWebP writes img to outputPath as a WebP image. The standard library
+// and x/image can only decode WebP, so the image goes through ffmpeg as a PNG.
+func encodeWebP(ctx context.Context, ffmpegPath string, img image.Image, outputPath string) error {
+	pngPath := outputPath + ".png"
+	f, err := os.Create(pngPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pngPath)
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-y",
+		"-i", pngPath,
+		"-c:v", "libwebp",
+		"-quality", "80",
+		"-f", "webp",
+		outputPath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return fmt.Errorf("ffmpeg was stopped: %w", ctx.Err())
+		}
+		return fmt.Errorf("ffmpeg error: %v: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// extractPosterFrame grabs a single frame at atSeconds and writes it as a JPEG
+// next to the video, returning the image path.
+func extractPosterFrame(ctx context.Context, ffmpegPath, videoPath string, atSeconds float64) (string, error) {
+	outputPath := videoPath + ".poster.jpg"
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-y",
+		"-ss", strconv.FormatFloat(atSeconds, 'f', 3, 64),
+		"-i", videoPath,
+		"-frames:v", "1",
+		"-q:v", "2",
+		outputPath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("ffmpeg was stopped: %w", ctx.Err())
+		}
+		return "", fmt.Errorf("ffmpeg error: %v: %s", err, stderr.String())
+	}
+	return outputPath, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// parseFFmpegProgress extracts how many seconds of output ffmpeg has written
+// from one line of its output. It understands the key=value lines printed
+// with -progress (out_time_us, out_time_ms, out_time) as well as the time=
+// field of the regular stderr status line.
+func parseFFmpegProgress(line string) (seconds float64, ok bool) {
+	line = strings.TrimSpace(line)
+	key, value, found := strings.Cut(line, "=")
+	if found {
+		switch key {
+		// Despite the name, out_time_ms is in microseconds too
+		case "out_time_us", "out_time_ms":
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || us < 0 {
+				return 0, false
+			}
+			return float64(us) / 1e6, true
+		case "out_time":
+			return parseFFmpegTimestamp(value)
+		}
+	}
+
+	// e.g. "frame=  240 fps= 60 q=28.0 size=  1024kB time=00:00:04.00 bitrate=..."
+	for _, field := range strings.Fields(line) {
+		if value, found := strings.CutPrefix(field, "time="); found {
+			return parseFFmpegTimestamp(value)
+		}
+	}
+	return 0, false
+}
+
+// parseFFmpegTimestamp parses HH:MM:SS.fraction.
+func parseFFmpegTimestamp(s string) (float64, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 {
+		return 0, false
+	}
+	secs, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || secs < 0 || secs >= 60 {
+		return 0, false
+	}
+	return float64(hours*3600+minutes*60) + secs, true
+}
+
+// ffmpegProgressWriter is used as the stdout of an ffmpeg run with
+// -progress pipe:1, calling onProgress for every position it reports.
+type ffmpegProgressWriter struct {
+	buf        []byte
+	onProgress func(seconds float64)
+}
+
+func (w *ffmpegProgressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if seconds, ok := parseFFmpegProgress(string(w.buf[:i])); ok {
+			w.onProgress(seconds)
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// withProgress adds the options that make ffmpeg report progress to cmd's
+// stdout, if onProgress is set. The args must not include the binary.
+func withProgress(args []string, onProgress func(seconds float64)) ([]string, *ffmpegProgressWriter) {
+	if onProgress == nil {
+		return args, nil
+	}
+	return append([]string{"-progress", "pipe:1", "-nostats"}, args...), &ffmpegProgressWriter{onProgress: onProgress}
+}
+
+// progressTracker turns the progress of several ffmpeg steps into one
+// overall percentage. Each step gets a share of the total by weight.
+type progressTracker struct {
+	duration float64
+	total    float64
+	assigned float64
+	last     float64
+	report   func(percent float64)
+}
+
+func newProgressTracker(duration, totalWeight float64, report func(percent float64)) *progressTracker {
+	return &progressTracker{duration: duration, total: totalWeight, report: report}
+}
+
+// step returns the progress callback for the next step. Reports are
+// throttled to whole percent increases so the database isn't hammered.
+func (t *progressTracker) step(weight float64) func(seconds float64) {
+	start := t.assigned
+	t.assigned += weight
+	return func(seconds float64) {
+		if t.duration <= 0 || t.total <= 0 {
+			return
+		}
+		fraction := min(seconds/t.duration, 1)
+		percent := 100 * (start + fraction*weight) / t.total
+		if percent-t.last < 1 {
+			return
+		}
+		t.last = percent
+		t.report(percent)
+	}
+}
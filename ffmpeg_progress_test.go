@@ -0,0 +1,74 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseFFmpegProgress(t *testing.T) {
+	tests := []struct {
+		line    string
+		seconds float64
+		ok      bool
+	}{
+		{"out_time_us=4000000", 4, true},
+		{"out_time_ms=1500000", 1.5, true},
+		{"out_time=00:01:02.500000", 62.5, true},
+		{"out_time=01:00:00.000000\n", 3600, true},
+		{"frame=  240 fps= 60 q=28.0 size=    1024kB time=00:00:04.00 bitrate=2097.2kbits/s speed=2x", 4, true},
+		// Before the first frame ffmpeg reports N/A
+		{"out_time_us=N/A", 0, false},
+		{"out_time=N/A", 0, false},
+		{"out_time_us=-9223372036854775807", 0, false},
+		{"frame=    0 fps=0.0 q=0.0 size=       0kB time=N/A bitrate=N/A speed=N/A", 0, false},
+		{"progress=continue", 0, false},
+		{"bitrate=2097.2kbits/s", 0, false},
+		{"out_time=00:61:00.00", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		seconds, ok := parseFFmpegProgress(tt.line)
+		if ok != tt.ok || seconds != tt.seconds {
+			t.Errorf("parseFFmpegProgress(%q) = %v, %v; want %v, %v", tt.line, seconds, ok, tt.seconds, tt.ok)
+		}
+	}
+}
+
+func TestFFmpegProgressWriter(t *testing.T) {
+	var got []float64
+	w := &ffmpegProgressWriter{onProgress: func(seconds float64) { got = append(got, seconds) }}
+
+	// A block of -progress output, split mid-line the way pipe reads are
+	output := "frame=120\nout_time_us=2000000\nout_time=00:00:02.000000\nprogress=continue\nframe=240\nout_time_us=4000000\nprogress=end\n"
+	for _, chunk := range strings.SplitAfter(output, "_us=") {
+		w.Write([]byte(chunk))
+	}
+
+	if want := []float64{2, 2, 4}; !slices.Equal(got, want) {
+		t.Errorf("reported %v, want %v", got, want)
+	}
+}
+
+func TestProgressTracker(t *testing.T) {
+	var reports []float64
+	tracker := newProgressTracker(10, 3, func(percent float64) { reports = append(reports, percent) })
+	transcode := tracker.step(2)
+	copyStep := tracker.step(1)
+
+	transcode(5)
+	transcode(5.01) // less than a percent more, so not reported
+	transcode(10)
+	copyStep(5)
+	copyStep(20) // past the end is capped
+
+	want := []float64{100.0 / 3, 200.0 / 3, 250.0 / 3, 100}
+	if len(reports) != len(want) {
+		t.Fatalf("reports = %v, want %v", reports, want)
+	}
+	for i := range want {
+		if diff := reports[i] - want[i]; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("report %d = %v, want %v", i, reports[i], want[i])
+		}
+	}
+}
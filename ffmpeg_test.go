@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+func TestParseProbeOutputAspectRatio(t *testing.T) {
+	tests := []struct {
+		name       string
+		output     string
+		wantRatio  string
+		wantWidth  int
+		wantHeight int
+		wantErr    error
+	}{
+		{
+			name:      "16:9",
+			output:    `{"streams": [{"codec_type": "video", "width": 1920, "height": 1080}]}`,
+			wantRatio: "16:9", wantWidth: 1920, wantHeight: 1080,
+		},
+		{
+			name:      "9:16",
+			output:    `{"streams": [{"codec_type": "video", "width": 1080, "height": 1920}]}`,
+			wantRatio: "9:16", wantWidth: 1080, wantHeight: 1920,
+		},
+		{
+			name:      "4:3",
+			output:    `{"streams": [{"codec_type": "video", "width": 640, "height": 480}]}`,
+			wantRatio: "4:3", wantWidth: 640, wantHeight: 480,
+		},
+		{
+			name:      "21:9",
+			output:    `{"streams": [{"codec_type": "video", "width": 2560, "height": 1080}]}`,
+			wantRatio: "21:9", wantWidth: 2560, wantHeight: 1080,
+		},
+		{
+			name:      "square",
+			output:    `{"streams": [{"codec_type": "video", "width": 1080, "height": 1080}]}`,
+			wantRatio: "other", wantWidth: 1080, wantHeight: 1080,
+		},
+		{
+			name:    "zero dimensions",
+			output:  `{"streams": [{"codec_type": "video", "width": 0, "height": 0}]}`,
+			wantErr: errInvalidDimensions,
+		},
+		{
+			name:    "audio only",
+			output:  `{"streams": [{"codec_type": "audio", "codec_name": "aac"}]}`,
+			wantErr: errNoVideoStream,
+		},
+		{
+			name: "audio first",
+			output: `{"streams": [
+				{"codec_type": "audio", "codec_name": "aac"},
+				{"codec_type": "video", "width": 1280, "height": 720}
+			]}`,
+			wantRatio: "16:9", wantWidth: 1280, wantHeight: 720,
+		},
+		{
+			name:      "rotate tag",
+			output:    `{"streams": [{"codec_type": "video", "width": 1920, "height": 1080, "tags": {"rotate": "90"}}]}`,
+			wantRatio: "9:16", wantWidth: 1080, wantHeight: 1920,
+		},
+		{
+			name: "display matrix rotation",
+			output: `{"streams": [{"codec_type": "video", "width": 1920, "height": 1080,
+				"side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]}]}`,
+			wantRatio: "9:16", wantWidth: 1080, wantHeight: 1920,
+		},
+		{
+			name:      "upside down",
+			output:    `{"streams": [{"codec_type": "video", "width": 1920, "height": 1080, "tags": {"rotate": "180"}}]}`,
+			wantRatio: "16:9", wantWidth: 1920, wantHeight: 1080,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := parseProbeOutput([]byte(tt.output))
+			if err != nil {
+				t.Fatalf("parseProbeOutput: %v", err)
+			}
+			ratio, width, height, err := response.aspectRatio()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ratio != tt.wantRatio || width != tt.wantWidth || height != tt.wantHeight {
+				t.Errorf("got %s %dx%d, want %s %dx%d", ratio, width, height, tt.wantRatio, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestStreamRotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		tags        string
+		displayRot  string
+		want        int
+		wantDisplay string
+	}{
+		{name: "none", want: 0, wantDisplay: "1920x1080"},
+		{name: "rotate 0", tags: "0", want: 0, wantDisplay: "1920x1080"},
+		{name: "rotate 90", tags: "90", want: 90, wantDisplay: "1080x1920"},
+		{name: "rotate 180", tags: "180", want: 180, wantDisplay: "1920x1080"},
+		{name: "rotate 270", tags: "270", want: 270, wantDisplay: "1080x1920"},
+		{name: "rotate -90", tags: "-90", want: 270, wantDisplay: "1080x1920"},
+		{name: "matrix 0", displayRot: "0", want: 0, wantDisplay: "1920x1080"},
+		{name: "matrix -90", displayRot: "-90", want: 90, wantDisplay: "1080x1920"},
+		{name: "matrix 180", displayRot: "180", want: 180, wantDisplay: "1920x1080"},
+		{name: "matrix 90", displayRot: "90", want: 270, wantDisplay: "1080x1920"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := `{"codec_type": "video", "width": 1920, "height": 1080`
+			if tt.tags != "" {
+				stream += `, "tags": {"rotate": "` + tt.tags + `"}`
+			}
+			if tt.displayRot != "" {
+				stream += `, "side_data_list": [{"side_data_type": "Display Matrix", "rotation": ` + tt.displayRot + `}]`
+			}
+			response, err := parseProbeOutput([]byte(`{"streams": [` + stream + `}]}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := response.Streams[0].rotation(); got != tt.want {
+				t.Errorf("rotation = %d, want %d", got, tt.want)
+			}
+			width, height, err := response.dimensions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%dx%d", width, height); got != tt.wantDisplay {
+				t.Errorf("dimensions = %s, want %s", got, tt.wantDisplay)
+			}
+		})
+	}
+}
+
+func TestParseProbeOutputInvalid(t *testing.T) {
+	if _, err := parseProbeOutput([]byte("not json")); err == nil {
+		t.Error("expected an error for output that isn't JSON")
+	}
+}
+
+func TestExactAspectRatio(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          string
+	}{
+		{1920, 1080, "16:9"},
+		{2560, 1080, "64:27"},
+		{1080, 1080, "1:1"},
+		{0, 1080, ""},
+	}
+	for _, tt := range tests {
+		if got := exactAspectRatio(tt.width, tt.height); got != tt.want {
+			t.Errorf("exactAspectRatio(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestAspectRatioNonStandard(t *testing.T) {
+	tests := []struct {
+		width, height int
+		category      string
+		exact         string
+	}{
+		{1366, 768, "16:9", "683:384"},
+		{854, 480, "16:9", "427:240"},
+		{720, 1280, "9:16", "9:16"},
+		{1280, 544, "other", "40:17"},
+		{720, 480, "other", "3:2"},
+		{1, 1, "other", "1:1"},
+	}
+	for _, tt := range tests {
+		if got := aspectRatioCategory(tt.width, tt.height); got != tt.category {
+			t.Errorf("aspectRatioCategory(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.category)
+		}
+		if got := exactAspectRatio(tt.width, tt.height); got != tt.exact {
+			t.Errorf("exactAspectRatio(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.exact)
+		}
+	}
+}
+
+func TestProbeVideoCancel(t *testing.T) {
+	cfg := newTestConfig(t)
+	waitForProbe, _ := holdFFprobe(t, cfg)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := probeVideo(ctx, cfg.ffprobePath, "unused.mp4")
+		errs <- err
+	}()
+	waitForProbe()
+	cancel()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("err = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("probeVideo didn't return after its context was cancelled")
+	}
+
+	// A probe that's still running keeps touching probe.waiting
+	waiting := filepath.Join(filepath.Dir(cfg.ffprobePath), "probe.waiting")
+	os.Remove(waiting)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat(waiting); err == nil {
+		t.Error("ffprobe is still running after its context was cancelled")
+	}
+}
+
+func TestHasFastStart(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"moov first", testMP4(0), true},
+		{"moov last", testMP4MoovLast(0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "video.mp4")
+			if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := hasFastStart(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("hasFastStart = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// partialFFmpeg writes some output to its last argument and then fails, like
+// ffmpeg dying partway through a file.
+const partialFFmpeg = `#!/bin/sh
+for arg in "$@"; do last="$arg"; done
+echo "partial output" > "$last"
+echo "fake ffmpeg failure" >&2
+exit 1
+`
+
+func TestProcessVideoForFastStartRemovesOutputOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	ffmpegPath := filepath.Join(dir, "ffmpeg")
+	writeTestFile(t, ffmpegPath, partialFFmpeg, 0o755)
+	input := filepath.Join(dir, "upload.mp4")
+	writeTestFile(t, input, string(testMP4MoovLast(0)), 0o644)
+
+	if _, err := processVideoForFastStart(t.Context(), ffmpegPath, input, nil); err == nil {
+		t.Fatal("expected an error from the failing ffmpeg")
+	}
+	if _, err := os.Stat(input + ".processed"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial output left behind: %v", err)
+	}
+}
+
+func TestEncodeWebP(t *testing.T) {
+	ffmpegPath, _ := requireFFmpeg(t)
+	if out, err := exec.Command(ffmpegPath, "-hide_banner", "-encoders").Output(); err != nil || !bytes.Contains(out, []byte("libwebp")) {
+		t.Skip("ffmpeg wasn't built with libwebp")
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(testImage(t, 160, 90, "image/png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputPath := filepath.Join(t.TempDir(), "thumb.webp")
+	if err := encodeWebP(t.Context(), ffmpegPath, img, outputPath); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		t.Fatalf("output doesn't start with the WebP magic bytes: % x", data[:min(len(data), 12)])
+	}
+	config, err := webp.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 160 || config.Height != 90 {
+		t.Errorf("output is %dx%d, want 160x90", config.Width, config.Height)
+	}
+	if _, err := os.Stat(outputPath + ".png"); !os.IsNotExist(err) {
+		t.Errorf("intermediate PNG left behind: %v", err)
+	}
+}
+
+func TestProbeMediaInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   mediaInfo
+	}{
+		{"h264 and aac", defaultProbeOutput, mediaInfo{videoCodec: "h264", audioCodec: "aac", container: "mov,mp4,m4a,3gp,3g2,mj2"}},
+		{
+			name: "audio first",
+			output: `{"streams": [
+				{"codec_type": "audio", "codec_name": "opus"},
+				{"codec_type": "video", "codec_name": "vp9", "width": 1280, "height": 720}
+			], "format": {"format_name": "matroska,webm"}}`,
+			want: mediaInfo{videoCodec: "vp9", audioCodec: "opus", container: "matroska,webm"},
+		},
+		{
+			name: "silent",
+			output: `{"streams": [{"codec_type": "video", "codec_name": "hevc", "width": 1280, "height": 720}],
+				"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2"}}`,
+			want: mediaInfo{videoCodec: "hevc", container: "mov,mp4,m4a,3gp,3g2,mj2"},
+		},
+		{
+			// A cover image or second angle after the main stream is ignored
+			name: "first of each",
+			output: `{"streams": [
+				{"codec_type": "video", "codec_name": "h264", "width": 1280, "height": 720},
+				{"codec_type": "audio", "codec_name": "aac"},
+				{"codec_type": "video", "codec_name": "mjpeg", "width": 300, "height": 300},
+				{"codec_type": "audio", "codec_name": "mp3"}
+			], "format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2"}}`,
+			want: mediaInfo{videoCodec: "h264", audioCodec: "aac", container: "mov,mp4,m4a,3gp,3g2,mj2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := parseProbeOutput([]byte(tt.output))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := response.mediaInfo(); got != tt.want {
+				t.Errorf("mediaInfo = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// createAPIKey makes an API key through the handler, using token.
+func createAPIKey(t *testing.T, cfg *apiConfig, token, name string) (uuid.UUID, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	cfg.handlerAPIKeyCreate(rec, newJSONRequest(t, http.MethodPost, "/api/api_keys", token, map[string]string{"name": name}))
+	var resp struct {
+		ID  uuid.UUID `json:"id"`
+		Key string    `json:"key"`
+	}
+	decodeResponse(t, rec, http.StatusCreated, &resp)
+	return resp.ID, resp.Key
+}
+
+// withAPIKey swaps the request's JWT for key.
+func withAPIKey(req *http.Request, key string) *http.Request {
+	req.Header.Del("Authorization")
+	req.Header.Set(auth.APIKeyHeader, key)
+	return req
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	keyID, key := createAPIKey(t, cfg, token, "ci")
+	_, otherKey := createAPIKey(t, cfg, otherToken, "other")
+
+	// The same video can be uploaded to with either
+	video := createTestVideo(t, cfg, user.ID, "Mixed")
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, withAPIKey(newThumbnailRequest(t, video.ID, "", "image/png", testImage(t, 64, 36, "image/png")), key))
+	decodeResponse(t, rec, http.StatusOK, nil)
+	rec = httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, withAPIKey(newUploadRequest(t, video.ID, "", "video/mp4", testMP4(0)), key))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	rec = httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 64, 36, "image/png")))
+	decodeResponse(t, rec, http.StatusOK, nil)
+
+	// Keys are scoped to their user like JWTs
+	rec = httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, withAPIKey(newThumbnailRequest(t, video.ID, "", "image/png", testImage(t, 64, 36, "image/png")), otherKey))
+	decodeResponse(t, rec, http.StatusForbidden, nil)
+
+	// A key can't be used to mint more keys
+	rec = httptest.NewRecorder()
+	cfg.handlerAPIKeyCreate(rec, withAPIKey(newJSONRequest(t, http.MethodPost, "/api/api_keys", "", map[string]string{"name": "more"}), key))
+	decodeResponse(t, rec, http.StatusUnauthorized, nil)
+
+	// Listing shows the key's use but never the key or its hash
+	rec = httptest.NewRecorder()
+	cfg.handlerAPIKeysList(rec, newJSONRequest(t, http.MethodGet, "/api/api_keys", token, nil))
+	var keys []map[string]any
+	decodeResponse(t, rec, http.StatusOK, &keys)
+	if len(keys) != 1 || keys[0]["id"] != keyID.String() || keys[0]["last_used_at"] == nil {
+		t.Errorf("listed keys = %v, want just %s with a last use", keys, keyID)
+	}
+	for _, field := range []string{"key", "key_hash", "KeyHash"} {
+		if len(keys) == 1 && keys[0][field] != nil {
+			t.Errorf("listing includes %s", field)
+		}
+	}
+
+	// Revoking only works with a JWT for the owner, then the key stops working
+	req := newJSONRequest(t, http.MethodDelete, "/api/api_keys/"+keyID.String(), otherToken, nil)
+	req.SetPathValue("keyID", keyID.String())
+	rec = httptest.NewRecorder()
+	cfg.handlerAPIKeyRevoke(rec, req)
+	decodeResponse(t, rec, http.StatusNotFound, nil)
+
+	req = newJSONRequest(t, http.MethodDelete, "/api/api_keys/"+keyID.String(), token, nil)
+	req.SetPathValue("keyID", keyID.String())
+	rec = httptest.NewRecorder()
+	cfg.handlerAPIKeyRevoke(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	rec = httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, withAPIKey(newThumbnailRequest(t, video.ID, "", "image/png", testImage(t, 64, 36, "image/png")), key))
+	decodeResponse(t, rec, http.StatusUnauthorized, nil)
+	// The JWT still works
+	rec = httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 64, 36, "image/png")))
+	decodeResponse(t, rec, http.StatusOK, nil)
+}
+
+func TestAPIKeyUnknown(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Video")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, withAPIKey(newThumbnailRequest(t, video.ID, "", "image/png", testImage(t, 64, 36, "image/png")), "tubely_not-a-key"))
+	decodeResponse(t, rec, http.StatusUnauthorized, nil)
+}
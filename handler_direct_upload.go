@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// directUploadKey is where a client uploads the original of a video with a
+// presigned PUT. It's derived from the IDs so finalizing doesn't need to
+// store anything.
+func directUploadKey(userID, videoID uuid.UUID) string {
+	return path.Join("uploads", userID.String(), videoID.String())
+}
+
+// handlerCreateVideoUploadURL hands the owner of a video a presigned PUT URL
+// to upload the original straight to storage.
+func (cfg *apiConfig) handlerCreateVideoUploadURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType   string `json:"content_type"`
+		ContentLength int64  `json:"content_length"`
+	}
+	type response struct {
+		UploadURL   string    `json:"upload_url"`
+		Key         string    `json:"key"`
+		ContentType string    `json:"content_type"`
+		ExpiresAt   time.Time `json:"expires_at"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	claims, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authenticate request", err)
+		return
+	}
+
+	uploader, ok := cfg.storage.(directUploader)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads aren't supported by this storage backend", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+	if !allowedVideoTypes[params.ContentType] {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type, only MP4, MOV and WebM are allowed", nil)
+		return
+	}
+	if params.ContentLength <= 0 {
+		respondWithError(w, http.StatusBadRequest, "content_length must be positive", nil)
+		return
+	}
+	if params.ContentLength > cfg.maxVideoUploadBytes {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds the %d byte limit", cfg.maxVideoUploadBytes), nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to get video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+
+	if err := cfg.checkStorageQuota(video.UserID, videoID, params.ContentLength); err != nil {
+		respondWithPipelineError(w, err)
+		return
+	}
+
+	key := directUploadKey(video.UserID, videoID)
+	uploadURL, err := uploader.PresignedPutURL(key, params.ContentType, params.ContentLength, cfg.presignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create upload URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		UploadURL:   uploadURL,
+		Key:         key,
+		ContentType: params.ContentType,
+		ExpiresAt:   time.Now().Add(cfg.presignExpiry),
+	})
+}
+
+// handlerFinalizeUpload processes a video that was uploaded directly to
+// storage: the original is downloaded, run through the regular pipeline and
+// then removed. Processing happens in the background; calling it again while
+// the video is processing or once it's ready just returns the video.
+func (cfg *apiConfig) handlerFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	claims, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authenticate request", err)
+		return
+	}
+
+	// Held until the job is queued so the processing check below can't race
+	// another upload or finalize
+	if !cfg.uploadLocks.tryLock(videoID) {
+		respondWithError(w, http.StatusConflict, "An upload to this video is already in progress", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(videoID)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to get video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+
+	// A finalize that's already running will pick the upload up
+	if video.Status == database.VideoStatusProcessing {
+		cfg.respondWithSignedVideo(w, http.StatusAccepted, video)
+		return
+	}
+
+	key := directUploadKey(video.UserID, videoID)
+	body, mediaType, err := cfg.storage.Get(r.Context(), key)
+	if errors.Is(err, errObjectNotFound) {
+		// The original is removed once it's processed, so a missing object
+		// on a video that has one means it was already finalized
+		if video.VideoURL != nil {
+			cfg.respondWithSignedVideo(w, http.StatusOK, video)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to download upload", err)
+		return
+	}
+	defer body.Close()
+
+	mediaType, _, err = mime.ParseMediaType(mediaType)
+	if err != nil || !allowedVideoTypes[mediaType] {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type, only MP4, MOV and WebM are allowed", err)
+		return
+	}
+
+	tmpFile, err := os.CreateTemp(cfg.tempDir, "tubely-upload-direct")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create temp file", err)
+		return
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			os.Remove(tmpFile.Name())
+		}
+	}()
+	defer tmpFile.Close()
+
+	written, sum, err := copyWithSHA256(tmpFile, body)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to download upload", err)
+		return
+	}
+	if written == 0 {
+		respondWithError(w, http.StatusBadRequest, "Uploaded file is empty", nil)
+		return
+	}
+	if err := verifyContentSHA256(r, sum); err != nil {
+		respondWithError(w, http.StatusBadRequest, "X-Content-SHA256 doesn't match the uploaded file", err)
+		return
+	}
+	video.ContentSHA256 = sum
+
+	if duplicate, ok, err := cfg.reuseDuplicateVideo(video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to check for duplicate uploads", err)
+		return
+	} else if ok {
+		// The original won't be processed, so it isn't needed anymore
+		if err := cfg.deleteUnreferencedObject(r.Context(), key); err != nil {
+			slog.ErrorContext(r.Context(), "couldn't delete upload", "key", key, "error", err.Error())
+		}
+		cfg.respondWithSignedVideo(w, http.StatusOK, duplicate)
+		return
+	}
+
+	video, err = cfg.enqueueProcessing(r.Context(), video, processingJob{
+		videoID:   videoID,
+		path:      tmpFile.Name(),
+		mediaType: mediaType,
+		// The original is only removed once it's been processed, so a
+		// failed run can be finalized again
+		sourceKey: key,
+	})
+	if err != nil {
+		respondWithQueueError(w, err)
+		return
+	}
+	queued = true
+
+	cfg.respondWithSignedVideo(w, http.StatusAccepted, video)
+}
+
+func (cfg *apiConfig) respondWithSignedVideo(w http.ResponseWriter, code int, video database.Video) {
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to sign video URL", err)
+		return
+	}
+	respondWithJSON(w, code, signedVideo)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// newDirectUploadRequest builds a request to /api/video_upload_url/{videoID}
+// followed by suffix.
+func newDirectUploadRequest(t *testing.T, videoID uuid.UUID, suffix, token string, body any) *http.Request {
+	t.Helper()
+	req := newJSONRequest(t, http.MethodPost, "/api/video_upload_url/"+videoID.String()+suffix, token, body)
+	req.SetPathValue("videoID", videoID.String())
+	return req
+}
+
+type uploadURLResponse struct {
+	UploadURL   string `json:"upload_url"`
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+}
+
+func TestHandlerCreateVideoUploadURL(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.storage = newTestS3Backend(t, &fakeS3{})
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, owner.ID, "Direct")
+
+	rec := httptest.NewRecorder()
+	params := map[string]any{"content_type": "video/mp4", "content_length": 4096}
+	cfg.handlerCreateVideoUploadURL(rec, newDirectUploadRequest(t, video.ID, "", ownerToken, params))
+	var resp uploadURLResponse
+	decodeResponse(t, rec, http.StatusOK, &resp)
+
+	if want := "uploads/" + owner.ID.String() + "/" + video.ID.String(); resp.Key != want {
+		t.Errorf("key = %q, want %q", resp.Key, want)
+	}
+	u, err := url.Parse(resp.UploadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/" + testBucket + "/" + resp.Key; u.Path != want {
+		t.Errorf("upload URL path = %q, want %q", u.Path, want)
+	}
+	query := u.Query()
+	if got := query.Get("X-Amz-Expires"); got != "3600" {
+		t.Errorf("X-Amz-Expires = %q, want 3600", got)
+	}
+	// The client can only upload what it asked to
+	signedHeaders := strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	for _, header := range []string{"content-type", "content-length"} {
+		if !slices.Contains(signedHeaders, header) {
+			t.Errorf("signed headers %q don't include %s", signedHeaders, header)
+		}
+	}
+}
+
+func TestHandlerCreateVideoUploadURLScoping(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.storage = newTestS3Backend(t, &fakeS3{})
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	other, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := createTestVideo(t, cfg, owner.ID, "Direct")
+	params := map[string]any{"content_type": "video/mp4", "content_length": 4096}
+
+	rec := httptest.NewRecorder()
+	cfg.handlerCreateVideoUploadURL(rec, newDirectUploadRequest(t, video.ID, "", otherToken, params))
+	decodeResponse(t, rec, http.StatusForbidden, nil)
+
+	// An admin uploading for someone else still writes under the owner
+	rec = httptest.NewRecorder()
+	cfg.handlerCreateVideoUploadURL(rec, newDirectUploadRequest(t, video.ID, "", adminToken(t, cfg, other.ID), params))
+	var resp uploadURLResponse
+	decodeResponse(t, rec, http.StatusOK, &resp)
+	if want := "uploads/" + owner.ID.String() + "/" + video.ID.String(); resp.Key != want {
+		t.Errorf("admin got key %q, want %q", resp.Key, want)
+	}
+
+	tests := []struct {
+		name   string
+		params map[string]any
+		want   int
+	}{
+		{"not a video", map[string]any{"content_type": "image/png", "content_length": 4096}, http.StatusBadRequest},
+		{"no length", map[string]any{"content_type": "video/mp4"}, http.StatusBadRequest},
+		{"too large", map[string]any{"content_type": "video/mp4", "content_length": cfg.maxVideoUploadBytes + 1}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerCreateVideoUploadURL(rec, newDirectUploadRequest(t, video.ID, "", ownerToken, tt.params))
+			decodeResponse(t, rec, tt.want, nil)
+		})
+	}
+}
+
+func TestHandlerCreateVideoUploadURLUnsupportedBackend(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, owner.ID, "Direct")
+
+	rec := httptest.NewRecorder()
+	params := map[string]any{"content_type": "video/mp4", "content_length": 4096}
+	cfg.handlerCreateVideoUploadURL(rec, newDirectUploadRequest(t, video.ID, "", token, params))
+	decodeResponse(t, rec, http.StatusNotImplemented, nil)
+}
+
+func TestHandlerFinalizeUpload(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := createTestVideo(t, cfg, owner.ID, "Direct")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerFinalizeUpload(rec, newDirectUploadRequest(t, video.ID, "/finalize", ownerToken, nil))
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+
+	key := directUploadKey(owner.ID, video.ID)
+	if err := cfg.storage.Put(t.Context(), key, bytes.NewReader(testMP4(0)), putOptions{contentType: "video/mp4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	cfg.handlerFinalizeUpload(rec, newDirectUploadRequest(t, video.ID, "/finalize", otherToken, nil))
+	decodeResponse(t, rec, http.StatusForbidden, nil)
+
+	rec = httptest.NewRecorder()
+	cfg.handlerFinalizeUpload(rec, newDirectUploadRequest(t, video.ID, "/finalize", ownerToken, nil))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	drainProcessing(t, cfg)
+
+	if ready.Width != 1920 || ready.Height != 1080 || ready.Duration != 5 {
+		t.Errorf("stored %dx%d, %vs; want 1920x1080, 5s", ready.Width, ready.Height, ready.Duration)
+	}
+	ref, err := parseStorageRef(*ready.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedKey := ref.Key
+	if keys := storedKeys(t, cfg); !slices.Equal(keys, []string{storedKey}) {
+		t.Errorf("objects = %q, want only the processed video %q", keys, storedKey)
+	}
+
+	// Finalizing again is a no-op
+	rec = httptest.NewRecorder()
+	cfg.handlerFinalizeUpload(rec, newDirectUploadRequest(t, video.ID, "/finalize", ownerToken, nil))
+	var again database.Video
+	decodeResponse(t, rec, http.StatusOK, &again)
+	if again.Status != database.VideoStatusReady {
+		t.Errorf("second finalize returned status %q, want ready", again.Status)
+	}
+	if got := getTestVideo(t, cfg, video.ID); *got.VideoURL != *ready.VideoURL {
+		t.Errorf("second finalize changed the video URL to %q", *got.VideoURL)
+	}
+}
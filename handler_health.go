@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// runHealthChecks runs every check and reports whether all of them passed.
+func runHealthChecks(ctx context.Context, checks map[string]func(context.Context) error) healthResponse {
+	response := healthResponse{Status: "ok", Checks: map[string]healthCheck{}}
+	for name, check := range checks {
+		if err := check(ctx); err != nil {
+			response.Status = "fail"
+			response.Checks[name] = healthCheck{Status: "fail", Error: err.Error()}
+			continue
+		}
+		response.Checks[name] = healthCheck{Status: "ok"}
+	}
+	return response
+}
+
+func respondWithHealth(w http.ResponseWriter, response healthResponse) {
+	w.Header().Set("Cache-Control", "no-store")
+	code := http.StatusOK
+	if response.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, code, response)
+}
+
+// handlerHealthz reports whether the database and storage can be reached.
+func (cfg *apiConfig) handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"database": cfg.db.Ping,
+	}
+	if checker, ok := cfg.storage.(healthChecker); ok {
+		checks["storage"] = checker.Check
+	}
+	respondWithHealth(w, runHealthChecks(ctx, checks))
+}
+
+// handlerReadyz reports whether this instance should be sent traffic. It
+// stops being ready as soon as shutdown starts, so a load balancer can drain
+// it before the server closes.
+func (cfg *apiConfig) handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	respondWithHealth(w, runHealthChecks(r.Context(), map[string]func(context.Context) error{
+		"processing": func(context.Context) error {
+			if cfg.processing.isClosed() {
+				return errPoolClosed
+			}
+			return nil
+		},
+	}))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandlerHealthz(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, cfg *apiConfig)
+		want  int
+		// the status of each check in the response
+		checks map[string]string
+	}{
+		{
+			name:   "healthy",
+			setup:  func(t *testing.T, cfg *apiConfig) { cfg.storage = newTestS3Backend(t, &fakeS3{}) },
+			want:   http.StatusOK,
+			checks: map[string]string{"database": "ok", "storage": "ok"},
+		},
+		{
+			name: "bucket unreachable",
+			setup: func(t *testing.T, cfg *apiConfig) {
+				cfg.storage = newTestS3Backend(t, &fakeS3{statuses: []int{http.StatusForbidden}})
+			},
+			want:   http.StatusServiceUnavailable,
+			checks: map[string]string{"database": "ok", "storage": "fail"},
+		},
+		{
+			name: "database closed",
+			setup: func(t *testing.T, cfg *apiConfig) {
+				cfg.storage = newTestS3Backend(t, &fakeS3{})
+				if err := cfg.db.Close(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:   http.StatusServiceUnavailable,
+			checks: map[string]string{"database": "fail", "storage": "ok"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			tt.setup(t, cfg)
+
+			rec := httptest.NewRecorder()
+			cfg.handlerHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			var resp healthResponse
+			decodeResponse(t, rec, tt.want, &resp)
+
+			if rec.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", rec.Header().Get("Cache-Control"))
+			}
+			if len(resp.Checks) != len(tt.checks) {
+				t.Errorf("checks = %v, want %v", resp.Checks, tt.checks)
+			}
+			for name, status := range tt.checks {
+				check := resp.Checks[name]
+				if check.Status != status {
+					t.Errorf("%s check = %q, want %q", name, check.Status, status)
+				}
+				if (status == "fail") != (check.Error != "") {
+					t.Errorf("%s check error = %q", name, check.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerReadyz(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	rec := httptest.NewRecorder()
+	cfg.handlerReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	decodeResponse(t, rec, http.StatusOK, nil)
+
+	// Once shutdown starts the instance stops taking traffic
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	cfg.processing.Shutdown(ctx)
+
+	rec = httptest.NewRecorder()
+	cfg.handlerReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var resp healthResponse
+	decodeResponse(t, rec, http.StatusServiceUnavailable, &resp)
+	if resp.Checks["processing"].Status != "fail" {
+		t.Errorf("processing check = %+v, want fail", resp.Checks["processing"])
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxPlaylistBytes bounds how much of a stored playlist is read. VOD
+// playlists list one line per segment, so even long videos stay small.
+const maxPlaylistBytes = 1 << 20
+
+// playlistURIAttr matches the URI attribute tags like EXT-X-MEDIA and
+// EXT-X-MAP use to reference other files.
+var playlistURIAttr = regexp.MustCompile(`URI="([^"]*)"`)
+
+// hlsPlaylistURL returns the link the app serves the playlist name of
+// videoID's HLS package at. The bucket is private, so playlists can't point
+// at their segments relatively; instead they're served through
+// handlerHLSPlaylist, which signs every file they list. The link itself is
+// signed so it works without a JWT until expires, like a presigned URL.
+func (cfg *apiConfig) hlsPlaylistURL(videoID uuid.UUID, name string, expires time.Time) string {
+	epoch := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", epoch)
+	query.Set("signature", cfg.hlsPlaylistSignature(videoID, name, epoch))
+	return fmt.Sprintf("%s/api/videos/%s/hls/%s?%s", cfg.publicBaseURL, videoID, url.PathEscape(name), query.Encode())
+}
+
+func (cfg *apiConfig) hlsPlaylistSignature(videoID uuid.UUID, name, expires string) string {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	fmt.Fprintf(mac, "hls-playlist:%s/%s:%s", videoID, name, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signHLSURL turns a stored master playlist reference into a link to the
+// rewritten playlist that's good for expiry.
+func (cfg *apiConfig) signHLSURL(videoID uuid.UUID, storedURL string, expiry time.Duration) (string, error) {
+	if isAbsoluteURL(storedURL) {
+		return storedURL, nil
+	}
+	ref, err := parseStorageRef(storedURL)
+	if err != nil {
+		return "", err
+	}
+	return cfg.hlsPlaylistURL(videoID, path.Base(ref.Key), time.Now().Add(expiry)), nil
+}
+
+// handlerHLSPlaylist serves one of a video's stored HLS playlists with every
+// segment presigned and every nested playlist pointing back here, so the
+// package plays from a private bucket.
+func (cfg *apiConfig) handlerHLSPlaylist(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	name := r.PathValue("name")
+	if path.Ext(name) != ".m3u8" || strings.Contains(name, "/") {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+
+	epoch := r.URL.Query().Get("expires")
+	expiresUnix, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Invalid playlist link", err)
+		return
+	}
+	signature := r.URL.Query().Get("signature")
+	if !hmac.Equal([]byte(signature), []byte(cfg.hlsPlaylistSignature(videoID, name, epoch))) {
+		respondWithError(w, http.StatusForbidden, "Invalid playlist link", nil)
+		return
+	}
+	expires := time.Unix(expiresUnix, 0)
+	if !time.Now().Before(expires) {
+		respondWithError(w, http.StatusForbidden, "Playlist link has expired", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || video.HLSURL == nil || isAbsoluteURL(*video.HLSURL) {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+	master, err := parseStorageRef(*video.HLSURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read stored playlist", err)
+		return
+	}
+	dir := path.Dir(master.Key)
+
+	body, _, err := cfg.storage.Get(r.Context(), path.Join(dir, name))
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read stored playlist", err)
+		return
+	}
+	defer body.Close()
+	playlist, err := io.ReadAll(io.LimitReader(body, maxPlaylistBytes))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read stored playlist", err)
+		return
+	}
+
+	rewritten, err := rewritePlaylist(playlist, func(uri string) (string, error) {
+		if isAbsoluteURL(uri) {
+			return uri, nil
+		}
+		if path.Ext(uri) == ".m3u8" {
+			return cfg.hlsPlaylistURL(videoID, uri, expires), nil
+		}
+		return cfg.signStoredURL(storageRef{master.Bucket, path.Join(dir, uri)}.String(), time.Until(expires))
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign playlist", err)
+		return
+	}
+
+	// The signed links inside expire, so the playlist mustn't outlive them
+	w.Header().Set("Content-Type", hlsContentTypes[".m3u8"])
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(rewritten)
+}
+
+// rewritePlaylist passes every URI in an M3U8 playlist through sign: the
+// lines that aren't tags or comments, and the URI attributes of tags.
+func rewritePlaylist(playlist []byte, sign func(uri string) (string, error)) ([]byte, error) {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			var signErr error
+			line = playlistURIAttr.ReplaceAllStringFunc(line, func(attr string) string {
+				signed, err := sign(playlistURIAttr.FindStringSubmatch(attr)[1])
+				if err != nil {
+					signErr = err
+					return attr
+				}
+				return `URI="` + signed + `"`
+			})
+			if signErr != nil {
+				return nil, signErr
+			}
+		default:
+			signed, err := sign(line)
+			if err != nil {
+				return nil, err
+			}
+			line = signed
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
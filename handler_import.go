@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// errBlockedAddress is returned when an import would connect to a loopback,
+// private or otherwise internal address.
+var errBlockedAddress = errors.New("address is not allowed")
+
+// newImportClient returns an HTTP client for fetching videos from
+// user-supplied URLs. The check happens on the resolved address of every
+// connection, so neither redirects nor DNS tricks can reach internal hosts.
+func newImportClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return validateImportURL(req.URL)
+		},
+	}
+}
+
+// nonPublicPrefixes are the special-purpose ranges from the IANA IPv4 and
+// IPv6 registries that aren't reachable on the public internet, or that
+// embed an IPv4 address which could itself be internal (NAT64, 6to4,
+// IPv4-compatible).
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this network"
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link local, cloud metadata
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, broadcast
+
+	netip.MustParsePrefix("::/96"),          // unspecified, loopback, IPv4-compatible
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local NAT64
+	netip.MustParsePrefix("100::/64"),       // discard
+	netip.MustParsePrefix("2001::/23"),      // IETF protocol assignments, Teredo
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("2002::/16"),      // 6to4
+	netip.MustParsePrefix("fc00::/7"),       // unique local
+	netip.MustParsePrefix("fe80::/10"),      // link local
+	netip.MustParsePrefix("fec0::/10"),      // site local
+	netip.MustParsePrefix("ff00::/8"),       // multicast
+}
+
+// isPublicAddr reports whether addr is routable on the public internet.
+// IPv4-mapped IPv6 addresses are checked as the IPv4 address they carry.
+func isPublicAddr(addr netip.Addr) bool {
+	// Zoned addresses never match a prefix, so drop the zone first
+	addr = addr.Unmap().WithZone("")
+	if !addr.IsValid() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateImportURL checks that u is an absolute http(s) URL. Hosts that are
+// literal IP addresses are checked up front; names are checked once they
+// resolve.
+func validateImportURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("url must use http or https")
+	}
+	if u.Hostname() == "" {
+		return errors.New("url must have a host")
+	}
+	if u.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !isPublicAddr(addr) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+// handlerImportVideo downloads a video from a remote URL and runs it through
+// the regular pipeline in the background.
+func (cfg *apiConfig) handlerImportVideo(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL string `json:"url"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	claims, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authenticate request", err)
+		return
+	}
+
+	idempotencyKey, replayed := cfg.replayIdempotentRequest(w, r, claims.UserID)
+	if replayed {
+		return
+	}
+	defer cfg.releaseIdempotencyKey(r, claims.UserID, idempotencyKey)
+
+	if !cfg.checkUploadRate(w, claims.UserID) {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+	sourceURL, err := url.Parse(params.URL)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid url", err)
+		return
+	}
+	if err := validateImportURL(sourceURL); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid url: %v", err), err)
+		return
+	}
+
+	if !cfg.uploadLocks.tryLock(videoID) {
+		respondWithError(w, http.StatusConflict, "An upload to this video is already in progress", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(videoID)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to get video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+	// A finished upload still owns the video until its processing is done
+	if video.Status == database.VideoStatusProcessing {
+		respondWithError(w, http.StatusConflict, "Video is already being processed", nil)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "importing video", "video_id", videoID, "user_id", claims.UserID, "host", sourceURL.Host)
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, sourceURL.String(), nil)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid url", err)
+		return
+	}
+	resp, err := cfg.importClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errBlockedAddress) {
+			respondWithError(w, http.StatusBadRequest, "Invalid url: address is not allowed", err)
+			return
+		}
+		respondWithError(w, http.StatusBadGateway, "Unable to download video", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respondWithError(w, http.StatusBadGateway, fmt.Sprintf("Remote server responded with %s", resp.Status), nil)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !allowedVideoTypes[mediaType] {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type, only MP4, MOV and WebM are allowed", err)
+		return
+	}
+	if resp.ContentLength > cfg.maxVideoUploadBytes {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Video exceeds the %d byte limit", cfg.maxVideoUploadBytes), nil)
+		return
+	}
+	if resp.ContentLength > 0 {
+		if err := cfg.checkStorageQuota(video.UserID, videoID, resp.ContentLength); err != nil {
+			respondWithPipelineError(w, err)
+			return
+		}
+	}
+
+	tmpFile, err := os.CreateTemp(cfg.tempDir, "tubely-upload-import")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create temp file", err)
+		return
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			os.Remove(tmpFile.Name())
+		}
+	}()
+	defer tmpFile.Close()
+
+	// The length header is optional and can lie, so cap the copy as well
+	written, sum, err := copyWithSHA256(tmpFile, io.LimitReader(resp.Body, cfg.maxVideoUploadBytes+1))
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Unable to download video", err)
+		return
+	}
+	if written > cfg.maxVideoUploadBytes {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Video exceeds the %d byte limit", cfg.maxVideoUploadBytes), nil)
+		return
+	}
+	if written == 0 {
+		respondWithError(w, http.StatusBadRequest, "Downloaded file is empty", nil)
+		return
+	}
+	if err := verifyContentSHA256(r, sum); err != nil {
+		respondWithError(w, http.StatusBadRequest, "X-Content-SHA256 doesn't match the downloaded file", err)
+		return
+	}
+	video.ContentSHA256 = sum
+
+	if duplicate, ok, err := cfg.reuseDuplicateVideo(video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to check for duplicate uploads", err)
+		return
+	} else if ok {
+		cfg.saveIdempotencyKey(r, claims.UserID, idempotencyKey, videoID, http.StatusOK)
+		cfg.respondWithSignedVideo(w, http.StatusOK, duplicate)
+		return
+	}
+
+	video, err = cfg.enqueueProcessing(r.Context(), video, processingJob{
+		videoID:   videoID,
+		path:      tmpFile.Name(),
+		mediaType: mediaType,
+	})
+	if err != nil {
+		respondWithQueueError(w, err)
+		return
+	}
+	queued = true
+
+	cfg.saveIdempotencyKey(r, claims.UserID, idempotencyKey, videoID, http.StatusAccepted)
+	cfg.respondWithSignedVideo(w, http.StatusAccepted, video)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"image"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	_ "golang.org/x/image/webp"
+)
+
+// Embeds of videos that haven't been probed yet get this size.
+const (
+	defaultEmbedWidth  = 640
+	defaultEmbedHeight = 360
+)
+
+// oEmbedResponse is a "video" type response from https://oembed.com.
+type oEmbedResponse struct {
+	Type         string `json:"type"`
+	Version      string `json:"version"`
+	Title        string `json:"title"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	// The thumbnail's size is required alongside its URL
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+	HTML            string `json:"html"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+}
+
+// embedSize returns the video's size scaled down, keeping its aspect ratio,
+// to fit within maxWidth by maxHeight. A max of 0 means no limit.
+func embedSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= 0 || height <= 0 {
+		width, height = defaultEmbedWidth, defaultEmbedHeight
+	}
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && float64(height)*scale > float64(maxHeight) {
+		scale = float64(maxHeight) / float64(height)
+	}
+	return max(1, int(float64(width)*scale)), max(1, int(float64(height)*scale))
+}
+
+// videoIDFromEmbedURL accepts the URL of a video's embed page or its public
+// API resource, on this server, and returns the video's ID.
+func (cfg *apiConfig) videoIDFromEmbedURL(rawURL string) (uuid.UUID, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	base, err := url.Parse(cfg.publicBaseURL)
+	if err != nil || !strings.EqualFold(u.Host, base.Host) {
+		return uuid.Nil, false
+	}
+	for _, prefix := range []string{"/embed/", "/api/public/videos/"} {
+		if rest, ok := strings.CutPrefix(u.Path, prefix); ok {
+			videoID, err := uuid.Parse(strings.TrimSuffix(rest, "/"))
+			return videoID, err == nil
+		}
+	}
+	return uuid.Nil, false
+}
+
+// thumbnailSize returns the size of the thumbnail stored as the asset name.
+func (cfg *apiConfig) thumbnailSize(name string) (int, int, error) {
+	f, err := os.Open(filepath.Join(cfg.assetsRoot, name))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// parseMaxDimension reads an optional maxwidth or maxheight parameter.
+func parseMaxDimension(r *http.Request, name string) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return n, nil
+}
+
+// handlerOEmbed describes how to embed an unlisted or public video, so sites
+// that support oEmbed can turn a link to it into a player.
+func (cfg *apiConfig) handlerOEmbed(w http.ResponseWriter, r *http.Request) {
+	if format := r.URL.Query().Get("format"); format != "" && format != "json" {
+		respondWithError(w, http.StatusNotImplemented, "Only the json format is supported", nil)
+		return
+	}
+	maxWidth, err := parseMaxDimension(r, "maxwidth")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	maxHeight, err := parseMaxDimension(r, "maxheight")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	videoID, ok := cfg.videoIDFromEmbedURL(r.URL.Query().Get("url"))
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || video.Visibility == database.VisibilityPrivate {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	width, height := embedSize(video.Width, video.Height, maxWidth, maxHeight)
+	embedURL := cfg.publicBaseURL + "/embed/" + video.ID.String()
+	resp := oEmbedResponse{
+		Type:         "video",
+		Version:      "1.0",
+		Title:        video.Title,
+		ProviderName: "Tubely",
+		ProviderURL:  cfg.publicBaseURL,
+		HTML: fmt.Sprintf(
+			`<iframe src="%s" width="%d" height="%d" frameborder="0" allow="fullscreen; picture-in-picture" allowfullscreen></iframe>`,
+			html.EscapeString(embedURL), width, height,
+		),
+		Width:  width,
+		Height: height,
+	}
+	// Consumers fetch the thumbnail from elsewhere, so its URL has to be
+	// absolute and on the public address. A thumbnail whose size can't be
+	// read is left out rather than sent without one.
+	if video.ThumbnailURL != nil {
+		if name, ok := assetName(*video.ThumbnailURL); ok {
+			thumbWidth, thumbHeight, err := cfg.thumbnailSize(name)
+			if err != nil {
+				slog.WarnContext(r.Context(), "couldn't read thumbnail size", "video_id", video.ID, "error", err.Error())
+			} else {
+				resp.ThumbnailURL = cfg.getAssetURL(name)
+				resp.ThumbnailWidth = thumbWidth
+				resp.ThumbnailHeight = thumbHeight
+			}
+		}
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+var embedTemplate = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>html,body{margin:0;height:100%;background:#000}video{width:100%;height:100%}</style>
+</head>
+<body>
+<video controls playsinline src="{{.VideoURL}}"{{with .ThumbnailURL}} poster="{{.}}"{{end}}></video>
+</body>
+</html>
+`))
+
+// handlerEmbed serves the player page that oEmbed iframes point at.
+func (cfg *apiConfig) handlerEmbed(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		http.Error(w, "Couldn't get video", http.StatusInternalServerError)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || video.Visibility == database.VisibilityPrivate || video.VideoURL == nil {
+		http.NotFound(w, r)
+		return
+	}
+	cfg.countView(r, &video, uuid.Nil)
+
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		http.Error(w, "Couldn't sign video URL", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Title        string
+		VideoURL     string
+		ThumbnailURL string
+	}{
+		Title:    video.Title,
+		VideoURL: *video.VideoURL,
+	}
+	if video.ThumbnailURL != nil {
+		data.ThumbnailURL = *video.ThumbnailURL
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	embedTemplate.Execute(w, data)
+}
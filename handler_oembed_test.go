@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandlerOEmbed(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.publicBaseURL = "https://videos.example.com"
+	video, token := readyPublicVideo(t, cfg)
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 64, 36, "image/png")))
+	decodeResponse(t, rec, http.StatusOK, nil)
+
+	embedURL := cfg.publicBaseURL + "/embed/" + video.ID.String()
+	rec = httptest.NewRecorder()
+	cfg.handlerOEmbed(rec, httptest.NewRequest(http.MethodGet, "/oembed?url="+url.QueryEscape(embedURL), nil))
+	var got map[string]any
+	decodeResponse(t, rec, http.StatusOK, &got)
+
+	want := map[string]any{
+		"type":             "video",
+		"version":          "1.0",
+		"title":            "Public",
+		"provider_name":    "Tubely",
+		"provider_url":     cfg.publicBaseURL,
+		"width":            float64(1920),
+		"height":           float64(1080),
+		"thumbnail_width":  float64(64),
+		"thumbnail_height": float64(36),
+	}
+	for field, value := range want {
+		if got[field] != value {
+			t.Errorf("%s = %v, want %v", field, got[field], value)
+		}
+	}
+	if thumb, _ := got["thumbnail_url"].(string); !strings.HasPrefix(thumb, cfg.publicBaseURL+"/assets/") {
+		t.Errorf("thumbnail_url = %v, want an asset under %s", got["thumbnail_url"], cfg.publicBaseURL)
+	}
+	if html, _ := got["html"].(string); !strings.Contains(html, `src="`+embedURL+`"`) {
+		t.Errorf("html = %v, want an iframe of %s", got["html"], embedURL)
+	}
+}
+
+func TestHandlerOEmbedMaxSize(t *testing.T) {
+	cfg := newTestConfig(t)
+	video, _ := readyPublicVideo(t, cfg)
+	embedURL := cfg.publicBaseURL + "/embed/" + video.ID.String()
+
+	// The video is 1920x1080
+	tests := []struct {
+		name          string
+		query         string
+		width, height int
+	}{
+		{"no limit", "", 1920, 1080},
+		{"maxwidth", "&maxwidth=640", 640, 360},
+		{"maxheight", "&maxheight=270", 480, 270},
+		{"both, height limits", "&maxwidth=640&maxheight=200", 355, 200},
+		{"larger than the video", "&maxwidth=4000&maxheight=4000", 1920, 1080},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerOEmbed(rec, httptest.NewRequest(http.MethodGet, "/oembed?url="+url.QueryEscape(embedURL)+tt.query, nil))
+			var got oEmbedResponse
+			decodeResponse(t, rec, http.StatusOK, &got)
+			if got.Width != tt.width || got.Height != tt.height {
+				t.Errorf("size = %dx%d, want %dx%d", got.Width, got.Height, tt.width, tt.height)
+			}
+		})
+	}
+}
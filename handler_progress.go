@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// progressPollInterval is how often the progress stream checks the video.
+const progressPollInterval = time.Second
+
+// handlerVideoProgress streams a video's processing progress as Server-Sent
+// Events. A "progress" event is sent whenever the percentage changes, and a
+// final "status" event once the video is ready or has failed.
+func (cfg *apiConfig) handlerVideoProgress(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	claims, err := cfg.parseJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	ticker := time.NewTicker(progressPollInterval)
+	defer ticker.Stop()
+
+	lastPercent := -1.0
+	for {
+		switch video.Status {
+		case database.VideoStatusReady, database.VideoStatusFailed:
+			writeSSE(w, "status", map[string]any{
+				"status": video.Status,
+				"error":  video.ProcessingError,
+			})
+			rc.Flush()
+			return
+		}
+
+		if video.Progress != lastPercent {
+			lastPercent = video.Progress
+			writeSSE(w, "progress", map[string]any{
+				"percent": video.Progress,
+				"status":  video.Status,
+			})
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-cfg.shuttingDown:
+			// The client can reconnect to another instance
+			return
+		case <-ticker.C:
+		}
+
+		video, err = cfg.db.GetVideo(videoID)
+		if err != nil || video.ID == uuid.Nil {
+			writeSSE(w, "error", map[string]string{"error": "Couldn't get video"})
+			rc.Flush()
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, data any) {
+	dat, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, dat)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+type sseEvent struct {
+	event string
+	data  map[string]any
+}
+
+// readSSE reads the next event from an event stream.
+func readSSE(t *testing.T, r *bufio.Reader) (sseEvent, bool) {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return ev, false
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return ev, true
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.data); err != nil {
+				t.Fatalf("bad event data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func newProgressServer(t *testing.T, cfg *apiConfig) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerVideoProgress)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func openProgressStream(t *testing.T, srv *httptest.Server, video database.Video, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+"/api/videos/"+video.ID.String()+"/progress", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestHandlerVideoProgress(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Progress")
+	video.Status = database.VideoStatusProcessing
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := openProgressStream(t, newProgressServer(t, cfg), video, token)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %d %s, want a 200 event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	events := bufio.NewReader(resp.Body)
+
+	ev, _ := readSSE(t, events)
+	if ev.event != "progress" || ev.data["percent"] != 0.0 {
+		t.Errorf("first event = %+v, want progress at 0", ev)
+	}
+
+	if err := cfg.db.UpdateVideoProgress(video.ID, 40); err != nil {
+		t.Fatal(err)
+	}
+	ev, _ = readSSE(t, events)
+	if ev.event != "progress" || ev.data["percent"] != 40.0 {
+		t.Errorf("second event = %+v, want progress at 40", ev)
+	}
+
+	video.Status = database.VideoStatusReady
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	ev, _ = readSSE(t, events)
+	if ev.event != "status" || ev.data["status"] != database.VideoStatusReady {
+		t.Errorf("last event = %+v, want status ready", ev)
+	}
+	if ev, ok := readSSE(t, events); ok {
+		t.Errorf("stream continued after completion with %+v", ev)
+	}
+}
+
+func TestHandlerVideoProgressOwnerOnly(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, _ := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := createTestVideo(t, cfg, owner.ID, "Progress")
+
+	resp := openProgressStream(t, newProgressServer(t, cfg), video, otherToken)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestHandlerVideoProgressClientDisconnect(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Progress")
+	video.Status = database.VideoStatusProcessing
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	req := newVideoRequest(t, http.MethodGet, video.ID, "/progress", token, nil)
+	ctx, cancel := context.WithCancel(req.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cfg.handlerVideoProgress(httptest.NewRecorder(), req.WithContext(ctx))
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler kept streaming after the client went away")
+	}
+}
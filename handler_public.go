@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var videoVisibilities = map[string]bool{
+	database.VisibilityPrivate:  true,
+	database.VisibilityUnlisted: true,
+	database.VisibilityPublic:   true,
+}
+
+// handlerVideoVisibility changes who can see a video.
+func (cfg *apiConfig) handlerVideoVisibility(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Visibility string `json:"visibility"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	claims, err := cfg.parseJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+	if !videoVisibilities[params.Visibility] {
+		respondWithError(w, http.StatusBadRequest, `visibility must be "private", "unlisted" or "public"`, nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+
+	if err := cfg.db.UpdateVideoVisibility(video.ID, params.Visibility); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	video.Visibility = params.Visibility
+
+	cfg.respondWithSignedVideo(w, http.StatusOK, video)
+}
+
+// publicVideo is what anonymous callers get to see of a video. Ownership,
+// checksums, processing state and storage details stay private.
+type publicVideo struct {
+	ID                uuid.UUID                  `json:"id"`
+	Title             string                     `json:"title"`
+	Description       string                     `json:"description"`
+	VideoURL          *string                    `json:"video_url"`
+	HLSURL            *string                    `json:"hls_url"`
+	ThumbnailURL      *string                    `json:"thumbnail_url"`
+	ThumbnailVariants database.ThumbnailVariants `json:"thumbnail_variants"`
+	Width             int                        `json:"width"`
+	Height            int                        `json:"height"`
+	AspectRatio       string                     `json:"aspect_ratio"`
+	Duration          float64                    `json:"duration"`
+}
+
+// toPublicVideo projects an already signed video for anonymous callers.
+func toPublicVideo(video database.Video) publicVideo {
+	return publicVideo{
+		ID:                video.ID,
+		Title:             video.Title,
+		Description:       video.Description,
+		VideoURL:          video.VideoURL,
+		HLSURL:            video.HLSURL,
+		ThumbnailURL:      video.ThumbnailURL,
+		ThumbnailVariants: video.ThumbnailVariants,
+		Width:             video.Width,
+		Height:            video.Height,
+		AspectRatio:       video.AspectRatio,
+		Duration:          video.Duration,
+	}
+}
+
+// handlerPublicVideoGet returns an unlisted or public video, with a presigned
+// URL, to anyone. Private videos look like they don't exist unless a share
+// token for the video is passed as ?share_token=.
+func (cfg *apiConfig) handlerPublicVideoGet(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	expiry := cfg.presignExpiry
+	if shareToken := r.URL.Query().Get("share_token"); shareToken != "" {
+		expiresAt, err := cfg.checkShareToken(shareToken, videoID)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid share token", err)
+			return
+		}
+		// The link shouldn't outlive the token it was handed out for
+		expiry = min(expiry, time.Until(expiresAt))
+	} else if video.Visibility == database.VisibilityPrivate {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	cfg.countView(r, &video, uuid.Nil)
+
+	signed, err := cfg.dbVideoToSignedVideoWithExpiry(video, expiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, toPublicVideo(signed))
+}
+
+// handlerPublicVideosList lists everyone's public videos, newest first.
+// Unlisted videos are left out.
+func (cfg *apiConfig) handlerPublicVideosList(w http.ResponseWriter, r *http.Request) {
+	params := database.VideoListParams{Visibility: database.VisibilityPublic}
+	if err := parsePage(r, &params, cfg.maxPageSize); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	videos, total, err := cfg.db.GetVideosPage(params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	cfg.signVideos(r.Context(), videos)
+	public := make([]publicVideo, len(videos))
+	for i, video := range videos {
+		public[i] = toPublicVideo(video)
+	}
+
+	setPageHeaders(w, r, params, len(videos), total)
+	respondWithJSON(w, http.StatusOK, public)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// readyPublicVideo uploads a video, waits for it to be processed and makes
+// it public.
+func readyPublicVideo(t *testing.T, cfg *apiConfig) (database.Video, string) {
+	t.Helper()
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Public")
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	video = waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	if err := cfg.db.UpdateVideoVisibility(video.ID, database.VisibilityPublic); err != nil {
+		t.Fatal(err)
+	}
+	video.Visibility = database.VisibilityPublic
+	return video, token
+}
+
+func TestHandlerPublicVideoGetHidesPrivateFields(t *testing.T) {
+	cfg := newTestConfig(t)
+	video, _ := readyPublicVideo(t, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/public/videos/"+video.ID.String(), nil)
+	req.SetPathValue("videoID", video.ID.String())
+	rec := httptest.NewRecorder()
+	cfg.handlerPublicVideoGet(rec, req)
+	var got map[string]any
+	decodeResponse(t, rec, http.StatusOK, &got)
+
+	for _, field := range []string{"user_id", "content_sha256", "processing_error", "status", "size_bytes", "video_codec", "deleted_at"} {
+		if _, ok := got[field]; ok {
+			t.Errorf("anonymous response includes %q", field)
+		}
+	}
+	if got["title"] != "Public" {
+		t.Errorf("title = %v, want Public", got["title"])
+	}
+	if url, _ := got["video_url"].(string); !strings.HasPrefix(url, "mem://") {
+		t.Errorf("video_url = %v, want a signed URL", got["video_url"])
+	}
+	if got["width"] != float64(1920) || got["height"] != float64(1080) {
+		t.Errorf("dimensions = %vx%v, want 1920x1080", got["width"], got["height"])
+	}
+}
+
+func TestHandlerPublicVideosListHidesPrivateFields(t *testing.T) {
+	cfg := newTestConfig(t)
+	readyPublicVideo(t, cfg)
+
+	rec := httptest.NewRecorder()
+	cfg.handlerPublicVideosList(rec, httptest.NewRequest(http.MethodGet, "/api/public/videos", nil))
+	var got []map[string]any
+	decodeResponse(t, rec, http.StatusOK, &got)
+
+	if len(got) != 1 {
+		t.Fatalf("got %d videos, want 1", len(got))
+	}
+	if _, ok := got[0]["user_id"]; ok {
+		t.Error("anonymous listing includes user_id")
+	}
+}
+
+func TestHandlerVideoVisibility(t *testing.T) {
+	tests := []struct {
+		visibility string
+		// What an anonymous client gets fetching the video, and whether
+		// it's in the public listing
+		anonymous int
+		listed    bool
+	}{
+		{database.VisibilityPrivate, http.StatusNotFound, false},
+		{database.VisibilityUnlisted, http.StatusOK, false},
+		{database.VisibilityPublic, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.visibility, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			video, token := readyPublicVideo(t, cfg)
+
+			rec := httptest.NewRecorder()
+			cfg.handlerVideoVisibility(rec, newVideoRequest(t, http.MethodPut, video.ID, "/visibility", token, map[string]string{"visibility": tt.visibility}))
+			var updated database.Video
+			decodeResponse(t, rec, http.StatusOK, &updated)
+			if updated.Visibility != tt.visibility {
+				t.Errorf("response visibility = %q, want %q", updated.Visibility, tt.visibility)
+			}
+
+			// The owner always sees the video, with its new visibility
+			rec = httptest.NewRecorder()
+			cfg.handlerVideoGet(rec, newVideoRequest(t, http.MethodGet, video.ID, "", token, nil))
+			var got database.Video
+			decodeResponse(t, rec, http.StatusOK, &got)
+			if got.Visibility != tt.visibility {
+				t.Errorf("owner sees visibility %q, want %q", got.Visibility, tt.visibility)
+			}
+
+			rec = httptest.NewRecorder()
+			cfg.handlerPublicVideoGet(rec, newVideoRequest(t, http.MethodGet, video.ID, "", "", nil))
+			decodeResponse(t, rec, tt.anonymous, nil)
+
+			rec = httptest.NewRecorder()
+			cfg.handlerPublicVideosList(rec, httptest.NewRequest(http.MethodGet, "/api/public/videos", nil))
+			var listed []publicVideo
+			decodeResponse(t, rec, http.StatusOK, &listed)
+			if got := len(listed) == 1; got != tt.listed {
+				t.Errorf("listed publicly = %v, want %v", got, tt.listed)
+			}
+		})
+	}
+}
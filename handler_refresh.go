@@ -1,15 +1,25 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
+// refreshTokenLifetime is how long a refresh token can be exchanged for. Each
+// exchange hands out a new one with a fresh lifetime.
+const refreshTokenLifetime = time.Hour * 24 * 60
+
+// handlerRefresh exchanges a refresh token for a new access token. The
+// refresh token is rotated: it's revoked and a new one is returned in its
+// place, so a stolen token stops working once either party uses it.
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
@@ -18,24 +28,58 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
+	stored, err := cfg.db.GetRefreshToken(refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get refresh token", err)
+		return
+	}
+	if stored.Token == "" {
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token", nil)
+		return
+	}
+	if stored.RevokedAt != nil {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token has been revoked", nil)
+		return
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token has expired", nil)
+		return
+	}
+
+	newRefreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+		return
+	}
+	err = cfg.db.RotateRefreshToken(refreshToken, database.CreateRefreshTokenParams{
+		UserID:    stored.UserID,
+		Token:     newRefreshToken,
+		ExpiresAt: time.Now().UTC().Add(refreshTokenLifetime),
+	})
+	if errors.Is(err, database.ErrRefreshTokenRevoked) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token has been revoked", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't rotate refresh token", err)
 		return
 	}
 
-	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour,
-	)
+	// The role may have changed since the last token, so look it up again
+	user, err := cfg.db.GetUser(stored.UserID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user for refresh token", err)
+		return
+	}
+	accessToken, err := cfg.makeJWT(*user, time.Hour)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Token: accessToken,
+		Token:        accessToken,
+		RefreshToken: newRefreshToken,
 	})
 }
 
@@ -54,3 +98,30 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// handlerLogout revokes the access token it's called with, so it's turned
+// away even before it expires. The client should also revoke its refresh
+// token.
+func (cfg *apiConfig) handlerLogout(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	parsed, err := auth.ParseJWT(token, cfg.jwtSecret, cfg.jwtClaims)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	if parsed.ID == "" {
+		respondWithError(w, http.StatusBadRequest, "Token can't be revoked, it has no ID", nil)
+		return
+	}
+
+	if err := cfg.db.RevokeToken(parsed.ID, parsed.ExpiresAt); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke token", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
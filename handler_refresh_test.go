@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type refreshResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// createRefreshToken stores a new refresh token for userID that expires at
+// expiresAt.
+func createRefreshToken(t *testing.T, cfg *apiConfig, userID uuid.UUID, expiresAt time.Time) string {
+	t.Helper()
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{Token: token, UserID: userID, ExpiresAt: expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// refresh calls handlerRefresh with refreshToken, checking the status.
+func refresh(t *testing.T, cfg *apiConfig, refreshToken string, want int) (refreshResponse, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	cfg.handlerRefresh(rec, newJSONRequest(t, http.MethodPost, "/api/refresh", refreshToken, nil))
+	var resp struct {
+		refreshResponse
+		Error string `json:"error"`
+	}
+	decodeResponse(t, rec, want, &resp)
+	return resp.refreshResponse, resp.Error
+}
+
+func TestHandlerRefresh(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	refreshToken := createRefreshToken(t, cfg, user.ID, time.Now().Add(time.Hour))
+
+	resp, _ := refresh(t, cfg, refreshToken, http.StatusOK)
+	if userID, err := auth.ValidateJWTWithClaims(resp.Token, cfg.jwtSecret, cfg.jwtClaims); err != nil || userID != user.ID {
+		t.Errorf("access token for %s, %v; want %s", userID, err, user.ID)
+	}
+	if resp.RefreshToken == "" || resp.RefreshToken == refreshToken {
+		t.Fatalf("refresh token wasn't rotated: %q", resp.RefreshToken)
+	}
+
+	// Only the hash is stored
+	stored, err := cfg.db.GetRefreshToken(resp.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Token == "" || stored.Token == resp.RefreshToken {
+		t.Errorf("stored token = %q, want a hash", stored.Token)
+	}
+	if stored.UserID != user.ID {
+		t.Errorf("new refresh token belongs to %s, want %s", stored.UserID, user.ID)
+	}
+
+	// The old token was used up, the new one works
+	if _, msg := refresh(t, cfg, refreshToken, http.StatusUnauthorized); msg != "Refresh token has been revoked" {
+		t.Errorf("reusing the old token: %q", msg)
+	}
+	refresh(t, cfg, resp.RefreshToken, http.StatusOK)
+}
+
+func TestHandlerRefreshRejects(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+
+	revoked := createRefreshToken(t, cfg, user.ID, time.Now().Add(time.Hour))
+	rec := httptest.NewRecorder()
+	cfg.handlerRevoke(rec, newJSONRequest(t, http.MethodPost, "/api/revoke", revoked, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"revoked", revoked, "Refresh token has been revoked"},
+		{"expired", createRefreshToken(t, cfg, user.ID, time.Now().Add(-time.Minute)), "Refresh token has expired"},
+		{"unknown", "not-a-refresh-token", "Invalid refresh token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, msg := refresh(t, cfg, tt.token, http.StatusUnauthorized); msg != tt.want {
+				t.Errorf("error = %q, want %q", msg, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		refresh(t, cfg, "", http.StatusBadRequest)
+	})
+}
+
+func TestHandlerLogout(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	other, err := cfg.makeJWT(user, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listVideos := func(token string) int {
+		rec := httptest.NewRecorder()
+		cfg.handlerVideosRetrieve(rec, newJSONRequest(t, http.MethodGet, "/api/videos", token, nil))
+		return rec.Code
+	}
+	if code := listVideos(token); code != http.StatusOK {
+		t.Fatalf("before logout got %d, want %d", code, http.StatusOK)
+	}
+
+	rec := httptest.NewRecorder()
+	cfg.handlerLogout(rec, newJSONRequest(t, http.MethodPost, "/api/logout", token, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	if code := listVideos(token); code != http.StatusUnauthorized {
+		t.Errorf("logged out token got %d, want %d", code, http.StatusUnauthorized)
+	}
+	// Only that token is revoked, not every session of the user
+	if code := listVideos(other); code != http.StatusOK {
+		t.Errorf("other token got %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestHandlerLogoutRejects(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	expired, err := cfg.makeJWT(user, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"no token", ""},
+		{"expired", expired},
+		{"wrong secret", func() string {
+			token, err := auth.MakeJWTWithClaims(user.ID, "", "other-secret", time.Hour, cfg.jwtClaims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerLogout(rec, newJSONRequest(t, http.MethodPost, "/api/logout", tt.token, nil))
+			decodeResponse(t, rec, http.StatusUnauthorized, nil)
+		})
+	}
+}
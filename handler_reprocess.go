@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoReprocess runs a stored video through the current pipeline
+// again, e.g. after a failed run or a change to the processing settings.
+// The result is stored under a new key and the old object is removed once
+// it succeeds. Calling it while the video is processing is a no-op.
+func (cfg *apiConfig) handlerVideoReprocess(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	claims, err := cfg.parseJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	if !cfg.uploadLocks.tryLock(videoID) {
+		respondWithError(w, http.StatusConflict, "An upload to this video is already in progress", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(videoID)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+
+	if video.Status == database.VideoStatusProcessing {
+		cfg.respondWithSignedVideo(w, http.StatusAccepted, video)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusBadRequest, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	ref, err := parseStorageRef(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Video isn't stored in a way that can be reprocessed", err)
+		return
+	}
+
+	body, _, err := cfg.storage.Get(r.Context(), ref.Key)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Stored video is missing", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to download video", err)
+		return
+	}
+	defer body.Close()
+
+	tmpFile, err := os.CreateTemp(cfg.tempDir, "tubely-reprocess")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create temp file", err)
+		return
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			os.Remove(tmpFile.Name())
+		}
+	}()
+	defer tmpFile.Close()
+
+	if _, err := io.Copy(tmpFile, body); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to download video", err)
+		return
+	}
+
+	// Stored videos are always MP4
+	video, err = cfg.enqueueProcessing(r.Context(), video, processingJob{
+		videoID:   videoID,
+		path:      tmpFile.Name(),
+		mediaType: "video/mp4",
+		sourceKey: ref.Key,
+	})
+	if err != nil {
+		respondWithQueueError(w, err)
+		return
+	}
+	queued = true
+
+	cfg.respondWithSignedVideo(w, http.StatusAccepted, video)
+}
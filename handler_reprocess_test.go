@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Reprocessing replaces the video's stored object and HLS package, except
+// where a deduplicated video still uses them.
+func TestHandlerVideoReprocessKeepsSharedObjects(t *testing.T) {
+	tests := []struct {
+		name   string
+		shared bool
+	}{
+		{"shared with a duplicate", true},
+		{"not shared", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			original := storeTestVideo(t, cfg, createTestVideo(t, cfg, user.ID, "Original"), "landscape/original.mp4", testMP4(0))
+			original = storeTestHLS(t, cfg, original, "landscape/original-hls")
+			if tt.shared {
+				duplicate := createTestVideo(t, cfg, user.ID, "Duplicate")
+				duplicate.VideoURL, duplicate.HLSURL = original.VideoURL, original.HLSURL
+				duplicate.Status = database.VideoStatusReady
+				if err := cfg.db.UpdateVideo(duplicate); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			cfg.handlerVideoReprocess(rec, newReprocessRequest(t, original, token))
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+			reprocessed := waitForStatus(t, cfg, original.ID, database.VideoStatusReady)
+			drainProcessing(t, cfg)
+			if *reprocessed.VideoURL == *original.VideoURL {
+				t.Fatal("reprocessing didn't store a new object")
+			}
+
+			keys := storedKeys(t, cfg)
+			if kept := slices.Contains(keys, "landscape/original.mp4"); kept != tt.shared {
+				t.Errorf("original object kept = %v, want %v; objects: %q", kept, tt.shared, keys)
+			}
+			hlsLeft := 0
+			for _, key := range keys {
+				if strings.HasPrefix(key, "landscape/original-hls/") {
+					hlsLeft++
+				}
+			}
+			wantHLS := 0
+			if tt.shared {
+				wantHLS = 4
+			}
+			if hlsLeft != wantHLS {
+				t.Errorf("%d objects of the old HLS package left, want %d; objects: %q", hlsLeft, wantHLS, keys)
+			}
+		})
+	}
+}
+
+func newReprocessRequest(t *testing.T, video database.Video, token string) *http.Request {
+	t.Helper()
+	return newVideoRequest(t, http.MethodPost, video.ID, "/reprocess", token, nil)
+}
+
+func TestHandlerVideoReprocess(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := storeTestVideo(t, cfg, createTestVideo(t, cfg, user.ID, "Reprocess"), "landscape/old.mp4", testMP4MoovLast(0))
+
+	waitForProbe, release := holdFFprobe(t, cfg)
+	rec := httptest.NewRecorder()
+	cfg.handlerVideoReprocess(rec, newReprocessRequest(t, video, token))
+	var accepted database.Video
+	decodeResponse(t, rec, http.StatusAccepted, &accepted)
+	if accepted.Status != database.VideoStatusProcessing {
+		t.Errorf("status = %q, want processing", accepted.Status)
+	}
+
+	// Asking again while it runs doesn't queue a second job
+	waitForProbe()
+	rec = httptest.NewRecorder()
+	cfg.handlerVideoReprocess(rec, newReprocessRequest(t, video, token))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	jobs, err := cfg.db.GetProcessingJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("%d processing jobs, want 1", len(jobs))
+	}
+	release()
+
+	ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	drainProcessing(t, cfg)
+	if *ready.VideoURL == *video.VideoURL {
+		t.Error("reprocessing didn't store a new object")
+	}
+	ref, err := parseStorageRef(*ready.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ref.Key
+	// The old object is replaced rather than left behind
+	if keys := storedKeys(t, cfg); !slices.Equal(keys, []string{key}) {
+		t.Errorf("objects = %q, want only %q", keys, key)
+	}
+	// The stored video had its moov box last, which the current pipeline
+	// fixes
+	if stored := storedVideoObject(t, cfg, ready); !bytes.Equal(stored, testMP4(0)) {
+		t.Error("reprocessed video wasn't rewritten for faststart")
+	}
+}
+
+func TestHandlerVideoReprocessRejects(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	stored := storeTestVideo(t, cfg, createTestVideo(t, cfg, owner.ID, "Stored"), "landscape/a.mp4", testMP4(0))
+	missing := createTestVideo(t, cfg, owner.ID, "Missing")
+	missingURL := testBucket + ",landscape/gone.mp4"
+	missing.VideoURL = &missingURL
+	if err := cfg.db.UpdateVideo(missing); err != nil {
+		t.Fatal(err)
+	}
+	notUploaded := createTestVideo(t, cfg, owner.ID, "Not uploaded")
+	trashed := storeTestVideo(t, cfg, createTestVideo(t, cfg, owner.ID, "Trashed"), "landscape/b.mp4", testMP4(0))
+	if err := cfg.db.SoftDeleteVideo(trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		video database.Video
+		token string
+		want  int
+	}{
+		{"not the owner", stored, otherToken, http.StatusForbidden},
+		{"no token", stored, "", http.StatusUnauthorized},
+		{"object missing", missing, ownerToken, http.StatusNotFound},
+		{"never uploaded", notUploaded, ownerToken, http.StatusBadRequest},
+		{"deleted", trashed, ownerToken, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerVideoReprocess(rec, newReprocessRequest(t, tt.video, tt.token))
+			decodeResponse(t, rec, tt.want, nil)
+			if got := getTestVideo(t, cfg, tt.video.ID); got.Status == database.VideoStatusProcessing {
+				t.Error("rejected request started processing")
+			}
+		})
+	}
+}
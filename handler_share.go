@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var errShareTokenRevoked = errors.New("share token has been revoked")
+
+// handlerVideoShare mints a share token that lets anyone watch one video,
+// even a private one, until it expires or is revoked.
+func (cfg *apiConfig) handlerVideoShare(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		// ExpiresInSeconds defaults to SHARE_TOKEN_EXPIRY and is clamped to
+		// SHARE_TOKEN_MAX_EXPIRY
+		ExpiresInSeconds int `json:"expires_in_seconds"`
+	}
+	type response struct {
+		database.ShareToken
+		Token string `json:"token"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	claims, err := cfg.parseJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// The body is optional
+	params := parameters{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithDecodeError(w, err)
+			return
+		}
+	}
+	if params.ExpiresInSeconds < 0 {
+		respondWithError(w, http.StatusBadRequest, "expires_in_seconds must be positive", nil)
+		return
+	}
+	expiry := cfg.shareTokenExpiry
+	if params.ExpiresInSeconds > 0 {
+		expiry = min(time.Duration(params.ExpiresInSeconds)*time.Second, cfg.shareTokenMaxExpiry)
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+
+	share, err := cfg.db.CreateShareToken(videoID, claims.UserID, time.Now().Add(expiry))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share token", err)
+		return
+	}
+	shareToken, err := auth.MakeShareToken(videoID, share.ID.String(), cfg.jwtSecret, share.ExpiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share token", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{ShareToken: share, Token: shareToken})
+}
+
+// handlerVideoShareRevoke revokes one of a video's share tokens.
+func (cfg *apiConfig) handlerVideoShareRevoke(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	shareID, err := uuid.Parse(r.PathValue("shareID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid share ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	claims, err := cfg.parseJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+
+	found, err := cfg.db.RevokeShareToken(shareID, videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke share token", err)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Share token not found", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkShareToken validates a share token for the video with videoID and
+// returns when it expires.
+func (cfg *apiConfig) checkShareToken(tokenString string, videoID uuid.UUID) (time.Time, error) {
+	token, err := auth.ParseShareToken(tokenString, cfg.jwtSecret)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if token.VideoID != videoID {
+		return time.Time{}, errors.New("share token is for another video")
+	}
+	shareID, err := uuid.Parse(token.ID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	share, err := cfg.db.GetShareToken(shareID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if share.ID == uuid.Nil || share.VideoID != videoID || share.RevokedAt != nil {
+		return time.Time{}, errShareTokenRevoked
+	}
+	return token.ExpiresAt, nil
+}
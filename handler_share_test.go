@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// newPublicVideoRequest returns an anonymous request for a video, passing
+// shareToken as ?share_token= if it's set.
+func newPublicVideoRequest(t *testing.T, videoID uuid.UUID, shareToken string) *http.Request {
+	t.Helper()
+	req := newVideoRequest(t, http.MethodGet, videoID, "", "", nil)
+	if shareToken != "" {
+		req.URL.RawQuery = url.Values{"share_token": {shareToken}}.Encode()
+	}
+	return req
+}
+
+func TestHandlerPublicVideoGetShareToken(t *testing.T) {
+	cfg := newTestConfig(t)
+	video, token := readyPublicVideo(t, cfg)
+	if err := cfg.db.UpdateVideoVisibility(video.ID, database.VisibilityPrivate); err != nil {
+		t.Fatal(err)
+	}
+	other := createTestVideo(t, cfg, video.UserID, "Other")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerVideoShare(rec, newVideoRequest(t, http.MethodPost, video.ID, "/share", token, nil))
+	var shared struct {
+		Token string `json:"token"`
+	}
+	decodeResponse(t, rec, http.StatusCreated, &shared)
+
+	// A token whose record has already expired, signed with the right key
+	past := time.Now().Add(-time.Minute)
+	expiredShare, err := cfg.db.CreateShareToken(video.ID, video.UserID, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := auth.MakeShareToken(video.ID, expiredShare.ID.String(), cfg.jwtSecret, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		videoID    uuid.UUID
+		shareToken string
+		want       int
+	}{
+		// Without a token the private video looks like it doesn't exist
+		{"no token", video.ID, "", http.StatusNotFound},
+		{"valid", video.ID, shared.Token, http.StatusOK},
+		{"expired", video.ID, expired, http.StatusUnauthorized},
+		{"other video", other.ID, shared.Token, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerPublicVideoGet(rec, newPublicVideoRequest(t, tt.videoID, tt.shareToken))
+			var got publicVideo
+			decodeResponse(t, rec, tt.want, &got)
+			if tt.want == http.StatusOK && got.ID != tt.videoID {
+				t.Errorf("got video %s, want %s", got.ID, tt.videoID)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const maxTagLength = 50
+
+// normalizeTag trims and lowercases a tag so "Travel" and "travel " are the
+// same tag. It returns "" for tags that aren't allowed.
+func normalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if utf8.RuneCountInString(tag) > maxTagLength || strings.ContainsAny(tag, ",/") {
+		return ""
+	}
+	return tag
+}
+
+// videoForTagging loads the video in the path for a tag request and checks
+// that the caller can change it. It writes the error response and returns
+// false if not.
+func (cfg *apiConfig) videoForTagging(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	claims, err := cfg.parseJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, false
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+func (cfg *apiConfig) respondWithVideoTags(w http.ResponseWriter, videoID uuid.UUID) {
+	type response struct {
+		Tags []string `json:"tags"`
+	}
+
+	tags, err := cfg.db.GetVideoTags(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get tags", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{Tags: tags})
+}
+
+// handlerVideoTagAdd tags a video and responds with all of its tags.
+func (cfg *apiConfig) handlerVideoTagAdd(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.videoForTagging(w, r)
+	if !ok {
+		return
+	}
+	tag := normalizeTag(r.PathValue("tag"))
+	if tag == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag", nil)
+		return
+	}
+
+	if err := cfg.db.AddVideoTag(video.ID, video.UserID, tag); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't add tag", err)
+		return
+	}
+	cfg.respondWithVideoTags(w, video.ID)
+}
+
+// handlerVideoTagRemove untags a video and responds with its remaining tags.
+func (cfg *apiConfig) handlerVideoTagRemove(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.videoForTagging(w, r)
+	if !ok {
+		return
+	}
+	tag := normalizeTag(r.PathValue("tag"))
+	if tag == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag", nil)
+		return
+	}
+
+	if err := cfg.db.RemoveVideoTag(video.ID, tag); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't remove tag", err)
+		return
+	}
+	cfg.respondWithVideoTags(w, video.ID)
+}
+
+// handlerVideoTagsList responds with a video's tags.
+func (cfg *apiConfig) handlerVideoTagsList(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.videoForTagging(w, r)
+	if !ok {
+		return
+	}
+	cfg.respondWithVideoTags(w, video.ID)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// newTagRequest returns a request to add or remove tag on a video.
+func newTagRequest(t *testing.T, method string, videoID uuid.UUID, tag, token string) *http.Request {
+	t.Helper()
+	req := newVideoRequest(t, method, videoID, "/tags/"+url.PathEscape(tag), token, nil)
+	req.SetPathValue("tag", tag)
+	return req
+}
+
+type tagsResponse struct {
+	Tags []string `json:"tags"`
+}
+
+func TestHandlerVideoTags(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, owner.ID, "Tagged")
+
+	// Tags are normalized, so adding the same one twice keeps one copy
+	for _, tag := range []string{"Travel", "travel ", "food"} {
+		rec := httptest.NewRecorder()
+		cfg.handlerVideoTagAdd(rec, newTagRequest(t, http.MethodPut, video.ID, tag, token))
+		decodeResponse(t, rec, http.StatusOK, nil)
+	}
+
+	rec := httptest.NewRecorder()
+	cfg.handlerVideoTagsList(rec, newVideoRequest(t, http.MethodGet, video.ID, "/tags", token, nil))
+	var got tagsResponse
+	decodeResponse(t, rec, http.StatusOK, &got)
+	slices.Sort(got.Tags)
+	if want := []string{"food", "travel"}; !slices.Equal(got.Tags, want) {
+		t.Errorf("tags = %q, want %q", got.Tags, want)
+	}
+
+	rec = httptest.NewRecorder()
+	cfg.handlerVideoTagRemove(rec, newTagRequest(t, http.MethodDelete, video.ID, "TRAVEL", token))
+	decodeResponse(t, rec, http.StatusOK, &got)
+	if want := []string{"food"}; !slices.Equal(got.Tags, want) {
+		t.Errorf("tags after removing travel = %q, want %q", got.Tags, want)
+	}
+
+	rec = httptest.NewRecorder()
+	cfg.handlerVideoTagAdd(rec, newTagRequest(t, http.MethodPut, video.ID, "a/b", token))
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestHandlerVideosRetrieveByTag(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	tags := map[string][]string{
+		"Beach":    {"travel", "summer"},
+		"Mountain": {"travel"},
+		"Recipe":   {"food"},
+	}
+	for title, videoTags := range tags {
+		video := createTestVideo(t, cfg, owner.ID, title)
+		for _, tag := range videoTags {
+			rec := httptest.NewRecorder()
+			cfg.handlerVideoTagAdd(rec, newTagRequest(t, http.MethodPut, video.ID, tag, token))
+			decodeResponse(t, rec, http.StatusOK, nil)
+		}
+	}
+
+	tests := []struct {
+		tag  string
+		want []string
+	}{
+		{"travel", []string{"Beach", "Mountain"}},
+		{"Summer", []string{"Beach"}},
+		{"music", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerVideosRetrieve(rec, newJSONRequest(t, http.MethodGet, "/api/videos?tag="+tt.tag, token, nil))
+			var videos []database.Video
+			decodeResponse(t, rec, http.StatusOK, &videos)
+
+			var titles []string
+			for _, video := range videos {
+				titles = append(titles, video.Title)
+			}
+			slices.Sort(titles)
+			if !slices.Equal(titles, tt.want) {
+				t.Errorf("got %q, want %q", titles, tt.want)
+			}
+		})
+	}
+}
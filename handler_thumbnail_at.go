@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerThumbnailAt sets the video's thumbnail to the frame at ?t= seconds.
+func (cfg *apiConfig) handlerThumbnailAt(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	claims, err := cfg.parseJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	atSeconds, err := strconv.ParseFloat(r.URL.Query().Get("t"), 64)
+	if err != nil || math.IsNaN(atSeconds) || math.IsInf(atSeconds, 0) || atSeconds < 0 {
+		respondWithError(w, http.StatusBadRequest, "t must be a non-negative number of seconds", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusBadRequest, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	ref, err := parseStorageRef(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Video isn't stored in a way frames can be read from", err)
+		return
+	}
+
+	// Check against the stored duration first so a bad t doesn't cost a
+	// download. Older videos don't have one, so those are checked after.
+	if video.Duration > 0 && atSeconds >= video.Duration {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("t must be less than the video's duration of %.2f seconds", video.Duration), nil)
+		return
+	}
+
+	body, _, err := cfg.storage.Get(r.Context(), ref.Key)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Stored video is missing", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to download video", err)
+		return
+	}
+	defer body.Close()
+
+	tmpFile, err := os.CreateTemp(cfg.tempDir, "tubely-frame")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create temp file", err)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	if _, err := io.Copy(tmpFile, body); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to download video", err)
+		return
+	}
+
+	if video.Duration <= 0 {
+		probeCtx, cancel := cfg.ffmpegContext(r.Context())
+		duration, err := getVideoDuration(probeCtx, cfg.ffprobePath, tmpFile.Name())
+		cancel()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to determine duration", err)
+			return
+		}
+		if atSeconds >= duration {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("t must be less than the video's duration of %.2f seconds", duration), nil)
+			return
+		}
+	}
+
+	if err := cfg.saveFrameAsThumbnail(r.Context(), &video, tmpFile.Name(), atSeconds); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to save thumbnail", err)
+		return
+	}
+
+	cfg.respondWithSignedVideo(w, http.StatusOK, video)
+}
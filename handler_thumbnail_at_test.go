@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerThumbnailAt(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Poster")
+	video.Duration = 5
+	video = storeTestVideo(t, cfg, video, "landscape/a.mp4", testMP4(0))
+
+	rec := httptest.NewRecorder()
+	cfg.handlerThumbnailAt(rec, newVideoRequest(t, http.MethodPost, video.ID, "/thumbnail/at?t=2.5", token, nil))
+	var got database.Video
+	decodeResponse(t, rec, http.StatusOK, &got)
+
+	if got.ThumbnailURL == nil {
+		t.Fatal("thumbnail wasn't set")
+	}
+	if !slices.ContainsFunc(ffmpegRuns(t, cfg), func(run string) bool { return strings.Contains(run, "-ss 2.500 ") }) {
+		t.Errorf("no frame was grabbed at 2.5s: %q", ffmpegRuns(t, cfg))
+	}
+	if saved := getTestVideo(t, cfg, video.ID); saved.ThumbnailURL == nil {
+		t.Error("thumbnail wasn't saved")
+	}
+}
+
+func TestHandlerThumbnailAtOutOfRange(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Poster")
+	video.Duration = 5
+	video = storeTestVideo(t, cfg, video, "landscape/a.mp4", testMP4(0))
+	// Older videos don't have a stored duration, so it's probed (5s by
+	// default)
+	legacy := storeTestVideo(t, cfg, createTestVideo(t, cfg, user.ID, "Legacy"), "landscape/b.mp4", testMP4(0))
+
+	tests := []struct {
+		name  string
+		video database.Video
+		query string
+	}{
+		{"at the end", video, "?t=5"},
+		{"past the end", video, "?t=12.5"},
+		{"past the probed end", legacy, "?t=7"},
+		{"negative", video, "?t=-1"},
+		{"not a number", video, "?t=soon"},
+		{"NaN", video, "?t=NaN"},
+		{"infinite", video, "?t=Inf"},
+		{"missing", video, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerThumbnailAt(rec, newVideoRequest(t, http.MethodPost, tt.video.ID, "/thumbnail/at"+tt.query, token, nil))
+			decodeResponse(t, rec, http.StatusBadRequest, nil)
+		})
+	}
+	if runs := ffmpegRuns(t, cfg); len(runs) > 0 {
+		t.Errorf("ffmpeg ran for out of range timestamps: %q", runs)
+	}
+	if got := getTestVideo(t, cfg, video.ID); got.ThumbnailURL != nil {
+		t.Errorf("thumbnail set to %q", *got.ThumbnailURL)
+	}
+}
+
+func TestHandlerThumbnailAtRejects(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	stored := storeTestVideo(t, cfg, createTestVideo(t, cfg, owner.ID, "Stored"), "landscape/a.mp4", testMP4(0))
+	trashed := storeTestVideo(t, cfg, createTestVideo(t, cfg, owner.ID, "Trashed"), "landscape/b.mp4", testMP4(0))
+	if err := cfg.db.SoftDeleteVideo(trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		video database.Video
+		token string
+		want  int
+	}{
+		{"not the owner", stored, otherToken, http.StatusForbidden},
+		{"no token", stored, "", http.StatusUnauthorized},
+		{"deleted", trashed, ownerToken, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerThumbnailAt(rec, newVideoRequest(t, http.MethodPost, tt.video.ID, "/thumbnail/at?t=1", tt.token, nil))
+			decodeResponse(t, rec, tt.want, nil)
+			if got := getTestVideo(t, cfg, tt.video.ID); got.ThumbnailURL != nil {
+				t.Errorf("thumbnail set to %q", *got.ThumbnailURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Core tus 1.0.0 resumable uploads (https://tus.io/protocols/resumable-upload).
+// A client creates an upload for a video with POST, appends bytes with PATCH
+// and, after a dropped connection, asks for the current offset with HEAD so
+// it can resume. Once every byte has arrived the file goes through the same
+// pipeline as a regular video upload.
+
+const tusVersion = "1.0.0"
+
+type tusUpload struct {
+	mu     sync.Mutex
+	id     uuid.UUID
+	userID uuid.UUID
+	// admin is set when an admin started the upload for someone else's video
+	admin     bool
+	videoID   uuid.UUID
+	mediaType string
+	length    int64
+	offset    int64
+	path      string
+	// contentSHA256 is the X-Content-SHA256 sent when the upload was
+	// created, checked once every byte has arrived
+	contentSHA256 string
+	// expiresAt is pushed back by every PATCH; once it passes, the session
+	// and its temp file are removed
+	expiresAt time.Time
+	// expired is set when the session is removed, for a request that
+	// looked it up just before
+	expired bool
+}
+
+type tusStore struct {
+	mu      sync.Mutex
+	uploads map[uuid.UUID]*tusUpload
+	// ttl is how long an upload may go without a PATCH
+	ttl time.Duration
+}
+
+func newTusStore(ttl time.Duration) *tusStore {
+	return &tusStore{uploads: map[uuid.UUID]*tusUpload{}, ttl: ttl}
+}
+
+func (s *tusStore) get(id uuid.UUID) (*tusUpload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[id]
+	return upload, ok
+}
+
+func (s *tusStore) add(upload *tusUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[upload.id] = upload
+}
+
+func (s *tusStore) remove(id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, id)
+}
+
+// removeExpired removes the uploads whose expiry is before now and returns
+// them. Uploads with a PATCH in progress are left for the next sweep.
+func (s *tusStore) removeExpired(now time.Time) []*tusUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []*tusUpload
+	for id, upload := range s.uploads {
+		if !upload.mu.TryLock() {
+			continue
+		}
+		if now.After(upload.expiresAt) {
+			upload.expired = true
+			delete(s.uploads, id)
+			expired = append(expired, upload)
+		}
+		upload.mu.Unlock()
+	}
+	return expired
+}
+
+// paths returns the temp files of the uploads in progress.
+func (s *tusStore) paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make([]string, 0, len(s.uploads))
+	for _, upload := range s.uploads {
+		paths = append(paths, upload.path)
+	}
+	return paths
+}
+
+// expireTusUploads removes uploads that haven't been touched for the store's
+// TTL along with their temp files.
+func (cfg *apiConfig) expireTusUploads(ctx context.Context) int {
+	expired := cfg.tusUploads.removeExpired(time.Now())
+	for _, upload := range expired {
+		if err := os.Remove(upload.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.ErrorContext(ctx, "couldn't remove expired upload", "path", upload.path, "error", err.Error())
+		}
+	}
+	return len(expired)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs
+// of a key and an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	claims, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authenticate request", err)
+		return
+	}
+	userID := claims.UserID
+
+	// Creating the session is what starts an upload, so that's what's
+	// limited rather than every PATCH
+	if !cfg.checkUploadRate(w, userID) {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to get video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Length", err)
+		return
+	}
+	if length > cfg.maxVideoUploadBytes {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds the %d byte limit", cfg.maxVideoUploadBytes), nil)
+		return
+	}
+	// Fail before any bytes are sent; the processed file is checked again
+	// before it's stored
+	if err := cfg.checkStorageQuota(video.UserID, videoID, length); err != nil {
+		respondWithPipelineError(w, err)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata", err)
+		return
+	}
+	mediaType := metadata["filetype"]
+	if mediaType == "" {
+		mediaType = "video/mp4"
+	}
+	if !allowedVideoTypes[mediaType] {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type, only MP4, MOV and WebM are allowed", nil)
+		return
+	}
+
+	tmpFile, err := os.CreateTemp(cfg.tempDir, "tubely-upload-tus")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create temp file", err)
+		return
+	}
+	tmpFile.Close()
+
+	upload := &tusUpload{
+		id:            uuid.New(),
+		userID:        userID,
+		admin:         isAdmin(claims),
+		videoID:       videoID,
+		mediaType:     mediaType,
+		length:        length,
+		path:          tmpFile.Name(),
+		expiresAt:     time.Now().Add(cfg.tusUploads.ttl),
+		contentSHA256: r.Header.Get(contentSHA256Header),
+	}
+	cfg.tusUploads.add(upload)
+
+	w.Header().Set("Location", "/api/tus/uploads/"+upload.id.String())
+	w.Header().Set("Upload-Expires", upload.expiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// getTusUpload resolves the upload in the request path and checks that it
+// belongs to the authenticated user. It responds with an error and returns
+// false when it doesn't.
+func (cfg *apiConfig) getTusUpload(w http.ResponseWriter, r *http.Request) (*tusUpload, bool) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID", err)
+		return nil, false
+	}
+
+	claims, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authenticate request", err)
+		return nil, false
+	}
+
+	upload, ok := cfg.tusUploads.get(uploadID)
+	if !ok || upload.userID != claims.UserID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return nil, false
+	}
+	return upload, true
+}
+
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if upload.expired {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+	w.Header().Set("Upload-Expires", upload.expiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+
+	// Only one PATCH may append to an upload at a time
+	if !upload.mu.TryLock() {
+		respondWithError(w, http.StatusConflict, "Upload is already in progress", nil)
+		return
+	}
+	defer upload.mu.Unlock()
+	if upload.expired {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset", err)
+		return
+	}
+	if offset != upload.offset {
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the current offset", nil)
+		return
+	}
+
+	f, err := os.OpenFile(upload.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to open upload", err)
+		return
+	}
+
+	// Keep whatever arrived even if the connection drops mid-chunk, so the
+	// client can resume from the new offset
+	written, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.length-upload.offset))
+	closeErr := f.Close()
+	upload.offset += written
+	upload.expiresAt = time.Now().Add(cfg.tusUploads.ttl)
+	if err := errors.Join(copyErr, closeErr); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to write upload", err)
+		return
+	}
+
+	if upload.offset < upload.length {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		w.Header().Set("Upload-Expires", upload.expiresAt.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Every byte has arrived, so hand the file to the regular pipeline. The
+	// session and its file are kept until the job is queued, so when that
+	// fails for a reason that passes, like another upload being busy with
+	// the video or a full queue, the client can retry the final PATCH
+	finish := func() {
+		cfg.tusUploads.remove(upload.id)
+		os.Remove(upload.path)
+	}
+	if !cfg.uploadLocks.tryLock(upload.videoID) {
+		respondWithError(w, http.StatusConflict, "An upload to this video is already in progress", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(upload.videoID)
+
+	video, err := cfg.db.GetVideo(upload.videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to get video metadata", err)
+		return
+	}
+	if video.Status == database.VideoStatusProcessing {
+		respondWithError(w, http.StatusConflict, "Video is already being processed", nil)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		finish()
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != upload.userID && !upload.admin {
+		finish()
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+
+	sum, err := fileSHA256(upload.path)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read upload", err)
+		return
+	}
+	// Resuming can't fix a corrupted file, so the client has to start over
+	if err := verifySHA256(upload.contentSHA256, sum); err != nil {
+		finish()
+		respondWithError(w, http.StatusBadRequest, "X-Content-SHA256 doesn't match the uploaded file", err)
+		return
+	}
+	video.ContentSHA256 = sum
+
+	if _, ok, err := cfg.reuseDuplicateVideo(video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to check for duplicate uploads", err)
+		return
+	} else if ok {
+		finish()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	_, err = cfg.enqueueProcessing(r.Context(), video, processingJob{
+		videoID:   video.ID,
+		path:      upload.path,
+		mediaType: upload.mediaType,
+	})
+	if err != nil {
+		respondWithQueueError(w, err)
+		return
+	}
+	// The processing job owns the file now
+	cfg.tusUploads.remove(upload.id)
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// newTusCreateRequest builds the POST that starts a tus upload of length
+// bytes for videoID.
+func newTusCreateRequest(t *testing.T, videoID uuid.UUID, token string, length int) *http.Request {
+	t.Helper()
+	req := newJSONRequest(t, http.MethodPost, "/api/videos/"+videoID.String()+"/tus", token, nil)
+	req.SetPathValue("videoID", videoID.String())
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	return req
+}
+
+// createTusUpload starts a tus upload of length bytes for video and returns
+// the session.
+func createTusUpload(t *testing.T, cfg *apiConfig, videoID uuid.UUID, token string, length int) *tusUpload {
+	t.Helper()
+	return createTusUploadWithRequest(t, cfg, newTusCreateRequest(t, videoID, token, length))
+}
+
+func createTusUploadWithRequest(t *testing.T, cfg *apiConfig, req *http.Request) *tusUpload {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	cfg.handlerTusCreate(rec, req)
+	decodeResponse(t, rec, http.StatusCreated, nil)
+
+	if _, err := http.ParseTime(rec.Header().Get("Upload-Expires")); err != nil {
+		t.Errorf("Upload-Expires %q: %v", rec.Header().Get("Upload-Expires"), err)
+	}
+	id, err := uuid.Parse(path.Base(rec.Header().Get("Location")))
+	if err != nil {
+		t.Fatalf("Location %q: %v", rec.Header().Get("Location"), err)
+	}
+	upload, ok := cfg.tusUploads.get(id)
+	if !ok {
+		t.Fatal("upload wasn't stored")
+	}
+	return upload
+}
+
+func tusRequest(t *testing.T, method string, upload *tusUpload, token string, offset int, data []byte) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(method, "/api/tus/uploads/"+upload.id.String(), bytes.NewReader(data))
+	req.SetPathValue("uploadID", upload.id.String())
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	}
+	return req
+}
+
+func TestTusUpload(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Resumable")
+	data := testMP4(4096)
+	upload := createTusUpload(t, cfg, video.ID, token, len(data))
+
+	half := len(data) / 2
+	rec := httptest.NewRecorder()
+	cfg.handlerTusPatch(rec, tusRequest(t, http.MethodPatch, upload, token, 0, data[:half]))
+	decodeResponse(t, rec, http.StatusNoContent, nil)
+	if got := rec.Header().Get("Upload-Offset"); got != strconv.Itoa(half) {
+		t.Errorf("Upload-Offset = %s, want %d", got, half)
+	}
+
+	rec = httptest.NewRecorder()
+	cfg.handlerTusPatch(rec, tusRequest(t, http.MethodPatch, upload, token, half, data[half:]))
+	decodeResponse(t, rec, http.StatusNoContent, nil)
+
+	waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	if _, ok := cfg.tusUploads.get(upload.id); ok {
+		t.Error("finished upload is still in the store")
+	}
+}
+
+// droppedReader returns data and then fails, like a request body whose
+// connection went away.
+type droppedReader struct {
+	data []byte
+}
+
+func (r *droppedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestTusUploadResumesAfterDroppedConnection(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Resumable")
+	data := testMP4(6000)
+	upload := createTusUpload(t, cfg, video.ID, token, len(data))
+	third := len(data) / 3
+
+	rec := httptest.NewRecorder()
+	cfg.handlerTusPatch(rec, tusRequest(t, http.MethodPatch, upload, token, 0, data[:third]))
+	decodeResponse(t, rec, http.StatusNoContent, nil)
+
+	// The second chunk's connection drops partway through
+	req := tusRequest(t, http.MethodPatch, upload, token, third, nil)
+	req.Body = io.NopCloser(&droppedReader{data: data[third : third+100]})
+	rec = httptest.NewRecorder()
+	cfg.handlerTusPatch(rec, req)
+	if rec.Code < 400 {
+		t.Fatalf("dropped PATCH got status %d", rec.Code)
+	}
+
+	// The client asks where to pick up again
+	rec = httptest.NewRecorder()
+	cfg.handlerTusHead(rec, tusRequest(t, http.MethodHead, upload, token, 0, nil))
+	decodeResponse(t, rec, http.StatusOK, nil)
+	offset, err := strconv.Atoi(rec.Header().Get("Upload-Offset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != third+100 {
+		t.Errorf("offset after the drop = %d, want %d", offset, third+100)
+	}
+
+	// Resending from the old offset is refused
+	rec = httptest.NewRecorder()
+	cfg.handlerTusPatch(rec, tusRequest(t, http.MethodPatch, upload, token, third, data[third:2*third]))
+	decodeResponse(t, rec, http.StatusConflict, nil)
+
+	rec = httptest.NewRecorder()
+	cfg.handlerTusPatch(rec, tusRequest(t, http.MethodPatch, upload, token, offset, data[offset:2*third]))
+	decodeResponse(t, rec, http.StatusNoContent, nil)
+	rec = httptest.NewRecorder()
+	cfg.handlerTusPatch(rec, tusRequest(t, http.MethodPatch, upload, token, 2*third, data[2*third:]))
+	decodeResponse(t, rec, http.StatusNoContent, nil)
+
+	ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	ref, err := parseStorageRef(*ready.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ref.Key
+	body, _, err := cfg.storage.Get(t.Context(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	stored, _ := io.ReadAll(body)
+	if !bytes.Equal(stored, data) {
+		t.Errorf("stored %d bytes that don't match the %d uploaded", len(stored), len(data))
+	}
+}
+
+func TestTusUploadExpiry(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.staleTempFileAge = time.Minute
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Resumable")
+	idle := createTusUpload(t, cfg, video.ID, token, 1000)
+	active := createTusUpload(t, cfg, video.ID, token, 1000)
+
+	// Both files are old enough for the stale file cleanup, but only the
+	// idle session has expired
+	old := time.Now().Add(-time.Hour)
+	for _, upload := range []*tusUpload{idle, active} {
+		if err := os.Chtimes(upload.path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idle.expiresAt = time.Now().Add(-time.Second)
+
+	cfg.cleanupTempDir(t.Context())
+
+	if _, err := os.Stat(idle.path); !os.IsNotExist(err) {
+		t.Errorf("expired upload's temp file still exists (err %v)", err)
+	}
+	rec := httptest.NewRecorder()
+	cfg.handlerTusHead(rec, tusRequest(t, http.MethodHead, idle, token, 0, nil))
+	decodeResponse(t, rec, http.StatusNotFound, nil)
+
+	if _, err := os.Stat(active.path); err != nil {
+		t.Errorf("active upload's temp file was removed: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	cfg.handlerTusHead(rec, tusRequest(t, http.MethodHead, active, token, 0, nil))
+	decodeResponse(t, rec, http.StatusOK, nil)
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	got, err := parseTusMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLm1wNA==, filetype dmlkZW8vbXA0,is_confidential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"filename": "world_domination_plan.mp4", "filetype": "video/mp4", "is_confidential": ""}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if _, err := parseTusMetadata("filename not-base64!"); err == nil {
+		t.Error("expected an error for a value that isn't base64")
+	}
+}
+
+func TestTusUploadKeepsSessionWhenQueueIsFull(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Busy")
+	data := testMP4(0)
+	upload := createTusUpload(t, cfg, video.ID, token, len(data))
+
+	working := cfg.processing
+	closed := NewProcessorPool(1, 1, cfg.runProcessingJob)
+	closed.Shutdown(t.Context())
+	cfg.processing = closed
+
+	rec := httptest.NewRecorder()
+	cfg.handlerTusPatch(rec, tusRequest(t, http.MethodPatch, upload, token, 0, data))
+	decodeResponse(t, rec, http.StatusServiceUnavailable, nil)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After on a 503")
+	}
+	if _, ok := cfg.tusUploads.get(upload.id); !ok {
+		t.Fatal("session was removed before the video was queued")
+	}
+	if _, err := os.Stat(upload.path); err != nil {
+		t.Fatalf("upload file was removed before the video was queued: %v", err)
+	}
+
+	// Retrying the final PATCH with nothing left to send queues the video
+	cfg.processing = working
+	rec = httptest.NewRecorder()
+	cfg.handlerTusPatch(rec, tusRequest(t, http.MethodPatch, upload, token, len(data), nil))
+	decodeResponse(t, rec, http.StatusNoContent, nil)
+	waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	if _, ok := cfg.tusUploads.get(upload.id); ok {
+		t.Error("queued upload is still in the store")
+	}
+}
+
+func TestTusUploadChecksum(t *testing.T) {
+	data := testMP4(0)
+	sum := sha256.Sum256(data)
+	tests := []struct {
+		name     string
+		checksum string
+		want     int
+		status   string
+	}{
+		{"matching", hex.EncodeToString(sum[:]), http.StatusNoContent, database.VideoStatusReady},
+		{"mismatched", strings.Repeat("0", 64), http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Checksummed")
+			req := newTusCreateRequest(t, video.ID, token, len(data))
+			req.Header.Set(contentSHA256Header, tt.checksum)
+			upload := createTusUploadWithRequest(t, cfg, req)
+
+			rec := httptest.NewRecorder()
+			cfg.handlerTusPatch(rec, tusRequest(t, http.MethodPatch, upload, token, 0, data))
+			decodeResponse(t, rec, tt.want, nil)
+
+			if tt.status != "" {
+				waitForStatus(t, cfg, video.ID, tt.status)
+				return
+			}
+			// A corrupted upload can't be resumed, so nothing is kept
+			if _, ok := cfg.tusUploads.get(upload.id); ok {
+				t.Error("session of a corrupted upload is still in the store")
+			}
+			if left := tempFiles(t, cfg); len(left) > 0 {
+				t.Errorf("temp files left behind: %v", left)
+			}
+			if got := getTestVideo(t, cfg, video.ID); got.VideoURL != nil || got.Status != video.Status {
+				t.Errorf("video changed: status %q, URL %v", got.Status, got.VideoURL)
+			}
+		})
+	}
+}
+
+func TestTusCreateLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(cfg *apiConfig)
+		// first is the status of the first create, second of the one after
+		first, second int
+	}{
+		{"within limits", func(cfg *apiConfig) {}, http.StatusCreated, http.StatusCreated},
+		{"rate limited", func(cfg *apiConfig) {
+			cfg.uploadLimiter = newUserRateLimiter(1, 1)
+		}, http.StatusCreated, http.StatusTooManyRequests},
+		{"over quota", func(cfg *apiConfig) {
+			cfg.storageQuotaBytes = 100
+		}, http.StatusForbidden, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			tt.configure(cfg)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Limited")
+
+			for i, want := range []int{tt.first, tt.second} {
+				rec := httptest.NewRecorder()
+				cfg.handlerTusCreate(rec, newTusCreateRequest(t, video.ID, token, 1000))
+				if rec.Code != want {
+					t.Fatalf("create %d: status = %d, want %d; body: %s", i+1, rec.Code, want, rec.Body.String())
+				}
+			}
+			// Refused sessions don't leave temp files behind
+			if want := len(cfg.tusUploads.paths()); len(tempFiles(t, cfg)) != want {
+				t.Errorf("temp files = %v, want one per session (%d)", tempFiles(t, cfg), want)
+			}
+		})
+	}
+}
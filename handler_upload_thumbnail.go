@@ -2,13 +2,14 @@ package main
 
 import (
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"log/slog"
+	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/google/uuid"
 )
 
@@ -20,22 +21,25 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	claims, err := cfg.authenticate(r)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authenticate request", err)
 		return
 	}
+	userID := claims.UserID
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	if !cfg.checkUploadRate(w, userID) {
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
+	slog.InfoContext(r.Context(), "uploading thumbnail", "video_id", videoID, "user_id", userID)
 
 	const maxMemory = 10 << 20
-	r.ParseMultipartForm(maxMemory)
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxThumbnailUploadBytes)
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		respondWithMultipartError(w, err)
+		return
+	}
 
 	file, header, err := r.FormFile("thumbnail")
 	if err != nil {
@@ -44,41 +48,102 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	}
 	defer file.Close()
 
-	// mediaType := header.Header.Get("Content-Type")
+	if header.Size == 0 {
+		respondWithError(w, http.StatusBadRequest, "Uploaded file is empty", nil)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+		return
+	}
+	if mediaType != "image/jpeg" && mediaType != "image/png" {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type, only JPEG and PNG are allowed", nil)
+		return
+	}
+
+	// The thumbnail is stored in the uploaded format unless another is asked for
+	outputType := mediaType
+	if format := r.URL.Query().Get("format"); format != "" {
+		var ok bool
+		outputType, ok = thumbnailFormats[format]
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown thumbnail format %q", format), nil)
+			return
+		}
+	}
 
-	// fileData, err := io.ReadAll(file)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusInternalServerError, "Unable to read file", err)
-	// 	return
-	// }
+	sniffedType, err := sniffContentType(file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read file", err)
+		return
+	}
+	if sniffedType != mediaType {
+		respondWithError(w, http.StatusBadRequest, "File contents don't match the declared Content-Type", nil)
+		return
+	}
 
 	metadata, err := cfg.db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Unable to get video metadata", err)
 		return
 	}
+	if metadata.ID == uuid.Nil || metadata.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
 
-	if metadata.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "User does not have access to this video", nil)
+	if !canManageVideo(claims, metadata) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
 		return
 	}
 
-	// Create filepath
-	contentType := header.Header.Get("Content-Type")
-	ext :=  "." + strings.Split(contentType, "/")[1]
-	filePath := filepath.Join(cfg.assetsRoot, videoIDString + ext)
+	// Phone photos are often stored sideways with an EXIF orientation. The
+	// image is re-encoded without its EXIF (GPS included), so turn it upright
+	// first.
+	orientation := 1
+	if mediaType == "image/jpeg" {
+		orientation = jpegOrientation(file)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to read file", err)
+			return
+		}
+	}
 
-	// Create file on server and copy multipart data to it
-	assetFile, err := os.Create(filePath)
+	// Check the declared dimensions before decoding allocates for them
+	imgConfig, _, err := image.DecodeConfig(file)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to create thumbnail file", err)
+		respondWithError(w, http.StatusBadRequest, "Unable to decode image", err)
+		return
+	}
+	if imgConfig.Width*imgConfig.Height > maxThumbnailPixels {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Image is too large, the limit is %d pixels", maxThumbnailPixels), nil)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read file", err)
+		return
+	}
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to decode image", err)
+		return
+	}
+	img = applyOrientation(img, orientation)
+
+	// Optionally match the video's shape so players don't letterbox the
+	// thumbnail. Videos that haven't been processed yet have no dimensions.
+	if r.URL.Query().Get("crop") == "true" && metadata.Width > 0 && metadata.Height > 0 {
+		img = cropToAspectRatio(img, metadata.Width, metadata.Height)
+	}
+
+	// Save the image and its sized copies, then the new URLs to the DB
+	if err := cfg.saveThumbnail(r.Context(), &metadata, img, outputType); err != nil {
+		respondWithPipelineError(w, err)
+		return
 	}
-	io.Copy(assetFile, file)
 
-	// Update thumbnail URL in metadata and save to DB
-	thumbnailUrl := fmt.Sprintf("http://localhost:8091/assets/%s", videoIDString + ext)
-	metadata.ThumbnailURL = &thumbnailUrl
-	cfg.db.UpdateVideo(metadata)
-	
 	respondWithJSON(w, http.StatusOK, metadata)
 }
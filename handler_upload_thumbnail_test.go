@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHandlerUploadThumbnailTruncated(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+
+	// The upload was cut off halfway through
+	data := testImage(t, 64, 64, "image/png")
+	data = data[:len(data)/2]
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", data))
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+
+	if files := assetFiles(t, cfg); len(files) > 0 {
+		t.Errorf("files left in assets: %v", files)
+	}
+	if got := getTestVideo(t, cfg, video.ID); got.ThumbnailURL != nil {
+		t.Errorf("thumbnail URL set to %q", *got.ThumbnailURL)
+	}
+}
+
+func TestWriteAssetRemovesFailedFile(t *testing.T) {
+	cfg := newTestConfig(t)
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+
+	if _, err := cfg.writeAsset(t.Context(), "thumb.gif", img, "image/gif"); err == nil {
+		t.Fatal("expected an error encoding an unsupported type")
+	}
+	if files := assetFiles(t, cfg); len(files) > 0 {
+		t.Errorf("files left in assets: %v", files)
+	}
+}
+
+// failingVariantFFmpeg encodes like ffmpeg, but fails for outputs whose name
+// contains the size named in fail_variant next to it.
+const failingVariantFFmpeg = `#!/bin/sh
+dir="$(dirname "$0")"
+for arg in "$@"; do last="$arg"; done
+case "$last" in *-"$(cat "$dir/fail_variant")".*) exit 1 ;; esac
+cp "$dir/frame.jpg" "$last"
+`
+
+func TestHandlerUploadThumbnailVariantFailure(t *testing.T) {
+	for _, size := range thumbnailSizes {
+		t.Run(size.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			writeTestFile(t, cfg.ffmpegPath, failingVariantFFmpeg, 0o755)
+			writeTestFile(t, filepath.Join(filepath.Dir(cfg.ffmpegPath), "fail_variant"), size.name, 0o644)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 64, 36, "image/png")))
+			decodeResponse(t, rec, http.StatusOK, nil)
+			previous := assetFiles(t, cfg)
+
+			req := newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 64, 36, "image/png"))
+			req.URL.RawQuery = "format=webp"
+			rec = httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(rec, req)
+			decodeResponse(t, rec, http.StatusInternalServerError, nil)
+
+			// Only the previous thumbnail's files are left, and it's still
+			// the one the video points at
+			if files := assetFiles(t, cfg); !slices.Equal(files, previous) {
+				t.Errorf("assets = %v, want %v", files, previous)
+			}
+			if got := getTestVideo(t, cfg, video.ID); !strings.HasSuffix(*got.ThumbnailURL, ".png") {
+				t.Errorf("thumbnail URL = %q, want the previous .png", *got.ThumbnailURL)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadThumbnailRejectsGIF(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+
+	var data bytes.Buffer
+	if err := gif.Encode(&data, image.NewPaletted(image.Rect(0, 0, 8, 8), palette.Plan9), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &countingRecorder{ResponseRecorder: httptest.NewRecorder()}
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/gif", data.Bytes()))
+	if rec.headers != 1 {
+		t.Errorf("handler wrote %d responses, want 1", rec.headers)
+	}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	decodeResponse(t, rec.ResponseRecorder, http.StatusBadRequest, &resp)
+
+	if files := assetFiles(t, cfg); len(files) > 0 {
+		t.Errorf("files left in assets: %v", files)
+	}
+}
+
+func TestHandlerUploadThumbnailSniffsContents(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+
+	tests := []struct {
+		name      string
+		mediaType string
+		data      []byte
+		want      int
+	}{
+		{"MP4 labeled as PNG", "image/png", testMP4(0), http.StatusBadRequest},
+		{"PNG labeled as JPEG", "image/jpeg", testImage(t, 64, 36, "image/png"), http.StatusBadRequest},
+		{"PNG", "image/png", testImage(t, 64, 36, "image/png"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, tt.mediaType, tt.data))
+			decodeResponse(t, rec, tt.want, nil)
+		})
+	}
+}
+
+func TestSniffContentTypeRewinds(t *testing.T) {
+	data := testImage(t, 64, 36, "image/png")
+	r := bytes.NewReader(data)
+
+	mediaType, err := sniffContentType(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "image/png" {
+		t.Errorf("sniffed %s, want image/png", mediaType)
+	}
+	if rest, _ := io.ReadAll(r); !bytes.Equal(rest, data) {
+		t.Errorf("read %d bytes after sniffing, want all %d", len(rest), len(data))
+	}
+}
+
+func TestHandlerUploadThumbnailEmpty(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", nil))
+	var resp struct {
+		Error string `json:"error"`
+	}
+	decodeResponse(t, rec, http.StatusBadRequest, &resp)
+	if resp.Error != "Uploaded file is empty" {
+		t.Errorf("error = %q, want Uploaded file is empty", resp.Error)
+	}
+	if files := assetFiles(t, cfg); len(files) > 0 {
+		t.Errorf("files left in assets: %v", files)
+	}
+}
+
+func TestHandlerUploadThumbnailSizeLimit(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+	data := testImage(t, 320, 180, "image/png")
+	bodySize := newThumbnailRequest(t, video.ID, token, "image/png", data).ContentLength
+
+	tests := []struct {
+		name  string
+		limit int64
+		want  int
+	}{
+		{"just under", bodySize, http.StatusOK},
+		{"just over", bodySize - 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.maxThumbnailUploadBytes = tt.limit
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", data))
+			decodeResponse(t, rec, tt.want, nil)
+		})
+	}
+}
+
+func TestHandlerUploadThumbnailPixelLimit(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+
+	// A tiny PNG whose header claims it's 20000x20000. Rewrite the IHDR
+	// chunk's width and height, then its CRC.
+	data := testImage(t, 8, 8, "image/png")
+	binary.BigEndian.PutUint32(data[16:], 20000)
+	binary.BigEndian.PutUint32(data[20:], 20000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", data))
+	var resp struct {
+		Error string `json:"error"`
+	}
+	decodeResponse(t, rec, http.StatusBadRequest, &resp)
+	if !strings.Contains(resp.Error, "too large") {
+		t.Errorf("error = %q, want the pixel limit", resp.Error)
+	}
+	if files := assetFiles(t, cfg); len(files) > 0 {
+		t.Errorf("files left in assets: %v", files)
+	}
+}
+
+func TestHandlerUploadThumbnailDBFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+	}{
+		{"first thumbnail", false},
+		{"replacing a thumbnail", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+			if tt.existing {
+				rec := httptest.NewRecorder()
+				cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 64, 36, "image/png")))
+				decodeResponse(t, rec, http.StatusOK, nil)
+				video = getTestVideo(t, cfg, video.ID)
+			}
+			previous := assetFiles(t, cfg)
+
+			failDBUpdates(t, cfg, "thumbnail_url", "")
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 64, 36, "image/png")))
+			var resp struct {
+				Error string `json:"error"`
+			}
+			decodeResponse(t, rec, http.StatusInternalServerError, &resp)
+			if resp.Error != "Unable to update video" {
+				t.Errorf("error = %q, want Unable to update video", resp.Error)
+			}
+
+			// The video still points at the previous files, which are all
+			// still there, and the new ones are gone
+			if files := assetFiles(t, cfg); !slices.Equal(files, previous) {
+				t.Errorf("assets = %v, want %v", files, previous)
+			}
+			if got := getTestVideo(t, cfg, video.ID); deref(got.ThumbnailURL) != deref(video.ThumbnailURL) {
+				t.Errorf("thumbnail URL = %q, want %q", deref(got.ThumbnailURL), deref(video.ThumbnailURL))
+			}
+		})
+	}
+}
+
+// assetSize returns the dimensions of the image stored under assetURL.
+func assetSize(t *testing.T, cfg *apiConfig, assetURL string) (int, int) {
+	t.Helper()
+	f, err := os.Open(filepath.Join(cfg.assetsRoot, path.Base(assetURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("couldn't decode %s: %v", assetURL, err)
+	}
+	return config.Width, config.Height
+}
+
+func TestHandlerUploadThumbnailSizes(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	tests := []struct {
+		name          string
+		mediaType     string
+		width, height int
+		want          map[string][2]int
+	}{
+		{"PNG", "image/png", 1600, 900, map[string][2]int{
+			"small":  {320, 180},
+			"medium": {640, 360},
+			"large":  {1280, 720},
+		}},
+		{"JPEG", "image/jpeg", 1500, 1000, map[string][2]int{
+			"small":  {320, 213},
+			"medium": {640, 427},
+			"large":  {1280, 853},
+		}},
+		// Sizes wider than the upload keep its size instead of scaling up
+		{"small PNG", "image/png", 500, 300, map[string][2]int{
+			"small":  {320, 192},
+			"medium": {500, 300},
+			"large":  {500, 300},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video := createTestVideo(t, cfg, user.ID, tt.name)
+			data := testImage(t, tt.width, tt.height, tt.mediaType)
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, tt.mediaType, data))
+			decodeResponse(t, rec, http.StatusOK, nil)
+
+			got := getTestVideo(t, cfg, video.ID)
+			if got.ThumbnailURL == nil {
+				t.Fatal("thumbnail URL not set")
+			}
+			if w, h := assetSize(t, cfg, *got.ThumbnailURL); w != tt.width || h != tt.height {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", w, h, tt.width, tt.height)
+			}
+			if len(got.ThumbnailVariants) != len(tt.want) {
+				t.Errorf("got %d variants, want %d", len(got.ThumbnailVariants), len(tt.want))
+			}
+			for name, size := range tt.want {
+				variantURL, ok := got.ThumbnailVariants[name]
+				if !ok {
+					t.Errorf("no %s variant", name)
+					continue
+				}
+				if w, h := assetSize(t, cfg, variantURL); w != size[0] || h != size[1] {
+					t.Errorf("%s is %dx%d, want %dx%d", name, w, h, size[0], size[1])
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerUploadThumbnailWebP(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+
+	// Without ?format= the uploaded format is kept and ffmpeg isn't needed
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 64, 36, "image/png")))
+	decodeResponse(t, rec, http.StatusOK, nil)
+	if got := getTestVideo(t, cfg, video.ID); !strings.HasSuffix(*got.ThumbnailURL, ".png") {
+		t.Errorf("thumbnail URL = %q, want a .png", *got.ThumbnailURL)
+	}
+	if runs := ffmpegRuns(t, cfg); len(runs) > 0 {
+		t.Errorf("ffmpeg ran for a PNG thumbnail: %v", runs)
+	}
+
+	req := newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 64, 36, "image/png"))
+	req.URL.RawQuery = "format=webp"
+	rec = httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, req)
+	decodeResponse(t, rec, http.StatusOK, nil)
+
+	got := getTestVideo(t, cfg, video.ID)
+	urls := []string{*got.ThumbnailURL}
+	for _, variantURL := range got.ThumbnailVariants {
+		urls = append(urls, variantURL)
+	}
+	for _, u := range urls {
+		if !strings.HasSuffix(u, ".webp") {
+			t.Errorf("URL %q isn't a .webp", u)
+		}
+	}
+	files := assetFiles(t, cfg)
+	if len(files) != len(urls) {
+		t.Errorf("assets = %v, want only the %d WebP files", files, len(urls))
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Join(cfg.assetsRoot, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sniffed := http.DetectContentType(data); sniffed != "image/webp" {
+			t.Errorf("%s sniffs as %s, want image/webp", name, sniffed)
+		}
+	}
+
+	// The file server picks the content type from the extension
+	handler := http.StripPrefix("/assets", assetCacheMiddleware(cfg.assetsRoot, http.FileServer(http.Dir(cfg.assetsRoot))))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/"+path.Base(*got.ThumbnailURL), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/webp" {
+		t.Errorf("Content-Type = %q, want image/webp", ct)
+	}
+}
@@ -1,7 +1,196 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
-func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {}
+func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
+	// Parts larger than maxMemory are spilled to temp files on disk rather
+	// than being buffered in memory
+	const maxMemory = 32 << 20 // 32 MB
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadBytes)
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	claims, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authenticate request", err)
+		return
+	}
+	userID := claims.UserID
+
+	// A retry of an upload that already went through gets the same answer
+	// instead of storing the file again
+	idempotencyKey, replayed := cfg.replayIdempotentRequest(w, r, userID)
+	if replayed {
+		return
+	}
+	defer cfg.releaseIdempotencyKey(r, userID, idempotencyKey)
+
+	if !cfg.checkUploadRate(w, userID) {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "uploading video", "video_id", videoID, "user_id", userID)
+
+	// Taken before the video is read so the upload works from its latest
+	// state
+	if !cfg.uploadLocks.tryLock(videoID) {
+		respondWithError(w, http.StatusConflict, "An upload to this video is already in progress", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(videoID)
+
+	metadata, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to get video metadata", err)
+		return
+	}
+	if metadata.ID == uuid.Nil || metadata.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	if !canManageVideo(claims, metadata) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+	// A finished upload still owns the video until its processing is done
+	if metadata.Status == database.VideoStatusProcessing {
+		respondWithError(w, http.StatusConflict, "Video is already being processed", nil)
+		return
+	}
+
+	storageClass := r.URL.Query().Get("storage_class")
+	if storageClass == "" {
+		storageClass = string(types.StorageClassStandard)
+	}
+	if !s3StorageClasses[storageClass] {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown storage class %q", storageClass), nil)
+		return
+	}
+
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		respondWithMultipartError(w, err)
+		return
+	}
+
+	file, header, err := r.FormFile("video")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+
+	if header.Size == 0 {
+		respondWithError(w, http.StatusBadRequest, "Uploaded file is empty", nil)
+		return
+	}
+
+	// Fail fast on the raw size; the processed file is checked again before
+	// it's stored
+	if err := cfg.checkStorageQuota(metadata.UserID, videoID, header.Size); err != nil {
+		respondWithPipelineError(w, err)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+		return
+	}
+	if !allowedVideoTypes[mediaType] {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type, only MP4, MOV and WebM are allowed", nil)
+		return
+	}
+
+	// Copy the upload to a temp file so ffprobe/ffmpeg can work on it. Once
+	// it's queued the processing job is responsible for removing it.
+	tmpFile, err := os.CreateTemp(cfg.tempDir, "tubely-upload.mp4")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create temp file", err)
+		return
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			os.Remove(tmpFile.Name())
+		}
+	}()
+	defer tmpFile.Close()
+
+	written, sum, err := copyWithSHA256(tmpFile, file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to write temp file", err)
+		return
+	}
+	if written == 0 {
+		respondWithError(w, http.StatusBadRequest, "Uploaded file is empty", nil)
+		return
+	}
+	if err := verifyContentSHA256(r, sum); err != nil {
+		respondWithError(w, http.StatusBadRequest, "X-Content-SHA256 doesn't match the uploaded file", err)
+		return
+	}
+	metadata.ContentSHA256 = sum
+
+	// Turn away files that clearly aren't video before queueing them.
+	// Processing still checks the container with ffprobe.
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read temp file", err)
+		return
+	}
+	sniffedType, err := sniffContentType(tmpFile)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read temp file", err)
+		return
+	}
+	if !mayBeVideo(sniffedType) {
+		respondWithError(w, http.StatusBadRequest, "File contents don't match the declared Content-Type", nil)
+		return
+	}
+
+	if duplicate, ok, err := cfg.reuseDuplicateVideo(metadata); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to check for duplicate uploads", err)
+		return
+	} else if ok {
+		cfg.saveIdempotencyKey(r, userID, idempotencyKey, videoID, http.StatusOK)
+		cfg.respondWithSignedVideo(w, http.StatusOK, duplicate)
+		return
+	}
+
+	// Processing can take a while, so it happens in the background and the
+	// client follows the video's status
+	metadata, err = cfg.enqueueProcessing(r.Context(), metadata, processingJob{
+		videoID:   videoID,
+		path:      tmpFile.Name(),
+		mediaType: mediaType,
+		opts: processOptions{
+			autoThumbnail: r.URL.Query().Get("auto_thumbnail") == "true",
+			storageClass:  storageClass,
+			skipFastStart: r.URL.Query().Get("faststart") == "false",
+		},
+	})
+	if err != nil {
+		respondWithQueueError(w, err)
+		return
+	}
+	queued = true
+
+	cfg.saveIdempotencyKey(r, userID, idempotencyKey, videoID, http.StatusAccepted)
+	cfg.respondWithSignedVideo(w, http.StatusAccepted, metadata)
+}
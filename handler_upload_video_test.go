@@ -0,0 +1,806 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerUploadVideo(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Upload")
+	data := testMP4(1024)
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", data))
+	var queued database.Video
+	decodeResponse(t, rec, http.StatusAccepted, &queued)
+	if queued.Status != database.VideoStatusProcessing {
+		t.Errorf("queued status = %q, want %q", queued.Status, database.VideoStatusProcessing)
+	}
+
+	ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	if ready.VideoURL == nil {
+		t.Fatal("ready video has no URL")
+	}
+	ref, err := parseStorageRef(*ready.VideoURL)
+	if err != nil {
+		t.Fatalf("stored URL %q: %v", *ready.VideoURL, err)
+	}
+	bucket, key := ref.Bucket, ref.Key
+	if bucket != testBucket {
+		t.Errorf("bucket = %q, want %q", bucket, testBucket)
+	}
+	if !strings.HasPrefix(key, "landscape/") || !strings.HasSuffix(key, ".mp4") {
+		t.Errorf("key = %q, want landscape/.../*.mp4", key)
+	}
+	if ready.Width != 1920 || ready.Height != 1080 {
+		t.Errorf("dimensions = %dx%d, want 1920x1080", ready.Width, ready.Height)
+	}
+
+	body, contentType, err := cfg.storage.Get(t.Context(), key)
+	if err != nil {
+		t.Fatalf("stored object: %v", err)
+	}
+	defer body.Close()
+	stored, _ := io.ReadAll(body)
+	if !bytes.Equal(stored, data) {
+		t.Errorf("stored %d bytes, want the %d uploaded", len(stored), len(data))
+	}
+	if contentType != "video/mp4" {
+		t.Errorf("content type = %q, want video/mp4", contentType)
+	}
+
+	signed, err := cfg.dbVideoToSignedVideo(ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(*signed.VideoURL, "mem://") {
+		t.Errorf("signed URL = %q, want a mem:// URL", *signed.VideoURL)
+	}
+}
+
+func TestHandlerUploadVideoRejects(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := createTestVideo(t, cfg, owner.ID, "Upload")
+
+	tests := []struct {
+		name      string
+		token     string
+		mediaType string
+		data      []byte
+		want      int
+	}{
+		{"no token", "", "video/mp4", testMP4(0), http.StatusUnauthorized},
+		{"not the owner", otherToken, "video/mp4", testMP4(0), http.StatusForbidden},
+		{"wrong media type", ownerToken, "image/png", testMP4(0), http.StatusBadRequest},
+		{"empty file", ownerToken, "video/mp4", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, tt.token, tt.mediaType, tt.data))
+			decodeResponse(t, rec, tt.want, nil)
+		})
+	}
+
+	if got := getTestVideo(t, cfg, video.ID); got.VideoURL != nil || got.Status == database.VideoStatusProcessing {
+		t.Errorf("rejected uploads changed the video: status %q, URL %v", got.Status, got.VideoURL)
+	}
+}
+
+func TestHandlerUploadVideoProcessingFailure(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Upload")
+	setProbeOutput(t, cfg, `{"streams": [], "format": {"format_name": "mov,mp4", "duration": "1.0"}}`)
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+
+	failed := waitForStatus(t, cfg, video.ID, database.VideoStatusFailed)
+	if failed.ProcessingError == nil {
+		t.Error("failed video has no processing error")
+	}
+	if failed.VideoURL != nil {
+		t.Errorf("failed video has URL %q", *failed.VideoURL)
+	}
+}
+
+func TestHandlerUploadVideoConcurrent(t *testing.T) {
+	cfg := newTestConfig(t)
+	// The winning upload is still processing when the others arrive
+	blockProcessing(t, cfg)
+
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Upload")
+
+	const uploads = 2
+	codes := make(chan int, uploads)
+	var wg sync.WaitGroup
+	for range uploads {
+		req := newUploadRequest(t, video.ID, token, "video/mp4", testMP4(64<<10))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, req)
+			codes <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusAccepted] != 1 || counts[http.StatusConflict] != 1 {
+		t.Fatalf("got status counts %v, want one 202 and one 409", counts)
+	}
+
+	// The lock is gone once the winner's job is queued, but the video is
+	// still processing
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusConflict, nil)
+}
+
+// countingRecorder counts the responses a handler starts.
+type countingRecorder struct {
+	*httptest.ResponseRecorder
+	headers int
+}
+
+func (r *countingRecorder) WriteHeader(code int) {
+	r.headers++
+	r.ResponseRecorder.WriteHeader(code)
+}
+
+func TestHandlerUploadVideoWrongTypeRespondsOnce(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Upload")
+
+	rec := &countingRecorder{ResponseRecorder: httptest.NewRecorder()}
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "text/plain", testMP4(0)))
+
+	if rec.headers != 1 {
+		t.Errorf("handler wrote %d responses, want 1", rec.headers)
+	}
+	// Unmarshal fails if a second body follows the first
+	var resp struct {
+		Error string `json:"error"`
+	}
+	decodeResponse(t, rec.ResponseRecorder, http.StatusBadRequest, &resp)
+	if resp.Error == "" {
+		t.Error("error response has no message")
+	}
+}
+
+func TestHandlerUploadVideoRemovesTempFiles(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	processed := createTestVideo(t, cfg, user.ID, "Processed")
+	rejected := createTestVideo(t, cfg, user.ID, "Rejected")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, processed.ID, token, "video/mp4", testMP4(1024)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	waitForStatus(t, cfg, processed.ID, database.VideoStatusReady)
+
+	// Rejected after the upload was copied to disk
+	req := newUploadRequest(t, rejected.ID, token, "video/mp4", testMP4(1024))
+	req.Header.Set("X-Content-SHA256", strings.Repeat("0", 64))
+	rec = httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, req)
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+
+	drainProcessing(t, cfg)
+	if left := tempFiles(t, cfg); len(left) > 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+}
+
+func TestHandlerUploadVideoLargerThanMemory(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Large")
+
+	// Past the 32 MB the form keeps in memory, so the part goes to disk
+	data := testMP4(80 << 20)
+	req := newUploadRequest(t, video.ID, token, "video/mp4", data)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, req)
+	runtime.ReadMemStats(&after)
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+
+	// Buffering the whole file would take several times its size as the
+	// buffer grows
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 2*uint64(len(data)) {
+		t.Errorf("handler allocated %d MB for a %d MB upload", alloc>>20, len(data)>>20)
+	}
+
+	ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	if ready.SizeBytes != int64(len(data)) {
+		t.Errorf("stored size = %d, want %d", ready.SizeBytes, len(data))
+	}
+}
+
+func TestHandlerUploadVideoResponse(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Upload")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	var queued database.Video
+	decodeResponse(t, rec, http.StatusAccepted, &queued)
+	if queued.ID != video.ID {
+		t.Errorf("response ID = %s, want %s", queued.ID, video.ID)
+	}
+	waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+
+	rec = httptest.NewRecorder()
+	cfg.handlerVideoGet(rec, newVideoRequest(t, http.MethodGet, video.ID, "", token, nil))
+	var ready database.Video
+	decodeResponse(t, rec, http.StatusOK, &ready)
+	if ready.ID != video.ID {
+		t.Errorf("response ID = %s, want %s", ready.ID, video.ID)
+	}
+	if ready.VideoURL == nil || *ready.VideoURL == "" {
+		t.Error("processed video has no video_url")
+	}
+}
+
+func TestHandlerUploadVideoAutoThumbnail(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  bool
+	}{
+		{"enabled", "?auto_thumbnail=true", true},
+		{"disabled", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Poster")
+
+			req := newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0))
+			req.URL.RawQuery = strings.TrimPrefix(tt.query, "?")
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, req)
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+			waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+			drainProcessing(t, cfg)
+
+			got := getTestVideo(t, cfg, video.ID)
+			if (got.ThumbnailURL != nil) != tt.want {
+				t.Fatalf("thumbnail URL = %v, want one: %v", got.ThumbnailURL, tt.want)
+			}
+			if tt.want && len(assetFiles(t, cfg)) == 0 {
+				t.Error("no thumbnail was written")
+			}
+			if !tt.want && len(assetFiles(t, cfg)) > 0 {
+				t.Errorf("thumbnail files written: %v", assetFiles(t, cfg))
+			}
+		})
+	}
+}
+
+// A poster that can't be saved doesn't fail the upload, and its files don't
+// linger.
+func TestHandlerUploadVideoAutoThumbnailDBFailure(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Poster")
+	// Queueing the upload saves the whole row, thumbnail_url included, so
+	// only setting one fails
+	failDBUpdates(t, cfg, "thumbnail_url", "NEW.thumbnail_url IS NOT NULL")
+
+	req := newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0))
+	req.URL.RawQuery = "auto_thumbnail=true"
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, req)
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	drainProcessing(t, cfg)
+
+	if got := getTestVideo(t, cfg, video.ID); got.ThumbnailURL != nil {
+		t.Errorf("thumbnail URL = %q, want none", *got.ThumbnailURL)
+	}
+	if files := assetFiles(t, cfg); len(files) > 0 {
+		t.Errorf("thumbnail files left behind: %v", files)
+	}
+}
+
+func TestHandlerUploadVideoStoresDimensions(t *testing.T) {
+	tests := []struct {
+		name                  string
+		probe                 string
+		wantWidth, wantHeight int
+		wantPrefix            string
+	}{
+		{"landscape", defaultProbeOutput, 1920, 1080, "landscape/"},
+		{
+			// Phones record sideways and tag the stream to be turned upright
+			name: "rotated portrait",
+			probe: `{"streams": [{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080,
+				"side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]}],
+				"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "5.0"}}`,
+			wantWidth: 1080, wantHeight: 1920, wantPrefix: "portrait/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			setProbeOutput(t, cfg, tt.probe)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Dimensions")
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+			waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+
+			// Read back from the database rather than trusting the job's copy
+			got := getTestVideo(t, cfg, video.ID)
+			if got.Width != tt.wantWidth || got.Height != tt.wantHeight {
+				t.Errorf("stored %dx%d, want %dx%d", got.Width, got.Height, tt.wantWidth, tt.wantHeight)
+			}
+			ref, err := parseStorageRef(*got.VideoURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := ref.Key
+			if !strings.HasPrefix(key, tt.wantPrefix) {
+				t.Errorf("key = %q, want it under %s", key, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+// testMOV returns a small file with a QuickTime ftyp brand, which doesn't
+// sniff as MP4.
+func testMOV() []byte {
+	data := testMP4(0)
+	copy(data[8:12], "qt  ")
+	copy(data[16:24], "qt  qt  ")
+	return data
+}
+
+// testWebM returns the start of a WebM file: an EBML header with the webm
+// doctype.
+func testWebM() []byte {
+	header := []byte{0x1A, 0x45, 0xDF, 0xA3, 0x9F, 0x42, 0x82, 0x84}
+	header = append(header, "webm"...)
+	return append(header, bytes.Repeat([]byte{0}, 256)...)
+}
+
+func TestHandlerUploadVideoTranscodesOtherContainers(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType string
+		data      []byte
+		probe     string
+	}{
+		{"mov", "video/quicktime", testMOV(), defaultProbeOutput},
+		{"webm", "video/webm", testWebM(), `{
+			"streams": [{"codec_type": "video", "codec_name": "vp9", "width": 1920, "height": 1080}],
+			"format": {"format_name": "matroska,webm", "duration": "5.0"}
+		}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			setProbeOutput(t, cfg, tt.probe)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Container")
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, tt.mediaType, tt.data))
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+			ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+
+			ref, err := parseStorageRef(*ready.VideoURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := ref.Key
+			if !strings.HasSuffix(key, ".mp4") {
+				t.Errorf("key = %q, want an .mp4", key)
+			}
+			body, contentType, err := cfg.storage.Get(t.Context(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			stored, _ := io.ReadAll(body)
+			if sniffed := http.DetectContentType(stored); sniffed != "video/mp4" {
+				t.Errorf("stored object sniffs as %s, want video/mp4", sniffed)
+			}
+			if contentType != "video/mp4" {
+				t.Errorf("content type = %q, want video/mp4", contentType)
+			}
+
+			// What's stored is the H.264 encode, not the upload
+			if !bytes.Equal(stored, fakeFFmpegOutput(t, cfg, "transcoded.mp4")) {
+				t.Error("stored object isn't the transcoded video")
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoSniffsContents(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	tests := []struct {
+		name string
+		data []byte
+		code int
+		want string
+	}{
+		// Turned away before it's queued
+		{"PNG labeled as MP4", testImage(t, 64, 36, "image/png"), http.StatusBadRequest, database.VideoStatusUploading},
+		{"MP4", testMP4(0), http.StatusAccepted, database.VideoStatusReady},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video := createTestVideo(t, cfg, user.ID, tt.name)
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", tt.data))
+			decodeResponse(t, rec, tt.code, nil)
+
+			got := waitForStatus(t, cfg, video.ID, tt.want)
+			if tt.code != http.StatusAccepted && got.VideoURL != nil {
+				t.Errorf("mislabeled upload was stored at %q", *got.VideoURL)
+			}
+		})
+	}
+
+	drainProcessing(t, cfg)
+	if files := tempFiles(t, cfg); len(files) > 0 {
+		t.Errorf("temp files left behind: %v", files)
+	}
+}
+
+func TestHandlerUploadVideoEmpty(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Empty")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", nil))
+	var resp struct {
+		Error string `json:"error"`
+	}
+	decodeResponse(t, rec, http.StatusBadRequest, &resp)
+	if resp.Error != "Uploaded file is empty" {
+		t.Errorf("error = %q, want Uploaded file is empty", resp.Error)
+	}
+
+	drainProcessing(t, cfg)
+	if runs := ffmpegRuns(t, cfg); len(runs) > 0 {
+		t.Errorf("ffmpeg ran on an empty upload: %q", runs)
+	}
+	if files := tempFiles(t, cfg); len(files) > 0 {
+		t.Errorf("temp files left behind: %v", files)
+	}
+}
+
+func TestHandlerUploadVideoSizeLimit(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	data := testMP4(64 << 10)
+	// The limit covers the whole request body, multipart framing included.
+	// Video IDs are all the same length, so any one will do for sizing it.
+	bodySize := newUploadRequest(t, user.ID, token, "video/mp4", data).ContentLength
+
+	tests := []struct {
+		name  string
+		limit int64
+		want  int
+	}{
+		{"just under", bodySize, http.StatusAccepted},
+		{"just over", bodySize - 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.maxVideoUploadBytes = tt.limit
+			video := createTestVideo(t, cfg, user.ID, tt.name)
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", data))
+			decodeResponse(t, rec, tt.want, nil)
+		})
+	}
+}
+
+func TestHandlerUploadVideoDurationLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration string
+		want     string
+	}{
+		{"short", "599.5", database.VideoStatusReady},
+		{"just over", "600.5", database.VideoStatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.maxDurationSeconds = 600
+			setProbeOutput(t, cfg, strings.Replace(defaultProbeOutput, `"5.000000"`, `"`+tt.duration+`"`, 1))
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Clip")
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+			got := waitForStatus(t, cfg, video.ID, tt.want)
+			drainProcessing(t, cfg)
+
+			if tt.want == database.VideoStatusReady {
+				return
+			}
+			if got.ProcessingError == nil || !strings.Contains(*got.ProcessingError, "limit is 600 seconds") {
+				t.Errorf("processing error = %v, want it to mention the limit", got.ProcessingError)
+			}
+			if keys := storedKeys(t, cfg); len(keys) > 0 {
+				t.Errorf("objects stored for a rejected video: %q", keys)
+			}
+			if files := tempFiles(t, cfg); len(files) > 0 {
+				t.Errorf("temp files left behind: %v", files)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoStoresExactAspectRatio(t *testing.T) {
+	cfg := newTestConfig(t)
+	setProbeOutput(t, cfg, `{"streams": [{"codec_type": "video", "codec_name": "h264", "width": 1366, "height": 768}], "format": {"format_name": "mov,mp4", "duration": "5.0"}}`)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Laptop screen")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+
+	if ready.AspectRatio != "683:384" {
+		t.Errorf("aspect ratio = %q, want 683:384", ready.AspectRatio)
+	}
+	// The category still picks the prefix
+	ref, err := parseStorageRef(*ready.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ref.Key
+	if !strings.HasPrefix(key, "landscape/") {
+		t.Errorf("key = %q, want it under landscape/", key)
+	}
+}
+
+func TestHandlerUploadVideoAspectRatioPrefixes(t *testing.T) {
+	tests := []struct {
+		width, height int
+		category      string
+		prefix        string
+	}{
+		{1440, 1080, "4:3", "standard/"},
+		{2560, 1080, "21:9", "ultrawide/"},
+		{1000, 700, "other", "other/"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%dx%d", tt.width, tt.height), func(t *testing.T) {
+			if got := aspectRatioCategory(tt.width, tt.height); got != tt.category {
+				t.Errorf("category = %q, want %q", got, tt.category)
+			}
+
+			cfg := newTestConfig(t)
+			setProbeOutput(t, cfg, fmt.Sprintf(`{"streams": [{"codec_type": "video", "codec_name": "h264", "width": %d, "height": %d}], "format": {"format_name": "mov,mp4", "duration": "5.0"}}`, tt.width, tt.height))
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Prefixed")
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+			ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+
+			ref, err := parseStorageRef(*ready.VideoURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := ref.Key
+			if !strings.HasPrefix(key, tt.prefix) {
+				t.Errorf("key = %q, want it under %s", key, tt.prefix)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoFastStart(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		query         string
+		wantRewritten bool
+	}{
+		{"moov at the end", testMP4MoovLast(0), "", true},
+		{"already faststart", testMP4(0), "", false},
+		{"skipped by the caller", testMP4MoovLast(0), "faststart=false", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Faststart")
+
+			req := newUploadRequest(t, video.ID, token, "video/mp4", tt.data)
+			req.URL.RawQuery = tt.query
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, req)
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+			ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+
+			// The upload is only rewritten when it needs it and the caller
+			// allows it
+			stored := storedVideoObject(t, cfg, ready)
+			if rewritten := !bytes.Equal(stored, tt.data); rewritten != tt.wantRewritten {
+				t.Errorf("stored object rewritten = %v, want %v", rewritten, tt.wantRewritten)
+			}
+			if tt.query == "" && !bytes.Equal(stored, testMP4(0)) {
+				t.Error("stored object doesn't have its moov box at the front")
+			}
+		})
+	}
+}
+
+// uploadFailingProbe uploads a video that ffprobe describes with output and
+// waits for processing to fail, checking nothing was left behind.
+func uploadFailingProbe(t *testing.T, output string) database.Video {
+	t.Helper()
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Upload")
+	setProbeOutput(t, cfg, output)
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+
+	failed := waitForStatus(t, cfg, video.ID, database.VideoStatusFailed)
+	drainProcessing(t, cfg)
+	if failed.VideoURL != nil {
+		t.Errorf("failed video has URL %q", *failed.VideoURL)
+	}
+	if keys := storedKeys(t, cfg); len(keys) > 0 {
+		t.Errorf("objects left in storage: %v", keys)
+	}
+	if files := tempFiles(t, cfg); len(files) > 0 {
+		t.Errorf("temp files left: %v", files)
+	}
+	if failed.ProcessingError == nil {
+		t.Fatal("failed video has no processing error")
+	}
+	return failed
+}
+
+func TestHandlerUploadVideoZeroDimensions(t *testing.T) {
+	outputs := map[string]string{
+		"zero width":  `{"streams": [{"codec_type": "video", "codec_name": "h264", "width": 0, "height": 1080}], "format": {"format_name": "mov,mp4", "duration": "5.0"}}`,
+		"zero height": `{"streams": [{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 0}], "format": {"format_name": "mov,mp4", "duration": "5.0"}}`,
+		"missing":     `{"streams": [{"codec_type": "video", "codec_name": "h264"}], "format": {"format_name": "mov,mp4", "duration": "5.0"}}`,
+	}
+	for name, output := range outputs {
+		t.Run(name, func(t *testing.T) {
+			failed := uploadFailingProbe(t, output)
+			if *failed.ProcessingError != "Video has invalid dimensions" {
+				t.Errorf("processing error = %q, want Video has invalid dimensions", *failed.ProcessingError)
+			}
+			if failed.AspectRatio != "" {
+				t.Errorf("aspect ratio = %q, want none", failed.AspectRatio)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoAudioOnly(t *testing.T) {
+	failed := uploadFailingProbe(t, `{
+		"streams": [{"codec_type": "audio", "codec_name": "aac"}],
+		"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "5.0"}
+	}`)
+	if *failed.ProcessingError != errNoVideoStream.Error() {
+		t.Errorf("processing error = %q, want %q", *failed.ProcessingError, errNoVideoStream)
+	}
+}
+
+func TestHandlerUploadVideoStoresCodecs(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Codecs")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+
+	rec = httptest.NewRecorder()
+	cfg.handlerVideoGet(rec, newVideoRequest(t, http.MethodGet, video.ID, "", token, nil))
+	var got database.Video
+	decodeResponse(t, rec, http.StatusOK, &got)
+	if got.VideoCodec != "h264" || got.AudioCodec != "aac" || got.Container != "mov,mp4,m4a,3gp,3g2,mj2" {
+		t.Errorf("codecs = %q/%q in %q, want h264/aac in mov,mp4,m4a,3gp,3g2,mj2", got.VideoCodec, got.AudioCodec, got.Container)
+	}
+}
+
+func TestHandlerUploadVideoCodecPolicy(t *testing.T) {
+	hevcProbe := `{
+		"streams": [{"codec_type": "video", "codec_name": "hevc", "width": 1920, "height": 1080}],
+		"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "5.0"}
+	}`
+	tests := []struct {
+		name          string
+		policy        codecPolicy
+		probe         string
+		wantTranscode bool
+		wantError     string
+	}{
+		{"h264 passes through", codecPolicyTranscode, defaultProbeOutput, false, ""},
+		{"h264 passes through when rejecting", codecPolicyReject, defaultProbeOutput, false, ""},
+		{"hevc transcoded", codecPolicyTranscode, hevcProbe, true, ""},
+		{"hevc rejected", codecPolicyReject, hevcProbe, false, `Video codec "hevc" isn't supported, please upload H.264`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.codecPolicy = tt.policy
+			setProbeOutput(t, cfg, tt.probe)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Codec")
+			data := testMP4(16)
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", data))
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+
+			if tt.wantError != "" {
+				failed := waitForStatus(t, cfg, video.ID, database.VideoStatusFailed)
+				drainProcessing(t, cfg)
+				if failed.ProcessingError == nil || *failed.ProcessingError != tt.wantError {
+					t.Errorf("processing error = %v, want %q", deref(failed.ProcessingError), tt.wantError)
+				}
+				if keys := storedKeys(t, cfg); len(keys) > 0 {
+					t.Errorf("rejected upload stored %v", keys)
+				}
+				return
+			}
+
+			ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+			want := data
+			if tt.wantTranscode {
+				want = fakeFFmpegOutput(t, cfg, "transcoded.mp4")
+			}
+			if stored := storedVideoObject(t, cfg, ready); !bytes.Equal(stored, want) {
+				t.Errorf("stored %d bytes, want the %d bytes of the transcoded = %v file", len(stored), len(want), tt.wantTranscode)
+			}
+		})
+	}
+}
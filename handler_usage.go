@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+type aspectRatioUsage struct {
+	VideoCount int   `json:"video_count"`
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+type storageUsage struct {
+	TotalBytes     int64                       `json:"total_bytes"`
+	VideoBytes     int64                       `json:"video_bytes"`
+	RenditionBytes int64                       `json:"rendition_bytes"`
+	VideoCount     int                         `json:"video_count"`
+	QuotaBytes     int64                       `json:"quota_bytes"`
+	ByAspectRatio  map[string]aspectRatioUsage `json:"by_aspect_ratio"`
+}
+
+// handlerUsersMeUsage reports how much the authenticated user is storing.
+// Only videos that have been uploaded count; quota_bytes is 0 when there's
+// no limit.
+func (cfg *apiConfig) handlerUsersMeUsage(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	videos, err := cfg.db.GetVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	usage := storageUsage{
+		QuotaBytes:    cfg.storageQuotaBytes,
+		ByAspectRatio: map[string]aspectRatioUsage{},
+	}
+	override, err := cfg.db.GetUserStorageQuota(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get storage quota", err)
+		return
+	}
+	if override != nil {
+		usage.QuotaBytes = *override
+	}
+
+	// Deduplicated videos share their stored objects, which only take up
+	// space once
+	counted := map[string]bool{}
+	for _, video := range videos {
+		if video.VideoURL == nil {
+			continue
+		}
+		var size int64
+		if !counted[*video.VideoURL] {
+			counted[*video.VideoURL] = true
+			usage.VideoBytes += video.SizeBytes
+			size += video.SizeBytes
+		}
+		if video.HLSURL != nil && !counted[*video.HLSURL] {
+			counted[*video.HLSURL] = true
+			usage.RenditionBytes += video.HLSSizeBytes
+			size += video.HLSSizeBytes
+		}
+		usage.VideoCount++
+		usage.TotalBytes += size
+
+		category := aspectRatioCategory(video.Width, video.Height)
+		bucket := usage.ByAspectRatio[category]
+		bucket.VideoCount++
+		bucket.TotalBytes += size
+		usage.ByAspectRatio[category] = bucket
+	}
+
+	respondWithJSON(w, http.StatusOK, usage)
+}
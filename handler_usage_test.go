@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerUsersMeUsage(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.storageQuotaBytes = 1 << 30
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	other, _ := createTestUser(t, cfg, "other@example.com")
+
+	uploaded := []struct {
+		width, height int
+		size          int
+		hlsSize       int64
+	}{
+		{1920, 1080, 1000, 300},
+		{1280, 720, 2000, 0},
+		{1080, 1920, 4000, 700},
+		{0, 0, 500, 0},
+	}
+	var first database.Video
+	for i, u := range uploaded {
+		video := createTestVideo(t, cfg, user.ID, "Uploaded")
+		video.Width, video.Height = u.width, u.height
+		if u.hlsSize > 0 {
+			hlsURL := fmt.Sprintf("%s,usage/%d-hls/master.m3u8", cfg.s3Bucket, i)
+			video.HLSURL = &hlsURL
+			video.HLSSizeBytes = u.hlsSize
+		}
+		video = storeTestVideo(t, cfg, video, fmt.Sprintf("usage/%d.mp4", i), make([]byte, u.size))
+		if i == 0 {
+			first = video
+		}
+	}
+	// A deduplicated upload shares the first video's objects, so it adds
+	// nothing to the bytes stored
+	duplicate := createTestVideo(t, cfg, user.ID, "Duplicate")
+	duplicate.VideoURL, duplicate.HLSURL = first.VideoURL, first.HLSURL
+	duplicate.Width, duplicate.Height = first.Width, first.Height
+	duplicate.SizeBytes, duplicate.HLSSizeBytes = first.SizeBytes, first.HLSSizeBytes
+	if err := cfg.db.UpdateVideo(duplicate); err != nil {
+		t.Fatal(err)
+	}
+	// Neither a video that was never uploaded nor another user's counts
+	createTestVideo(t, cfg, user.ID, "Draft")
+	storeTestVideo(t, cfg, createTestVideo(t, cfg, other.ID, "Theirs"), "usage/theirs.mp4", make([]byte, 8000))
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUsersMeUsage(rec, newJSONRequest(t, http.MethodGet, "/api/users/me/usage", token, nil))
+	var got storageUsage
+	decodeResponse(t, rec, http.StatusOK, &got)
+
+	want := storageUsage{
+		TotalBytes:     8500,
+		VideoBytes:     7500,
+		RenditionBytes: 1000,
+		VideoCount:     5,
+		QuotaBytes:     1 << 30,
+		ByAspectRatio: map[string]aspectRatioUsage{
+			"16:9":  {VideoCount: 3, TotalBytes: 3300},
+			"9:16":  {VideoCount: 1, TotalBytes: 4700},
+			"other": {VideoCount: 1, TotalBytes: 500},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("usage = %+v, want %+v", got, want)
+	}
+}
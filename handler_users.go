@@ -6,6 +6,7 @@ import (
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request) {
@@ -18,7 +19,7 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithDecodeError(w, err)
 		return
 	}
 
@@ -44,3 +45,58 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 
 	respondWithJSON(w, http.StatusCreated, user)
 }
+
+// handlerUserStorageQuota lets an admin give a user their own storage quota
+// in bytes, overriding STORAGE_QUOTA_MB. 0 means unlimited, and null clears
+// the override so the global quota applies again.
+func (cfg *apiConfig) handlerUserStorageQuota(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		StorageQuotaBytes *int64 `json:"storage_quota_bytes"`
+	}
+	type response struct {
+		UserID            uuid.UUID `json:"user_id"`
+		StorageQuotaBytes *int64    `json:"storage_quota_bytes"`
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	claims, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authenticate request", err)
+		return
+	}
+	if !isAdmin(claims) {
+		respondWithError(w, http.StatusForbidden, "Only admins can set storage quotas", nil)
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+	if params.StorageQuotaBytes != nil && *params.StorageQuotaBytes < 0 {
+		respondWithError(w, http.StatusBadRequest, "storage_quota_bytes can't be negative", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+
+	if err := cfg.db.SetUserStorageQuota(userID, params.StorageQuotaBytes); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't set storage quota", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{UserID: userID, StorageQuotaBytes: params.StorageQuotaBytes})
+}
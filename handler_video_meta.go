@@ -3,6 +3,9 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -19,17 +22,23 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
+	idempotencyKey, replayed := cfg.replayIdempotentRequest(w, r, userID)
+	if replayed {
+		return
+	}
+	defer cfg.releaseIdempotencyKey(r, userID, idempotencyKey)
+
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err = decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithDecodeError(w, err)
 		return
 	}
 	params.UserID = userID
@@ -40,6 +49,7 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	cfg.saveIdempotencyKey(r, userID, idempotencyKey, video.ID, http.StatusCreated)
 	respondWithJSON(w, http.StatusCreated, video)
 }
 
@@ -56,7 +66,7 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	claims, err := cfg.parseJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -64,15 +74,21 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "You can't delete this video", nil)
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	// The video only goes to the trash so it can be restored; it's purged
+	// with its files once the retention period is over
+	err = cfg.db.SoftDeleteVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
@@ -81,6 +97,52 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handlerVideoRestore brings a video back out of the trash.
+func (cfg *apiConfig) handlerVideoRestore(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	claims, err := cfg.parseJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "You can't restore this video", nil)
+		return
+	}
+	if video.DeletedAt == nil {
+		respondWithError(w, http.StatusConflict, "Video isn't deleted", nil)
+		return
+	}
+
+	if err := cfg.db.RestoreVideo(videoID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore video", err)
+		return
+	}
+	video.DeletedAt = nil
+
+	cfg.respondWithSignedVideo(w, http.StatusOK, video)
+}
+
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -89,11 +151,65 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	claims, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authenticate request", err)
+		return
+	}
+
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	// Anyone else has to go through the public endpoint, which checks the
+	// visibility
+	if !canManageVideo(claims, video) {
+		respondWithError(w, http.StatusForbidden, "User does not have access to this video", nil)
+		return
+	}
+
+	cfg.countView(r, &video, claims.UserID)
+
+	// Callers may ask for a different link lifetime in seconds. Anything
+	// above the configured maximum is clamped rather than rejected.
+	expiry := cfg.presignExpiry
+	if expires := r.URL.Query().Get("expires"); expires != "" {
+		seconds, err := strconv.Atoi(expires)
+		if err != nil || seconds <= 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid expires value", err)
+			return
+		}
+		expiry = min(time.Duration(seconds)*time.Second, cfg.presignMaxExpiry)
+	}
+
+	// ?download=true links to the file as an attachment named after the
+	// title rather than for inline playback
+	var downloadURL string
+	if r.URL.Query().Get("download") == "true" && video.VideoURL != nil {
+		title := video.Title
+		if title == "" {
+			title = "video"
+		}
+		downloadURL, err = cfg.signDownloadURL(*video.VideoURL, title+".mp4", expiry)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+			return
+		}
+	}
+
+	video, err = cfg.dbVideoToSignedVideoWithExpiry(video, expiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+		return
+	}
+	if downloadURL != "" {
+		video.VideoURL = &downloadURL
+	}
 
 	respondWithJSON(w, http.StatusOK, video)
 }
@@ -104,17 +220,37 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	// ?q= searches titles and descriptions, ?tag= filters by tag, and
+	// ?limit= and ?offset= page through the results
+	query := r.URL.Query()
+	params := database.VideoListParams{
+		UserID: userID,
+		Query:  strings.TrimSpace(query.Get("q")),
+		Tag:    normalizeTag(query.Get("tag")),
+	}
+	if query.Get("tag") != "" && params.Tag == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag", nil)
+		return
+	}
+	if err := parsePage(r, &params, cfg.maxPageSize); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	videos, total, err := cfg.db.GetVideosPage(params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
+	cfg.signVideos(r.Context(), videos)
+
+	setPageHeaders(w, r, params, len(videos), total)
 	respondWithJSON(w, http.StatusOK, videos)
 }
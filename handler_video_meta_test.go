@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// failingDeleteBackend can't delete anything, like an S3 bucket whose
+// object has already gone or that the app can't write to.
+type failingDeleteBackend struct {
+	*memBackend
+}
+
+func (b failingDeleteBackend) Delete(ctx context.Context, key string) error {
+	return errors.New("delete failed")
+}
+
+func TestHandlerVideoMetaDelete(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := storeTestVideo(t, cfg, createTestVideo(t, cfg, owner.ID, "Doomed"), "landscape/doomed.mp4", testMP4(0))
+
+	tests := []struct {
+		name    string
+		videoID uuid.UUID
+		token   string
+		want    int
+	}{
+		{"missing video", uuid.New(), ownerToken, http.StatusNotFound},
+		{"not the owner", video.ID, otherToken, http.StatusForbidden},
+		{"no token", video.ID, "", http.StatusUnauthorized},
+		{"owner", video.ID, ownerToken, http.StatusNoContent},
+		{"already deleted", video.ID, ownerToken, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerVideoMetaDelete(rec, newVideoRequest(t, http.MethodDelete, tt.videoID, "", tt.token, nil))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d; body: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+
+	if exists, _ := cfg.storage.(objectChecker).Exists(t.Context(), "landscape/doomed.mp4"); !exists {
+		t.Error("object was deleted before the video was purged")
+	}
+}
+
+func TestHandlerVideoRestore(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := storeTestVideo(t, cfg, createTestVideo(t, cfg, owner.ID, "Trashed"), "landscape/trashed.mp4", testMP4(0))
+	if err := cfg.db.SoftDeleteVideo(video.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		videoID uuid.UUID
+		token   string
+		want    int
+	}{
+		{"missing video", uuid.New(), ownerToken, http.StatusNotFound},
+		{"not the owner", video.ID, otherToken, http.StatusForbidden},
+		{"no token", video.ID, "", http.StatusUnauthorized},
+		{"owner", video.ID, ownerToken, http.StatusOK},
+		{"not deleted", video.ID, ownerToken, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerVideoRestore(rec, newVideoRequest(t, http.MethodPost, tt.videoID, "/restore", tt.token, nil))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d; body: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+
+	if got := getTestVideo(t, cfg, video.ID); got.DeletedAt != nil {
+		t.Error("video is still in the trash")
+	}
+}
+
+// A video in the trash can't be uploaded to until it's restored.
+func TestUploadsRejectDeletedVideo(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.storage = newTestS3Backend(t, &fakeS3{})
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, owner.ID, "Trashed")
+	if err := cfg.db.SoftDeleteVideo(video.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		req     *http.Request
+	}{
+		{"upload video", cfg.handlerUploadVideo, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0))},
+		{"upload thumbnail", cfg.handlerUploadThumbnail, newThumbnailRequest(t, video.ID, token, "image/png", testImage(t, 64, 36, "image/png"))},
+		{"import", cfg.handlerImportVideo, newImportRequest(t, video.ID, token, "http://localhost/video.mp4")},
+		{"direct upload", cfg.handlerCreateVideoUploadURL, newDirectUploadRequest(t, video.ID, "", token, map[string]any{"content_type": "video/mp4", "content_length": 4096})},
+		{"resumable upload", cfg.handlerTusCreate, newTusCreateRequest(t, video.ID, token, 4096)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.handler(rec, tt.req)
+			decodeResponse(t, rec, http.StatusNotFound, nil)
+		})
+	}
+
+	if got := getTestVideo(t, cfg, video.ID); got.VideoURL != nil || got.ThumbnailURL != nil || got.Status != video.Status {
+		t.Errorf("deleted video changed to %+v", got)
+	}
+}
+
+func TestPurgeVideo(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, _ := createTestUser(t, cfg, "owner@example.com")
+	video := storeTestVideo(t, cfg, createTestVideo(t, cfg, owner.ID, "Doomed"), "landscape/doomed.mp4", testMP4(0))
+
+	if err := cfg.purgeVideo(t.Context(), video); err != nil {
+		t.Fatal(err)
+	}
+	if got := getTestVideo(t, cfg, video.ID); got.ID != uuid.Nil {
+		t.Error("video is still in the database")
+	}
+	if exists, _ := cfg.storage.(objectChecker).Exists(t.Context(), "landscape/doomed.mp4"); exists {
+		t.Error("video object wasn't deleted")
+	}
+}
+
+func TestPurgeVideoDeletesHLSPackage(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, _ := createTestUser(t, cfg, "owner@example.com")
+	video := storeTestHLS(t, cfg, createTestVideo(t, cfg, owner.ID, "Streamed"), "landscape/streamed-hls")
+	shared := storeTestHLS(t, cfg, createTestVideo(t, cfg, owner.ID, "Shared"), "landscape/shared-hls")
+	// A deduplicated upload points at the same package
+	duplicate := createTestVideo(t, cfg, owner.ID, "Duplicate")
+	duplicate.HLSURL = shared.HLSURL
+	if err := cfg.db.UpdateVideo(duplicate); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []database.Video{video, shared} {
+		if err := cfg.purgeVideo(t.Context(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		want   int
+	}{
+		{"landscape/streamed-hls/", 0},
+		{"landscape/shared-hls/", 4},
+	}
+	for _, tt := range tests {
+		objects, err := cfg.storage.(objectLister).List(t.Context(), tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objects) != tt.want {
+			t.Errorf("%d objects left under %s, want %d", len(objects), tt.prefix, tt.want)
+		}
+	}
+}
+
+func TestPurgeVideoStorageFailure(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, _ := createTestUser(t, cfg, "owner@example.com")
+	cfg.storage = failingDeleteBackend{newMemBackend()}
+	video := createTestVideo(t, cfg, owner.ID, "Missing object")
+	videoURL := testBucket + ",landscape/missing.mp4"
+	video.VideoURL = &videoURL
+	video.Status = database.VideoStatusReady
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.purgeVideo(t.Context(), video); err != nil {
+		t.Fatalf("purge failed on a storage error: %v", err)
+	}
+	if got := getTestVideo(t, cfg, video.ID); got.ID != uuid.Nil {
+		t.Error("video is still in the database")
+	}
+}
+
+func TestHandlerVideoGetExpiry(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	video := storeTestVideo(t, cfg, createTestVideo(t, cfg, owner.ID, "Signed"), "landscape/signed.mp4", testMP4(0))
+
+	tests := []struct {
+		name    string
+		query   string
+		want    int
+		expires string
+	}{
+		{"default", "", http.StatusOK, "expires=3600"},
+		{"shorter", "?expires=600", http.StatusOK, "expires=600"},
+		{"above the maximum is clamped", "?expires=999999", http.StatusOK, "expires=86400"},
+		{"negative", "?expires=-5", http.StatusBadRequest, ""},
+		{"not a number", "?expires=soon", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerVideoGet(rec, newVideoRequest(t, http.MethodGet, video.ID, tt.query, token, nil))
+			if tt.want != http.StatusOK {
+				decodeResponse(t, rec, tt.want, nil)
+				return
+			}
+			var got database.Video
+			decodeResponse(t, rec, http.StatusOK, &got)
+			if !strings.HasSuffix(*got.VideoURL, tt.expires) {
+				t.Errorf("video URL = %q, want %s", *got.VideoURL, tt.expires)
+			}
+		})
+	}
+}
+
+func TestHandlerVideosRetrieveSignsEachVideo(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+
+	malformed := map[string]string{
+		"malformed": "not,a,reference",
+		"empty":     "",
+	}
+	for title, storedURL := range malformed {
+		video := createTestVideo(t, cfg, owner.ID, title)
+		video.VideoURL = &storedURL
+		if err := cfg.db.UpdateVideo(video); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Enough valid videos to keep every signing worker busy
+	for i := range 2 * presignWorkers {
+		video := createTestVideo(t, cfg, owner.ID, fmt.Sprintf("valid %d", i))
+		storeTestVideo(t, cfg, video, fmt.Sprintf("landscape/%d.mp4", i), testMP4(0))
+	}
+	want := len(malformed) + 2*presignWorkers
+
+	rec := httptest.NewRecorder()
+	cfg.handlerVideosRetrieve(rec, newJSONRequest(t, http.MethodGet, "/api/videos?limit=100", token, nil))
+	var videos []database.Video
+	decodeResponse(t, rec, http.StatusOK, &videos)
+	if len(videos) != want {
+		t.Fatalf("got %d videos, want %d", len(videos), want)
+	}
+	for _, video := range videos {
+		if strings.HasPrefix(video.Title, "valid") {
+			if video.VideoURL == nil || !strings.HasPrefix(*video.VideoURL, "mem://") {
+				t.Errorf("%s: video URL = %v, want a signed URL", video.Title, video.VideoURL)
+			}
+		} else if video.VideoURL != nil {
+			t.Errorf("%s: video URL = %q, want nil", video.Title, *video.VideoURL)
+		}
+	}
+}
+
+func TestHandlerVideosRetrieveSearch(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	for _, title := range []string{"Cats in 100% HD", "my_cat_video", "Dog walk"} {
+		createTestVideo(t, cfg, owner.ID, title)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"matching", "CAT", []string{"Cats in 100% HD", "my_cat_video"}},
+		{"not matching", "zebra", nil},
+		{"empty", "", []string{"Cats in 100% HD", "Dog walk", "my_cat_video"}},
+		// LIKE wildcards in the query only match themselves
+		{"percent", "%", []string{"Cats in 100% HD"}},
+		{"underscore", "_", []string{"my_cat_video"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/api/videos?q=" + url.QueryEscape(tt.query)
+			rec := httptest.NewRecorder()
+			cfg.handlerVideosRetrieve(rec, newJSONRequest(t, http.MethodGet, target, token, nil))
+			var videos []database.Video
+			decodeResponse(t, rec, http.StatusOK, &videos)
+
+			var titles []string
+			for _, video := range videos {
+				titles = append(titles, video.Title)
+			}
+			slices.Sort(titles)
+			if !slices.Equal(titles, tt.want) {
+				t.Errorf("got %q, want %q", titles, tt.want)
+			}
+			if got := rec.Header().Get("X-Total-Count"); got != strconv.Itoa(len(tt.want)) {
+				t.Errorf("X-Total-Count = %q, want %d", got, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestHandlerVideoGetDownload(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.storage = newTestS3Backend(t, &fakeS3{})
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+
+	tests := []struct {
+		title    string
+		query    string
+		filename string
+	}{
+		{"Boots: the movie", "?download=true", "Boots: the movie.mp4"},
+		{"Café tour", "?download=true", "Café tour.mp4"},
+		{"", "?download=true", "video.mp4"},
+		{"Inline", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title+tt.query, func(t *testing.T) {
+			video := createTestVideo(t, cfg, owner.ID, tt.title)
+			storedURL := testBucket + ",landscape/a.mp4"
+			video.VideoURL = &storedURL
+			if err := cfg.db.UpdateVideo(video); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			cfg.handlerVideoGet(rec, newVideoRequest(t, http.MethodGet, video.ID, tt.query, token, nil))
+			var got database.Video
+			decodeResponse(t, rec, http.StatusOK, &got)
+
+			u, err := url.Parse(*got.VideoURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			disposition := u.Query().Get("response-content-disposition")
+			if tt.filename == "" {
+				if disposition != "" {
+					t.Errorf("inline URL overrides the disposition with %q", disposition)
+				}
+				return
+			}
+			mediaType, params, err := mime.ParseMediaType(disposition)
+			if err != nil {
+				t.Fatalf("couldn't parse disposition %q: %v", disposition, err)
+			}
+			if mediaType != "attachment" || params["filename"] != tt.filename {
+				t.Errorf("disposition = %q, want an attachment named %q", disposition, tt.filename)
+			}
+		})
+	}
+}
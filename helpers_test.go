@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	testJWTSecret = "test-secret"
+	testBucket    = "test-bucket"
+)
+
+// fakeFFprobe logs its arguments to ffprobe.log and prints whatever
+// setProbeOutput last wrote next to it, after
+// sleeping for the seconds in probe.delay if there are any. While
+// probe.hold exists it waits, leaving probe.waiting behind to say so.
+const fakeFFprobe = `#!/bin/sh
+dir="$(dirname "$0")"
+echo "$*" >> "$dir/ffprobe.log"
+[ -e "$dir/probe.delay" ] && sleep "$(cat "$dir/probe.delay")"
+while [ -e "$dir/probe.hold" ]; do touch "$dir/probe.waiting"; sleep 0.01; done
+cat "$dir/probe.json"
+`
+
+// fakeFFmpeg logs its arguments to ffmpeg.log and copies its -i input to
+// its last argument, which is where every command the app runs writes its
+// output. Where the real ffmpeg would write something else, so does the
+// fake: frames grabbed as JPEGs are frame.jpg, re-encodes to H.264 are
+// transcoded.mp4 and WebP encodes are image.webp, all from next to it, and
+// faststart moves the moov box at the end of a testMP4MoovLast file back
+// behind the ftyp box. It fails if ffmpeg_fail exists.
+const fakeFFmpeg = `#!/bin/sh
+dir="$(dirname "$0")"
+echo "$*" >> "$dir/ffmpeg.log"
+[ -e "$dir/ffmpeg_fail" ] && { echo "fake ffmpeg failure" >&2; exit 1; }
+in=""; prev=""; last=""; out=""; faststart=""
+for arg in "$@"; do
+	[ "$prev" = "-i" ] && in="$arg"
+	[ "$arg" = "libx264" ] && out="transcoded.mp4"
+	[ "$arg" = "libwebp" ] && out="image.webp"
+	[ "$arg" = "faststart" ] && faststart=1
+	prev="$arg"; last="$arg"
+done
+case "$last" in
+*.jpg) cp "$dir/frame.jpg" "$last" ;;
+*) if [ -n "$out" ]; then
+	cp "$dir/$out" "$last"
+elif [ -n "$faststart" ] && [ "$(dd if="$in" bs=1 skip=28 count=4 2>/dev/null)" != moov ]; then
+	# The ftyp and moov boxes of test files are 24 bytes each
+	size=$(wc -c < "$in")
+	{ head -c 24 "$in"; tail -c 24 "$in"; tail -c +25 "$in" | head -c $((size - 48)); } > "$last"
+elif [ -n "$in" ]; then
+	cp "$in" "$last"
+fi ;;
+esac
+exit 0
+`
+
+// defaultProbeOutput describes a 1920x1080 H.264/AAC MP4 that's 5 seconds long.
+const defaultProbeOutput = `{
+	"streams": [
+		{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080},
+		{"codec_type": "audio", "codec_name": "aac"}
+	],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "5.000000"}
+}`
+
+// newTestConfig returns an apiConfig backed by a fresh SQLite database, an
+// in-memory storage backend and shell scripts standing in for ffmpeg and
+// ffprobe, with a processing pool that's shut down when the test ends.
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := database.NewClient(filepath.Join(dir, "tubely.db") + "?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("couldn't create database: %v", err)
+	}
+
+	binDir := filepath.Join(dir, "bin")
+	writeTestFile(t, filepath.Join(binDir, "ffprobe"), fakeFFprobe, 0o755)
+	writeTestFile(t, filepath.Join(binDir, "ffmpeg"), fakeFFmpeg, 0o755)
+	writeTestFile(t, filepath.Join(binDir, "probe.json"), defaultProbeOutput, 0o644)
+	writeTestFile(t, filepath.Join(binDir, "frame.jpg"), string(testImage(t, 320, 180, "image/jpeg")), 0o644)
+	writeTestFile(t, filepath.Join(binDir, "transcoded.mp4"), string(testMP4(32)), 0o644)
+	writeTestFile(t, filepath.Join(binDir, "image.webp"), string(testWebP()), 0o644)
+
+	tempDir := filepath.Join(dir, "tmp")
+	assetsRoot := filepath.Join(dir, "assets")
+	for _, d := range []string{tempDir, assetsRoot} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keyTemplate, err := parseKeyTemplate(defaultKeyTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &apiConfig{
+		db:                      db,
+		jwtSecret:               testJWTSecret,
+		platform:                "dev",
+		assetsRoot:              assetsRoot,
+		storage:                 newMemBackend(),
+		s3Bucket:                testBucket,
+		port:                    "8091",
+		publicBaseURL:           "http://localhost:8091",
+		tempDir:                 tempDir,
+		ffmpegPath:              filepath.Join(binDir, "ffmpeg"),
+		ffprobePath:             filepath.Join(binDir, "ffprobe"),
+		ffmpegTimeout:           time.Minute,
+		codecPolicy:             codecPolicyTranscode,
+		tusUploads:              newTusStore(time.Hour),
+		keyTemplate:             keyTemplate,
+		uploadLocks:             newVideoLocks(),
+		presignExpiry:           time.Hour,
+		presignMaxExpiry:        24 * time.Hour,
+		presignCache:            newPresignCache(5 * time.Minute),
+		maxVideoUploadBytes:     100 << 20,
+		maxThumbnailUploadBytes: 10 << 20,
+		maxJSONBodyBytes:        1 << 20,
+		trashRetention:          30 * 24 * time.Hour,
+		shareTokenExpiry:        24 * time.Hour,
+		shareTokenMaxExpiry:     7 * 24 * time.Hour,
+		views:                   newViewTracker(30 * time.Minute),
+		idempotencyKeyTTL:       24 * time.Hour,
+		maxPageSize:             100,
+		orphanCleanup:           orphanCleanupConfig{gracePeriod: time.Hour},
+		importClient:            http.DefaultClient,
+		shuttingDown:            make(chan struct{}),
+	}
+	pool := NewProcessorPool(1, 16, cfg.runProcessingJob)
+	cfg.processing = pool
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		pool.Shutdown(ctx)
+	})
+	return cfg
+}
+
+// failDBUpdates makes every UPDATE that sets column on the videos table fail
+// from now on, by adding a trigger to the test database. when, if set, is a
+// SQL condition on NEW that limits which updates fail.
+func failDBUpdates(t *testing.T, cfg *apiConfig, column, when string) {
+	t.Helper()
+	// newTestConfig keeps the database next to tempDir
+	db, err := sql.Open("sqlite3", filepath.Join(filepath.Dir(cfg.tempDir), "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if when != "" {
+		when = "WHEN " + when
+	}
+	trigger := fmt.Sprintf(`CREATE TRIGGER fail_%[1]s BEFORE UPDATE OF %[1]s ON videos %[2]s
+	BEGIN SELECT RAISE(ABORT, 'update failed'); END`, column, when)
+	if _, err := db.Exec(trigger); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// drainProcessing shuts down the processing pool, waiting for running jobs
+// to finish and clean up after themselves.
+func drainProcessing(t *testing.T, cfg *apiConfig) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if requeued := cfg.processing.Shutdown(ctx); len(requeued) > 0 {
+		t.Fatalf("%d processing jobs didn't finish", len(requeued))
+	}
+}
+
+// tempFiles returns the names of the app's files left in tempDir.
+func tempFiles(t *testing.T, cfg *apiConfig) []string {
+	t.Helper()
+	entries, err := os.ReadDir(cfg.tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "tubely-") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// blockProcessing holds every processing job until release is called or
+// the test ends, so tests can act on a video while it's processing.
+func blockProcessing(t *testing.T, cfg *apiConfig) (release func()) {
+	t.Helper()
+	ch := make(chan struct{})
+	var once sync.Once
+	release = func() { once.Do(func() { close(ch) }) }
+	pool := NewProcessorPool(1, 16, func(ctx context.Context, job database.ProcessingJob) error {
+		<-ch
+		return cfg.runProcessingJob(ctx, job)
+	})
+	cfg.processing = pool
+	t.Cleanup(func() {
+		release()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		pool.Shutdown(ctx)
+	})
+	return release
+}
+
+func writeTestFile(t *testing.T, path, content string, perm os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setProbeOutput changes what the fake ffprobe prints.
+func setProbeOutput(t *testing.T, cfg *apiConfig, output string) {
+	t.Helper()
+	writeTestFile(t, filepath.Join(filepath.Dir(cfg.ffprobePath), "probe.json"), output, 0o644)
+}
+
+// holdFFprobe makes the fake ffprobe wait until release is called.
+// waitForProbe blocks until a probe is being held.
+func holdFFprobe(t *testing.T, cfg *apiConfig) (waitForProbe, release func()) {
+	t.Helper()
+	dir := filepath.Dir(cfg.ffprobePath)
+	hold := filepath.Join(dir, "probe.hold")
+	writeTestFile(t, hold, "", 0o644)
+	release = func() { os.Remove(hold) }
+	t.Cleanup(release)
+	waitForProbe = func() {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, err := os.Stat(filepath.Join(dir, "probe.waiting")); err == nil {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("ffprobe was never called")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return waitForProbe, release
+}
+
+// ffmpegRuns returns the argument lists the fake ffmpeg has been run with.
+func ffmpegRuns(t *testing.T, cfg *apiConfig) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(cfg.ffmpegPath), "ffmpeg.log"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// ffprobeRuns returns the argument lists the fake ffprobe has been run with.
+func ffprobeRuns(t *testing.T, cfg *apiConfig) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(cfg.ffprobePath), "ffprobe.log"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// failFFmpeg makes every later fake ffmpeg run fail.
+func failFFmpeg(t *testing.T, cfg *apiConfig) {
+	t.Helper()
+	writeTestFile(t, filepath.Join(filepath.Dir(cfg.ffmpegPath), "ffmpeg_fail"), "", 0o644)
+}
+
+// createTestUser adds a user and returns them with an access token.
+func createTestUser(t *testing.T, cfg *apiConfig, email string) (database.User, string) {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: email, Password: "unused"})
+	if err != nil {
+		t.Fatalf("couldn't create user: %v", err)
+	}
+	token, err := cfg.makeJWT(*user, time.Hour)
+	if err != nil {
+		t.Fatalf("couldn't make JWT: %v", err)
+	}
+	return *user, token
+}
+
+// adminToken returns an access token with the admin role for userID.
+func adminToken(t *testing.T, cfg *apiConfig, userID uuid.UUID) string {
+	t.Helper()
+	token, err := auth.MakeJWTWithClaims(userID, database.RoleAdmin, cfg.jwtSecret, time.Hour, cfg.jwtClaims)
+	if err != nil {
+		t.Fatalf("couldn't make JWT: %v", err)
+	}
+	return token
+}
+
+func createTestVideo(t *testing.T, cfg *apiConfig, userID uuid.UUID, title string) database.Video {
+	t.Helper()
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: title, Description: "description", UserID: userID})
+	if err != nil {
+		t.Fatalf("couldn't create video: %v", err)
+	}
+	return video
+}
+
+func getTestVideo(t *testing.T, cfg *apiConfig, id uuid.UUID) database.Video {
+	t.Helper()
+	video, err := cfg.db.GetVideo(id)
+	if err != nil {
+		t.Fatalf("couldn't get video: %v", err)
+	}
+	return video
+}
+
+// storeTestVideo stores data under key and points the video at it, as if
+// it had been processed.
+func storeTestVideo(t *testing.T, cfg *apiConfig, video database.Video, key string, data []byte) database.Video {
+	t.Helper()
+	if err := cfg.storage.Put(t.Context(), key, bytes.NewReader(data), putOptions{contentType: "video/mp4"}); err != nil {
+		t.Fatal(err)
+	}
+	videoURL := cfg.objectRef(key)
+	video.VideoURL = &videoURL
+	video.Status = database.VideoStatusReady
+	video.SizeBytes = int64(len(data))
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	return getTestVideo(t, cfg, video.ID)
+}
+
+// waitForStatus polls the video until it has status, failing the test if
+// that takes too long or processing fails instead.
+func waitForStatus(t *testing.T, cfg *apiConfig, id uuid.UUID, status string) database.Video {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		video := getTestVideo(t, cfg, id)
+		if video.Status == status {
+			return video
+		}
+		if video.Status == database.VideoStatusFailed {
+			t.Fatalf("video failed, want %q: %s", status, *video.ProcessingError)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("video status is %q, want %q", video.Status, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testMP4 returns a small file that sniffs as MP4 and already has its moov
+// box ahead of the media data. padding extra bytes of media data are added.
+func testMP4(padding int) []byte {
+	box := func(kind string, payload []byte) []byte {
+		b := make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+		copy(b[4:], kind)
+		return append(b, payload...)
+	}
+	var buf bytes.Buffer
+	buf.Write(box("ftyp", []byte("mp42\x00\x00\x00\x00mp42isom")))
+	buf.Write(box("moov", make([]byte, 16)))
+	buf.Write(box("mdat", bytes.Repeat([]byte{0xAB}, 64+padding)))
+	return buf.Bytes()
+}
+
+// testMP4MoovLast is testMP4 with the moov box after mdat, the layout that
+// needs faststart.
+func testMP4MoovLast(padding int) []byte {
+	data := testMP4(padding)
+	ftypLen := int(binary.BigEndian.Uint32(data))
+	moovLen := int(binary.BigEndian.Uint32(data[ftypLen:]))
+	moovLast := append([]byte{}, data[:ftypLen]...)
+	moovLast = append(moovLast, data[ftypLen+moovLen:]...)
+	return append(moovLast, data[ftypLen:ftypLen+moovLen]...)
+}
+
+// testWebP returns the start of a lossy WebP image, enough to sniff as one.
+func testWebP() []byte {
+	return append([]byte("RIFF\x16\x00\x00\x00WEBPVP8 \x0a\x00\x00\x00"), make([]byte, 10)...)
+}
+
+// fakeFFmpegOutput returns the file the fake ffmpeg writes for name, one of
+// the outputs listed on fakeFFmpeg.
+func fakeFFmpegOutput(t *testing.T, cfg *apiConfig, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(cfg.ffmpegPath), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// storedVideoObject returns the contents of the object video points at.
+func storedVideoObject(t *testing.T, cfg *apiConfig, video database.Video) []byte {
+	t.Helper()
+	if video.VideoURL == nil {
+		t.Fatal("video has no stored object")
+	}
+	ref, err := parseStorageRef(*video.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ref.Key
+	body, _, err := cfg.storage.Get(t.Context(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// newMultipartRequest builds a POST with data as the form file field, sent
+// with the given Content-Type, authenticated with token.
+func newMultipartRequest(t *testing.T, target, token, field, mediaType string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="`+field+`"; filename="upload"`)
+	header.Set("Content-Type", mediaType)
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// newUploadRequest builds a video upload for videoID.
+func newUploadRequest(t *testing.T, videoID uuid.UUID, token, mediaType string, data []byte) *http.Request {
+	t.Helper()
+	req := newMultipartRequest(t, "/api/video_upload/"+videoID.String(), token, "video", mediaType, data)
+	req.SetPathValue("videoID", videoID.String())
+	return req
+}
+
+// newThumbnailRequest builds a thumbnail upload for videoID.
+func newThumbnailRequest(t *testing.T, videoID uuid.UUID, token, mediaType string, data []byte) *http.Request {
+	t.Helper()
+	req := newMultipartRequest(t, "/api/thumbnail_upload/"+videoID.String(), token, "thumbnail", mediaType, data)
+	req.SetPathValue("videoID", videoID.String())
+	return req
+}
+
+// testImage returns a width x height image encoded as mediaType, filled with
+// a gradient so it isn't trivially compressible.
+func testImage(t *testing.T, width, height int, mediaType string) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, mediaType); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// assetFiles returns the names of the files in assetsRoot.
+func assetFiles(t *testing.T, cfg *apiConfig) []string {
+	t.Helper()
+	entries, err := os.ReadDir(cfg.assetsRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// newJSONRequest builds a request with body encoded as JSON, if it isn't nil.
+func newJSONRequest(t *testing.T, method, target, token string, body any) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, target, &buf)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// newVideoRequest builds a JSON request to /api/videos/{videoID} followed by
+// suffix, with the path value set.
+func newVideoRequest(t *testing.T, method string, videoID uuid.UUID, suffix, token string, body any) *http.Request {
+	t.Helper()
+	req := newJSONRequest(t, method, "/api/videos/"+videoID.String()+suffix, token, body)
+	req.SetPathValue("videoID", videoID.String())
+	return req
+}
+
+// decodeResponse decodes a JSON response body into v, failing the test if
+// the status isn't want.
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder, want int, v any) {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, want, rec.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("couldn't decode response %q: %v", rec.Body.String(), err)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that's safe to log to from server goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records decodes each JSON log line written so far.
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	for line := range strings.Lines(b.buf.String()) {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line isn't JSON: %q", line)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// captureLogs sends everything logged during the test to the returned buffer
+// using the app's JSON logger.
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	logs := &syncBuffer{}
+	prev, prevOutput, prevFlags := slog.Default(), log.Writer(), log.Flags()
+	slog.SetDefault(newLogger(logs))
+	t.Cleanup(func() {
+		slog.SetDefault(prev)
+		log.SetOutput(prevOutput)
+		log.SetFlags(prevFlags)
+	})
+	return logs
+}
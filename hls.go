@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+}
+
+// uploadHLS packages the video at videoPath as HLS and uploads every
+// generated file under keyPrefix, keeping the playlists' relative paths
+// intact. It returns the key of the master playlist, the keys of the files
+// uploaded (even if it fails part way) and the total number of bytes
+// uploaded.
+//
+// The stored playlists reference their segments relatively; they're served
+// through handlerHLSPlaylist, which signs each one.
+func (cfg *apiConfig) uploadHLS(ctx context.Context, videoPath, keyPrefix string, opts putOptions, onProgress func(seconds float64)) (string, []string, int64, error) {
+	outDir, err := os.MkdirTemp(cfg.tempDir, "tubely-hls")
+	if err != nil {
+		return "", nil, 0, err
+	}
+	defer os.RemoveAll(outDir)
+
+	// Only packaging is bounded by FFMPEG_TIMEOUT; the uploads take as long
+	// as they take
+	packageCtx, cancel := cfg.ffmpegContext(ctx)
+	err = packageHLS(packageCtx, cfg.ffmpegPath, videoPath, outDir, cfg.hlsSegmentSeconds, onProgress)
+	cancel()
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	var keys []string
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		contentType, ok := hlsContentTypes[filepath.Ext(entry.Name())]
+		if !ok {
+			return "", keys, 0, fmt.Errorf("unexpected HLS output file %s", entry.Name())
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return "", keys, 0, err
+		}
+		opts.contentType = contentType
+		key := path.Join(keyPrefix, entry.Name())
+		if err := cfg.uploadFile(ctx, filepath.Join(outDir, entry.Name()), key, opts); err != nil {
+			return "", keys, 0, err
+		}
+		keys = append(keys, key)
+		total += info.Size()
+	}
+
+	return path.Join(keyPrefix, "master.m3u8"), keys, total, nil
+}
+
+func (cfg *apiConfig) uploadFile(ctx context.Context, filePath, key string, opts putOptions) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cfg.storage.Put(ctx, key, f, opts)
+}
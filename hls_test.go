@@ -0,0 +1,277 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// requireFFmpeg returns the paths of the real ffmpeg and ffprobe, skipping
+// the test if they aren't installed.
+func requireFFmpeg(t *testing.T) (ffmpegPath, ffprobePath string) {
+	t.Helper()
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg isn't installed")
+	}
+	ffprobePath, err = exec.LookPath("ffprobe")
+	if err != nil {
+		t.Skip("ffprobe isn't installed")
+	}
+	return ffmpegPath, ffprobePath
+}
+
+// playlistSegments returns the segment URIs listed in a media playlist.
+func playlistSegments(playlist string) []string {
+	var segments []string
+	for _, line := range strings.Split(playlist, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			segments = append(segments, line)
+		}
+	}
+	return segments
+}
+
+func TestPackageHLSSegmentCount(t *testing.T) {
+	ffmpegPath, _ := requireFFmpeg(t)
+	dir := t.TempDir()
+
+	// 10 seconds with a keyframe every second, so 2 second segments split
+	// evenly
+	input := filepath.Join(dir, "input.mp4")
+	cmd := exec.Command(ffmpegPath, "-v", "error", "-f", "lavfi", "-i", "testsrc=duration=10:size=320x180:rate=10",
+		"-c:v", "libx264", "-g", "10", "-pix_fmt", "yuv420p", input)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("couldn't make the fixture: %v: %s", err, out)
+	}
+
+	outDir := filepath.Join(dir, "hls")
+	if err := os.Mkdir(outDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := packageHLS(t.Context(), ffmpegPath, input, outDir, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(outDir, "index.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := playlistSegments(string(playlist))
+	if len(segments) != 5 {
+		t.Errorf("playlist lists %d segments, want 5:\n%s", len(segments), playlist)
+	}
+	for _, segment := range segments {
+		if _, err := os.Stat(filepath.Join(outDir, segment)); err != nil {
+			t.Errorf("segment %s wasn't written: %v", segment, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "master.m3u8")); err != nil {
+		t.Errorf("no master playlist: %v", err)
+	}
+}
+
+// fakeHLSFFmpeg writes a master playlist and a media playlist listing
+// three segments into the directory of its last argument.
+const fakeHLSFFmpeg = `#!/bin/sh
+for arg in "$@"; do last="$arg"; done
+out="$(dirname "$last")"
+printf '#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nindex.m3u8\n' > "$out/master.m3u8"
+printf '#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\nsegment_000.ts\n#EXTINF:2.0,\nsegment_001.ts\n#EXTINF:1.0,\nsegment_002.ts\n#EXT-X-ENDLIST\n' > "$last"
+for i in 000 001 002; do printf 'segment' > "$out/segment_$i.ts"; done
+`
+
+func TestUploadHLS(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.hlsSegmentSeconds = 2
+	writeTestFile(t, cfg.ffmpegPath, fakeHLSFFmpeg, 0o755)
+
+	manifestKey, keys, size, err := cfg.uploadHLS(t.Context(), "unused.mp4", "landscape/video-hls", putOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifestKey != "landscape/video-hls/master.m3u8" {
+		t.Errorf("manifest key = %q", manifestKey)
+	}
+
+	slices.Sort(keys)
+	want := []string{
+		"landscape/video-hls/index.m3u8",
+		"landscape/video-hls/master.m3u8",
+		"landscape/video-hls/segment_000.ts",
+		"landscape/video-hls/segment_001.ts",
+		"landscape/video-hls/segment_002.ts",
+	}
+	if !slices.Equal(keys, want) {
+		t.Errorf("uploaded %q, want %q", keys, want)
+	}
+
+	body, contentType, err := cfg.storage.Get(t.Context(), "landscape/video-hls/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist, _ := io.ReadAll(body)
+	body.Close()
+	if contentType != "application/vnd.apple.mpegurl" {
+		t.Errorf("playlist content type = %q", contentType)
+	}
+	// Segments are referenced relative to the playlist, so they have to sit
+	// next to it
+	for _, segment := range playlistSegments(string(playlist)) {
+		_, contentType, err := cfg.storage.Get(t.Context(), "landscape/video-hls/"+segment)
+		if err != nil {
+			t.Errorf("segment %s: %v", segment, err)
+		} else if contentType != "video/mp2t" {
+			t.Errorf("segment %s content type = %q", segment, contentType)
+		}
+	}
+
+	var total int64
+	for _, key := range keys {
+		body, _, _ := cfg.storage.Get(t.Context(), key)
+		data, _ := io.ReadAll(body)
+		body.Close()
+		total += int64(len(data))
+	}
+	if size != total {
+		t.Errorf("size = %d, want %d", size, total)
+	}
+	if left := tempFiles(t, cfg); len(left) > 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+}
+
+// storeTestHLS stores a master playlist, a media playlist and two segments
+// under prefix and points the video at them.
+func storeTestHLS(t *testing.T, cfg *apiConfig, video database.Video, prefix string) database.Video {
+	t.Helper()
+	files := map[string]string{
+		"master.m3u8":    "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nindex.m3u8\n",
+		"index.m3u8":     "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\nsegment_000.ts\n#EXTINF:1.0,\nsegment_001.ts\n#EXT-X-ENDLIST\n",
+		"segment_000.ts": "segment",
+		"segment_001.ts": "segment",
+	}
+	for name, data := range files {
+		if err := cfg.storage.Put(t.Context(), prefix+"/"+name, strings.NewReader(data), putOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hlsURL := cfg.objectRef(prefix + "/master.m3u8")
+	video.HLSURL = &hlsURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	return getTestVideo(t, cfg, video.ID)
+}
+
+// getPlaylist requests a playlist link the way a player would, without
+// any credentials.
+func getPlaylist(t *testing.T, cfg *apiConfig, link string) *httptest.ResponseRecorder {
+	t.Helper()
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/api/videos/"), "/")
+	if len(parts) != 3 || parts[1] != "hls" {
+		t.Fatalf("unexpected playlist link %q", link)
+	}
+	req := httptest.NewRequest(http.MethodGet, link, nil)
+	req.SetPathValue("videoID", parts[0])
+	req.SetPathValue("name", parts[2])
+	rec := httptest.NewRecorder()
+	cfg.handlerHLSPlaylist(rec, req)
+	return rec
+}
+
+func TestHandlerHLSPlaylistSignsSegments(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	video := storeTestHLS(t, cfg, createTestVideo(t, cfg, user.ID, "Streamed"), "landscape/video-hls")
+
+	signed, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(*signed.HLSURL, cfg.publicBaseURL+"/api/videos/"+video.ID.String()+"/hls/master.m3u8?") {
+		t.Fatalf("hls_url = %q, want a link to the served master playlist", *signed.HLSURL)
+	}
+
+	rec := getPlaylist(t, cfg, *signed.HLSURL)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("master status = %d; body: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("content type = %q", ct)
+	}
+	variants := playlistSegments(rec.Body.String())
+	if len(variants) != 1 {
+		t.Fatalf("master lists %q, want one media playlist", variants)
+	}
+
+	rec = getPlaylist(t, cfg, variants[0])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("media playlist status = %d; body: %s", rec.Code, rec.Body.String())
+	}
+	segments := playlistSegments(rec.Body.String())
+	want := []string{"landscape/video-hls/segment_000.ts", "landscape/video-hls/segment_001.ts"}
+	if len(segments) != len(want) {
+		t.Fatalf("media playlist lists %q, want %d segments", segments, len(want))
+	}
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "mem://"+url.PathEscape(want[i])+"?") {
+			t.Errorf("segment %d = %q, want a presigned URL for %s", i, segment, want[i])
+		}
+	}
+	if !strings.Contains(rec.Body.String(), "#EXTINF:1.0,\n") {
+		t.Errorf("tags weren't kept:\n%s", rec.Body.String())
+	}
+}
+
+func TestHandlerHLSPlaylistRejectsBadLinks(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	video := storeTestHLS(t, cfg, createTestVideo(t, cfg, user.ID, "Streamed"), "landscape/video-hls")
+	other := storeTestHLS(t, cfg, createTestVideo(t, cfg, user.ID, "Other"), "landscape/other-hls")
+	expires := time.Now().Add(time.Hour)
+
+	valid := cfg.hlsPlaylistURL(video.ID, "master.m3u8", expires)
+	tests := []struct {
+		name string
+		link string
+		want int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"tampered signature", strings.Replace(valid, "signature=", "signature=x", 1), http.StatusForbidden},
+		{"expired", cfg.hlsPlaylistURL(video.ID, "master.m3u8", time.Now().Add(-time.Minute)), http.StatusForbidden},
+		{"signed for another video", strings.Replace(valid, video.ID.String(), other.ID.String(), 1), http.StatusForbidden},
+		{"segment instead of playlist", cfg.hlsPlaylistURL(video.ID, "segment_000.ts", expires), http.StatusNotFound},
+		{"missing playlist", cfg.hlsPlaylistURL(video.ID, "missing.m3u8", expires), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := getPlaylist(t, cfg, tt.link); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d; body: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+
+	// Trashed videos stop streaming even with a link that hasn't expired
+	if err := cfg.db.SoftDeleteVideo(video.ID); err != nil {
+		t.Fatal(err)
+	}
+	if rec := getPlaylist(t, cfg, valid); rec.Code != http.StatusNotFound {
+		t.Errorf("deleted video: status = %d, want 404", rec.Code)
+	}
+}
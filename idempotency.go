@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// replayIdempotentRequest answers a request whose Idempotency-Key the user
+// has sent before with the video the first request produced, in its current
+// state, or with 409 while the first request is still running. Otherwise it
+// reserves the key and returns it, along with whether a response has
+// already been written. The caller saves the key's result once the request
+// succeeds and defers releaseIdempotencyKey so a failed request can be
+// retried.
+func (cfg *apiConfig) replayIdempotentRequest(w http.ResponseWriter, r *http.Request, userID uuid.UUID) (string, bool) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		return "", false
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		respondWithError(w, http.StatusBadRequest, "Idempotency-Key is too long", nil)
+		return "", true
+	}
+
+	// Reserving before the request runs means two requests sent at once
+	// can't both go through
+	reserved, err := cfg.db.ReserveIdempotencyKey(database.IdempotencyKey{
+		UserID:    userID,
+		Key:       key,
+		Request:   r.Method + " " + r.URL.Path,
+		ExpiresAt: time.Now().Add(cfg.idempotencyKeyTTL),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check Idempotency-Key", err)
+		return "", true
+	}
+	if reserved {
+		return key, false
+	}
+
+	saved, err := cfg.db.GetIdempotencyKey(userID, key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check Idempotency-Key", err)
+		return "", true
+	}
+	// The first request failed and released the key since it was reserved
+	if saved.Key == "" {
+		respondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is in progress", nil)
+		return "", true
+	}
+	if saved.Request != r.Method+" "+r.URL.Path {
+		respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request", nil)
+		return "", true
+	}
+	if saved.Pending() {
+		respondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is in progress", nil)
+		return "", true
+	}
+
+	video, err := cfg.db.GetVideo(saved.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return "", true
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return "", true
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	cfg.respondWithSignedVideo(w, saved.StatusCode, video)
+	return "", true
+}
+
+// saveIdempotencyKey records the result of a request made with key. The
+// request has already succeeded, so failing to save is only logged.
+func (cfg *apiConfig) saveIdempotencyKey(r *http.Request, userID uuid.UUID, key string, videoID uuid.UUID, code int) {
+	if key == "" {
+		return
+	}
+	err := cfg.db.SaveIdempotencyKey(database.IdempotencyKey{
+		UserID:     userID,
+		Key:        key,
+		Request:    r.Method + " " + r.URL.Path,
+		VideoID:    videoID,
+		StatusCode: code,
+		ExpiresAt:  time.Now().Add(cfg.idempotencyKeyTTL),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't save idempotency key", "user_id", userID, "error", err.Error())
+	}
+}
+
+// releaseIdempotencyKey drops the reservation on key if the request didn't
+// save a result, so the client can retry it. Failing to release is only
+// logged; the key then expires as usual.
+func (cfg *apiConfig) releaseIdempotencyKey(r *http.Request, userID uuid.UUID, key string) {
+	if key == "" {
+		return
+	}
+	if err := cfg.db.ReleaseIdempotencyKey(userID, key); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't release idempotency key", "user_id", userID, "error", err.Error())
+	}
+}
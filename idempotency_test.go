@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// newCreateRequest returns a request to create a video titled title, sent
+// with the Idempotency-Key key.
+func newCreateRequest(t *testing.T, token, key, title string) *http.Request {
+	t.Helper()
+	req := newJSONRequest(t, http.MethodPost, "/api/videos", token, map[string]string{"title": title})
+	req.Header.Set(idempotencyKeyHeader, key)
+	return req
+}
+
+func TestIdempotencyKeyReplay(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	var first, second database.Video
+	rec := httptest.NewRecorder()
+	cfg.handlerVideoMetaCreate(rec, newCreateRequest(t, token, "create-1", "First"))
+	decodeResponse(t, rec, http.StatusCreated, &first)
+
+	rec = httptest.NewRecorder()
+	cfg.handlerVideoMetaCreate(rec, newCreateRequest(t, token, "create-1", "First"))
+	decodeResponse(t, rec, http.StatusCreated, &second)
+	if rec.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("%s header not set on the retry", idempotentReplayedHeader)
+	}
+	if second.ID != first.ID {
+		t.Errorf("retry returned video %s, want %s", second.ID, first.ID)
+	}
+
+	videos, err := cfg.db.GetVideos(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 1 {
+		t.Errorf("user has %d videos, want 1", len(videos))
+	}
+}
+
+func TestIdempotencyKeyConcurrent(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	// Every request that isn't the first either replays its video or is
+	// told the first is still running
+	const requests = 8
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			cfg.handlerVideoMetaCreate(rec, newCreateRequest(t, token, "create-1", "Video"))
+			codes[i] = rec.Code
+		}()
+	}
+	wg.Wait()
+
+	for _, code := range codes {
+		if code != http.StatusCreated && code != http.StatusConflict {
+			t.Errorf("got status %d, want %d or %d", code, http.StatusCreated, http.StatusConflict)
+		}
+	}
+	videos, err := cfg.db.GetVideos(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 1 {
+		t.Errorf("user has %d videos, want 1", len(videos))
+	}
+}
+
+func TestIdempotencyKeyPending(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	// Another request has reserved the key and is still running
+	reserved, err := cfg.db.ReserveIdempotencyKey(database.IdempotencyKey{
+		UserID:    user.ID,
+		Key:       "create-1",
+		Request:   "POST /api/videos",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil || !reserved {
+		t.Fatalf("couldn't reserve key: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	cfg.handlerVideoMetaCreate(rec, newCreateRequest(t, token, "create-1", "Video"))
+	decodeResponse(t, rec, http.StatusConflict, nil)
+
+	// Using the key for a different request is still an error of its own
+	req := newJSONRequest(t, http.MethodPost, "/api/videos/import", token, nil)
+	req.Header.Set(idempotencyKeyHeader, "create-1")
+	rec = httptest.NewRecorder()
+	cfg.handlerVideoMetaCreate(rec, req)
+	decodeResponse(t, rec, http.StatusUnprocessableEntity, nil)
+}
+
+func TestIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	req := newCreateRequest(t, token, "create-1", "Video")
+	req.Body = http.NoBody
+	rec := httptest.NewRecorder()
+	cfg.handlerVideoMetaCreate(rec, req)
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+
+	// The failed request doesn't hold on to the key, so a retry goes through
+	rec = httptest.NewRecorder()
+	cfg.handlerVideoMetaCreate(rec, newCreateRequest(t, token, "create-1", "Video"))
+	decodeResponse(t, rec, http.StatusCreated, nil)
+
+	videos, err := cfg.db.GetVideos(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 1 {
+		t.Errorf("user has %d videos, want 1", len(videos))
+	}
+}
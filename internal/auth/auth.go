@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -18,6 +19,7 @@ type TokenType string
 
 const (
 	TokenTypeAccess TokenType = "tubely-access"
+	TokenTypeShare  TokenType = "tubely-share"
 )
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
@@ -34,50 +36,163 @@ func CheckPasswordHash(password, hash string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
+// Claims are the issuer and audience that tokens are made with and checked
+// against, so tokens signed with the same secret for another service aren't
+// accepted. An empty Issuer means TokenTypeAccess; an empty Audience is
+// neither set nor checked.
+type Claims struct {
+	Issuer   string
+	Audience string
+}
+
+func (c Claims) issuer() string {
+	if c.Issuer == "" {
+		return string(TokenTypeAccess)
+	}
+	return c.Issuer
+}
+
 func MakeJWT(
 	userID uuid.UUID,
 	tokenSecret string,
 	expiresIn time.Duration,
+) (string, error) {
+	return MakeJWTWithClaims(userID, "", tokenSecret, expiresIn, Claims{})
+}
+
+// tokenClaims are the claims in an access token. Role is left out when empty.
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Role string `json:"role,omitempty"`
+}
+
+func MakeJWTWithClaims(
+	userID uuid.UUID,
+	role string,
+	tokenSecret string,
+	expiresIn time.Duration,
+	claims Claims,
 ) (string, error) {
 	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
+	registered := jwt.RegisteredClaims{
+		Issuer:    claims.issuer(),
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
 		Subject:   userID.String(),
+		// A unique ID lets a single token be revoked
+		ID: uuid.NewString(),
+	}
+	if claims.Audience != "" {
+		registered.Audience = jwt.ClaimStrings{claims.Audience}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+		RegisteredClaims: registered,
+		Role:             role,
 	})
 	return token.SignedString(signingKey)
 }
 
 func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+	return ValidateJWTWithClaims(tokenString, tokenSecret, Claims{})
+}
+
+func ValidateJWTWithClaims(tokenString, tokenSecret string, claims Claims) (uuid.UUID, error) {
+	token, err := ParseJWT(tokenString, tokenSecret, claims)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return token.UserID, nil
+}
+
+// Token is a validated access token.
+type Token struct {
+	UserID uuid.UUID
+	// ID is the token's jti claim; tokens made before it was added have none
+	ID        string
+	ExpiresAt time.Time
+	// Role is the user's role when the token was made, e.g. "admin"
+	Role string
+}
+
+// ParseJWT validates an access token like ValidateJWTWithClaims and returns
+// its claims.
+func ParseJWT(tokenString, tokenSecret string, claims Claims) (Token, error) {
+	options := []jwt.ParserOption{jwt.WithIssuer(claims.issuer())}
+	if claims.Audience != "" {
+		options = append(options, jwt.WithAudience(claims.Audience))
+	}
+
+	claimsStruct := tokenClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		options...,
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return Token{}, err
 	}
 
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return Token{}, err
 	}
 
-	issuer, err := token.Claims.GetIssuer()
+	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, err
+		return Token{}, fmt.Errorf("invalid user ID: %w", err)
 	}
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+
+	parsed := Token{UserID: id, ID: claimsStruct.ID, Role: claimsStruct.Role}
+	if claimsStruct.ExpiresAt != nil {
+		parsed.ExpiresAt = claimsStruct.ExpiresAt.Time
 	}
+	return parsed, nil
+}
 
-	id, err := uuid.Parse(userIDString)
+// MakeShareToken returns a token that gives anyone holding it access to a
+// single video until expiresAt. id identifies the token so it can be
+// revoked.
+func MakeShareToken(videoID uuid.UUID, id, tokenSecret string, expiresAt time.Time) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    string(TokenTypeShare),
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(expiresAt.UTC()),
+		Subject:   videoID.String(),
+		ID:        id,
+	})
+	return token.SignedString([]byte(tokenSecret))
+}
+
+// ShareToken is a validated share token.
+type ShareToken struct {
+	VideoID   uuid.UUID
+	ID        string
+	ExpiresAt time.Time
+}
+
+// ParseShareToken validates a share token and returns its claims.
+func ParseShareToken(tokenString, tokenSecret string) (ShareToken, error) {
+	claims := jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claims,
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		jwt.WithIssuer(string(TokenTypeShare)),
+	)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return ShareToken{}, err
 	}
-	return id, nil
+	// Share tokens must not be valid forever
+	if claims.ExpiresAt == nil {
+		return ShareToken{}, errors.New("share token has no expiry")
+	}
+
+	videoID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return ShareToken{}, fmt.Errorf("invalid video ID: %w", err)
+	}
+	return ShareToken{VideoID: videoID, ID: claims.ID, ExpiresAt: claims.ExpiresAt.Time}, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -102,6 +217,27 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+// APIKeyHeader carries an API key, for clients that authenticate with one
+// instead of a JWT.
+const APIKeyHeader = "X-API-Key"
+
+// MakeAPIKey returns a new random API key. The prefix makes leaked keys easy
+// to recognize, e.g. by secret scanners.
+func MakeAPIKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return "tubely_" + hex.EncodeToString(key), nil
+}
+
+// HashAPIKey returns the hash API keys are stored and looked up by. Keys are
+// random, so a plain SHA-256 is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const testSecret = "test-secret"
+
+func TestValidateJWTWithClaims(t *testing.T) {
+	userID := uuid.New()
+	configured := Claims{Issuer: "tubely", Audience: "tubely-api"}
+
+	// A token made without the library, so claims can be left out entirely
+	unclaimed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   userID.String(),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		made    Claims
+		checked Claims
+		token   string
+		wantErr error
+	}{
+		{name: "defaults", made: Claims{}, checked: Claims{}},
+		{name: "matching", made: configured, checked: configured},
+		// Audience is opt-in, so tokens made with one still work without
+		{name: "audience not checked", made: configured, checked: Claims{Issuer: "tubely"}},
+		{name: "wrong issuer", made: Claims{Issuer: "other"}, checked: configured, wantErr: jwt.ErrTokenInvalidIssuer},
+		{name: "wrong audience", made: Claims{Issuer: "tubely", Audience: "other"}, checked: configured, wantErr: jwt.ErrTokenInvalidAudience},
+		{name: "missing audience", made: Claims{Issuer: "tubely"}, checked: configured, wantErr: jwt.ErrTokenRequiredClaimMissing},
+		{name: "missing issuer", token: unclaimed, checked: Claims{}, wantErr: jwt.ErrTokenRequiredClaimMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token
+			if token == "" {
+				token, err = MakeJWTWithClaims(userID, "", testSecret, time.Hour, tt.made)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := ValidateJWTWithClaims(token, testSecret, tt.checked)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != userID {
+				t.Errorf("user ID = %s, want %s", got, userID)
+			}
+		})
+	}
+}
+
+func TestValidateJWTRejects(t *testing.T) {
+	userID := uuid.New()
+	expired, err := MakeJWT(userID, testSecret, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := MakeShareToken(uuid.New(), "share-id", testSecret, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := MakeJWT(userID, testSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		secret  string
+		wantErr error
+	}{
+		{"expired", expired, testSecret, jwt.ErrTokenExpired},
+		{"wrong secret", valid, "other-secret", jwt.ErrTokenSignatureInvalid},
+		{"share token", share, testSecret, jwt.ErrTokenInvalidIssuer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ValidateJWT(tt.token, tt.secret); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseShareToken(t *testing.T) {
+	videoID := uuid.New()
+	valid, err := MakeShareToken(videoID, "share-id", testSecret, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := MakeShareToken(videoID, "share-id", testSecret, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := MakeJWT(uuid.New(), testSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		secret  string
+		wantErr error
+	}{
+		{"valid", valid, testSecret, nil},
+		{"expired", expired, testSecret, jwt.ErrTokenExpired},
+		{"wrong secret", valid, "other-secret", jwt.ErrTokenSignatureInvalid},
+		{"access token", access, testSecret, jwt.ErrTokenInvalidIssuer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseShareToken(tt.token, tt.secret)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (got.VideoID != videoID || got.ID != "share-id") {
+				t.Errorf("got %+v, want video %s and ID share-id", got, videoID)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APIKey is a long-lived credential for server-to-server clients. Only the
+// hash of the key is stored.
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+	KeyHash    string     `json:"-"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+const apiKeyColumns = `id, created_at, user_id, name, key_hash, last_used_at, revoked_at`
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var id, userID string
+	err := row.Scan(&id, &key.CreatedAt, &userID, &key.Name, &key.KeyHash, &key.LastUsedAt, &key.RevokedAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if key.ID, err = uuid.Parse(id); err != nil {
+		return APIKey{}, err
+	}
+	if key.UserID, err = uuid.Parse(userID); err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+func (c Client) CreateAPIKey(userID uuid.UUID, name, keyHash string) (APIKey, error) {
+	id := uuid.New()
+	_, err := c.db.Exec(`
+		INSERT INTO api_keys (id, created_at, user_id, name, key_hash)
+		VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	`, id.String(), userID.String(), name, keyHash)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return scanAPIKey(c.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id.String()))
+}
+
+// GetAPIKeyByHash returns the key with keyHash, or an empty APIKey if there's
+// none.
+func (c Client) GetAPIKeyByHash(keyHash string) (APIKey, error) {
+	key, err := scanAPIKey(c.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, keyHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, nil
+	}
+	return key, err
+}
+
+func (c Client) GetAPIKeys(userID uuid.UUID) ([]APIKey, error) {
+	rows, err := c.db.Query(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys
+		WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// TouchAPIKey records that the key was just used.
+func (c Client) TouchAPIKey(id uuid.UUID) error {
+	_, err := c.db.Exec(`UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?`, id.String())
+	return err
+}
+
+// RevokeAPIKey revokes one of the user's keys. It reports whether there was
+// such a key.
+func (c Client) RevokeAPIKey(id, userID uuid.UUID) (bool, error) {
+	result, err := c.db.Exec(`
+		UPDATE api_keys
+		SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP)
+		WHERE id = ? AND user_id = ?
+	`, id.String(), userID.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -25,6 +26,16 @@ func NewClient(pathToDB string) (Client, error) {
 
 }
 
+// Ping checks that the database can still be reached.
+func (c Client) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
+// Close closes the database. Later calls fail.
+func (c Client) Close() error {
+	return c.db.Close()
+}
+
 func (c *Client) autoMigrate() error {
 	userTable := `
 	CREATE TABLE IF NOT EXISTS users (
@@ -72,6 +83,187 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	apiKeyTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		key_hash TEXT UNIQUE NOT NULL,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(apiKeyTable)
+	if err != nil {
+		return err
+	}
+
+	revokedTokenTable := `
+	CREATE TABLE IF NOT EXISTS revoked_tokens (
+		jti TEXT PRIMARY KEY,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(revokedTokenTable)
+	if err != nil {
+		return err
+	}
+
+	tagTables := `
+	CREATE TABLE IF NOT EXISTS tags (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		UNIQUE(user_id, name),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE TABLE IF NOT EXISTS video_tags (
+		video_id TEXT NOT NULL,
+		tag_id TEXT NOT NULL,
+		PRIMARY KEY(video_id, tag_id),
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(tag_id) REFERENCES tags(id)
+	);
+	`
+	_, err = c.db.Exec(tagTables)
+	if err != nil {
+		return err
+	}
+
+	shareTokenTable := `
+	CREATE TABLE IF NOT EXISTS share_tokens (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(shareTokenTable)
+	if err != nil {
+		return err
+	}
+
+	idempotencyKeyTable := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		status_code INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		PRIMARY KEY(user_id, key),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(idempotencyKeyTable)
+	if err != nil {
+		return err
+	}
+
+	processingJobTable := `
+	CREATE TABLE IF NOT EXISTS processing_jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		path TEXT NOT NULL,
+		media_type TEXT NOT NULL,
+		auto_thumbnail INTEGER NOT NULL DEFAULT 0,
+		storage_class TEXT NOT NULL DEFAULT '',
+		skip_faststart INTEGER NOT NULL DEFAULT 0,
+		source_key TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(processingJobTable)
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the original schema. CREATE TABLE IF NOT EXISTS
+	// won't touch existing databases, so add any that are missing.
+	addedColumns := []struct {
+		table      string
+		name       string
+		definition string
+	}{
+		{"videos", "width", "INTEGER NOT NULL DEFAULT 0"},
+		{"videos", "height", "INTEGER NOT NULL DEFAULT 0"},
+		{"videos", "hls_url", "TEXT"},
+		{"videos", "duration", "REAL NOT NULL DEFAULT 0"},
+		{"videos", "size_bytes", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "storage_quota_bytes", "INTEGER"},
+		{"videos", "hls_size_bytes", "INTEGER NOT NULL DEFAULT 0"},
+		{"videos", "aspect_ratio", "TEXT NOT NULL DEFAULT ''"},
+		{"videos", "status", "TEXT NOT NULL DEFAULT 'uploading'"},
+		{"videos", "processing_error", "TEXT"},
+		{"videos", "progress", "REAL NOT NULL DEFAULT 0"},
+		{"videos", "thumbnail_variants", "TEXT"},
+		{"videos", "blur_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"videos", "dominant_color", "TEXT NOT NULL DEFAULT ''"},
+		{"refresh_tokens", "hashed", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "role", "TEXT NOT NULL DEFAULT 'user'"},
+		{"videos", "video_codec", "TEXT NOT NULL DEFAULT ''"},
+		{"videos", "audio_codec", "TEXT NOT NULL DEFAULT ''"},
+		{"videos", "container", "TEXT NOT NULL DEFAULT ''"},
+		{"videos", "content_sha256", "TEXT NOT NULL DEFAULT ''"},
+		{"videos", "deleted_at", "TIMESTAMP"},
+		{"videos", "visibility", "TEXT NOT NULL DEFAULT 'private'"},
+		{"videos", "views", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, col := range addedColumns {
+		err = c.addColumnIfMissing(col.table, col.name, col.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := c.hashRefreshTokens(); err != nil {
+		return fmt.Errorf("failed to hash refresh tokens: %w", err)
+	}
+
+	// Videos uploaded before there was a status are already playable
+	_, err = c.db.Exec(`UPDATE videos SET status = 'ready' WHERE status = 'uploading' AND video_url IS NOT NULL`)
+	return err
+}
+
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -79,9 +271,30 @@ func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM api_keys"); err != nil {
+		return fmt.Errorf("failed to reset table api_keys: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM revoked_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table revoked_tokens: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM idempotency_keys"); err != nil {
+		return fmt.Errorf("failed to reset table idempotency_keys: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM share_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table share_tokens: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_tags"); err != nil {
+		return fmt.Errorf("failed to reset table video_tags: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM tags"); err != nil {
+		return fmt.Errorf("failed to reset table tags: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM processing_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table processing_jobs: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
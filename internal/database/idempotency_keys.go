@@ -0,0 +1,92 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotencyKey records the outcome of a request made with an
+// Idempotency-Key header, so a retry can be answered with the same result.
+// Keys are scoped to the user who sent them.
+type IdempotencyKey struct {
+	UserID uuid.UUID
+	Key    string
+	// Request is the method and path the key was first used with
+	Request string
+	// VideoID and StatusCode are zero while the first request is still
+	// running
+	VideoID    uuid.UUID
+	StatusCode int
+	ExpiresAt  time.Time
+}
+
+// Pending reports whether the request that reserved the key hasn't
+// finished yet.
+func (k IdempotencyKey) Pending() bool {
+	return k.StatusCode == 0
+}
+
+// ReserveIdempotencyKey claims a key for a request that's about to run,
+// before its result is known. It returns false if the user already has the
+// key. Expired keys are cleared out as new ones are added.
+func (c Client) ReserveIdempotencyKey(key IdempotencyKey) (bool, error) {
+	if _, err := c.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+		return false, err
+	}
+	result, err := c.db.Exec(`
+		INSERT INTO idempotency_keys (user_id, key, request, video_id, status_code, expires_at)
+		VALUES (?, ?, ?, ?, 0, ?)
+		ON CONFLICT (user_id, key) DO NOTHING
+	`, key.UserID.String(), key.Key, key.Request, uuid.Nil.String(), key.ExpiresAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// SaveIdempotencyKey records the result of the request that reserved key.
+func (c Client) SaveIdempotencyKey(key IdempotencyKey) error {
+	_, err := c.db.Exec(`
+		UPDATE idempotency_keys SET video_id = ?, status_code = ?, expires_at = ?
+		WHERE user_id = ? AND key = ?
+	`, key.VideoID.String(), key.StatusCode, key.ExpiresAt.UTC(), key.UserID.String(), key.Key)
+	return err
+}
+
+// ReleaseIdempotencyKey drops a reservation whose request failed, so the
+// key can be retried. Keys that already have a result are kept.
+func (c Client) ReleaseIdempotencyKey(userID uuid.UUID, key string) error {
+	_, err := c.db.Exec(`
+		DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND status_code = 0
+	`, userID.String(), key)
+	return err
+}
+
+// GetIdempotencyKey returns the user's key, or an empty IdempotencyKey if
+// there's none or it has expired.
+func (c Client) GetIdempotencyKey(userID uuid.UUID, key string) (IdempotencyKey, error) {
+	result := IdempotencyKey{UserID: userID, Key: key}
+	var videoID string
+	err := c.db.QueryRow(`
+		SELECT request, video_id, status_code, expires_at
+		FROM idempotency_keys
+		WHERE user_id = ? AND key = ? AND expires_at > ?
+	`, userID.String(), key, time.Now().UTC()).Scan(&result.Request, &videoID, &result.StatusCode, &result.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return IdempotencyKey{}, nil
+	}
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	if result.VideoID, err = uuid.Parse(videoID); err != nil {
+		return IdempotencyKey{}, err
+	}
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProcessingJob is a queued upload waiting to be processed. Jobs are kept
+// until processing finishes, so any that were interrupted by a shutdown can
+// be picked up again on the next start.
+type ProcessingJob struct {
+	ID            uuid.UUID
+	CreatedAt     time.Time
+	VideoID       uuid.UUID
+	Path          string
+	MediaType     string
+	AutoThumbnail bool
+	StorageClass  string
+	SkipFastStart bool
+	// SourceKey is a storage object to delete once the job succeeds
+	SourceKey string
+}
+
+func (c Client) CreateProcessingJob(job ProcessingJob) (ProcessingJob, error) {
+	job.ID = uuid.New()
+	job.CreatedAt = time.Now().UTC()
+	query := `
+	INSERT INTO processing_jobs (
+		id,
+		created_at,
+		video_id,
+		path,
+		media_type,
+		auto_thumbnail,
+		storage_class,
+		skip_faststart,
+		source_key
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query,
+		job.ID,
+		job.CreatedAt,
+		job.VideoID,
+		job.Path,
+		job.MediaType,
+		job.AutoThumbnail,
+		job.StorageClass,
+		job.SkipFastStart,
+		job.SourceKey,
+	)
+	if err != nil {
+		return ProcessingJob{}, err
+	}
+	return job, nil
+}
+
+// GetProcessingJobs returns every unfinished job, oldest first.
+func (c Client) GetProcessingJobs() ([]ProcessingJob, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		video_id,
+		path,
+		media_type,
+		auto_thumbnail,
+		storage_class,
+		skip_faststart,
+		source_key
+	FROM processing_jobs
+	ORDER BY created_at
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []ProcessingJob{}
+	for rows.Next() {
+		var job ProcessingJob
+		err := rows.Scan(
+			&job.ID,
+			&job.CreatedAt,
+			&job.VideoID,
+			&job.Path,
+			&job.MediaType,
+			&job.AutoThumbnail,
+			&job.StorageClass,
+			&job.SkipFastStart,
+			&job.SourceKey,
+		)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (c Client) DeleteProcessingJob(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM processing_jobs WHERE id = ?", id)
+	return err
+}
@@ -1,12 +1,28 @@
 package database
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrRefreshTokenRevoked is returned by RotateRefreshToken when the token was
+// already revoked, e.g. by a concurrent refresh.
+var ErrRefreshTokenRevoked = errors.New("refresh token has been revoked")
+
+// Refresh tokens are stored as SHA-256 hashes so a leaked database doesn't
+// hand out working sessions. They're random, so no salt is needed. Methods
+// take the plain token and hash it themselves; RefreshToken.Token is the
+// hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 type RefreshToken struct {
 	CreateRefreshTokenParams
 	CreatedAt time.Time  `json:"created_at"`
@@ -27,10 +43,11 @@ func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToke
 			created_at,
 			updated_at,
 			user_id,
-			expires_at
-		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+			expires_at,
+			hashed
+		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, 1)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	_, err := c.db.Exec(query, hashToken(params.Token), params.UserID.String(), params.ExpiresAt)
 	if err != nil {
 		return RefreshToken{}, err
 	}
@@ -44,10 +61,51 @@ func (c Client) RevokeRefreshToken(token string) error {
 		SET revoked_at = CURRENT_TIMESTAMP
 		WHERE token = ?
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.db.Exec(query, hashToken(token))
 	return err
 }
 
+// RotateRefreshToken revokes token and saves next in its place, as one
+// transaction so a token can only be exchanged once.
+func (c Client) RotateRefreshToken(token string, next CreateRefreshTokenParams) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE token = ? AND revoked_at IS NULL
+	`, hashToken(token))
+	if err != nil {
+		return err
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return ErrRefreshTokenRevoked
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (
+			token,
+			created_at,
+			updated_at,
+			user_id,
+			expires_at,
+			hashed
+		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, 1)
+	`, hashToken(next.Token), next.UserID.String(), next.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	query := `
 		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
@@ -56,7 +114,7 @@ func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	`
 	var rt RefreshToken
 	var userID string
-	err := c.db.QueryRow(query, token).
+	err := c.db.QueryRow(query, hashToken(token)).
 		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -73,11 +131,40 @@ func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	return rt, nil
 }
 
+// hashRefreshTokens hashes tokens saved before they were stored hashed.
+func (c Client) hashRefreshTokens() error {
+	rows, err := c.db.Query(`SELECT token FROM refresh_tokens WHERE hashed = 0`)
+	if err != nil {
+		return err
+	}
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		_, err := c.db.Exec(`UPDATE refresh_tokens SET token = ?, hashed = 1 WHERE token = ? AND hashed = 0`, hashToken(token), token)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c Client) DeleteRefreshToken(token string) error {
 	query := `
 		DELETE FROM refresh_tokens
 		WHERE token = ?
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.db.Exec(query, hashToken(token))
 	return err
 }
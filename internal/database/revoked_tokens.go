@@ -0,0 +1,35 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// RevokeToken records the ID of an access token that was logged out. It's
+// kept until the token would have expired anyway, and expired entries are
+// cleared out as new ones are added.
+func (c Client) RevokeToken(jti string, expiresAt time.Time) error {
+	if _, err := c.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err := c.db.Exec(`
+		INSERT INTO revoked_tokens (jti, expires_at)
+		VALUES (?, ?)
+		ON CONFLICT (jti) DO NOTHING
+	`, jti, expiresAt.UTC())
+	return err
+}
+
+// IsTokenRevoked reports whether the access token with ID jti was logged out.
+func (c Client) IsTokenRevoked(jti string) (bool, error) {
+	var found int
+	err := c.db.QueryRow(`SELECT 1 FROM revoked_tokens WHERE jti = ?`, jti).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShareToken records a share link handed out for a video. The token itself
+// is signed and not stored; the record is what lets it be revoked.
+type ShareToken struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	VideoID   uuid.UUID  `json:"video_id"`
+	UserID    uuid.UUID  `json:"user_id"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+const shareTokenColumns = `id, created_at, video_id, user_id, expires_at, revoked_at`
+
+func scanShareToken(row rowScanner) (ShareToken, error) {
+	var token ShareToken
+	var id, videoID, userID string
+	err := row.Scan(&id, &token.CreatedAt, &videoID, &userID, &token.ExpiresAt, &token.RevokedAt)
+	if err != nil {
+		return ShareToken{}, err
+	}
+	if token.ID, err = uuid.Parse(id); err != nil {
+		return ShareToken{}, err
+	}
+	if token.VideoID, err = uuid.Parse(videoID); err != nil {
+		return ShareToken{}, err
+	}
+	if token.UserID, err = uuid.Parse(userID); err != nil {
+		return ShareToken{}, err
+	}
+	return token, nil
+}
+
+func (c Client) CreateShareToken(videoID, userID uuid.UUID, expiresAt time.Time) (ShareToken, error) {
+	id := uuid.New()
+	_, err := c.db.Exec(`
+		INSERT INTO share_tokens (id, created_at, video_id, user_id, expires_at)
+		VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	`, id.String(), videoID.String(), userID.String(), expiresAt.UTC())
+	if err != nil {
+		return ShareToken{}, err
+	}
+	return scanShareToken(c.db.QueryRow(`SELECT `+shareTokenColumns+` FROM share_tokens WHERE id = ?`, id.String()))
+}
+
+// GetShareToken returns the share token with id, or an empty ShareToken if
+// there's none.
+func (c Client) GetShareToken(id uuid.UUID) (ShareToken, error) {
+	token, err := scanShareToken(c.db.QueryRow(`SELECT `+shareTokenColumns+` FROM share_tokens WHERE id = ?`, id.String()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ShareToken{}, nil
+	}
+	return token, err
+}
+
+// GetShareTokens returns the share tokens of a video that haven't expired,
+// newest first.
+func (c Client) GetShareTokens(videoID uuid.UUID) ([]ShareToken, error) {
+	rows, err := c.db.Query(`
+		SELECT `+shareTokenColumns+`
+		FROM share_tokens
+		WHERE video_id = ? AND expires_at > ?
+		ORDER BY created_at DESC
+	`, videoID.String(), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []ShareToken{}
+	for rows.Next() {
+		token, err := scanShareToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeShareToken revokes one of the video's share tokens. It reports
+// whether there was such a token.
+func (c Client) RevokeShareToken(id, videoID uuid.UUID) (bool, error) {
+	result, err := c.db.Exec(`
+		UPDATE share_tokens
+		SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP)
+		WHERE id = ? AND video_id = ?
+	`, id.String(), videoID.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+// AddVideoTag tags a video. Tags belong to the video's owner, so the same
+// tag on two of their videos is shared. Adding a tag twice is a no-op.
+func (c Client) AddVideoTag(videoID, userID uuid.UUID, name string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO tags (id, user_id, name)
+		VALUES (?, ?, ?)
+		ON CONFLICT (user_id, name) DO NOTHING
+	`, uuid.New().String(), userID.String(), name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO video_tags (video_id, tag_id)
+		SELECT ?, id FROM tags WHERE user_id = ? AND name = ?
+		ON CONFLICT (video_id, tag_id) DO NOTHING
+	`, videoID, userID.String(), name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveVideoTag removes a tag from a video. Removing a tag the video doesn't
+// have is a no-op.
+func (c Client) RemoveVideoTag(videoID uuid.UUID, name string) error {
+	_, err := c.db.Exec(`
+		DELETE FROM video_tags
+		WHERE video_id = ? AND tag_id IN (SELECT id FROM tags WHERE name = ?)
+	`, videoID, name)
+	return err
+}
+
+// GetVideoTags returns the names of a video's tags in alphabetical order.
+func (c Client) GetVideoTags(videoID uuid.UUID) ([]string, error) {
+	rows, err := c.db.Query(`
+		SELECT t.name
+		FROM video_tags vt
+		JOIN tags t ON t.id = vt.tag_id
+		WHERE vt.video_id = ?
+		ORDER BY t.name
+	`, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tags = append(tags, name)
+	}
+	return tags, rows.Err()
+}
@@ -2,40 +2,172 @@ package database
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Video statuses. A video waits for its upload, is processed in the
+// background and then either becomes playable or records why it failed.
+const (
+	VideoStatusUploading  = "uploading"
+	VideoStatusProcessing = "processing"
+	VideoStatusReady      = "ready"
+	VideoStatusFailed     = "failed"
+)
+
+// Video visibilities. Private videos are only visible to their owner,
+// unlisted ones to anyone with the link, and public ones are also listed.
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID                uuid.UUID         `json:"id"`
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
+	ThumbnailURL      *string           `json:"thumbnail_url"`
+	ThumbnailVariants ThumbnailVariants `json:"thumbnail_variants"`
+	BlurHash          string            `json:"blur_hash"`
+	DominantColor     string            `json:"dominant_color"`
+	VideoURL          *string           `json:"video_url"`
+	HLSURL            *string           `json:"hls_url"`
+	Width             int               `json:"width"`
+	Height            int               `json:"height"`
+	AspectRatio       string            `json:"aspect_ratio"`
+	Duration          float64           `json:"duration"`
+	VideoCodec        string            `json:"video_codec"`
+	AudioCodec        string            `json:"audio_codec"`
+	Container         string            `json:"container"`
+	SizeBytes         int64             `json:"size_bytes"`
+	ContentSHA256     string            `json:"content_sha256"`
+	HLSSizeBytes      int64             `json:"hls_size_bytes"`
+	Status            string            `json:"status"`
+	ProcessingError   *string           `json:"processing_error"`
+	Progress          float64           `json:"progress"`
+	Visibility        string            `json:"visibility"`
+	Views             int64             `json:"views"`
+	DeletedAt         *time.Time        `json:"deleted_at"`
 	CreateVideoParams
 }
 
+// ThumbnailVariants maps a size name ("small", "medium", "large") to the URL
+// of the thumbnail scaled to that size. It's stored as a JSON object.
+type ThumbnailVariants map[string]string
+
+func (v ThumbnailVariants) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (v *ThumbnailVariants) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*v = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(src), v)
+	case []byte:
+		return json.Unmarshal(src, v)
+	default:
+		return fmt.Errorf("can't scan %T into ThumbnailVariants", src)
+	}
+}
+
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// videoColumns lists the columns read by scanVideo, in order.
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_variants,
+		blur_hash,
+		dominant_color,
 		video_url,
-		user_id
+		hls_url,
+		width,
+		height,
+		aspect_ratio,
+		duration,
+		video_codec,
+		audio_codec,
+		container,
+		size_bytes,
+		content_sha256,
+		hls_size_bytes,
+		status,
+		processing_error,
+		progress,
+		visibility,
+		views,
+		deleted_at,
+		user_id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailVariants,
+		&video.BlurHash,
+		&video.DominantColor,
+		&video.VideoURL,
+		&video.HLSURL,
+		&video.Width,
+		&video.Height,
+		&video.AspectRatio,
+		&video.Duration,
+		&video.VideoCodec,
+		&video.AudioCodec,
+		&video.Container,
+		&video.SizeBytes,
+		&video.ContentSHA256,
+		&video.HLSSizeBytes,
+		&video.Status,
+		&video.ProcessingError,
+		&video.Progress,
+		&video.Visibility,
+		&video.Views,
+		&video.DeletedAt,
+		&video.UserID,
+	)
+	return video, err
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
-	WHERE user_id = ?
+	WHERE user_id = ? AND deleted_at IS NULL
 	ORDER BY created_at DESC
 	`
 
@@ -47,17 +179,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -66,6 +189,79 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	return videos, nil
 }
 
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// VideoListParams selects a page of videos, newest first.
+type VideoListParams struct {
+	// UserID limits the list to one user's videos; uuid.Nil lists everyone's
+	UserID uuid.UUID
+	// Visibility, if set, only matches videos with that visibility
+	Visibility string
+	// Query, if set, matches titles and descriptions case-insensitively
+	Query string
+	// Tag, if set, only matches videos with that tag
+	Tag    string
+	Limit  int
+	Offset int
+}
+
+// GetVideosPage returns one page of the videos matching params along with
+// the total number of matching videos.
+func (c Client) GetVideosPage(params VideoListParams) ([]Video, int, error) {
+	where := `WHERE deleted_at IS NULL`
+	var args []any
+	if params.UserID != uuid.Nil {
+		where += ` AND user_id = ?`
+		args = append(args, params.UserID)
+	}
+	if params.Visibility != "" {
+		where += ` AND visibility = ?`
+		args = append(args, params.Visibility)
+	}
+	if params.Query != "" {
+		// LIKE is case-insensitive for ASCII in SQLite. The wildcards are
+		// escaped so they match literally.
+		pattern := "%" + likeEscaper.Replace(params.Query) + "%"
+		where += ` AND (title LIKE ? ESCAPE '\' OR description LIKE ? ESCAPE '\')`
+		args = append(args, pattern, pattern)
+	}
+	if params.Tag != "" {
+		where += ` AND id IN (
+			SELECT vt.video_id FROM video_tags vt JOIN tags t ON t.id = vt.tag_id
+			WHERE t.name = ?
+		)`
+		args = append(args, params.Tag)
+	}
+
+	var total int
+	if err := c.db.QueryRow(`SELECT COUNT(*) FROM videos `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	` + where + `
+	ORDER BY created_at DESC, id
+	LIMIT ? OFFSET ?
+	`
+	rows, err := c.db.Query(query, append(args, params.Limit, params.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, total, rows.Err()
+}
+
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	id := uuid.New()
 	query := `
@@ -88,29 +284,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -128,7 +307,25 @@ func (c Client) UpdateVideo(video Video) error {
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnail_variants = ?,
+		blur_hash = ?,
+		dominant_color = ?,
 		video_url = ?,
+		hls_url = ?,
+		width = ?,
+		height = ?,
+		aspect_ratio = ?,
+		duration = ?,
+		video_codec = ?,
+		audio_codec = ?,
+		container = ?,
+		size_bytes = ?,
+		content_sha256 = ?,
+		hls_size_bytes = ?,
+		status = ?,
+		processing_error = ?,
+		progress = ?,
+		visibility = ?,
 		user_id = ?
 	WHERE id = ?
 	`
@@ -138,18 +335,356 @@ func (c Client) UpdateVideo(video Video) error {
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		video.ThumbnailVariants,
+		video.BlurHash,
+		video.DominantColor,
 		&video.VideoURL,
+		&video.HLSURL,
+		video.Width,
+		video.Height,
+		video.AspectRatio,
+		video.Duration,
+		video.VideoCodec,
+		video.AudioCodec,
+		video.Container,
+		video.SizeBytes,
+		video.ContentSHA256,
+		video.HLSSizeBytes,
+		video.Status,
+		video.ProcessingError,
+		video.Progress,
+		video.Visibility,
 		video.UserID,
 		video.ID,
 	)
 	return err
 }
 
+// UpdateVideoProcessingResult saves only what processing a video changes:
+// its stored files, their media details and the processing state. Anything
+// the owner edited while the video was processing is left alone.
+func (c Client) UpdateVideoProcessingResult(video Video) error {
+	query := `
+	UPDATE videos
+	SET
+		video_url = ?,
+		hls_url = ?,
+		width = ?,
+		height = ?,
+		aspect_ratio = ?,
+		duration = ?,
+		video_codec = ?,
+		audio_codec = ?,
+		container = ?,
+		size_bytes = ?,
+		hls_size_bytes = ?,
+		status = ?,
+		processing_error = ?,
+		progress = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+
+	_, err := c.db.Exec(
+		query,
+		&video.VideoURL,
+		&video.HLSURL,
+		video.Width,
+		video.Height,
+		video.AspectRatio,
+		video.Duration,
+		video.VideoCodec,
+		video.AudioCodec,
+		video.Container,
+		video.SizeBytes,
+		video.HLSSizeBytes,
+		video.Status,
+		video.ProcessingError,
+		video.Progress,
+		video.ID,
+	)
+	return err
+}
+
+// UpdateVideoThumbnail saves only the video's thumbnail columns.
+func (c Client) UpdateVideoThumbnail(video Video) error {
+	query := `
+	UPDATE videos
+	SET
+		thumbnail_url = ?,
+		thumbnail_variants = ?,
+		blur_hash = ?,
+		dominant_color = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+
+	_, err := c.db.Exec(
+		query,
+		&video.ThumbnailURL,
+		video.ThumbnailVariants,
+		video.BlurHash,
+		video.DominantColor,
+		video.ID,
+	)
+	return err
+}
+
+// UpdateVideoVisibility saves only the video's visibility, so it can't
+// undo changes made to the rest of the row since it was read.
+func (c Client) UpdateVideoVisibility(id uuid.UUID, visibility string) error {
+	_, err := c.db.Exec(
+		"UPDATE videos SET visibility = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		visibility, id,
+	)
+	return err
+}
+
+// GetStorageUsage returns the total stored bytes of a user's videos,
+// including HLS renditions, not counting the video with ID exclude (use
+// uuid.Nil to count everything). Deduplicated videos share their stored
+// objects, so each object is only counted once.
+func (c Client) GetStorageUsage(userID, exclude uuid.UUID) (int64, error) {
+	query := `
+	SELECT
+		(SELECT COALESCE(SUM(size), 0) FROM (
+			SELECT MAX(size_bytes) AS size
+			FROM videos
+			WHERE user_id = ? AND id != ? AND video_url IS NOT NULL
+			GROUP BY video_url
+		))
+		+
+		(SELECT COALESCE(SUM(size), 0) FROM (
+			SELECT MAX(hls_size_bytes) AS size
+			FROM videos
+			WHERE user_id = ? AND id != ? AND hls_url IS NOT NULL
+			GROUP BY hls_url
+		))
+	`
+	var total int64
+	err := c.db.QueryRow(query, userID, exclude, userID, exclude).Scan(&total)
+	return total, err
+}
+
+// UpdateVideoProgress sets only the processing progress, so it can be called
+// while the rest of the video is being worked on.
+func (c Client) UpdateVideoProgress(id uuid.UUID, percent float64) error {
+	_, err := c.db.Exec("UPDATE videos SET progress = ? WHERE id = ?", percent, id)
+	return err
+}
+
+// IncrementVideoViews adds one to a video's view count. UpdateVideo leaves
+// the count alone so concurrent views aren't lost.
+func (c Client) IncrementVideoViews(id uuid.UUID) error {
+	_, err := c.db.Exec("UPDATE videos SET views = views + 1 WHERE id = ?", id)
+	return err
+}
+
+// GetVideoByContentSHA256 returns a processed video of the user whose upload
+// had the given checksum, other than the video with ID exclude. It returns an
+// empty Video if there is none.
+func (c Client) GetVideoByContentSHA256(userID uuid.UUID, sum string, exclude uuid.UUID) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND content_sha256 = ? AND id != ? AND status = ? AND video_url IS NOT NULL
+	ORDER BY created_at
+	LIMIT 1
+	`
+
+	video, err := scanVideo(c.db.QueryRow(query, userID, sum, exclude, VideoStatusReady))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+	return video, nil
+}
+
+// CountVideosWithURL returns how many videos other than exclude point at the
+// stored object, which may be stored as any of videoURLs.
+func (c Client) CountVideosWithURL(videoURLs []string, exclude uuid.UUID) (int, error) {
+	return c.countVideosWith("video_url", videoURLs, exclude)
+}
+
+// CountVideosWithHLSURL returns how many videos other than exclude point at
+// the stored HLS package, which may be stored as any of hlsURLs.
+func (c Client) CountVideosWithHLSURL(hlsURLs []string, exclude uuid.UUID) (int, error) {
+	return c.countVideosWith("hls_url", hlsURLs, exclude)
+}
+
+func (c Client) countVideosWith(column string, values []string, exclude uuid.UUID) (int, error) {
+	if len(values) == 0 {
+		return 0, nil
+	}
+	args := make([]any, 0, len(values)+1)
+	for _, v := range values {
+		args = append(args, v)
+	}
+	args = append(args, exclude.String())
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	query := `SELECT COUNT(*) FROM videos WHERE ` + column + ` IN (` + placeholders + `) AND id != ?`
+	var count int
+	err := c.db.QueryRow(query, args...).Scan(&count)
+	return count, err
+}
+
+// SoftDeleteVideo marks a video as deleted. It's hidden from listings but
+// can be restored until it's purged.
+func (c Client) SoftDeleteVideo(id uuid.UUID) error {
+	_, err := c.db.Exec(`UPDATE videos SET deleted_at = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, time.Now().UTC(), id)
+	return err
+}
+
+// RestoreVideo clears the deletion mark of a soft-deleted video.
+func (c Client) RestoreVideo(id uuid.UUID) error {
+	_, err := c.db.Exec(`UPDATE videos SET deleted_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, id)
+	return err
+}
+
+// GetVideosDeletedBefore returns the soft-deleted videos that were deleted
+// before cutoff.
+func (c Client) GetVideosDeletedBefore(cutoff time.Time) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE deleted_at IS NOT NULL AND deleted_at < ?
+	`
+
+	rows, err := c.db.Query(query, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	if _, err := c.db.Exec(`DELETE FROM video_tags WHERE video_id = ?`, id.String()); err != nil {
+		return err
+	}
+	if _, err := c.db.Exec(`DELETE FROM share_tokens WHERE video_id = ?`, id.String()); err != nil {
+		return err
+	}
+	if _, err := c.db.Exec(`DELETE FROM idempotency_keys WHERE video_id = ?`, id.String()); err != nil {
+		return err
+	}
+
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err := c.db.Exec(query, id.String())
 	return err
 }
+
+// VideoObjectURLs are the stored object references of a video.
+type VideoObjectURLs struct {
+	ID       uuid.UUID
+	VideoURL *string
+	HLSURL   *string
+}
+
+// GetVideoObjectURLs returns the stored object references of every video,
+// including ones in the trash.
+func (c Client) GetVideoObjectURLs() ([]VideoObjectURLs, error) {
+	rows, err := c.db.Query(`SELECT id, video_url, hls_url FROM videos`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var videos []VideoObjectURLs
+	for rows.Next() {
+		var v VideoObjectURLs
+		if err := rows.Scan(&v.ID, &v.VideoURL, &v.HLSURL); err != nil {
+			return nil, err
+		}
+		videos = append(videos, v)
+	}
+	return videos, rows.Err()
+}
+
+// RewriteVideoURLs passes every stored video_url and hls_url through rewrite
+// and saves the values that change, all in one transaction. It returns the
+// number of videos updated.
+func (c Client) RewriteVideoURLs(rewrite func(string) (string, error)) (int, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+	SELECT id, video_url, hls_url
+	FROM videos
+	WHERE video_url IS NOT NULL OR hls_url IS NOT NULL
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	type videoURLs struct {
+		id       uuid.UUID
+		videoURL *string
+		hlsURL   *string
+	}
+	var videos []videoURLs
+	for rows.Next() {
+		var v videoURLs
+		if err := rows.Scan(&v.id, &v.videoURL, &v.hlsURL); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		videos = append(videos, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, v := range videos {
+		changed := false
+		for _, u := range []*string{v.videoURL, v.hlsURL} {
+			if u == nil {
+				continue
+			}
+			rewritten, err := rewrite(*u)
+			if err != nil {
+				return 0, fmt.Errorf("video %s: %w", v.id, err)
+			}
+			if rewritten != *u {
+				*u = rewritten
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		_, err := tx.Exec(`
+		UPDATE videos
+		SET video_url = ?, hls_url = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+		`, v.videoURL, v.hlsURL, v.id)
+		if err != nil {
+			return 0, err
+		}
+		updated++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return updated, nil
+}
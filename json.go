@@ -2,16 +2,18 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 )
 
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
+	logger := requestLogger(w)
 	if err != nil {
-		log.Println(err)
+		logger.Info("request error", "error", err.Error(), "status", code)
 	}
 	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+		logger.Error("responding with 5XX error", "message", msg)
 	}
 	type errorResponse struct {
 		Error string `json:"error"`
@@ -25,10 +27,32 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		requestLogger(w).Error("couldn't marshal JSON", "error", err.Error())
 		w.WriteHeader(500)
 		return
 	}
 	w.WriteHeader(code)
 	w.Write(dat)
 }
+
+// respondWithDecodeError reports a JSON body that couldn't be decoded, using
+// 413 when it was cut off by http.MaxBytesReader.
+func respondWithDecodeError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the %d byte limit", maxBytesErr.Limit), err)
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+}
+
+// respondWithMultipartError reports a failed ParseMultipartForm, using 413
+// when the body was cut off by http.MaxBytesReader.
+func respondWithMultipartError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds the %d byte limit", maxBytesErr.Limit), err)
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, "Unable to parse multipart form", err)
+}
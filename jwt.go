@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// makeJWT creates an access token for user with the configured claims.
+func (cfg *apiConfig) makeJWT(user database.User, expiresIn time.Duration) (string, error) {
+	return auth.MakeJWTWithClaims(user.ID, user.Role, cfg.jwtSecret, expiresIn, cfg.jwtClaims)
+}
+
+// errTokenRevoked is returned by validateJWT for a token that was logged out.
+var errTokenRevoked = errors.New("token has been revoked")
+
+// validateJWT checks an access token, including the configured issuer and
+// audience and that it hasn't been logged out, and returns the user it was
+// made for.
+func (cfg *apiConfig) validateJWT(token string) (uuid.UUID, error) {
+	parsed, err := cfg.parseJWT(token)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return parsed.UserID, nil
+}
+
+// parseJWT is validateJWT for handlers that need more than the user ID.
+func (cfg *apiConfig) parseJWT(token string) (auth.Token, error) {
+	parsed, err := auth.ParseJWT(token, cfg.jwtSecret, cfg.jwtClaims)
+	if err != nil {
+		return auth.Token{}, err
+	}
+	if parsed.ID != "" {
+		revoked, err := cfg.db.IsTokenRevoked(parsed.ID)
+		if err != nil {
+			return auth.Token{}, err
+		}
+		if revoked {
+			return auth.Token{}, errTokenRevoked
+		}
+	}
+	return parsed, nil
+}
+
+// errInvalidAPIKey is returned by authenticate for an unknown or revoked key.
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// authenticate accepts either an API key in the X-API-Key header or a bearer
+// JWT. API keys act as their user but never with the admin role.
+func (cfg *apiConfig) authenticate(r *http.Request) (auth.Token, error) {
+	if apiKey := r.Header.Get(auth.APIKeyHeader); apiKey != "" {
+		key, err := cfg.db.GetAPIKeyByHash(auth.HashAPIKey(apiKey))
+		if err != nil {
+			return auth.Token{}, err
+		}
+		if key.ID == uuid.Nil || key.RevokedAt != nil {
+			return auth.Token{}, errInvalidAPIKey
+		}
+		if err := cfg.db.TouchAPIKey(key.ID); err != nil {
+			slog.ErrorContext(r.Context(), "couldn't record API key use", "api_key_id", key.ID, "error", err.Error())
+		}
+		return auth.Token{UserID: key.UserID}, nil
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return auth.Token{}, err
+	}
+	return cfg.parseJWT(token)
+}
+
+// isAdmin reports whether the token was made for an admin.
+func isAdmin(claims auth.Token) bool {
+	return claims.Role == database.RoleAdmin
+}
+
+// canManageVideo reports whether the token's user may change video: its
+// owner or an admin. Nobody can manage the zero Video that GetVideo returns
+// for a missing ID; handlers respond 404 for that before asking.
+func canManageVideo(claims auth.Token, video database.Video) bool {
+	if video.ID == uuid.Nil {
+		return false
+	}
+	return video.UserID == claims.UserID || isAdmin(claims)
+}
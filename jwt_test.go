@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestCanManageVideo(t *testing.T) {
+	owner, other := uuid.New(), uuid.New()
+	video := database.Video{ID: uuid.New()}
+	video.UserID = owner
+
+	tests := []struct {
+		name   string
+		claims auth.Token
+		video  database.Video
+		want   bool
+	}{
+		{"owner", auth.Token{UserID: owner}, video, true},
+		{"other user", auth.Token{UserID: other}, video, false},
+		{"admin", auth.Token{UserID: other, Role: database.RoleAdmin}, video, true},
+		{"admin, missing video", auth.Token{UserID: other, Role: database.RoleAdmin}, database.Video{}, false},
+		{"missing video", auth.Token{UserID: uuid.Nil}, database.Video{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canManageVideo(tt.claims, tt.video); got != tt.want {
+				t.Errorf("canManageVideo = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Admins pass the ownership check for any video, so handlers have to catch
+// missing videos before asking it.
+func TestUploadHandlersMissingVideoAsAdmin(t *testing.T) {
+	cfg := newTestConfig(t)
+	admin, _ := createTestUser(t, cfg, "admin@example.com")
+	token := adminToken(t, cfg, admin.ID)
+	missing := uuid.New()
+
+	var thumbnail bytes.Buffer
+	png.Encode(&thumbnail, image.NewRGBA(image.Rect(0, 0, 16, 9)))
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		req     func() *http.Request
+	}{
+		{"upload video", cfg.handlerUploadVideo, func() *http.Request {
+			return newUploadRequest(t, missing, token, "video/mp4", testMP4(0))
+		}},
+		{"upload thumbnail", cfg.handlerUploadThumbnail, func() *http.Request {
+			return newMultipartRequest(t, "/api/thumbnail_upload/"+missing.String(), token, "thumbnail", "image/png", thumbnail.Bytes())
+		}},
+		{"import", cfg.handlerImportVideo, func() *http.Request {
+			return newJSONRequest(t, http.MethodPost, "/api/videos/"+missing.String()+"/import", token, map[string]string{"url": "https://example.com/video.mp4"})
+		}},
+		{"finalize", cfg.handlerFinalizeUpload, func() *http.Request {
+			return newJSONRequest(t, http.MethodPost, "/api/videos/"+missing.String()+"/finalize", token, nil)
+		}},
+		{"tus create", cfg.handlerTusCreate, func() *http.Request {
+			req := newJSONRequest(t, http.MethodPost, "/api/videos/"+missing.String()+"/tus", token, nil)
+			req.Header.Set("Tus-Resumable", "1.0.0")
+			req.Header.Set("Upload-Length", "100")
+			return req
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req()
+			req.SetPathValue("videoID", missing.String())
+			rec := httptest.NewRecorder()
+			tt.handler(rec, req)
+			decodeResponse(t, rec, http.StatusNotFound, nil)
+		})
+	}
+}
+
+func TestHandlersAdminManagesOthersVideos(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, _ := createTestUser(t, cfg, "owner@example.com")
+	regular, regularToken := createTestUser(t, cfg, "regular@example.com")
+	admin, _ := createTestUser(t, cfg, "admin@example.com")
+	tokens := map[string]string{
+		"regular user": regularToken,
+		"admin":        adminToken(t, cfg, admin.ID),
+		// The role comes from the token, so a regular user can't claim it
+		"regular user claiming admin": func() string {
+			token, err := auth.MakeJWTWithClaims(regular.ID, database.RoleAdmin, "other-secret", time.Hour, cfg.jwtClaims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}(),
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		req     func(videoID uuid.UUID, token string) *http.Request
+		want    int
+	}{
+		{"upload thumbnail", cfg.handlerUploadThumbnail, func(videoID uuid.UUID, token string) *http.Request {
+			return newThumbnailRequest(t, videoID, token, "image/png", testImage(t, 64, 36, "image/png"))
+		}, http.StatusOK},
+		{"upload video", cfg.handlerUploadVideo, func(videoID uuid.UUID, token string) *http.Request {
+			return newUploadRequest(t, videoID, token, "video/mp4", testMP4(0))
+		}, http.StatusAccepted},
+		{"delete", cfg.handlerVideoMetaDelete, func(videoID uuid.UUID, token string) *http.Request {
+			return newVideoRequest(t, http.MethodDelete, videoID, "", token, nil)
+		}, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		for who, token := range tokens {
+			t.Run(tt.name+" as "+who, func(t *testing.T) {
+				video := createTestVideo(t, cfg, owner.ID, tt.name)
+				rec := httptest.NewRecorder()
+				tt.handler(rec, tt.req(video.ID, token))
+
+				want := tt.want
+				switch who {
+				case "regular user":
+					want = http.StatusForbidden
+				case "regular user claiming admin":
+					// The forged token doesn't verify at all
+					want = http.StatusUnauthorized
+				}
+				if rec.Code != want {
+					t.Fatalf("status = %d, want %d; body: %s", rec.Code, want, rec.Body)
+				}
+				// Let the admin's upload finish before the pool shuts down
+				if rec.Code == http.StatusAccepted {
+					waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+				}
+				// The video still belongs to its owner either way
+				if got, err := cfg.db.GetVideo(video.ID); err == nil && got.ID != uuid.Nil && got.UserID != owner.ID {
+					t.Errorf("video now belongs to %s, want %s", got.UserID, owner.ID)
+				}
+			})
+		}
+	}
+}
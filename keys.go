@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultKeyTemplate spreads videos out by upload date under each aspect
+// ratio prefix, since S3 throttles requests per prefix.
+const defaultKeyTemplate = "{aspect}/{yyyy}/{mm}/{dd}/{rand}.{ext}"
+
+var keyPlaceholderRe = regexp.MustCompile(`\{[^{}]*\}`)
+
+// keyPlaceholders are the placeholders a key template can use.
+var keyPlaceholders = map[string]bool{
+	"{aspect}":  true,
+	"{yyyy}":    true,
+	"{mm}":      true,
+	"{dd}":      true,
+	"{userID}":  true,
+	"{videoID}": true,
+	"{rand}":    true,
+	"{ext}":     true,
+}
+
+// keyTemplate lays out the object keys videos are stored under, e.g.
+// "{aspect}/{yyyy}/{mm}/{userID}/{rand}.{ext}". Dates are in UTC.
+type keyTemplate string
+
+// keyVars are the values a keyTemplate is expanded with.
+type keyVars struct {
+	aspect  string
+	userID  uuid.UUID
+	videoID uuid.UUID
+	time    time.Time
+	rand    string
+	// ext is the file extension without the dot
+	ext string
+}
+
+// parseKeyTemplate checks that a template only uses known placeholders,
+// includes {rand} so keys are unique, and expands to a clean relative path.
+func parseKeyTemplate(raw string) (keyTemplate, error) {
+	for _, placeholder := range keyPlaceholderRe.FindAllString(raw, -1) {
+		if !keyPlaceholders[placeholder] {
+			return "", fmt.Errorf("unknown placeholder %s", placeholder)
+		}
+	}
+	if strings.ContainsAny(keyPlaceholderRe.ReplaceAllString(raw, ""), "{}") {
+		return "", errors.New("unbalanced braces")
+	}
+	if !strings.Contains(raw, "{rand}") {
+		return "", errors.New("template must include {rand}")
+	}
+
+	t := keyTemplate(raw)
+	sample := t.expand(keyVars{
+		aspect:  "landscape",
+		userID:  uuid.New(),
+		videoID: uuid.New(),
+		time:    time.Now(),
+		rand:    "rand",
+		ext:     "mp4",
+	})
+	if sample != path.Clean(sample) || strings.HasPrefix(sample, "/") || strings.HasPrefix(sample, "../") {
+		return "", fmt.Errorf("template expands to %q, which isn't a clean relative path", sample)
+	}
+	return t, nil
+}
+
+func (t keyTemplate) expand(vars keyVars) string {
+	utc := vars.time.UTC()
+	return keyPlaceholderRe.ReplaceAllStringFunc(string(t), func(placeholder string) string {
+		switch placeholder {
+		case "{aspect}":
+			return vars.aspect
+		case "{yyyy}":
+			return utc.Format("2006")
+		case "{mm}":
+			return utc.Format("01")
+		case "{dd}":
+			return utc.Format("02")
+		case "{userID}":
+			return vars.userID.String()
+		case "{videoID}":
+			return vars.videoID.String()
+		case "{rand}":
+			return vars.rand
+		case "{ext}":
+			return vars.ext
+		}
+		return placeholder
+	})
+}
+
+// listPrefixes returns the key prefixes every expansion of the template
+// falls under, for the orphan cleanup to list. A template that starts with
+// anything other than {aspect} or fixed text can put keys anywhere, so it
+// gets the empty prefix; see hasFixedPrefix.
+func (t keyTemplate) listPrefixes() []string {
+	raw := string(t)
+	first := keyPlaceholderRe.FindStringIndex(raw)
+	literal := raw[:first[0]]
+	literal = literal[:strings.LastIndex(literal, "/")+1]
+
+	if literal != raw[:first[0]] || raw[first[0]:first[1]] != "{aspect}" || !strings.HasPrefix(raw[first[1]:], "/") {
+		return []string{literal}
+	}
+	var prefixes []string
+	for _, prefix := range aspectRatioPrefixes {
+		prefixes = append(prefixes, literal+prefix+"/")
+	}
+	return prefixes
+}
+
+// hasFixedPrefix reports whether the template keeps its keys under a fixed
+// directory. Without one the orphan cleanup would have to list, and could
+// delete from, the whole bucket.
+func (t keyTemplate) hasFixedPrefix() bool {
+	return !slices.Contains(t.listPrefixes(), "")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// existsBackend reports the keys in taken as existing and records every
+// key it's asked about.
+type existsBackend struct {
+	*memBackend
+	taken   map[string]bool
+	checked []string
+}
+
+func (b *existsBackend) Exists(ctx context.Context, key string) (bool, error) {
+	b.checked = append(b.checked, key)
+	return b.taken[key], nil
+}
+
+// sequentialKeys returns a newKey func that hands out keys in order.
+func sequentialKeys(keys ...string) func() (string, error) {
+	return func() (string, error) {
+		if len(keys) == 0 {
+			return "", errors.New("out of keys")
+		}
+		key := keys[0]
+		keys = keys[1:]
+		return key, nil
+	}
+}
+
+func TestGetUniqueKey(t *testing.T) {
+	storage := &existsBackend{memBackend: newMemBackend(), taken: map[string]bool{"first": true}}
+
+	key, err := getUniqueKey(t.Context(), storage, sequentialKeys("first", "second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "second" {
+		t.Errorf("key = %q, want second", key)
+	}
+	if len(storage.checked) != 2 {
+		t.Errorf("checked %v, want both keys", storage.checked)
+	}
+}
+
+func TestGetUniqueKeyGivesUp(t *testing.T) {
+	storage := &existsBackend{memBackend: newMemBackend(), taken: map[string]bool{"a": true, "b": true, "c": true}}
+
+	if _, err := getUniqueKey(t.Context(), storage, sequentialKeys("a", "b", "c", "d")); err == nil {
+		t.Fatal("expected an error once every attempt collides")
+	}
+	if len(storage.checked) != uniqueKeyAttempts {
+		t.Errorf("checked %d keys, want %d", len(storage.checked), uniqueKeyAttempts)
+	}
+}
+
+func TestGetUniqueKeyMemBackend(t *testing.T) {
+	storage := newMemBackend()
+	if err := storage.Put(t.Context(), "taken.mp4", strings.NewReader("x"), putOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := getUniqueKey(t.Context(), storage, sequentialKeys("taken.mp4", "free.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "free.mp4" {
+		t.Errorf("key = %q, want free.mp4", key)
+	}
+}
+
+func TestKeyTemplateExpand(t *testing.T) {
+	vars := keyVars{
+		aspect:  "portrait",
+		userID:  uuid.MustParse("11111111-1111-1111-1111-111111111111"),
+		videoID: uuid.MustParse("22222222-2222-2222-2222-222222222222"),
+		// Already the 4th in UTC
+		time: time.Date(2024, 3, 3, 22, 30, 0, 0, time.FixedZone("EST", -5*60*60)),
+		rand: "abc",
+		ext:  "mp4",
+	}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{defaultKeyTemplate, "portrait/2024/03/04/abc.mp4"},
+		{"{rand}.{ext}", "abc.mp4"},
+		{"videos/{userID}/{videoID}-{rand}.{ext}", "videos/11111111-1111-1111-1111-111111111111/22222222-2222-2222-2222-222222222222-abc.mp4"},
+		{"{aspect}/{yyyy}-{mm}/{rand}", "portrait/2024-03/abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, err := parseKeyTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tmpl.expand(vars); got != tt.want {
+				t.Errorf("expand = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKeyTemplateRejects(t *testing.T) {
+	tests := []string{
+		"{aspect}/{name}.{ext}",
+		"{aspect}/{rand}.{ext",
+		"{aspect}/{rand}}.{ext}",
+		"{aspect}/{videoID}.{ext}",
+		"/{aspect}/{rand}.{ext}",
+		"../{rand}.{ext}",
+		"{aspect}//{rand}.{ext}",
+	}
+	for _, raw := range tests {
+		t.Run(raw, func(t *testing.T) {
+			if _, err := parseKeyTemplate(raw); err == nil {
+				t.Errorf("parseKeyTemplate(%q) succeeded, want an error", raw)
+			}
+		})
+	}
+}
+
+func TestKeyTemplateListPrefixes(t *testing.T) {
+	var aspectPrefixes []string
+	for _, prefix := range aspectRatioPrefixes {
+		aspectPrefixes = append(aspectPrefixes, "media/"+prefix+"/")
+	}
+	slices.Sort(aspectPrefixes)
+
+	tests := []struct {
+		template string
+		want     []string
+	}{
+		{"media/{aspect}/{rand}.{ext}", aspectPrefixes},
+		{"media/{userID}/{rand}.{ext}", []string{"media/"}},
+		{"media/v-{rand}.{ext}", []string{"media/"}},
+		{"{yyyy}/{rand}.{ext}", []string{""}},
+		{"media/{aspect}-{rand}.{ext}", []string{"media/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, err := parseKeyTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tmpl.listPrefixes()
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("listPrefixes = %q, want %q", got, tt.want)
+			}
+			if fixed, want := tmpl.hasFixedPrefix(), !slices.Contains(tt.want, ""); fixed != want {
+				t.Errorf("hasFixedPrefix = %v, want %v", fixed, want)
+			}
+		})
+	}
+}
+
+func TestUploadedVideoKeyHasDate(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Dated")
+
+	before := time.Now().UTC().Format("2006/01/02")
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	after := time.Now().UTC().Format("2006/01/02")
+
+	ref, err := parseStorageRef(*ready.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ref.Key
+	// The upload may straddle midnight
+	if !strings.HasPrefix(key, "landscape/"+before+"/") && !strings.HasPrefix(key, "landscape/"+after+"/") {
+		t.Errorf("key = %q, want it under landscape/%s/", key, before)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// videoLocks keeps track of which videos have an upload in progress, so two
+// uploads to the same video can't interleave. A lock only covers a request
+// up to queueing its processing job; handlers refuse videos that are still
+// processing to cover the rest.
+type videoLocks struct {
+	mu     sync.Mutex
+	locked map[uuid.UUID]bool
+}
+
+func newVideoLocks() *videoLocks {
+	return &videoLocks{locked: map[uuid.UUID]bool{}}
+}
+
+// tryLock locks the video and returns true, or returns false if it's
+// already locked.
+func (l *videoLocks) tryLock(videoID uuid.UUID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locked[videoID] {
+		return false
+	}
+	l.locked[videoID] = true
+	return true
+}
+
+func (l *videoLocks) unlock(videoID uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.locked, videoID)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID requestLogMiddleware gave the request,
+// or "" outside of a request.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request ID to every record logged with a request's
+// context, e.g. through slog.InfoContext(r.Context(), ...).
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// newLogger returns a JSON logger. Made the default, it also formats
+// everything logged with the log package.
+func newLogger(w io.Writer) *slog.Logger {
+	return slog.New(contextHandler{slog.NewJSONHandler(w, nil)})
+}
+
+// loggingResponseWriter records the status code for the request log, and
+// carries the request ID so respondWithError can log it.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status    int
+	requestID string
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush server-sent events.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestLogger returns the default logger, tagged with the request ID when w
+// belongs to a request seen by requestLogMiddleware.
+func requestLogger(w http.ResponseWriter) *slog.Logger {
+	if lw, ok := w.(*loggingResponseWriter); ok {
+		return slog.Default().With("request_id", lw.requestID)
+	}
+	return slog.Default()
+}
+
+// requestLogMiddleware gives every request an ID, returned in the
+// X-Request-ID header, and logs each request once it's been served.
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := uuid.NewString()
+		w.Header().Set("X-Request-ID", requestID)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, requestID)
+		r = r.WithContext(ctx)
+		lw := &loggingResponseWriter{ResponseWriter: w, requestID: requestID}
+		next.ServeHTTP(lw, r)
+
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		slog.InfoContext(ctx, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestLogMiddleware(t *testing.T) {
+	logs := captureLogs(t)
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+	handler := requestLogMiddleware(http.HandlerFunc(cfg.handlerUploadThumbnail))
+
+	// An image that can't be decoded logs from the handler and from
+	// respondWithError
+	data := testImage(t, 64, 64, "image/png")
+	req := newThumbnailRequest(t, video.ID, token, "image/png", data[:len(data)/2])
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+
+	requestID := rec.Header().Get("X-Request-ID")
+	if requestID == "" {
+		t.Fatal("no X-Request-ID header")
+	}
+	messages := map[string]map[string]any{}
+	for _, record := range logs.records(t) {
+		if record["request_id"] == nil {
+			continue
+		}
+		if record["request_id"] != requestID {
+			t.Errorf("%q logged with request_id %v, want %q", record["msg"], record["request_id"], requestID)
+		}
+		messages[record["msg"].(string)] = record
+	}
+	for _, msg := range []string{"uploading thumbnail", "request error", "request"} {
+		if messages[msg] == nil {
+			t.Errorf("%q wasn't logged with the request ID", msg)
+		}
+	}
+
+	if logged := messages["request"]; logged != nil {
+		if logged["method"] != http.MethodPost || logged["path"] != req.URL.Path {
+			t.Errorf("request logged as %v %v, want POST %s", logged["method"], logged["path"], req.URL.Path)
+		}
+		if logged["status"] != float64(http.StatusBadRequest) {
+			t.Errorf("logged status = %v, want %d", logged["status"], http.StatusBadRequest)
+		}
+		if _, ok := logged["duration_ms"].(float64); !ok {
+			t.Errorf("logged duration_ms = %v", logged["duration_ms"])
+		}
+	}
+
+	// Each request gets its own ID
+	rec2 := httptest.NewRecorder()
+	handler.ServeHTTP(rec2, newThumbnailRequest(t, video.ID, token, "image/png", nil))
+	if id := rec2.Header().Get("X-Request-ID"); id == "" || id == requestID {
+		t.Errorf("second request ID = %q, want a new one", id)
+	}
+}
+
+func TestRequestLogMiddlewareDefaultStatus(t *testing.T) {
+	logs := captureLogs(t)
+	handler := requestLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	records := logs.records(t)
+	if len(records) != 1 || records[0]["status"] != float64(http.StatusOK) {
+		t.Errorf("logged %v, want one request with status 200", records)
+	}
+}
@@ -1,10 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 
 	"github.com/joho/godotenv"
@@ -12,15 +24,81 @@ import (
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
+	db        database.Client
+	jwtSecret string
+	// jwtClaims are the optional issuer and audience checked on tokens
+	jwtClaims        auth.Claims
 	platform         string
 	filepathRoot     string
 	assetsRoot       string
+	storage          StorageBackend
 	s3Bucket         string
 	s3Region         string
 	s3CfDistribution string
 	port             string
+	// publicBaseURL is where clients reach the server, used in embed links
+	// and asset URLs
+	publicBaseURL string
+	tempDir       string
+	ffmpegPath    string
+	ffprobePath   string
+	ffmpegTimeout time.Duration
+	// codecPolicy decides what happens to MP4s that aren't H.264
+	codecPolicy codecPolicy
+	// hlsSegmentSeconds is the target HLS segment length; 0 disables HLS
+	hlsSegmentSeconds int
+	tusUploads        *tusStore
+	// staleTempFileAge is how old a temp file nothing claims has to be
+	// before it's removed; 0 keeps them
+	staleTempFileAge time.Duration
+	// keyTemplate lays out the keys videos are stored under
+	keyTemplate keyTemplate
+	// uploadLocks stops two uploads to the same video running at once
+	uploadLocks      *videoLocks
+	presignExpiry    time.Duration
+	presignMaxExpiry time.Duration
+	presignCache     *presignCache
+	// cloudFront signs video URLs for the CDN when a key pair is configured;
+	// otherwise the storage backend presigns them
+	cloudFront *cloudFrontSigner
+	// Request body limits for uploads, and for every other route
+	maxVideoUploadBytes     int64
+	maxThumbnailUploadBytes int64
+	maxJSONBodyBytes        int64
+	// maxDurationSeconds caps video length; 0 means no limit
+	maxDurationSeconds int
+	// storageQuotaBytes is the default per-user quota; 0 means unlimited.
+	// Users can have their own quota in the database.
+	storageQuotaBytes int64
+	// dedupeUploads points re-uploads of a file the user already has at the
+	// existing object instead of processing and storing it again
+	dedupeUploads bool
+	// trashRetention is how long deleted videos can be restored before
+	// they're purged
+	trashRetention time.Duration
+	// Share tokens last shareTokenExpiry unless the owner asks for
+	// something else, up to shareTokenMaxExpiry
+	shareTokenExpiry    time.Duration
+	shareTokenMaxExpiry time.Duration
+	// views de-duplicates view counts per viewer
+	views *viewTracker
+	// idempotencyKeyTTL is how long a retry with the same Idempotency-Key
+	// gets the original result
+	idempotencyKeyTTL time.Duration
+	// maxPageSize caps how many videos a list request returns
+	maxPageSize   int
+	orphanCleanup orphanCleanupConfig
+	processing    *ProcessorPool
+	// webhook is nil unless WEBHOOK_URL is set
+	webhook *webhookNotifier
+	// importClient fetches videos from remote URLs and refuses to connect
+	// to internal addresses
+	importClient *http.Client
+	// uploadLimiter rate limits uploads per user; nil means no limit
+	uploadLimiter *userRateLimiter
+	// shuttingDown is closed once the server starts shutting down, so
+	// long-lived streams can end instead of holding it up
+	shuttingDown chan struct{}
 }
 
 type thumbnail struct {
@@ -30,6 +108,7 @@ type thumbnail struct {
 
 func main() {
 	godotenv.Load(".env")
+	slog.SetDefault(newLogger(os.Stdout))
 
 	pathToDB := os.Getenv("DB_PATH")
 	if pathToDB == "" {
@@ -41,11 +120,25 @@ func main() {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate-video-urls" {
+		if err := migrateVideoURLs(db); err != nil {
+			log.Fatalf("Couldn't migrate video URLs: %v", err)
+		}
+		return
+	}
+
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
 		log.Fatal("JWT_SECRET environment variable is not set")
 	}
 
+	// Unset, tokens are issued by and checked for "tubely-access" as before
+	// and the audience isn't checked
+	jwtClaims := auth.Claims{
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Audience: os.Getenv("JWT_AUDIENCE"),
+	}
+
 	platform := os.Getenv("PLATFORM")
 	if platform == "" {
 		log.Fatal("PLATFORM environment variable is not set")
@@ -81,16 +174,165 @@ func main() {
 		log.Fatal("PORT environment variable is not set")
 	}
 
+	var storage StorageBackend
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "s3":
+		awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+		if err != nil {
+			log.Fatalf("Couldn't load AWS config: %v", err)
+		}
+		multipart := s3MultipartConfig{
+			threshold:   int64(envInt("S3_MULTIPART_THRESHOLD_MB", 100)) << 20,
+			partSize:    int64(envInt("S3_PART_SIZE_MB", 16)) << 20,
+			concurrency: envInt("S3_UPLOAD_CONCURRENCY", 4),
+		}
+		if multipart.partSize < minPartSize {
+			log.Fatalf("S3_PART_SIZE_MB must be at least %d", minPartSize>>20)
+		}
+		if multipart.concurrency < 1 {
+			log.Fatal("S3_UPLOAD_CONCURRENCY must be at least 1")
+		}
+		encryption, err := parseS3EncryptionConfig(os.Getenv("S3_SSE"), os.Getenv("S3_SSE_KMS_KEY_ID"))
+		if err != nil {
+			log.Fatalf("Invalid S3 encryption config: %v", err)
+		}
+		// A custom endpoint points the client at an S3-compatible store such
+		// as MinIO or LocalStack, which usually need path-style addressing
+		endpoint := os.Getenv("S3_ENDPOINT")
+		usePathStyle := os.Getenv("S3_USE_PATH_STYLE") == "true"
+		client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+			if endpoint != "" {
+				o.BaseEndpoint = aws.String(endpoint)
+			}
+			o.UsePathStyle = usePathStyle
+		})
+		storage = newS3Backend(client, s3Bucket, multipart, encryption)
+	case "fs":
+		storageRoot := os.Getenv("STORAGE_ROOT")
+		if storageRoot == "" {
+			storageRoot = "./storage"
+		}
+		storage, err = newFSBackend(storageRoot, "http://localhost:"+port+"/storage")
+		if err != nil {
+			log.Fatalf("Couldn't create storage directory: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q, expected \"s3\" or \"fs\"", backend)
+	}
+
+	publicBaseURL := strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/")
+	if publicBaseURL == "" {
+		publicBaseURL = "http://localhost:" + port
+	}
+
+	rawKeyTemplate := os.Getenv("VIDEO_KEY_TEMPLATE")
+	if rawKeyTemplate == "" {
+		rawKeyTemplate = defaultKeyTemplate
+	}
+	keyTemplate, err := parseKeyTemplate(rawKeyTemplate)
+	if err != nil {
+		log.Fatalf("Invalid VIDEO_KEY_TEMPLATE %q: %v", rawKeyTemplate, err)
+	}
+
+	tempDir := os.Getenv("TEMP_DIR")
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+
+	ffmpegPath := os.Getenv("FFMPEG_PATH")
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	if _, err := exec.LookPath(ffmpegPath); err != nil {
+		log.Fatalf("Couldn't find ffmpeg binary %q: %v", ffmpegPath, err)
+	}
+
+	ffprobePath := os.Getenv("FFPROBE_PATH")
+	if ffprobePath == "" {
+		ffprobePath = "ffprobe"
+	}
+	if _, err := exec.LookPath(ffprobePath); err != nil {
+		log.Fatalf("Couldn't find ffprobe binary %q: %v", ffprobePath, err)
+	}
+
+	ffmpegTimeout := envDuration("FFMPEG_TIMEOUT", 5*time.Minute)
+
+	codecPolicy := codecPolicy(os.Getenv("CODEC_POLICY"))
+	switch codecPolicy {
+	case "":
+		codecPolicy = codecPolicyTranscode
+	case codecPolicyTranscode, codecPolicyReject:
+	default:
+		log.Fatalf("Unknown CODEC_POLICY %q, expected \"transcode\" or \"reject\"", codecPolicy)
+	}
+	hlsSegmentSeconds := envInt("HLS_SEGMENT_SECONDS", 6)
+
+	presignExpiry := envDuration("PRESIGN_EXPIRY", time.Hour)
+	presignMaxExpiry := envDuration("PRESIGN_MAX_EXPIRY", 24*time.Hour)
+	if presignExpiry <= 0 || presignExpiry > presignMaxExpiry {
+		log.Fatal("PRESIGN_EXPIRY must be positive and no greater than PRESIGN_MAX_EXPIRY")
+	}
+
+	var cloudFront *cloudFrontSigner
+	cfKeyPairID := os.Getenv("CF_KEY_PAIR_ID")
+	cfPrivateKeyPath := os.Getenv("CF_PRIVATE_KEY_PATH")
+	if (cfKeyPairID == "") != (cfPrivateKeyPath == "") {
+		log.Fatal("CF_KEY_PAIR_ID and CF_PRIVATE_KEY_PATH must be set together")
+	}
+	if cfKeyPairID != "" {
+		cloudFront, err = newCloudFrontSigner(s3CfDistribution, cfKeyPairID, cfPrivateKeyPath)
+		if err != nil {
+			log.Fatalf("Couldn't load CloudFront private key: %v", err)
+		}
+	}
+
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		db:                      db,
+		jwtSecret:               jwtSecret,
+		jwtClaims:               jwtClaims,
+		platform:                platform,
+		filepathRoot:            filepathRoot,
+		assetsRoot:              assetsRoot,
+		storage:                 storage,
+		s3Bucket:                s3Bucket,
+		s3Region:                s3Region,
+		s3CfDistribution:        s3CfDistribution,
+		port:                    port,
+		publicBaseURL:           publicBaseURL,
+		tempDir:                 tempDir,
+		ffmpegPath:              ffmpegPath,
+		ffprobePath:             ffprobePath,
+		ffmpegTimeout:           ffmpegTimeout,
+		codecPolicy:             codecPolicy,
+		hlsSegmentSeconds:       hlsSegmentSeconds,
+		tusUploads:              newTusStore(envDuration("TUS_UPLOAD_TTL", 24*time.Hour)),
+		staleTempFileAge:        envDuration("STALE_TEMP_FILE_AGE", 24*time.Hour),
+		uploadLocks:             newVideoLocks(),
+		keyTemplate:             keyTemplate,
+		presignExpiry:           presignExpiry,
+		presignMaxExpiry:        presignMaxExpiry,
+		cloudFront:              cloudFront,
+		presignCache:            newPresignCache(envDuration("PRESIGN_CACHE_REFRESH", 5*time.Minute)),
+		maxVideoUploadBytes:     int64(envInt("MAX_VIDEO_UPLOAD_MB", 1024)) << 20,
+		maxThumbnailUploadBytes: int64(envInt("MAX_THUMBNAIL_UPLOAD_MB", 10)) << 20,
+		maxJSONBodyBytes:        int64(envInt("MAX_JSON_BODY_KB", 1024)) << 10,
+		maxDurationSeconds:      envInt("MAX_VIDEO_DURATION_SECONDS", 0),
+		storageQuotaBytes:       int64(envInt("STORAGE_QUOTA_MB", 0)) << 20,
+		dedupeUploads:           os.Getenv("DEDUPE_UPLOADS") == "true",
+		trashRetention:          envDuration("TRASH_RETENTION", 30*24*time.Hour),
+		maxPageSize:             envInt("MAX_PAGE_SIZE", 100),
+		idempotencyKeyTTL:       envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+		views:                   newViewTracker(envDuration("VIEW_DEDUPE_WINDOW", 30*time.Minute)),
+		shareTokenExpiry:        envDuration("SHARE_TOKEN_EXPIRY", 24*time.Hour),
+		shareTokenMaxExpiry:     envDuration("SHARE_TOKEN_MAX_EXPIRY", 7*24*time.Hour),
+		orphanCleanup: orphanCleanupConfig{
+			interval:    envDuration("ORPHAN_CLEANUP_INTERVAL", 24*time.Hour),
+			gracePeriod: envDuration("ORPHAN_CLEANUP_GRACE", 24*time.Hour),
+			delete:      os.Getenv("ORPHAN_CLEANUP_DELETE") == "true",
+		},
+		importClient:  newImportClient(envDuration("IMPORT_TIMEOUT", 10*time.Minute)),
+		uploadLimiter: newUserRateLimiter(float64(envInt("UPLOAD_RATE_PER_MINUTE", 0)), envInt("UPLOAD_RATE_BURST", 5)),
+		shuttingDown:  make(chan struct{}),
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -98,33 +340,152 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	err = cfg.ensureTempDir()
+	if err != nil {
+		log.Fatalf("Temp directory %s isn't usable: %v", tempDir, err)
+	}
+	cfg.cleanupTempDir(context.Background())
+
+	if cfg.maxPageSize < 1 {
+		log.Fatal("MAX_PAGE_SIZE must be at least 1")
+	}
+	if cfg.orphanCleanup.interval > 0 && !cfg.keyTemplate.hasFixedPrefix() {
+		log.Fatalf("VIDEO_KEY_TEMPLATE %q must start with a fixed directory or {aspect}/ while the orphan cleanup is on; set ORPHAN_CLEANUP_INTERVAL=0 to turn it off", keyTemplate)
+	}
+
+	processingWorkers := envInt("PROCESSING_WORKERS", 2)
+	if processingWorkers < 1 {
+		log.Fatal("PROCESSING_WORKERS must be at least 1")
+	}
+	if webhookURL := os.Getenv("WEBHOOK_URL"); webhookURL != "" {
+		webhookSecret := os.Getenv("WEBHOOK_SECRET")
+		if webhookSecret == "" {
+			log.Fatal("WEBHOOK_SECRET must be set when WEBHOOK_URL is")
+		}
+		cfg.webhook = newWebhookNotifier(webhookURL, webhookSecret)
+	}
+
+	cfg.processing = NewProcessorPool(processingWorkers, envInt("PROCESSING_QUEUE_SIZE", 64), cfg.runProcessingJob)
+	if err := cfg.resumeProcessingJobs(context.Background()); err != nil {
+		log.Fatalf("Couldn't resume processing jobs: %v", err)
+	}
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", cacheMiddleware(assetsHandler))
+	assetsHandler := http.StripPrefix("/assets", assetCacheMiddleware(assetsRoot, http.FileServer(http.Dir(assetsRoot))))
+	mux.Handle("/assets/", assetsHandler)
+
+	if fsStorage, ok := storage.(*fsBackend); ok {
+		mux.Handle("/storage/", http.StripPrefix("/storage", fsStorage.handler()))
+	}
+
+	// Every route that takes a body gets a limit: uploads their own, anything
+	// else is JSON and small
+	jsonBody := func(h http.HandlerFunc) http.Handler {
+		return bodyLimitMiddleware(cfg.maxJSONBodyBytes, h)
+	}
+
+	mux.HandleFunc("GET /healthz", cfg.handlerHealthz)
+	mux.HandleFunc("GET /readyz", cfg.handlerReadyz)
+
+	mux.Handle("POST /api/login", jsonBody(cfg.handlerLogin))
+	mux.Handle("POST /api/refresh", jsonBody(cfg.handlerRefresh))
+	mux.Handle("POST /api/revoke", jsonBody(cfg.handlerRevoke))
+	mux.Handle("POST /api/logout", jsonBody(cfg.handlerLogout))
 
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	mux.Handle("POST /api/api_keys", jsonBody(cfg.handlerAPIKeyCreate))
+	mux.HandleFunc("GET /api/api_keys", cfg.handlerAPIKeysList)
+	mux.Handle("DELETE /api/api_keys/{keyID}", jsonBody(cfg.handlerAPIKeyRevoke))
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.Handle("POST /api/users", jsonBody(cfg.handlerUsersCreate))
+	mux.HandleFunc("GET /api/users/me/usage", cfg.handlerUsersMeUsage)
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.Handle("POST /api/videos", jsonBody(cfg.handlerVideoMetaCreate))
+	mux.Handle("POST /api/thumbnail_upload/{videoID}", bodyLimitMiddleware(cfg.maxThumbnailUploadBytes, http.HandlerFunc(cfg.handlerUploadThumbnail)))
+	mux.Handle("POST /api/video_upload/{videoID}", bodyLimitMiddleware(cfg.maxVideoUploadBytes, http.HandlerFunc(cfg.handlerUploadVideo)))
+	mux.Handle("POST /api/videos/{videoID}/import", jsonBody(cfg.handlerImportVideo))
+	mux.Handle("POST /api/video_upload_url/{videoID}", jsonBody(cfg.handlerCreateVideoUploadURL))
+	mux.Handle("POST /api/video_upload_url/{videoID}/finalize", jsonBody(cfg.handlerFinalizeUpload))
+	mux.HandleFunc("OPTIONS /api/tus/", cfg.handlerTusOptions)
+	mux.Handle("POST /api/tus/{videoID}", jsonBody(cfg.handlerTusCreate))
+	mux.HandleFunc("HEAD /api/tus/uploads/{uploadID}", cfg.handlerTusHead)
+	mux.Handle("PATCH /api/tus/uploads/{uploadID}", bodyLimitMiddleware(cfg.maxVideoUploadBytes, http.HandlerFunc(cfg.handlerTusPatch)))
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerVideoProgress)
+	mux.HandleFunc("GET /api/videos/{videoID}/hls/{name}", cfg.handlerHLSPlaylist)
+	mux.Handle("POST /api/videos/{videoID}/reprocess", jsonBody(cfg.handlerVideoReprocess))
+	mux.Handle("POST /api/videos/{videoID}/thumbnail/at", jsonBody(cfg.handlerThumbnailAt))
+	mux.Handle("DELETE /api/videos/{videoID}", jsonBody(cfg.handlerVideoMetaDelete))
+	mux.Handle("POST /api/videos/{videoID}/restore", jsonBody(cfg.handlerVideoRestore))
+	mux.Handle("PUT /api/videos/{videoID}/visibility", jsonBody(cfg.handlerVideoVisibility))
+	mux.Handle("POST /api/videos/{videoID}/share", jsonBody(cfg.handlerVideoShare))
+	mux.Handle("DELETE /api/videos/{videoID}/share/{shareID}", jsonBody(cfg.handlerVideoShareRevoke))
+	mux.HandleFunc("GET /api/videos/{videoID}/tags", cfg.handlerVideoTagsList)
+	mux.Handle("PUT /api/videos/{videoID}/tags/{tag}", jsonBody(cfg.handlerVideoTagAdd))
+	mux.Handle("DELETE /api/videos/{videoID}/tags/{tag}", jsonBody(cfg.handlerVideoTagRemove))
 
-	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("GET /api/public/videos", cfg.handlerPublicVideosList)
+	mux.HandleFunc("GET /api/public/videos/{videoID}", cfg.handlerPublicVideoGet)
+	mux.HandleFunc("GET /oembed", cfg.handlerOEmbed)
+	mux.HandleFunc("GET /embed/{videoID}", cfg.handlerEmbed)
+
+	mux.Handle("POST /admin/reset", jsonBody(cfg.handlerReset))
+	mux.Handle("PUT /admin/users/{userID}/quota", jsonBody(cfg.handlerUserStorageQuota))
+
+	cors := corsConfig{
+		allowedOrigins: envList("CORS_ALLOWED_ORIGINS", nil),
+		allowedMethods: envList("CORS_ALLOWED_METHODS", []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}),
+		allowedHeaders: envList("CORS_ALLOWED_HEADERS", []string{"Authorization", "Content-Type", auth.APIKeyHeader, contentSHA256Header, idempotencyKeyHeader, "Upload-Length", "Upload-Offset", "Upload-Metadata", "Tus-Resumable"}),
+	}
 
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: requestLogMiddleware(recoverMiddleware(corsMiddleware(cors, mux))),
+	}
+	srv.RegisterOnShutdown(func() { close(cfg.shuttingDown) })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go runEvery(ctx, time.Hour, cfg.purgeDeletedVideos)
+	go runEvery(ctx, tempDirCleanupInterval, cfg.cleanupTempDir)
+	if cfg.orphanCleanup.interval > 0 {
+		go runEvery(ctx, cfg.orphanCleanup.interval, cfg.cleanupOrphanedObjects)
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		slog.Info("serving", "url", "http://localhost:"+port+"/app/")
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+
+	cfg.shutdown(srv, envDuration("SHUTDOWN_TIMEOUT", 30*time.Second), envDuration("PROCESSING_SHUTDOWN_GRACE", 30*time.Second))
+}
+
+// shutdown stops srv taking requests, giving in-flight ones requestTimeout
+// to finish, then gives video processing processingGrace to do the same.
+func (cfg *apiConfig) shutdown(srv *http.Server, requestTimeout, processingGrace time.Duration) {
+	// Stop taking requests and let in-flight ones, like uploads, finish first
+	// since they may still queue videos for processing
+	slog.Info("shutting down, waiting for in-flight requests to finish")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("requests didn't finish in time, closing connections", "error", err.Error())
+		srv.Close()
+	}
+
+	// Jobs that don't finish within the grace period stay saved and are
+	// resumed on the next start
+	slog.Info("waiting for video processing to finish")
+	graceCtx, cancel := context.WithTimeout(context.Background(), processingGrace)
+	defer cancel()
+	if requeued := cfg.processing.Shutdown(graceCtx); len(requeued) > 0 {
+		slog.Info("processing jobs will resume on the next start", "count", len(requeued))
+	}
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// startServer serves handler on a local port the way main does, returning
+// the server and its base URL.
+func startServer(t *testing.T, cfg *apiConfig, handler http.Handler) (*http.Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	srv.RegisterOnShutdown(func() { close(cfg.shuttingDown) })
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return srv, "http://" + ln.Addr().String()
+}
+
+type getResult struct {
+	body string
+	err  error
+}
+
+// getAsync requests url in the background on its own connection.
+func getAsync(url string) <-chan getResult {
+	result := make(chan getResult, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get(url)
+		if err != nil {
+			result <- getResult{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		result <- getResult{string(body), err}
+	}()
+	return result
+}
+
+func TestShutdownDrainsRequestsAndProcessing(t *testing.T) {
+	cfg := newTestConfig(t)
+	drainProcessing(t, cfg)
+
+	jobStarted, releaseJob := make(chan struct{}), make(chan struct{})
+	jobFinished := false
+	cfg.processing = NewProcessorPool(1, 1, func(ctx context.Context, job database.ProcessingJob) error {
+		close(jobStarted)
+		<-releaseJob
+		jobFinished = true
+		return nil
+	})
+	if err := cfg.processing.Submit(database.ProcessingJob{VideoID: uuid.New()}); err != nil {
+		t.Fatal(err)
+	}
+	<-jobStarted
+
+	requestStarted, releaseRequest := make(chan struct{}), make(chan struct{})
+	srv, url := startServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requestStarted)
+		<-releaseRequest
+		io.WriteString(w, "done")
+	}))
+	slow := getAsync(url)
+	<-requestStarted
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		cfg.shutdown(srv, 5*time.Second, 5*time.Second)
+		close(shutdownDone)
+	}()
+	<-cfg.shuttingDown
+
+	// New requests are turned away while the slow one carries on
+	if result := <-getAsync(url); result.err == nil {
+		t.Error("server took a request after shutdown started")
+	}
+	select {
+	case <-shutdownDone:
+		t.Fatal("shutdown returned before the request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(releaseRequest)
+	if result := <-slow; result.err != nil || result.body != "done" {
+		t.Fatalf("slow request = %q, %v; want it to complete", result.body, result.err)
+	}
+
+	// Processing gets to finish too
+	select {
+	case <-shutdownDone:
+		t.Fatal("shutdown returned before the processing job finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(releaseJob)
+	<-shutdownDone
+	if !jobFinished {
+		t.Error("processing job didn't finish")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	requestStarted, releaseRequest := make(chan struct{}), make(chan struct{})
+	defer close(releaseRequest)
+	srv, url := startServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requestStarted)
+		<-releaseRequest
+	}))
+	stuck := getAsync(url)
+	<-requestStarted
+
+	start := time.Now()
+	cfg.shutdown(srv, 100*time.Millisecond, time.Second)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+	// The connection is closed rather than left waiting
+	if result := <-stuck; result.err == nil {
+		t.Error("stuck request succeeded, want its connection closed")
+	}
+}
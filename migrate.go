@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// normalizeVideoURL converts the storage reference formats that have been
+// written over time into a canonical "s3://bucket/key" storageRef:
+//
+//   - "bucket,key" (possibly with stray whitespace)
+//   - "s3://bucket/key"
+//   - https://bucket.s3.region.amazonaws.com/key (virtual-hosted style)
+//   - https://s3.region.amazonaws.com/bucket/key (path style)
+//
+// Other absolute URLs, e.g. CDN links, are returned unchanged since they
+// don't point into the bucket. Canonical values also come back unchanged, so
+// normalizing is idempotent.
+func normalizeVideoURL(value string) (string, error) {
+	if bucket, key, found := strings.Cut(value, ","); found && !strings.Contains(bucket, "://") {
+		value = strings.TrimSpace(bucket) + "," + strings.TrimSpace(key)
+	}
+	if ref, err := parseStorageRef(value); err == nil {
+		return ref.String(), nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" || u.Scheme == "s3" {
+		return "", fmt.Errorf("malformed storage reference %q", value)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+
+	if !strings.HasSuffix(u.Host, ".amazonaws.com") {
+		return value, nil
+	}
+	// Virtual-hosted style puts the bucket in front of ".s3"
+	if !strings.HasPrefix(u.Host, "s3.") && !strings.HasPrefix(u.Host, "s3-") {
+		bucket, _, _ := strings.Cut(u.Host, ".s3")
+		return storageRef{bucket, key}.String(), nil
+	}
+	bucket, key, found := strings.Cut(key, "/")
+	if !found {
+		return "", fmt.Errorf("malformed S3 URL %q", value)
+	}
+	return storageRef{bucket, key}.String(), nil
+}
+
+// migrateVideoURLs rewrites every stored video reference into canonical
+// form. It's run with `tubely migrate-video-urls` and is safe to re-run.
+func migrateVideoURLs(db database.Client) error {
+	updated, err := db.RewriteVideoURLs(normalizeVideoURL)
+	if err != nil {
+		return err
+	}
+	slog.Info("migrated storage references", "videos", updated)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestNormalizeVideoURL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"tubely,landscape/a.mp4", "s3://tubely/landscape/a.mp4"},
+		{" tubely , landscape/a.mp4 ", "s3://tubely/landscape/a.mp4"},
+		{"s3://tubely/landscape/a.mp4", "s3://tubely/landscape/a.mp4"},
+		{"https://tubely.s3.us-east-2.amazonaws.com/landscape/a.mp4", "s3://tubely/landscape/a.mp4"},
+		{"https://s3.us-east-2.amazonaws.com/tubely/landscape/a.mp4", "s3://tubely/landscape/a.mp4"},
+		{"https://cdn.example.com/landscape/a.mp4", "https://cdn.example.com/landscape/a.mp4"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeVideoURL(tt.value)
+		if err != nil {
+			t.Errorf("normalizeVideoURL(%q): %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeVideoURL(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "landscape/a.mp4", "tubely,", ",landscape/a.mp4", "tubely,a,b.mp4", "https://s3.us-east-2.amazonaws.com/tubely", "s3://tubely", "s3://tubely/"} {
+		if got, err := normalizeVideoURL(value); err == nil {
+			t.Errorf("normalizeVideoURL(%q) = %q, want an error", value, got)
+		}
+	}
+}
+
+// setStoredURLs writes raw storage references for a video, bypassing any
+// normalization.
+func setStoredURLs(t *testing.T, cfg *apiConfig, video database.Video, videoURL, hlsURL *string) {
+	t.Helper()
+	video.VideoURL = videoURL
+	video.HLSURL = hlsURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRewriteVideoURLs(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+
+	ptr := func(s string) *string { return &s }
+	fixtures := []struct {
+		videoURL, hlsURL *string
+		want, wantHLS    *string
+	}{
+		{ptr("tubely,landscape/a.mp4"), nil, ptr("s3://tubely/landscape/a.mp4"), nil},
+		{ptr("s3://tubely/portrait/b.mp4"), ptr("https://tubely.s3.us-east-2.amazonaws.com/portrait/hls/b/master.m3u8"), ptr("s3://tubely/portrait/b.mp4"), ptr("s3://tubely/portrait/hls/b/master.m3u8")},
+		{ptr("https://s3.us-east-2.amazonaws.com/tubely/other/c.mp4"), nil, ptr("s3://tubely/other/c.mp4"), nil},
+		{ptr("https://cdn.example.com/d.mp4"), nil, ptr("https://cdn.example.com/d.mp4"), nil},
+		{nil, nil, nil, nil},
+	}
+	var videos []database.Video
+	for _, f := range fixtures {
+		video := createTestVideo(t, cfg, user.ID, "Fixture")
+		setStoredURLs(t, cfg, video, f.videoURL, f.hlsURL)
+		videos = append(videos, video)
+	}
+
+	updated, err := cfg.db.RewriteVideoURLs(normalizeVideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 3 {
+		t.Errorf("updated %d videos, want 3", updated)
+	}
+	for i, f := range fixtures {
+		got := getTestVideo(t, cfg, videos[i].ID)
+		if !equalStrPtr(got.VideoURL, f.want) || !equalStrPtr(got.HLSURL, f.wantHLS) {
+			t.Errorf("video %d: got %v, %v; want %v, %v", i, deref(got.VideoURL), deref(got.HLSURL), deref(f.want), deref(f.wantHLS))
+		}
+	}
+
+	// Re-running the migration changes nothing
+	updated, err = cfg.db.RewriteVideoURLs(normalizeVideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 0 {
+		t.Errorf("second run updated %d videos, want 0", updated)
+	}
+}
+
+func TestRewriteVideoURLsRollsBack(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+
+	legacy := "tubely,landscape/a.mp4"
+	malformed := "landscape/b.mp4"
+	first := createTestVideo(t, cfg, user.ID, "Legacy")
+	setStoredURLs(t, cfg, first, &legacy, nil)
+	second := createTestVideo(t, cfg, user.ID, "Malformed")
+	setStoredURLs(t, cfg, second, &malformed, nil)
+
+	if _, err := cfg.db.RewriteVideoURLs(normalizeVideoURL); err == nil {
+		t.Fatal("expected an error for the malformed reference")
+	}
+	if got := getTestVideo(t, cfg, first.ID); *got.VideoURL != legacy {
+		t.Errorf("video URL = %q after a failed migration, want it left as %q", *got.VideoURL, legacy)
+	}
+}
+
+func TestParseStorageRef(t *testing.T) {
+	want := storageRef{"tubely", "landscape/a.mp4"}
+	for _, value := range []string{"s3://tubely/landscape/a.mp4", "tubely,landscape/a.mp4"} {
+		got, err := parseStorageRef(value)
+		if err != nil || got != want {
+			t.Errorf("parseStorageRef(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"", "landscape/a.mp4", "s3://tubely", "s3://tubely/", "s3:///a.mp4", "tubely,", ",a.mp4", "tubely,a,b.mp4", "a/b,c.mp4"} {
+		if got, err := parseStorageRef(value); err == nil {
+			t.Errorf("parseStorageRef(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func equalStrPtr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return "<nil>"
+	}
+	return *s
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+)
+
+// orphanCleanupConfig controls the removal of stored objects that no video
+// points at, e.g. left behind by failed uploads or crashed processing.
+type orphanCleanupConfig struct {
+	// interval between runs; 0 disables the cleanup
+	interval time.Duration
+	// gracePeriod protects recent objects, which may belong to a video
+	// that's still being processed
+	gracePeriod time.Duration
+	// delete has to be set for objects to actually be removed; otherwise
+	// they're only logged
+	delete bool
+}
+
+// cleanupOrphanedObjects deletes, or in dry-run mode logs, the objects under
+// the prefixes the app writes to that no video references.
+func (cfg *apiConfig) cleanupOrphanedObjects(ctx context.Context) {
+	lister, ok := cfg.storage.(objectLister)
+	if !ok {
+		return
+	}
+
+	videos, err := cfg.db.GetVideoObjectURLs()
+	if err != nil {
+		slog.ErrorContext(ctx, "orphan cleanup: couldn't list videos", "error", err.Error())
+		return
+	}
+	keys := map[string]bool{}
+	videoIDs := map[string]bool{}
+	// HLS segments live next to their manifest
+	var hlsDirs []string
+	for _, v := range videos {
+		if v.VideoURL != nil {
+			if ref, err := parseStorageRef(*v.VideoURL); err == nil {
+				keys[ref.Key] = true
+			}
+		}
+		if v.HLSURL != nil {
+			if ref, err := parseStorageRef(*v.HLSURL); err == nil {
+				hlsDirs = append(hlsDirs, path.Dir(ref.Key)+"/")
+			}
+		}
+		videoIDs[v.ID.String()] = true
+	}
+	referenced := func(key string) bool {
+		if keys[key] {
+			return true
+		}
+		// Direct uploads wait under their video's ID until it's finalized
+		if strings.HasPrefix(key, "uploads/") && videoIDs[path.Base(key)] {
+			return true
+		}
+		for _, dir := range hlsDirs {
+			if strings.HasPrefix(key, dir) {
+				return true
+			}
+		}
+		return false
+	}
+
+	prefixes := []string{"uploads/"}
+	if cfg.keyTemplate.hasFixedPrefix() {
+		prefixes = append(prefixes, cfg.keyTemplate.listPrefixes()...)
+	} else {
+		// Startup refuses this, but the bucket may hold objects that aren't
+		// the app's, so never go through all of it
+		slog.WarnContext(ctx, "orphan cleanup: key template has no fixed prefix, only checking uploads/", "key_template", string(cfg.keyTemplate))
+	}
+
+	cutoff := time.Now().Add(-cfg.orphanCleanup.gracePeriod)
+	found, deleted := 0, 0
+	for _, prefix := range prefixes {
+		objects, err := lister.List(ctx, prefix)
+		if err != nil {
+			slog.ErrorContext(ctx, "orphan cleanup: couldn't list objects", "prefix", prefix, "error", err.Error())
+			continue
+		}
+		for _, obj := range objects {
+			if obj.lastModified.After(cutoff) || referenced(obj.key) {
+				continue
+			}
+			found++
+			if !cfg.orphanCleanup.delete {
+				slog.InfoContext(ctx, "orphan cleanup: would delete object", "key", obj.key)
+				continue
+			}
+			if err := cfg.storage.Delete(ctx, obj.key); err != nil {
+				slog.ErrorContext(ctx, "orphan cleanup: couldn't delete object", "key", obj.key, "error", err.Error())
+				continue
+			}
+			deleted++
+		}
+	}
+	if found > 0 {
+		slog.InfoContext(ctx, "orphan cleanup finished", "found", found, "deleted", deleted)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// plantObjects stores empty objects under keys in the in-memory backend, as
+// if they'd been written at modTime.
+func plantObjects(t *testing.T, cfg *apiConfig, modTime time.Time, keys ...string) {
+	t.Helper()
+	storage, ok := cfg.storage.(*memBackend)
+	if !ok {
+		t.Fatalf("storage is %T, want *memBackend", cfg.storage)
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	for _, key := range keys {
+		storage.objects[key] = memObject{data: []byte{}, modTime: modTime}
+	}
+}
+
+func storedKeys(t *testing.T, cfg *apiConfig) []string {
+	t.Helper()
+	objects, err := cfg.storage.(objectLister).List(t.Context(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// setupOrphans plants the objects of a processed video, an HLS rendition, a
+// trashed video and a pending direct upload, plus orphans next to each, all
+// older than the grace period. It returns the keys that must survive.
+func setupOrphans(t *testing.T, cfg *apiConfig) (keep, orphans []string) {
+	t.Helper()
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	old := time.Now().Add(-2 * cfg.orphanCleanup.gracePeriod)
+
+	video := createTestVideo(t, cfg, user.ID, "Stored")
+	videoURL := cfg.objectRef("landscape/2024/01/02/video.mp4")
+	hlsURL := cfg.objectRef("landscape/hls/" + video.ID.String() + "/master.m3u8")
+	video.VideoURL = &videoURL
+	video.HLSURL = &hlsURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	trashed := createTestVideo(t, cfg, user.ID, "Trashed")
+	// Stored before the migration to s3:// references
+	trashedURL := testBucket + ",portrait/2024/01/02/trashed.mp4"
+	trashed.VideoURL = &trashedURL
+	if err := cfg.db.UpdateVideo(trashed); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.db.SoftDeleteVideo(trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := createTestVideo(t, cfg, user.ID, "Pending")
+
+	keep = []string{
+		"landscape/2024/01/02/video.mp4",
+		"landscape/hls/" + video.ID.String() + "/master.m3u8",
+		"landscape/hls/" + video.ID.String() + "/segment0.ts",
+		"portrait/2024/01/02/trashed.mp4",
+		"uploads/" + pending.ID.String(),
+	}
+	orphans = []string{
+		"landscape/2024/01/02/orphan.mp4",
+		"landscape/hls/" + uuid.NewString() + "/master.m3u8",
+		"other/2023/12/31/orphan.mp4",
+		"uploads/" + uuid.NewString(),
+	}
+	plantObjects(t, cfg, old, keep...)
+	plantObjects(t, cfg, old, orphans...)
+	return keep, orphans
+}
+
+func TestCleanupOrphanedObjects(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.orphanCleanup.delete = true
+	keep, _ := setupOrphans(t, cfg)
+
+	// Recent objects may belong to a video that's still being processed
+	recent := []string{"landscape/2024/01/02/in-progress.mp4", "uploads/" + uuid.NewString()}
+	plantObjects(t, cfg, time.Now(), recent...)
+	// Objects outside the app's prefixes aren't the cleanup's business
+	plantObjects(t, cfg, time.Now().Add(-48*time.Hour), "backups/db.sqlite")
+
+	cfg.cleanupOrphanedObjects(t.Context())
+
+	want := append(append(append([]string{}, keep...), recent...), "backups/db.sqlite")
+	slices.Sort(want)
+	if got := storedKeys(t, cfg); !slices.Equal(got, want) {
+		t.Errorf("objects after cleanup = %q, want %q", got, want)
+	}
+}
+
+func TestCleanupOrphanedObjectsDryRun(t *testing.T) {
+	cfg := newTestConfig(t)
+	keep, orphans := setupOrphans(t, cfg)
+
+	cfg.cleanupOrphanedObjects(t.Context())
+
+	want := append(append([]string{}, keep...), orphans...)
+	slices.Sort(want)
+	if got := storedKeys(t, cfg); !slices.Equal(got, want) {
+		t.Errorf("dry run changed the objects to %q, want %q", got, want)
+	}
+}
+
+// A template without a fixed prefix could put keys anywhere, so the
+// cleanup leaves the bucket alone rather than deleting what isn't the app's.
+func TestCleanupOrphanedObjectsNoFixedPrefix(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.orphanCleanup.delete = true
+	keyTemplate, err := parseKeyTemplate("{userID}/{rand}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.keyTemplate = keyTemplate
+
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Stored")
+	videoURL := testBucket + "," + user.ID.String() + "/video.mp4"
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * cfg.orphanCleanup.gracePeriod)
+	keep := []string{user.ID.String() + "/video.mp4", user.ID.String() + "/orphan.mp4", "backups/db.sqlite"}
+	plantObjects(t, cfg, old, keep...)
+	// Direct uploads still have a prefix of their own
+	plantObjects(t, cfg, old, "uploads/"+uuid.NewString())
+
+	cfg.cleanupOrphanedObjects(t.Context())
+
+	slices.Sort(keep)
+	if got := storedKeys(t, cfg); !slices.Equal(got, keep) {
+		t.Errorf("objects after cleanup = %q, want %q", got, keep)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// parsePage reads ?limit= and ?offset= into params. The limit defaults to,
+// and is clamped to, maxPageSize.
+func parsePage(r *http.Request, params *database.VideoListParams, maxPageSize int) error {
+	query := r.URL.Query()
+	params.Limit = maxPageSize
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return errors.New("limit must be a positive integer")
+		}
+		params.Limit = min(n, maxPageSize)
+	}
+	if offset := query.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return errors.New("offset must be a non-negative integer")
+		}
+		params.Offset = n
+	}
+	return nil
+}
+
+// setPageHeaders sends the total number of results and, if there are more,
+// a link to the next page. List bodies stay plain arrays.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, params database.VideoListParams, count, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next := params.Offset + count; next < total {
+		query := r.URL.Query()
+		query.Set("limit", strconv.Itoa(params.Limit))
+		query.Set("offset", strconv.Itoa(next))
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, query.Encode()))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestHandlerVideosRetrievePages(t *testing.T) {
+	cfg := newTestConfig(t)
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	for i := range 5 {
+		createTestVideo(t, cfg, owner.ID, fmt.Sprintf("Video %d", i))
+	}
+	// Someone else's videos don't count towards the owner's total
+	other, _ := createTestUser(t, cfg, "other@example.com")
+	createTestVideo(t, cfg, other.ID, "Other")
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+		link   string
+	}{
+		{"first", "/api/videos?limit=2", 2, `</api/videos?limit=2&offset=2>; rel="next"`},
+		{"middle", "/api/videos?limit=2&offset=2", 2, `</api/videos?limit=2&offset=4>; rel="next"`},
+		{"last", "/api/videos?limit=2&offset=4", 1, ""},
+	}
+	seen := map[uuid.UUID]bool{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerVideosRetrieve(rec, newJSONRequest(t, http.MethodGet, tt.target, token, nil))
+			var videos []database.Video
+			decodeResponse(t, rec, http.StatusOK, &videos)
+
+			if len(videos) != tt.want {
+				t.Errorf("got %d videos, want %d", len(videos), tt.want)
+			}
+			if got := rec.Header().Get("X-Total-Count"); got != "5" {
+				t.Errorf("X-Total-Count = %q, want 5", got)
+			}
+			if got := rec.Header().Get("Link"); got != tt.link {
+				t.Errorf("Link = %q, want %q", got, tt.link)
+			}
+			for _, video := range videos {
+				if seen[video.ID] {
+					t.Errorf("%s is on more than one page", video.Title)
+				}
+				seen[video.ID] = true
+			}
+		})
+	}
+	if len(seen) != 5 {
+		t.Errorf("pages held %d videos, want 5", len(seen))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type presignCacheEntry struct {
+	url       string
+	expiresAt time.Time
+}
+
+// presignExpiryBucket is the granularity expiries are rounded down to, so
+// callers asking for slightly different lifetimes (share links count down
+// to their token's expiry) share cache entries.
+const presignExpiryBucket = time.Minute
+
+// presignCache remembers presigned URLs so listing videos doesn't sign every
+// object on every request. Entries are keyed by the stored reference and the
+// bucketed expiry, and are dropped once they're within refreshWindow of
+// expiring so callers never get a link that's about to die.
+type presignCache struct {
+	mu            sync.Mutex
+	entries       map[string]presignCacheEntry
+	refreshWindow time.Duration
+	lastPrune     time.Time
+}
+
+func newPresignCache(refreshWindow time.Duration) *presignCache {
+	return &presignCache{
+		entries:       map[string]presignCacheEntry{},
+		refreshWindow: refreshWindow,
+	}
+}
+
+// bucketPresignExpiry rounds expiry down to presignExpiryBucket, leaving
+// anything shorter than a bucket alone. Signing with the rounded expiry
+// means a cached link never outlives what was asked for.
+func bucketPresignExpiry(expiry time.Duration) time.Duration {
+	if expiry < presignExpiryBucket {
+		return expiry
+	}
+	return expiry.Truncate(presignExpiryBucket)
+}
+
+func presignCacheKey(storedURL string, expiry time.Duration) string {
+	return storedURL + "|" + expiry.String()
+}
+
+func (c *presignCache) get(storedURL string, expiry time.Duration) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := presignCacheKey(storedURL, expiry)
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Until(entry.expiresAt) <= c.refreshWindow {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.url, true
+}
+
+func (c *presignCache) set(storedURL string, expiry time.Duration, url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.entries[presignCacheKey(storedURL, expiry)] = presignCacheEntry{
+		url:       url,
+		expiresAt: now.Add(expiry),
+	}
+
+	// Entries that are never asked for again would otherwise stay forever.
+	// Sweeping once per refreshWindow keeps sets cheap.
+	if now.Sub(c.lastPrune) < c.refreshWindow {
+		return
+	}
+	c.lastPrune = now
+	for key, entry := range c.entries {
+		if entry.expiresAt.Sub(now) <= c.refreshWindow {
+			delete(c.entries, key)
+		}
+	}
+}
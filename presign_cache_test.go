@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketPresignExpiry(t *testing.T) {
+	tests := []struct {
+		expiry time.Duration
+		want   time.Duration
+	}{
+		{30 * time.Second, 30 * time.Second},
+		{time.Minute, time.Minute},
+		{time.Hour + 59*time.Second, time.Hour},
+		{23*time.Hour + 59*time.Minute + 59*time.Second + 999*time.Millisecond, 23*time.Hour + 59*time.Minute},
+	}
+	for _, tt := range tests {
+		if got := bucketPresignExpiry(tt.expiry); got != tt.want {
+			t.Errorf("bucketPresignExpiry(%v) = %v, want %v", tt.expiry, got, tt.want)
+		}
+	}
+}
+
+func TestPresignCache(t *testing.T) {
+	c := newPresignCache(5 * time.Minute)
+
+	c.set("bucket,a.mp4", time.Hour, "signed-a")
+	if got, ok := c.get("bucket,a.mp4", time.Hour); !ok || got != "signed-a" {
+		t.Errorf("get = %q, %v; want signed-a, true", got, ok)
+	}
+	if _, ok := c.get("bucket,a.mp4", 2*time.Hour); ok {
+		t.Error("a different expiry hit the cache")
+	}
+
+	// A link that's about to expire is never handed out
+	c.set("bucket,b.mp4", 4*time.Minute, "signed-b")
+	if _, ok := c.get("bucket,b.mp4", 4*time.Minute); ok {
+		t.Error("got a link within the refresh window")
+	}
+}
+
+func TestPresignCachePrunes(t *testing.T) {
+	c := newPresignCache(5 * time.Minute)
+	for i := range 100 {
+		c.set(fmt.Sprintf("bucket,%d.mp4", i), time.Minute, "signed")
+	}
+	// Force the next set to sweep
+	c.lastPrune = time.Time{}
+	c.set("bucket,kept.mp4", time.Hour, "signed")
+
+	if len(c.entries) != 1 {
+		t.Errorf("cache has %d entries after pruning, want 1", len(c.entries))
+	}
+}
+
+func TestSignStoredURLSharesBucketedExpiries(t *testing.T) {
+	cfg := newTestConfig(t)
+	if err := cfg.storage.Put(t.Context(), "a.mp4", strings.NewReader("video"), putOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	stored := testBucket + ",a.mp4"
+
+	first, err := cfg.signStoredURL(stored, time.Hour+10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cfg.signStoredURL(stored, time.Hour+40*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("expiries in the same bucket signed different URLs: %q and %q", first, second)
+	}
+	if len(cfg.presignCache.entries) != 1 {
+		t.Errorf("cache has %d entries, want 1", len(cfg.presignCache.entries))
+	}
+}
+
+func BenchmarkSignStoredURL(b *testing.B) {
+	cfg := &apiConfig{
+		storage:      newTestS3Backend(b, &fakeS3{}),
+		presignCache: newPresignCache(5 * time.Minute),
+	}
+	stored := testBucket + ",landscape/a.mp4"
+
+	b.Run("cached", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := cfg.signStoredURL(stored, time.Hour); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		for b.Loop() {
+			cfg.presignCache.mu.Lock()
+			clear(cfg.presignCache.entries)
+			cfg.presignCache.mu.Unlock()
+			if _, err := cfg.signStoredURL(stored, time.Hour); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var (
+	// errQueueFull is returned by Submit when every worker is busy and the
+	// queue has no room left.
+	errQueueFull = errors.New("processing queue is full")
+	// errPoolClosed is returned by Submit once the pool is shutting down.
+	errPoolClosed = errors.New("processing pool is shutting down")
+)
+
+// ProcessorPool runs queued jobs on a fixed number of workers.
+//
+// Shutdown stops new submissions and lets running jobs finish. Jobs that
+// were still queued, or were still running when the grace period ran out,
+// are handed back as requeued so they can be picked up again later.
+type ProcessorPool struct {
+	jobs chan database.ProcessingJob
+	run  func(ctx context.Context, job database.ProcessingJob) error
+
+	// ctx is given to every job and cancelled when the grace period ends
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.RWMutex
+	closed   bool
+	requeued []database.ProcessingJob
+}
+
+// NewProcessorPool starts n workers calling run for each job, with room for
+// queueSize jobs to wait. run should return ctx's error if it was stopped
+// before it could finish.
+func NewProcessorPool(n, queueSize int, run func(ctx context.Context, job database.ProcessingJob) error) *ProcessorPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &ProcessorPool{
+		jobs:   make(chan database.ProcessingJob, queueSize),
+		run:    run,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for range n {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	return p
+}
+
+func (p *ProcessorPool) worker() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		// Once shutting down, queued jobs are handed back rather than started
+		if p.isClosed() {
+			p.requeue(job)
+			continue
+		}
+		if err := p.run(p.ctx, job); err != nil && p.ctx.Err() != nil {
+			p.requeue(job)
+		}
+	}
+}
+
+// Submit queues job without blocking.
+func (p *ProcessorPool) Submit(job database.ProcessingJob) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return errPoolClosed
+	}
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// Shutdown stops accepting jobs and waits for running ones to finish. If ctx
+// expires first the running jobs are cancelled. It returns every job that
+// didn't complete.
+func (p *ProcessorPool) Shutdown(ctx context.Context) []database.ProcessingJob {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		p.cancel()
+		<-done
+	}
+	p.cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requeued
+}
+
+func (p *ProcessorPool) isClosed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.closed
+}
+
+func (p *ProcessorPool) requeue(job database.ProcessingJob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requeued = append(p.requeued, job)
+}
+
+// processingJob is what a handler hands to enqueueProcessing. The job owns
+// the file at path and removes it once it's done.
+type processingJob struct {
+	videoID   uuid.UUID
+	path      string
+	mediaType string
+	opts      processOptions
+	// sourceKey, if set, is a storage object removed once the video has been
+	// processed successfully
+	sourceKey string
+}
+
+// enqueueProcessing marks the video as processing and queues the job. The
+// job is saved first so it survives a restart. The caller keeps ownership of
+// job.path if it returns an error.
+func (cfg *apiConfig) enqueueProcessing(ctx context.Context, video database.Video, job processingJob) (database.Video, error) {
+	// The status has to be saved before the job is queued, otherwise a fast
+	// worker could mark the video ready only to have it overwritten here
+	previous := video
+	video.Status = database.VideoStatusProcessing
+	video.ProcessingError = nil
+	video.Progress = 0
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		return previous, err
+	}
+
+	saved, err := cfg.db.CreateProcessingJob(database.ProcessingJob{
+		VideoID:       job.videoID,
+		Path:          job.path,
+		MediaType:     job.mediaType,
+		AutoThumbnail: job.opts.autoThumbnail,
+		StorageClass:  job.opts.storageClass,
+		SkipFastStart: job.opts.skipFastStart,
+		SourceKey:     job.sourceKey,
+	})
+	if err == nil {
+		err = cfg.processing.Submit(saved)
+		if err != nil {
+			if delErr := cfg.db.DeleteProcessingJob(saved.ID); delErr != nil {
+				slog.ErrorContext(ctx, "couldn't delete processing job", "job_id", saved.ID, "error", delErr.Error())
+			}
+		}
+	}
+	if err != nil {
+		if restoreErr := cfg.db.UpdateVideo(previous); restoreErr != nil {
+			slog.ErrorContext(ctx, "couldn't restore video status", "video_id", video.ID, "error", restoreErr.Error())
+		}
+		return previous, err
+	}
+	return video, nil
+}
+
+// resumeProcessingJobs queues the jobs left over from the last run.
+func (cfg *apiConfig) resumeProcessingJobs(ctx context.Context) error {
+	jobs, err := cfg.db.GetProcessingJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if _, err := os.Stat(job.Path); err != nil {
+			slog.ErrorContext(ctx, "upload for processing job is gone", "job_id", job.ID, "error", err.Error())
+			cfg.finishProcessingJob(ctx, job)
+			cfg.markProcessingFailed(ctx, job.VideoID, &pipelineError{http.StatusInternalServerError, "Upload was lost, please upload again", err})
+			continue
+		}
+		// Anything that doesn't fit stays saved for the next start
+		if err := cfg.processing.Submit(job); err != nil {
+			slog.ErrorContext(ctx, "couldn't resume processing job", "job_id", job.ID, "error", err.Error())
+		}
+	}
+	return nil
+}
+
+func respondWithQueueError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errQueueFull) || errors.Is(err, errPoolClosed) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusServiceUnavailable, "Too many videos are being processed, try again later", err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Unable to queue video for processing", err)
+}
+
+// runProcessingJob is the ProcessorPool's run function. If ctx is cancelled
+// the job is left saved, with its upload, to be resumed on the next start.
+func (cfg *apiConfig) runProcessingJob(ctx context.Context, job database.ProcessingJob) error {
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't load video for processing", "video_id", job.VideoID, "error", err.Error())
+		return err
+	}
+	if video.ID == uuid.Nil {
+		// The video was deleted while its job was queued
+		cfg.finishProcessingJob(ctx, job)
+		return nil
+	}
+
+	opts := processOptions{
+		autoThumbnail: job.AutoThumbnail,
+		storageClass:  job.StorageClass,
+		skipFastStart: job.SkipFastStart,
+	}
+	processed, err := cfg.processVideo(ctx, video, job.Path, job.MediaType, opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		slog.ErrorContext(ctx, "processing video failed", "video_id", job.VideoID, "error", err.Error())
+		cfg.finishProcessingJob(ctx, job)
+		cfg.markProcessingFailed(ctx, job.VideoID, err)
+		return err
+	}
+
+	if job.SourceKey != "" {
+		if err := cfg.deleteUnreferencedObject(ctx, job.SourceKey); err != nil {
+			slog.ErrorContext(ctx, "couldn't delete source object", "key", job.SourceKey, "error", err.Error())
+		}
+		// A reprocessed video's old HLS package was made from the source,
+		// so it goes too unless a duplicate still streams it
+		if replacedHLS(video, processed, job.SourceKey) {
+			if err := cfg.deleteUnreferencedHLS(ctx, *video.HLSURL, uuid.Nil); err != nil {
+				slog.ErrorContext(ctx, "couldn't delete HLS package", "video_id", video.ID, "hls_url", *video.HLSURL, "error", err.Error())
+			}
+		}
+	}
+	cfg.finishProcessingJob(ctx, job)
+	cfg.notifyVideoProcessed(ctx, processed)
+	return nil
+}
+
+// replacedHLS reports whether processing sourceKey, the stored object
+// before is playing, gave the video a new HLS package in place of one it
+// had stored.
+func replacedHLS(before, after database.Video, sourceKey string) bool {
+	if before.VideoURL == nil || before.HLSURL == nil || isAbsoluteURL(*before.HLSURL) {
+		return false
+	}
+	if ref, err := parseStorageRef(*before.VideoURL); err != nil || ref.Key != sourceKey {
+		return false
+	}
+	return after.HLSURL == nil || *after.HLSURL != *before.HLSURL
+}
+
+// finishProcessingJob removes a job that won't be run again, with its upload.
+func (cfg *apiConfig) finishProcessingJob(ctx context.Context, job database.ProcessingJob) {
+	os.Remove(job.Path)
+	if err := cfg.db.DeleteProcessingJob(job.ID); err != nil {
+		slog.ErrorContext(ctx, "couldn't delete processing job", "job_id", job.ID, "error", err.Error())
+	}
+}
+
+// markProcessingFailed records err on the video. It reloads the video so
+// nothing half-done by processVideo is saved along with the status.
+func (cfg *apiConfig) markProcessingFailed(ctx context.Context, videoID uuid.UUID, err error) {
+	video, getErr := cfg.db.GetVideo(videoID)
+	if getErr != nil {
+		slog.ErrorContext(ctx, "couldn't load video to mark it failed", "video_id", videoID, "error", getErr.Error())
+		return
+	}
+	if video.ID == uuid.Nil {
+		return
+	}
+
+	// Only the client facing part of a pipelineError is stored
+	msg := "Unable to process video"
+	var pErr *pipelineError
+	if errors.As(err, &pErr) {
+		msg = pErr.msg
+	}
+	video.Status = database.VideoStatusFailed
+	video.ProcessingError = &msg
+	if err := cfg.db.UpdateVideoProcessingResult(video); err != nil {
+		slog.ErrorContext(ctx, "couldn't mark video failed", "video_id", videoID, "error", err.Error())
+		return
+	}
+	cfg.notifyVideoProcessed(ctx, video)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestProcessingKeepsEditsMadeWhileProcessing(t *testing.T) {
+	cfg := newTestConfig(t)
+	waitForProbe, release := holdFFprobe(t, cfg)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Before")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	// The job has loaded the video by the time it probes the upload
+	waitForProbe()
+
+	edited := getTestVideo(t, cfg, video.ID)
+	edited.Title = "After"
+	edited.Description = "edited while processing"
+	edited.Visibility = database.VisibilityPublic
+	if err := cfg.db.UpdateVideo(edited); err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	if ready.Title != "After" || ready.Description != "edited while processing" || ready.Visibility != database.VisibilityPublic {
+		t.Errorf("edits were reverted: title %q, description %q, visibility %q", ready.Title, ready.Description, ready.Visibility)
+	}
+	if ready.VideoURL == nil || ready.Width != 1920 {
+		t.Errorf("processing result wasn't saved: URL %v, width %d", ready.VideoURL, ready.Width)
+	}
+}
+
+// getVideoStatus fetches the video through the GET endpoint.
+func getVideoStatus(t *testing.T, cfg *apiConfig, video database.Video, token string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	cfg.handlerVideoGet(rec, newVideoRequest(t, http.MethodGet, video.ID, "", token, nil))
+	var got database.Video
+	decodeResponse(t, rec, http.StatusOK, &got)
+	return got.Status
+}
+
+func TestVideoStatusTransitions(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Status")
+	if got := getVideoStatus(t, cfg, video, token); got != database.VideoStatusUploading {
+		t.Errorf("new video is %q, want uploading", got)
+	}
+
+	waitForProbe, release := holdFFprobe(t, cfg)
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	var accepted database.Video
+	decodeResponse(t, rec, http.StatusAccepted, &accepted)
+	if accepted.Status != database.VideoStatusProcessing {
+		t.Errorf("upload response says %q, want processing", accepted.Status)
+	}
+	waitForProbe()
+	if got := getVideoStatus(t, cfg, video, token); got != database.VideoStatusProcessing {
+		t.Errorf("video is %q while processing, want processing", got)
+	}
+	release()
+
+	waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+	if got := getVideoStatus(t, cfg, video, token); got != database.VideoStatusReady {
+		t.Errorf("processed video is %q, want ready", got)
+	}
+}
+
+func TestVideoStatusFailedOnFFmpegError(t *testing.T) {
+	cfg := newTestConfig(t)
+	failFFmpeg(t, cfg)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Status")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4MoovLast(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+
+	failed := waitForStatus(t, cfg, video.ID, database.VideoStatusFailed)
+	drainProcessing(t, cfg)
+	if failed.ProcessingError == nil || *failed.ProcessingError == "" {
+		t.Error("failed video has no processing error")
+	}
+	if got := getVideoStatus(t, cfg, video, token); got != database.VideoStatusFailed {
+		t.Errorf("video is %q, want failed", got)
+	}
+	jobs, err := cfg.db.GetProcessingJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) > 0 {
+		t.Errorf("%d processing jobs left after the failure", len(jobs))
+	}
+}
+
+func TestProcessorPoolShutdown(t *testing.T) {
+	jobs := make([]database.ProcessingJob, 6)
+	quick := map[uuid.UUID]bool{}
+	for i := range jobs {
+		jobs[i].ID = uuid.New()
+		// The first two occupy both workers until they're cancelled
+		quick[jobs[i].ID] = i >= 2
+	}
+
+	started := make(chan uuid.UUID, len(jobs))
+	var mu sync.Mutex
+	var finished []uuid.UUID
+	pool := NewProcessorPool(2, len(jobs), func(ctx context.Context, job database.ProcessingJob) error {
+		started <- job.ID
+		if !quick[job.ID] {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		mu.Lock()
+		finished = append(finished, job.ID)
+		mu.Unlock()
+		return nil
+	})
+
+	var accepted []uuid.UUID
+	for i, job := range jobs {
+		if err := pool.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+		accepted = append(accepted, job.ID)
+		if i < 2 {
+			<-started
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	requeued := pool.Shutdown(ctx)
+
+	if err := pool.Submit(database.ProcessingJob{ID: uuid.New()}); !errors.Is(err, errPoolClosed) {
+		t.Errorf("Submit after shutdown = %v, want errPoolClosed", err)
+	}
+
+	var requeuedIDs []uuid.UUID
+	for _, job := range requeued {
+		requeuedIDs = append(requeuedIDs, job.ID)
+	}
+	// The running jobs were cancelled and the queued ones never started
+	if len(finished) > 0 {
+		t.Errorf("%d queued jobs started after shutdown", len(finished))
+	}
+	all := append(append([]uuid.UUID{}, finished...), requeuedIDs...)
+	slices.SortFunc(all, uuidCompare)
+	slices.SortFunc(accepted, uuidCompare)
+	if !slices.Equal(all, accepted) {
+		t.Errorf("finished %v and requeued %v, want every accepted job %v", finished, requeuedIDs, accepted)
+	}
+}
+
+func TestProcessorPoolShutdownLetsRunningJobsFinish(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var done atomic.Bool
+	pool := NewProcessorPool(1, 1, func(ctx context.Context, job database.ProcessingJob) error {
+		close(started)
+		<-release
+		done.Store(true)
+		return nil
+	})
+	if err := pool.Submit(database.ProcessingJob{ID: uuid.New()}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := pool.Submit(database.ProcessingJob{ID: uuid.New()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Submit(database.ProcessingJob{ID: uuid.New()}); !errors.Is(err, errQueueFull) {
+		t.Errorf("Submit to a full queue = %v, want errQueueFull", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	requeued := pool.Shutdown(t.Context())
+	if !done.Load() {
+		t.Error("Shutdown returned before the running job finished")
+	}
+	if len(requeued) != 1 {
+		t.Errorf("requeued %d jobs, want the 1 still queued", len(requeued))
+	}
+}
+
+func uuidCompare(a, b uuid.UUID) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func TestShutdownKeepsInterruptedJobSaved(t *testing.T) {
+	cfg := newTestConfig(t)
+	waitForProbe, release := holdFFprobe(t, cfg)
+	defer release()
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Interrupted")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	waitForProbe()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	requeued := cfg.processing.Shutdown(ctx)
+	if len(requeued) != 1 {
+		t.Fatalf("requeued %d jobs, want 1", len(requeued))
+	}
+
+	// The job and its upload are left for the next start to resume
+	jobs, err := cfg.db.GetProcessingJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].VideoID != video.ID {
+		t.Fatalf("saved jobs = %+v, want the interrupted one", jobs)
+	}
+	if _, err := os.Stat(jobs[0].Path); err != nil {
+		t.Errorf("upload of the interrupted job is gone: %v", err)
+	}
+	if got := getTestVideo(t, cfg, video.ID); got.Status != database.VideoStatusProcessing {
+		t.Errorf("interrupted video is %q, want it still processing", got.Status)
+	}
+}
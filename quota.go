@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// checkStorageQuota returns a 403 pipelineError if storing size more bytes
+// for videoID would push the user over their quota. The video's current
+// object doesn't count toward usage since a new upload replaces it.
+func (cfg *apiConfig) checkStorageQuota(userID, videoID uuid.UUID, size int64) error {
+	quota := cfg.storageQuotaBytes
+	override, err := cfg.db.GetUserStorageQuota(userID)
+	if err != nil {
+		return &pipelineError{http.StatusInternalServerError, "Unable to get storage quota", err}
+	}
+	if override != nil {
+		quota = *override
+	}
+	if quota <= 0 {
+		return nil
+	}
+
+	usage, err := cfg.db.GetStorageUsage(userID, videoID)
+	if err != nil {
+		return &pipelineError{http.StatusInternalServerError, "Unable to get storage usage", err}
+	}
+	if usage+size > quota {
+		return &pipelineError{
+			http.StatusForbidden,
+			fmt.Sprintf("Storage quota exceeded: using %d of %d bytes, upload needs %d more", usage, quota, size),
+			nil,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestHandlerUploadVideoQuota(t *testing.T) {
+	stored := testMP4(1000)
+	upload := testMP4(500)
+	ptr := func(n int64) *int64 { return &n }
+
+	tests := []struct {
+		name     string
+		global   int64
+		override *int64
+		want     int
+	}{
+		{"within the global quota", int64(len(stored) + len(upload)), nil, http.StatusAccepted},
+		{"over the global quota", int64(len(stored) + len(upload) - 1), nil, http.StatusForbidden},
+		{"override raises the quota", int64(len(stored)), ptr(int64(len(stored) + len(upload))), http.StatusAccepted},
+		{"override lowers the quota", 0, ptr(int64(len(stored))), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.storageQuotaBytes = tt.global
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			if err := cfg.db.SetUserStorageQuota(user.ID, tt.override); err != nil {
+				t.Fatal(err)
+			}
+			storeTestVideo(t, cfg, createTestVideo(t, cfg, user.ID, "Existing"), "landscape/existing.mp4", stored)
+			video := createTestVideo(t, cfg, user.ID, "New")
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", upload))
+			var resp struct {
+				Error string `json:"error"`
+			}
+			decodeResponse(t, rec, tt.want, &resp)
+			if tt.want != http.StatusForbidden {
+				return
+			}
+			if usage := fmt.Sprintf("using %d of", len(stored)); !strings.Contains(resp.Error, usage) {
+				t.Errorf("error = %q, want the current usage (%s)", resp.Error, usage)
+			}
+			if got := getTestVideo(t, cfg, video.ID); got.Status == database.VideoStatusProcessing {
+				t.Error("blocked upload was queued for processing")
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoQuotaIgnoresReplacedVideo(t *testing.T) {
+	cfg := newTestConfig(t)
+	data := testMP4(1000)
+	cfg.storageQuotaBytes = int64(len(data))
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := storeTestVideo(t, cfg, createTestVideo(t, cfg, user.ID, "Replaced"), "landscape/old.mp4", data)
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", data))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+}
+
+// A deduplicated video shares the original's objects, so they only count
+// toward the quota once.
+func TestHandlerUploadVideoQuotaCountsSharedObjectsOnce(t *testing.T) {
+	cfg := newTestConfig(t)
+	stored := testMP4(1000)
+	upload := testMP4(500)
+	cfg.storageQuotaBytes = int64(len(stored) + len(upload))
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	original := storeTestVideo(t, cfg, createTestVideo(t, cfg, user.ID, "Original"), "landscape/original.mp4", stored)
+	duplicate := createTestVideo(t, cfg, user.ID, "Duplicate")
+	duplicate.VideoURL = original.VideoURL
+	duplicate.SizeBytes = original.SizeBytes
+	duplicate.Status = database.VideoStatusReady
+	if err := cfg.db.UpdateVideo(duplicate); err != nil {
+		t.Fatal(err)
+	}
+
+	video := createTestVideo(t, cfg, user.ID, "New")
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", upload))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+}
+
+func TestHandlerUserStorageQuota(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "user@example.com")
+	admin, _ := createTestUser(t, cfg, "admin@example.com")
+	adminJWT := adminToken(t, cfg, admin.ID)
+	ptr := func(n int64) *int64 { return &n }
+
+	quotaRequest := func(t *testing.T, userID, token string, body any) *http.Request {
+		req := newJSONRequest(t, http.MethodPut, "/admin/users/"+userID+"/quota", token, body)
+		req.SetPathValue("userID", userID)
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		userID string
+		body   any
+		want   int
+		quota  *int64
+	}{
+		{"set", adminJWT, user.ID.String(), map[string]any{"storage_quota_bytes": 1 << 20}, http.StatusOK, ptr(1 << 20)},
+		{"not an admin", token, user.ID.String(), map[string]any{"storage_quota_bytes": 1 << 30}, http.StatusForbidden, ptr(1 << 20)},
+		{"negative", adminJWT, user.ID.String(), map[string]any{"storage_quota_bytes": -1}, http.StatusBadRequest, ptr(1 << 20)},
+		{"unknown user", adminJWT, uuid.NewString(), map[string]any{"storage_quota_bytes": 1}, http.StatusNotFound, ptr(1 << 20)},
+		{"cleared", adminJWT, user.ID.String(), map[string]any{"storage_quota_bytes": nil}, http.StatusOK, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cfg.handlerUserStorageQuota(rec, quotaRequest(t, tt.userID, tt.token, tt.body))
+			decodeResponse(t, rec, tt.want, nil)
+
+			got, err := cfg.db.GetUserStorageQuota(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != (tt.quota == nil) || (got != nil && *got != *tt.quota) {
+				t.Errorf("quota = %v, want %v", got, tt.quota)
+			}
+		})
+	}
+}
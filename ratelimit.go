@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+)
+
+// userRateLimiter gives each user their own token bucket.
+type userRateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[uuid.UUID]*rate.Limiter
+	lastPrune time.Time
+}
+
+// newUserRateLimiter allows each user perMinute requests a minute on average,
+// with bursts of up to burst. It returns nil, which allows everything, when
+// perMinute is 0.
+func newUserRateLimiter(perMinute float64, burst int) *userRateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &userRateLimiter{
+		limit:    rate.Limit(perMinute / 60),
+		burst:    max(burst, 1),
+		limiters: map[uuid.UUID]*rate.Limiter{},
+	}
+}
+
+// allow takes a token from the user's bucket. If there's none it returns
+// false along with how long until there will be.
+func (l *userRateLimiter) allow(userID uuid.UUID) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Users who've been idle long enough to have a full bucket again don't
+	// need remembering
+	if now.Sub(l.lastPrune) > time.Minute {
+		for id, limiter := range l.limiters {
+			if limiter.TokensAt(now) >= float64(l.burst) {
+				delete(l.limiters, id)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	limiter, ok := l.limiters[userID]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[userID] = limiter
+	}
+
+	reservation := limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// checkUploadRate responds with 429 and returns false if the user is over the
+// upload rate limit.
+func (cfg *apiConfig) checkUploadRate(w http.ResponseWriter, userID uuid.UUID) bool {
+	ok, retryAfter := cfg.uploadLimiter.allow(userID)
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, "Too many uploads, try again later", nil)
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUserRateLimiter(t *testing.T) {
+	limiter := newUserRateLimiter(60, 3)
+	user, other := uuid.New(), uuid.New()
+
+	for i := range 3 {
+		if ok, _ := limiter.allow(user); !ok {
+			t.Fatalf("request %d within the burst was refused", i+1)
+		}
+	}
+	ok, retryAfter := limiter.allow(user)
+	if ok {
+		t.Fatal("request over the burst was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("retry after %v, want up to a second at 60 a minute", retryAfter)
+	}
+	// Refused requests don't use up tokens
+	if _, again := limiter.allow(user); again > retryAfter {
+		t.Errorf("retry after grew from %v to %v", retryAfter, again)
+	}
+	if ok, _ := limiter.allow(other); !ok {
+		t.Error("another user was limited")
+	}
+
+	unlimited := newUserRateLimiter(0, 1)
+	for range 10 {
+		if ok, _ := unlimited.allow(user); !ok {
+			t.Fatal("limiter disabled with 0 refused a request")
+		}
+	}
+}
+
+func TestUploadRateLimit(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.uploadLimiter = newUserRateLimiter(1, 2)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Limited")
+	data := testImage(t, 64, 36, "image/png")
+
+	for range 2 {
+		rec := httptest.NewRecorder()
+		cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", data))
+		decodeResponse(t, rec, http.StatusOK, nil)
+	}
+
+	// Thumbnails and videos share the user's bucket
+	requests := map[string]func() *httptest.ResponseRecorder{
+		"thumbnail": func() *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", data))
+			return rec
+		},
+		"video": func() *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+			return rec
+		},
+	}
+	for name, do := range requests {
+		t.Run(name, func(t *testing.T) {
+			rec := do()
+			decodeResponse(t, rec, http.StatusTooManyRequests, nil)
+			seconds, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+			if err != nil || seconds < 1 || seconds > 60 {
+				t.Errorf("Retry-After = %q, want 1-60 seconds", rec.Header().Get("Retry-After"))
+			}
+		})
+	}
+
+	// Another user has their own bucket; they get a 403 for a video they
+	// don't own rather than a 429
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, otherToken, "image/png", data))
+	decodeResponse(t, rec, http.StatusForbidden, nil)
+}
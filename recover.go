@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverMiddleware turns a panic in a handler into a 500 instead of a
+// dropped connection. The stack is logged with the request ID, which the
+// client also gets, so a bug report can be matched to the log.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// The server uses this panic to abort a response on purpose
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			slog.ErrorContext(r.Context(), "panic serving request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(err),
+				"stack", string(debug.Stack()),
+			)
+			respondWithError(w, http.StatusInternalServerError, "Something went wrong", nil)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
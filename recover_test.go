@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	logs := captureLogs(t)
+	handler := requestLogMiddleware(recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var streams []int
+		_ = streams[0]
+	})))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/videos", nil))
+	var resp struct {
+		Error string `json:"error"`
+	}
+	decodeResponse(t, rec, http.StatusInternalServerError, &resp)
+	if resp.Error != "Something went wrong" {
+		t.Errorf("error = %q, want Something went wrong", resp.Error)
+	}
+
+	requestID := rec.Header().Get("X-Request-ID")
+	var logged map[string]any
+	for _, record := range logs.records(t) {
+		if record["msg"] == "panic serving request" {
+			logged = record
+		}
+	}
+	if logged == nil {
+		t.Fatal("panic wasn't logged")
+	}
+	if logged["request_id"] != requestID {
+		t.Errorf("logged request_id = %v, want %q", logged["request_id"], requestID)
+	}
+	if !strings.Contains(logged["panic"].(string), "index out of range") {
+		t.Errorf("logged panic = %v", logged["panic"])
+	}
+	if !strings.Contains(logged["stack"].(string), "recover_test.go") {
+		t.Errorf("logged stack doesn't reach the handler: %v", logged["stack"])
+	}
+}
+
+func TestRecoverMiddlewareKeepsServing(t *testing.T) {
+	captureLogs(t)
+	cfg := newTestConfig(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	mux.HandleFunc("GET /ok", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	_, url := startServer(t, cfg, requestLogMiddleware(recoverMiddleware(mux)))
+
+	for range 2 {
+		resp, err := http.Get(url + "/panic")
+		if err != nil {
+			t.Fatalf("connection dropped: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+		}
+	}
+	resp, err := http.Get(url + "/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("after panics got %d %q, want 200 ok", resp.StatusCode, body)
+	}
+}
+
+func TestRecoverMiddlewareAbortHandler(t *testing.T) {
+	handler := recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on", err)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	t.Error("http.ErrAbortHandler was swallowed")
+}
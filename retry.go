@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	retryBaseDelay = 200 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// permanentError marks an error that retryWithBackoff shouldn't retry.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// retryWithBackoff calls fn until it succeeds, returns a permanent error, or
+// maxAttempts is reached, sleeping with jittered exponential backoff between
+// attempts. It stops early if ctx is cancelled while waiting.
+func retryWithBackoff(ctx context.Context, maxAttempts int, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		var pErr *permanentError
+		if errors.As(err, &pErr) {
+			return pErr.err
+		}
+		if attempt >= maxAttempts {
+			return err
+		}
+
+		delay := min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+		// Pick a delay in [delay/2, delay) so concurrent callers spread out
+		delay = delay/2 + rand.N(delay/2)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// putMaxAttempts is how many times a PutObject is tried before giving up.
+const putMaxAttempts = 3
+
+// s3StorageClasses are the storage classes an upload may ask for. Archive
+// classes like GLACIER need a restore before the object can be played.
+var s3StorageClasses = map[string]bool{
+	string(types.StorageClassStandard):           true,
+	string(types.StorageClassStandardIa):         true,
+	string(types.StorageClassOnezoneIa):          true,
+	string(types.StorageClassIntelligentTiering): true,
+	string(types.StorageClassGlacierIr):          true,
+	string(types.StorageClassGlacier):            true,
+	string(types.StorageClassDeepArchive):        true,
+}
+
+// s3Tagging encodes tags as the URL query string S3 expects for Tagging,
+// or nil when there are none.
+func s3Tagging(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return aws.String(values.Encode())
+}
+
+// s3EncryptionConfig selects server-side encryption for stored objects. An
+// empty mode leaves it to the bucket's default.
+type s3EncryptionConfig struct {
+	mode     types.ServerSideEncryption
+	kmsKeyID string
+}
+
+// parseS3EncryptionConfig validates an S3_SSE mode ("", "AES256" or
+// "aws:kms") and optional KMS key ID.
+func parseS3EncryptionConfig(mode, kmsKeyID string) (s3EncryptionConfig, error) {
+	switch types.ServerSideEncryption(mode) {
+	case "", types.ServerSideEncryptionAes256:
+		if kmsKeyID != "" {
+			return s3EncryptionConfig{}, errors.New("a KMS key ID requires aws:kms encryption")
+		}
+	case types.ServerSideEncryptionAwsKms:
+	default:
+		return s3EncryptionConfig{}, fmt.Errorf("unknown encryption mode %q, expected AES256 or aws:kms", mode)
+	}
+	return s3EncryptionConfig{
+		mode:     types.ServerSideEncryption(mode),
+		kmsKeyID: kmsKeyID,
+	}, nil
+}
+
+// keyID returns the KMS key ID to send, or nil to use the AWS managed key.
+func (e s3EncryptionConfig) keyID() *string {
+	if e.kmsKeyID == "" {
+		return nil
+	}
+	return aws.String(e.kmsKeyID)
+}
+
+type s3Backend struct {
+	client *s3.Client
+	// presignClient is built once; constructing one per URL is wasteful when
+	// signing a whole list of videos
+	presignClient *s3.PresignClient
+	bucket        string
+	multipart     s3MultipartConfig
+	encryption    s3EncryptionConfig
+}
+
+func newS3Backend(client *s3.Client, bucket string, multipart s3MultipartConfig, encryption s3EncryptionConfig) *s3Backend {
+	return &s3Backend{
+		client:        client,
+		presignClient: s3.NewPresignClient(client),
+		bucket:        bucket,
+		multipart:     multipart,
+		encryption:    encryption,
+	}
+}
+
+func (b *s3Backend) Put(ctx context.Context, key string, body io.Reader, opts putOptions) error {
+	// Large files are sent in parts so a failure only retries one part and
+	// several parts can be in flight at once
+	if f, ok := body.(*os.File); ok {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() > b.multipart.threshold {
+			input := &s3.CreateMultipartUploadInput{
+				Bucket:               aws.String(b.bucket),
+				Key:                  aws.String(key),
+				ContentType:          aws.String(opts.contentType),
+				StorageClass:         types.StorageClass(opts.storageClass),
+				Tagging:              s3Tagging(opts.tags),
+				ServerSideEncryption: b.encryption.mode,
+				SSEKMSKeyId:          b.encryption.keyID(),
+			}
+			return putMultipart(ctx, b.client, input, f, info.Size(), b.multipart)
+		}
+	}
+
+	// The body has to be rewound before a retry, which only works if it can
+	// seek
+	seeker, canSeek := body.(io.Seeker)
+	attempts := 1
+	if canSeek {
+		attempts = putMaxAttempts
+	}
+
+	// S3 rejects the object if it doesn't arrive intact. Hashing needs a
+	// second pass over the body, so it's only done when it can be rewound.
+	var md5Sum *string
+	if canSeek {
+		sum, err := contentMD5(body)
+		if err != nil {
+			return err
+		}
+		md5Sum = aws.String(sum)
+	}
+
+	return retryWithBackoff(ctx, attempts, func() error {
+		if canSeek {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return permanent(err)
+			}
+		}
+		_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(b.bucket),
+			Key:                  aws.String(key),
+			Body:                 body,
+			ContentMD5:           md5Sum,
+			ContentType:          aws.String(opts.contentType),
+			StorageClass:         types.StorageClass(opts.storageClass),
+			Tagging:              s3Tagging(opts.tags),
+			ServerSideEncryption: b.encryption.mode,
+			SSEKMSKeyId:          b.encryption.keyID(),
+		})
+		if err != nil && !isRetryableS3Error(err) {
+			return permanent(err)
+		}
+		return err
+	})
+}
+
+// contentMD5 returns the base64 MD5 of everything read from r, in the form
+// S3 expects for Content-MD5.
+func contentMD5(r io.Reader) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// isRetryableS3Error reports whether err is a transient failure (throttling,
+// a 5xx response or a dropped connection) worth retrying.
+func isRetryableS3Error(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout",
+			"RequestTimeTooSkewed", "InternalError", "ServiceUnavailable":
+			return true
+		}
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() >= 500 {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (b *s3Backend) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, "", errObjectNotFound
+		}
+		return nil, "", err
+	}
+	return out.Body, aws.ToString(out.ContentType), nil
+}
+
+func (b *s3Backend) PresignedGetURL(key string, d time.Duration) (string, error) {
+	return generatePresignedURL(b.presignClient, b.bucket, key, d, "")
+}
+
+func (b *s3Backend) PresignedDownloadURL(key, contentDisposition string, d time.Duration) (string, error) {
+	return generatePresignedURL(b.presignClient, b.bucket, key, d, contentDisposition)
+}
+
+// PresignedPutURL signs a PutObject for key. Encryption and storage class
+// aren't part of the signature (the client would have to send matching
+// headers), so directly uploaded objects get the bucket defaults.
+func (b *s3Backend) PresignedPutURL(key, contentType string, contentLength int64, d time.Duration) (string, error) {
+	req, err := b.presignClient.PresignPutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(contentLength),
+	}, s3.WithPresignExpires(d))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (b *s3Backend) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var objects []objectInfo
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, objectInfo{key: aws.ToString(obj.Key), lastModified: aws.ToTime(obj.LastModified)})
+		}
+	}
+	return objects, nil
+}
+
+func (b *s3Backend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *s3Backend) Delete(ctx context.Context, key string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// Check makes sure the bucket exists and the credentials can reach it.
+func (b *s3Backend) Check(ctx context.Context) error {
+	_, err := b.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(b.bucket),
+	})
+	return err
+}
+
+// generatePresignedURL signs a GetObject for key. A non-empty
+// contentDisposition overrides the Content-Disposition S3 responds with.
+func generatePresignedURL(presignClient *s3.PresignClient, bucket, key string, expireTime time.Duration, contentDisposition string) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if contentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(contentDisposition)
+	}
+	req, err := presignClient.PresignGetObject(context.Background(), input, s3.WithPresignExpires(expireTime))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
+	return cfg.dbVideoToSignedVideoWithExpiry(video, cfg.presignExpiry)
+}
+
+func (cfg *apiConfig) dbVideoToSignedVideoWithExpiry(video database.Video, expiry time.Duration) (database.Video, error) {
+	if video.VideoURL != nil {
+		presignedURL, err := cfg.signStoredURL(*video.VideoURL, expiry)
+		if err != nil {
+			return video, err
+		}
+		video.VideoURL = &presignedURL
+	}
+	if video.HLSURL != nil {
+		playlistURL, err := cfg.signHLSURL(video.ID, *video.HLSURL, expiry)
+		if err != nil {
+			return video, err
+		}
+		video.HLSURL = &playlistURL
+	}
+	return video, nil
+}
+
+func isAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// presignWorkers bounds how many videos signVideos signs concurrently.
+const presignWorkers = 8
+
+// signVideos presigns the URLs of every video in place. A video whose stored
+// URL can't be signed gets nil URLs instead of failing the whole list.
+func (cfg *apiConfig) signVideos(ctx context.Context, videos []database.Video) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(presignWorkers, len(videos)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				signed, err := cfg.dbVideoToSignedVideo(videos[i])
+				if err != nil {
+					slog.ErrorContext(ctx, "couldn't sign video URLs", "video_id", videos[i].ID, "error", err.Error())
+					signed = videos[i]
+					signed.VideoURL = nil
+					signed.HLSURL = nil
+				}
+				videos[i] = signed
+			}
+		}()
+	}
+	for i := range videos {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// signDownloadURL signs a stored reference so that following the link
+// downloads the object as filename instead of playing it inline. Through
+// CloudFront the disposition is a signed query parameter the distribution
+// forwards to S3. Backends that can't override the disposition get a plain
+// presigned URL.
+func (cfg *apiConfig) signDownloadURL(storedURL, filename string, expiry time.Duration) (string, error) {
+	if isAbsoluteURL(storedURL) {
+		return storedURL, nil
+	}
+	ref, err := parseStorageRef(storedURL)
+	if err != nil {
+		return "", err
+	}
+	key := ref.Key
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	if cfg.cloudFront != nil {
+		params := url.Values{"response-content-disposition": {disposition}}
+		return cfg.cloudFront.signWithParams(key, params, time.Now().Add(expiry))
+	}
+	presigner, ok := cfg.storage.(downloadPresigner)
+	if !ok {
+		return cfg.storage.PresignedGetURL(key, expiry)
+	}
+	return presigner.PresignedDownloadURL(key, disposition, expiry)
+}
+
+func (cfg *apiConfig) signStoredURL(storedURL string, expiry time.Duration) (string, error) {
+	// Older rows hold a plain URL rather than a storage reference
+	if isAbsoluteURL(storedURL) {
+		return storedURL, nil
+	}
+
+	expiry = bucketPresignExpiry(expiry)
+	if signed, ok := cfg.presignCache.get(storedURL, expiry); ok {
+		return signed, nil
+	}
+
+	ref, err := parseStorageRef(storedURL)
+	if err != nil {
+		return "", err
+	}
+	key := ref.Key
+	var signed string
+	if cfg.cloudFront != nil {
+		signed, err = cfg.cloudFront.sign(key, time.Now().Add(expiry))
+	} else {
+		signed, err = cfg.storage.PresignedGetURL(key, expiry)
+	}
+	if err != nil {
+		return "", err
+	}
+	cfg.presignCache.set(storedURL, expiry, signed)
+	return signed, nil
+}
@@ -0,0 +1,182 @@
+//go:build integration
+
+// These tests run the S3 backend against a real S3-compatible store, such as
+// LocalStack:
+//
+//	docker run --rm -p 4566:4566 localstack/localstack
+//	AWS_ACCESS_KEY_ID=test AWS_SECRET_ACCESS_KEY=test \
+//	S3_ENDPOINT=http://localhost:4566 S3_USE_PATH_STYLE=true \
+//	go test -tags integration -run Integration .
+//
+// Each test creates its own bucket and removes it afterward.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// newIntegrationS3Backend returns an s3Backend for a new bucket on the store
+// at S3_ENDPOINT, configured the way main does. The test is skipped if
+// S3_ENDPOINT isn't set.
+func newIntegrationS3Backend(t *testing.T, multipart s3MultipartConfig) *s3Backend {
+	t.Helper()
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_ENDPOINT isn't set")
+	}
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	awsCfg, err := config.LoadDefaultConfig(t.Context(), config.WithRegion(region))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+		o.UsePathStyle = os.Getenv("S3_USE_PATH_STYLE") == "true"
+	})
+
+	bucket := "tubely-test-" + uuid.NewString()[:8]
+	if _, err := client.CreateBucket(t.Context(), &s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatalf("couldn't create bucket: %v", err)
+	}
+	backend := newS3Backend(client, bucket, multipart, s3EncryptionConfig{})
+	t.Cleanup(func() {
+		ctx := context.Background()
+		objects, err := backend.List(ctx, "")
+		if err != nil {
+			t.Errorf("couldn't list bucket: %v", err)
+		}
+		for _, obj := range objects {
+			backend.Delete(ctx, obj.key)
+		}
+		if _, err := client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(bucket)}); err != nil {
+			t.Errorf("couldn't delete bucket: %v", err)
+		}
+	})
+	return backend
+}
+
+// singlePart keeps every test upload in one PutObject.
+var singlePart = s3MultipartConfig{threshold: 1 << 40, partSize: minPartSize, concurrency: 1}
+
+func TestS3IntegrationRoundTrip(t *testing.T) {
+	backend := newIntegrationS3Backend(t, singlePart)
+	ctx := t.Context()
+	data := testMP4(1024)
+
+	if err := backend.Check(ctx); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if err := backend.Put(ctx, "landscape/a.mp4", bytes.NewReader(data), putOptions{contentType: "video/mp4"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	body, contentType, err := backend.Get(ctx, "landscape/a.mp4")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || contentType != "video/mp4" {
+		t.Errorf("Get returned %d bytes of %q, want %d bytes of video/mp4", len(got), contentType, len(data))
+	}
+
+	if exists, err := backend.Exists(ctx, "landscape/a.mp4"); err != nil || !exists {
+		t.Errorf("Exists = %v, %v; want true", exists, err)
+	}
+	if exists, err := backend.Exists(ctx, "landscape/missing.mp4"); err != nil || exists {
+		t.Errorf("Exists for a missing key = %v, %v; want false", exists, err)
+	}
+
+	objects, err := backend.List(ctx, "landscape/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.key)
+	}
+	if !slices.Equal(keys, []string{"landscape/a.mp4"}) {
+		t.Errorf("List = %v, want [landscape/a.mp4]", keys)
+	}
+
+	if err := backend.Delete(ctx, "landscape/a.mp4"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if exists, err := backend.Exists(ctx, "landscape/a.mp4"); err != nil || exists {
+		t.Errorf("Exists after Delete = %v, %v; want false", exists, err)
+	}
+}
+
+func TestS3IntegrationPresignedURL(t *testing.T) {
+	backend := newIntegrationS3Backend(t, singlePart)
+	data := testMP4(64)
+	if err := backend.Put(t.Context(), "landscape/a.mp4", bytes.NewReader(data), putOptions{contentType: "video/mp4"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	presigned, err := backend.PresignedGetURL("landscape/a.mp4", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, data) {
+		t.Errorf("presigned GET = %d with %d bytes, want 200 with %d", resp.StatusCode, len(got), len(data))
+	}
+}
+
+func TestS3IntegrationMultipart(t *testing.T) {
+	backend := newIntegrationS3Backend(t, s3MultipartConfig{threshold: minPartSize, partSize: minPartSize, concurrency: 2})
+	// Two full parts and a short last one. Only files are sent in parts.
+	data := bytes.Repeat([]byte("tubely"), (2*minPartSize+1024)/len("tubely"))
+	path := filepath.Join(t.TempDir(), "large.mp4")
+	writeTestFile(t, path, string(data), 0o644)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := backend.Put(t.Context(), "landscape/large.mp4", f, putOptions{contentType: "video/mp4"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	body, _, err := backend.Get(t.Context(), "landscape/large.mp4")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes back, want the %d uploaded", len(got), len(data))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// minPartSize is the smallest part S3 accepts, other than the last one.
+const minPartSize = 5 << 20
+
+type s3MultipartConfig struct {
+	// threshold is the object size above which multipart upload is used
+	threshold   int64
+	partSize    int64
+	concurrency int
+}
+
+// s3MultipartAPI is the subset of *s3.Client used for multipart uploads.
+type s3MultipartAPI interface {
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// putMultipart uploads size bytes from body as a multipart upload, sending up
+// to cfg.concurrency parts at once. input describes the object (bucket, key,
+// content type, encryption, ...). If any part fails the upload is aborted so
+// S3 doesn't keep (and bill for) the parts that did arrive.
+func putMultipart(ctx context.Context, client s3MultipartAPI, input *s3.CreateMultipartUploadInput, body io.ReaderAt, size int64, cfg s3MultipartConfig) error {
+	bucket, key := aws.ToString(input.Bucket), aws.ToString(input.Key)
+	created, err := client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return err
+	}
+	uploadID := created.UploadId
+
+	err = uploadParts(ctx, client, bucket, key, uploadID, body, size, cfg)
+	if err != nil {
+		abortMultipart(ctx, client, bucket, key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func uploadParts(ctx context.Context, client s3MultipartAPI, bucket, key string, uploadID *string, body io.ReaderAt, size int64, cfg s3MultipartConfig) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	numParts := int((size + cfg.partSize - 1) / cfg.partSize)
+	parts := make([]types.CompletedPart, numParts)
+	sem := make(chan struct{}, cfg.concurrency)
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for i := 0; i < numParts; i++ {
+		offset := int64(i) * cfg.partSize
+		length := min(cfg.partSize, size-offset)
+		partNumber := aws.Int32(int32(i + 1))
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			sum, err := contentMD5(io.NewSectionReader(body, offset, length))
+			var out *s3.UploadPartOutput
+			if err == nil {
+				out, err = client.UploadPart(ctx, &s3.UploadPartInput{
+					Bucket:        aws.String(bucket),
+					Key:           aws.String(key),
+					UploadId:      uploadID,
+					PartNumber:    partNumber,
+					Body:          io.NewSectionReader(body, offset, length),
+					ContentLength: aws.Int64(length),
+					ContentMD5:    aws.String(sum),
+				})
+			}
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("part %d: %w", *partNumber, err)
+					cancel()
+				})
+				return
+			}
+			parts[*partNumber-1] = types.CompletedPart{ETag: out.ETag, PartNumber: partNumber}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	_, err := client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+func abortMultipart(ctx context.Context, client s3MultipartAPI, bucket, key string, uploadID *string) {
+	// The request context may already be cancelled, but the abort should
+	// still go through
+	_, err := client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't abort multipart upload", "key", key, "error", err.Error())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeMultipartClient records a multipart upload. UploadPart fails for
+// failPart, if it's set.
+type fakeMultipartClient struct {
+	failPart int32
+
+	mu        sync.Mutex
+	parts     map[int32][]byte
+	completed []int32
+	aborted   bool
+}
+
+func (c *fakeMultipartClient) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	c.parts = map[int32][]byte{}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+func (c *fakeMultipartClient) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	number := aws.ToInt32(params.PartNumber)
+	if number == c.failPart {
+		return nil, errors.New("connection reset")
+	}
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != aws.ToInt64(params.ContentLength) {
+		return nil, errors.New("part length doesn't match ContentLength")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.parts[number] = data
+	return &s3.UploadPartOutput{ETag: aws.String("etag")}, nil
+}
+
+func (c *fakeMultipartClient) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	for _, part := range params.MultipartUpload.Parts {
+		c.completed = append(c.completed, aws.ToInt32(part.PartNumber))
+	}
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (c *fakeMultipartClient) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	c.aborted = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestPutMultipart(t *testing.T) {
+	client := &fakeMultipartClient{}
+	// Three full parts and a short last one
+	data := bytes.Repeat([]byte("0123456789"), 3*minPartSize/10+100)
+	input := &s3.CreateMultipartUploadInput{Bucket: aws.String(testBucket), Key: aws.String("landscape/big.mp4")}
+	cfg := s3MultipartConfig{partSize: minPartSize, concurrency: 2}
+
+	if err := putMultipart(t.Context(), client, input, bytes.NewReader(data), int64(len(data)), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(client.completed, []int32{1, 2, 3, 4}) {
+		t.Fatalf("completed parts %v, want 1 to 4 in order", client.completed)
+	}
+	var joined []byte
+	for _, number := range client.completed {
+		joined = append(joined, client.parts[number]...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Error("parts don't add up to the body")
+	}
+	if got := len(client.parts[4]); got != 1000 {
+		t.Errorf("last part is %d bytes, want 1000", got)
+	}
+	if client.aborted {
+		t.Error("successful upload was aborted")
+	}
+}
+
+func TestPutMultipartAbortsOnError(t *testing.T) {
+	client := &fakeMultipartClient{failPart: 2}
+	data := bytes.Repeat([]byte{1}, 3*minPartSize)
+	input := &s3.CreateMultipartUploadInput{Bucket: aws.String(testBucket), Key: aws.String("landscape/big.mp4")}
+	cfg := s3MultipartConfig{partSize: minPartSize, concurrency: 1}
+
+	if err := putMultipart(t.Context(), client, input, bytes.NewReader(data), int64(len(data)), cfg); err == nil {
+		t.Fatal("expected an error when a part fails")
+	}
+	if !client.aborted {
+		t.Error("failed upload wasn't aborted")
+	}
+	if len(client.completed) > 0 {
+		t.Error("failed upload was completed")
+	}
+	// With one part at a time, nothing after the failed part is sent
+	if _, ok := client.parts[3]; ok {
+		t.Error("part 3 was uploaded after part 2 failed")
+	}
+}
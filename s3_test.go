@@ -0,0 +1,386 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// s3Request is a request received by a test S3 server.
+type s3Request struct {
+	method string
+	path   string
+	query  string
+	header http.Header
+	body   []byte
+}
+
+// fakeS3 records the requests it gets. Each one is answered by the next
+// status in statuses, then 200 once they run out, except that HEAD is a 404
+// for anything that hasn't been PUT.
+type fakeS3 struct {
+	mu       sync.Mutex
+	requests []s3Request
+	statuses []int
+	stored   map[string]bool
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.requests = append(s.requests, s3Request{r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Clone(), body})
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+	switch {
+	// HEAD on the bucket itself is a HeadBucket, which always finds it
+	case r.Method == http.MethodHead && r.URL.Path != "/"+testBucket && !s.stored[r.URL.Path]:
+		status = http.StatusNotFound
+	case r.Method == http.MethodPut && status < 300:
+		if s.stored == nil {
+			s.stored = map[string]bool{}
+		}
+		s.stored[r.URL.Path] = true
+	}
+	s.mu.Unlock()
+
+	if r.Method == http.MethodHead && status >= 300 {
+		w.WriteHeader(status)
+		return
+	}
+
+	if status >= 300 {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(status)
+		code := "InternalError"
+		switch status {
+		case http.StatusServiceUnavailable:
+			code = "SlowDown"
+		case http.StatusForbidden:
+			code = "AccessDenied"
+		}
+		io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>`+code+`</Code><Message>fake</Message></Error>`)
+		return
+	}
+	w.Header().Set("ETag", `"etag"`)
+}
+
+func (s *fakeS3) received() []s3Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]s3Request{}, s.requests...)
+}
+
+// newTestS3Backend returns an s3Backend talking to fake over HTTP. The SDK's
+// own retries are off so the backend's can be counted.
+func newTestS3Backend(t testing.TB, fake *fakeS3) *s3Backend {
+	t.Helper()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+		}),
+		Retryer: aws.NopRetryer{},
+	})
+	return newS3Backend(client, testBucket, s3MultipartConfig{threshold: 1 << 40, partSize: minPartSize, concurrency: 1}, s3EncryptionConfig{})
+}
+
+func TestS3BackendPutRetries(t *testing.T) {
+	fake := &fakeS3{statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}}
+	storage := newTestS3Backend(t, fake)
+
+	if err := storage.Put(t.Context(), "landscape/a.mp4", strings.NewReader("video bytes"), putOptions{contentType: "video/mp4"}); err != nil {
+		t.Fatalf("Put failed after transient errors: %v", err)
+	}
+	requests := fake.received()
+	if len(requests) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(requests))
+	}
+	// Every attempt sends the whole body again
+	for i, req := range requests {
+		if string(req.body) != "video bytes" {
+			t.Errorf("attempt %d sent %q", i+1, req.body)
+		}
+	}
+}
+
+func TestS3BackendPutGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		body     io.Reader
+		want     int
+	}{
+		{"keeps failing", []int{503, 503, 503, 503}, strings.NewReader("x"), putMaxAttempts},
+		{"not retryable", []int{http.StatusForbidden}, strings.NewReader("x"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeS3{statuses: tt.statuses}
+			storage := newTestS3Backend(t, fake)
+			if err := storage.Put(t.Context(), "landscape/a.mp4", tt.body, putOptions{}); err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := len(fake.received()); got != tt.want {
+				t.Errorf("got %d attempts, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestS3BackendPutUnseekableBody(t *testing.T) {
+	fake := &fakeS3{statuses: []int{503, 503}}
+	storage := newTestS3Backend(t, fake)
+
+	// A body that can't be rewound can't be sent again
+	if err := storage.Put(t.Context(), "landscape/a.mp4", io.MultiReader(strings.NewReader("x")), putOptions{}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := len(fake.received()); got > 1 {
+		t.Errorf("got %d attempts, want at most 1", got)
+	}
+}
+
+func BenchmarkGeneratePresignedURL(b *testing.B) {
+	storage := newTestS3Backend(b, &fakeS3{})
+
+	b.Run("shared client", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := generatePresignedURL(storage.presignClient, testBucket, "landscape/a.mp4", time.Hour, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("client per call", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := generatePresignedURL(s3.NewPresignClient(storage.client), testBucket, "landscape/a.mp4", time.Hour, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDBVideoToSignedVideo(t *testing.T) {
+	cfg := newTestConfig(t)
+	if err := cfg.storage.Put(t.Context(), "landscape/a.mp4", strings.NewReader("video"), putOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		stored  string
+		want    string
+		wantErr bool
+	}{
+		{"bucket and key", testBucket + ",landscape/a.mp4", "mem://landscape%2Fa.mp4?expires=3600", false},
+		{"legacy URL", "https://tubely.s3.us-east-1.amazonaws.com/landscape/b.mp4", "https://tubely.s3.us-east-1.amazonaws.com/landscape/b.mp4", false},
+		{"legacy URL with a comma", "https://cdn.example.com/a,b.mp4", "https://cdn.example.com/a,b.mp4", false},
+		{"relative path", "/assets/a.mp4", "", true},
+		{"too many commas", "tubely,landscape,a.mp4", "", true},
+		{"non-http scheme", "ftp://example.com/a.mp4", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video, err := cfg.dbVideoToSignedVideo(database.Video{VideoURL: &tt.stored})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("signed %q as %q, want an error", tt.stored, *video.VideoURL)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *video.VideoURL != tt.want {
+				t.Errorf("video URL = %q, want %q", *video.VideoURL, tt.want)
+			}
+		})
+	}
+}
+
+func TestS3BackendPutEncryption(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		kmsKeyID  string
+		wantSSE   string
+		wantKeyID string
+	}{
+		{"bucket default", "", "", "", ""},
+		{"SSE-S3", "AES256", "", "AES256", ""},
+		{"SSE-KMS with the AWS managed key", "aws:kms", "", "aws:kms", ""},
+		{"SSE-KMS with a customer key", "aws:kms", "arn:aws:kms:us-east-1:111122223333:key/test", "aws:kms", "arn:aws:kms:us-east-1:111122223333:key/test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encryption, err := parseS3EncryptionConfig(tt.mode, tt.kmsKeyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fake := &fakeS3{}
+			storage := newTestS3Backend(t, fake)
+			storage.encryption = encryption
+
+			if err := storage.Put(t.Context(), "landscape/a.mp4", strings.NewReader("video"), putOptions{contentType: "video/mp4"}); err != nil {
+				t.Fatal(err)
+			}
+			header := fake.received()[0].header
+			if got := header.Get("X-Amz-Server-Side-Encryption"); got != tt.wantSSE {
+				t.Errorf("encryption header = %q, want %q", got, tt.wantSSE)
+			}
+			if got := header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != tt.wantKeyID {
+				t.Errorf("KMS key header = %q, want %q", got, tt.wantKeyID)
+			}
+		})
+	}
+}
+
+func TestParseS3EncryptionConfigRejects(t *testing.T) {
+	tests := []struct {
+		mode, kmsKeyID string
+	}{
+		{"aws:kms:dsse", ""},
+		{"aes256", ""},
+		{"", "arn:aws:kms:us-east-1:111122223333:key/test"},
+		{"AES256", "arn:aws:kms:us-east-1:111122223333:key/test"},
+	}
+	for _, tt := range tests {
+		if _, err := parseS3EncryptionConfig(tt.mode, tt.kmsKeyID); err == nil {
+			t.Errorf("parseS3EncryptionConfig(%q, %q) succeeded, want an error", tt.mode, tt.kmsKeyID)
+		}
+	}
+}
+
+// s3Puts returns the PutObject requests fake received for keys under prefix.
+func s3Puts(fake *fakeS3, prefix string) []s3Request {
+	var puts []s3Request
+	for _, req := range fake.received() {
+		if req.method == http.MethodPut && strings.HasPrefix(req.path, "/"+testBucket+"/"+prefix) {
+			puts = append(puts, req)
+		}
+	}
+	return puts
+}
+
+func TestHandlerUploadVideoStorageClass(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+		class string
+	}{
+		{"", http.StatusAccepted, "STANDARD"},
+		{"storage_class=GLACIER_IR", http.StatusAccepted, "GLACIER_IR"},
+		{"storage_class=INTELLIGENT_TIERING", http.StatusAccepted, "INTELLIGENT_TIERING"},
+		{"storage_class=FROZEN", http.StatusBadRequest, ""},
+		{"storage_class=standard", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(cmp.Or(tt.query, "default"), func(t *testing.T) {
+			cfg := newTestConfig(t)
+			fake := &fakeS3{}
+			cfg.storage = newTestS3Backend(t, fake)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Archived")
+
+			req := newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0))
+			req.URL.RawQuery = tt.query
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, req)
+			decodeResponse(t, rec, tt.want, nil)
+			if tt.want != http.StatusAccepted {
+				return
+			}
+			waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+
+			puts := s3Puts(fake, "landscape/")
+			if len(puts) != 1 {
+				t.Fatalf("got %d puts of the video, want 1", len(puts))
+			}
+			if got := puts[0].header.Get("X-Amz-Storage-Class"); got != tt.class {
+				t.Errorf("storage class = %q, want %q", got, tt.class)
+			}
+		})
+	}
+}
+
+func TestS3Tagging(t *testing.T) {
+	if got := s3Tagging(nil); got != nil {
+		t.Errorf("no tags encoded as %q, want nil", *got)
+	}
+	got := s3Tagging(map[string]string{"aspect_ratio": "16:9", "title": "a&b=c d"})
+	if want := "aspect_ratio=16%3A9&title=a%26b%3Dc+d"; got == nil || *got != want {
+		t.Errorf("tagging = %v, want %q", got, want)
+	}
+}
+
+func TestHandlerUploadVideoTagsObject(t *testing.T) {
+	cfg := newTestConfig(t)
+	fake := &fakeS3{}
+	cfg.storage = newTestS3Backend(t, fake)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Tagged")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+
+	puts := s3Puts(fake, "landscape/")
+	if len(puts) != 1 {
+		t.Fatalf("got %d puts of the video, want 1", len(puts))
+	}
+	tags, err := url.ParseQuery(puts[0].header.Get("X-Amz-Tagging"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := url.Values{
+		"user_id":      {user.ID.String()},
+		"video_id":     {video.ID.String()},
+		"aspect_ratio": {"16:9"},
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %v, want %v", tags, want)
+	}
+}
+
+func TestS3BackendPutContentMD5(t *testing.T) {
+	fake := &fakeS3{}
+	storage := newTestS3Backend(t, fake)
+	data := "video bytes"
+
+	if err := storage.Put(t.Context(), "landscape/a.mp4", strings.NewReader(data), putOptions{contentType: "video/mp4"}); err != nil {
+		t.Fatal(err)
+	}
+	puts := s3Puts(fake, "")
+	if len(puts) != 1 {
+		t.Fatalf("got %d PUTs, want 1", len(puts))
+	}
+	sum := md5.Sum([]byte(data))
+	if got, want := puts[0].header.Get("Content-MD5"), base64.StdEncoding.EncodeToString(sum[:]); got != want {
+		t.Errorf("Content-MD5 = %q, want %q", got, want)
+	}
+	if string(puts[0].body) != data {
+		t.Errorf("body = %q, want %q", puts[0].body, data)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// sniffContentType detects the media type of f from its first 512 bytes and
+// rewinds it so the whole file can still be read afterward.
+func sniffContentType(f io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// mayBeVideo reports whether a type sniffed by sniffContentType could be
+// one of the accepted videos. Anything else, like an image or text, surely
+// isn't.
+func mayBeVideo(sniffed string) bool {
+	return strings.HasPrefix(sniffed, "video/") || sniffed == "application/octet-stream"
+}
+
+// videoFormatNames maps accepted video media types to the ffprobe container
+// names that are allowed for them.
+var videoFormatNames = map[string][]string{
+	"video/mp4":       {"mp4", "mov"},
+	"video/quicktime": {"mov", "mp4"},
+	"video/webm":      {"webm", "matroska"},
+}
+
+// videoMatchesMediaType checks that the file at filePath really is the
+// declared kind of video. http.DetectContentType only recognizes some of
+// these containers (QuickTime files usually sniff as octet-stream), so when
+// it doesn't agree the container ffprobe detected, formatName, has the final
+// say. formatName is empty when ffprobe couldn't make sense of the file.
+func videoMatchesMediaType(filePath, mediaType, formatName string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	sniffed, err := sniffContentType(f)
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+	if sniffed == mediaType {
+		return true, nil
+	}
+	if !mayBeVideo(sniffed) {
+		return false, nil
+	}
+
+	for _, name := range strings.Split(formatName, ",") {
+		for _, allowed := range videoFormatNames[mediaType] {
+			if name == allowed {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
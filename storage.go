@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// errObjectNotFound is returned by StorageBackend.Get for a missing key.
+var errObjectNotFound = errors.New("object not found")
+
+// StorageBackend is where uploaded video objects live. Handlers only deal in
+// object keys; each backend decides how keys map to stored bytes and URLs.
+type StorageBackend interface {
+	Put(ctx context.Context, key string, body io.Reader, opts putOptions) error
+	// Get opens the object at key and returns its content type. It returns
+	// errObjectNotFound if there's no such object.
+	Get(ctx context.Context, key string) (io.ReadCloser, string, error)
+	PresignedGetURL(key string, d time.Duration) (string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// directUploader is implemented by backends that let clients upload straight
+// to storage with a presigned PUT, so the bytes don't pass through the
+// server. The URL only accepts exactly contentType and contentLength.
+type directUploader interface {
+	PresignedPutURL(key, contentType string, contentLength int64, d time.Duration) (string, error)
+}
+
+// downloadPresigner is implemented by backends whose presigned URLs can
+// override the Content-Disposition of the response, e.g. to force a download.
+type downloadPresigner interface {
+	PresignedDownloadURL(key, contentDisposition string, d time.Duration) (string, error)
+}
+
+// objectLister is implemented by backends that can enumerate their objects,
+// which the orphan cleanup needs.
+type objectLister interface {
+	// List returns every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]objectInfo, error)
+}
+
+// objectChecker is implemented by backends that can cheaply tell whether an
+// object exists, so generated keys can be checked for collisions.
+type objectChecker interface {
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+// objectInfo describes a stored object.
+type objectInfo struct {
+	key          string
+	lastModified time.Time
+}
+
+// healthChecker is implemented by backends that can cheaply check they're
+// reachable, for the health check endpoint.
+type healthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// putOptions describes how an object is stored. Backends ignore options they
+// have no equivalent for.
+type putOptions struct {
+	contentType string
+	// storageClass is an S3 storage class; empty uses the bucket default
+	storageClass string
+	// tags label the object, e.g. so storage costs can be attributed
+	tags map[string]string
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fsBackend stores objects as plain files under root and serves them from
+// baseURL, so the app can run locally without AWS credentials.
+type fsBackend struct {
+	root    string
+	baseURL string
+}
+
+func newFSBackend(root, baseURL string) (*fsBackend, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &fsBackend{root: root, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+// Check makes sure the root directory is still there.
+func (b *fsBackend) Check(ctx context.Context) error {
+	info, err := os.Stat(b.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(b.root + " is not a directory")
+	}
+	return nil
+}
+
+// objectPath maps a key to a path inside root. Cleaning the key as an
+// absolute path first stops "../" segments from escaping the root.
+func (b *fsBackend) objectPath(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (b *fsBackend) Put(ctx context.Context, key string, body io.Reader, opts putOptions) error {
+	objectPath := b.objectPath(key)
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(objectPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(objectPath)
+		return err
+	}
+	return f.Close()
+}
+
+// Get guesses the content type from the key's extension since local files
+// don't keep one.
+func (b *fsBackend) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	f, err := os.Open(b.objectPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", errObjectNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return f, mime.TypeByExtension(path.Ext(key)), nil
+}
+
+// PresignedGetURL ignores the expiry; local files are served without signing.
+func (b *fsBackend) PresignedGetURL(key string, d time.Duration) (string, error) {
+	return b.baseURL + "/" + strings.TrimPrefix(path.Clean("/"+key), "/"), nil
+}
+
+// List walks the directory for prefix. Only whole path segments are matched,
+// which is all the callers need.
+func (b *fsBackend) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var objects []objectInfo
+	err := filepath.WalkDir(b.objectPath(prefix), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(b.root, p)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, objectInfo{key: filepath.ToSlash(rel), lastModified: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (b *fsBackend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(b.objectPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *fsBackend) Delete(ctx context.Context, key string) error {
+	err := os.Remove(b.objectPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// handler serves stored objects by key (mount it with the URL prefix
+// stripped). http.ServeContent takes care of Range requests, which players
+// need to seek, along with conditional requests and the content type.
+func (b *fsBackend) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		f, err := os.Open(b.objectPath(r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	})
+}
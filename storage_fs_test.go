@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func newTestFSBackend(t *testing.T) *fsBackend {
+	t.Helper()
+	storage, err := newFSBackend(filepath.Join(t.TempDir(), "storage"), "http://localhost:8091/storage/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestFSBackend(t *testing.T) {
+	testStorageBackend(t, newTestFSBackend(t))
+}
+
+func TestFSBackendStaysInRoot(t *testing.T) {
+	storage := newTestFSBackend(t)
+	if err := storage.Put(t.Context(), "../../escape.mp4", strings.NewReader("x"), putOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(storage.root, "escape.mp4")); err != nil {
+		t.Errorf("object wasn't stored inside the root: %v", err)
+	}
+	if got, _ := storage.PresignedGetURL("../../escape.mp4", 0); got != "http://localhost:8091/storage/escape.mp4" {
+		t.Errorf("PresignedGetURL = %q", got)
+	}
+}
+
+func TestFSBackendRoundTrip(t *testing.T) {
+	cfg := newTestConfig(t)
+	storage := newTestFSBackend(t)
+	cfg.storage = storage
+
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Local")
+	data := testMP4(4096)
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", data))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+
+	signed, err := cfg.dbVideoToSignedVideo(ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, found := strings.CutPrefix(*signed.VideoURL, "http://localhost:8091/storage")
+	if !found {
+		t.Fatalf("video URL = %q, want one under the storage base URL", *signed.VideoURL)
+	}
+
+	srv := httptest.NewServer(http.StripPrefix("/storage", storage.handler()))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/storage" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("served %d bytes, want the %d uploaded", len(got), len(data))
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "video/mp4" {
+		t.Errorf("Content-Type = %q, want video/mp4", ct)
+	}
+}
+
+func TestFSBackendHandlerRange(t *testing.T) {
+	storage := newTestFSBackend(t)
+	data := testMP4(1000)
+	if err := storage.Put(t.Context(), "landscape/a.mp4", bytes.NewReader(data), putOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.StripPrefix("/storage", storage.handler())
+
+	req := httptest.NewRequest(http.MethodGet, "/storage/landscape/a.mp4", nil)
+	req.Header.Set("Range", "bytes=0-99")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", rec.Code)
+	}
+	if want := fmt.Sprintf("bytes 0-99/%d", len(data)); rec.Header().Get("Content-Range") != want {
+		t.Errorf("Content-Range = %q, want %q", rec.Header().Get("Content-Range"), want)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data[:100]) {
+		t.Errorf("got %d bytes, want the first 100", rec.Body.Len())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "video/mp4" {
+		t.Errorf("Content-Type = %q, want video/mp4", got)
+	}
+
+	// A conditional request for an unchanged object gets no body
+	req = httptest.NewRequest(http.MethodGet, "/storage/landscape/a.mp4", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("conditional request status = %d, want 304", rec.Code)
+	}
+
+	for _, target := range []string{"/storage/landscape/missing.mp4", "/storage/landscape"} {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s status = %d, want 404", target, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memObject struct {
+	data    []byte
+	opts    putOptions
+	modTime time.Time
+}
+
+// memBackend keeps objects in memory, standing in for S3 in tests.
+type memBackend struct {
+	mu      sync.RWMutex
+	objects map[string]memObject
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{objects: map[string]memObject{}}
+}
+
+func (b *memBackend) Put(ctx context.Context, key string, body io.Reader, opts putOptions) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = memObject{data: data, opts: opts, modTime: time.Now()}
+	return nil
+}
+
+func (b *memBackend) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	obj, ok := b.objects[key]
+	if !ok {
+		return nil, "", errObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), obj.opts.contentType, nil
+}
+
+// PresignedGetURL returns a deterministic fake URL so callers can assert on it.
+func (b *memBackend) PresignedGetURL(key string, d time.Duration) (string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if _, ok := b.objects[key]; !ok {
+		return "", fmt.Errorf("object %q not found", key)
+	}
+	return fmt.Sprintf("mem://%s?expires=%d", url.PathEscape(key), int(d.Seconds())), nil
+}
+
+func (b *memBackend) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var objects []objectInfo
+	for key, obj := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, objectInfo{key: key, lastModified: obj.modTime})
+		}
+	}
+	return objects, nil
+}
+
+func (b *memBackend) Exists(ctx context.Context, key string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.objects[key]
+	return ok, nil
+}
+
+func (b *memBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	return nil
+}
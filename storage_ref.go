@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// storageRef identifies an object in the bucket. It's stored in the database
+// as an "s3://bucket/key" URI.
+type storageRef struct {
+	Bucket string
+	Key    string
+}
+
+func (r storageRef) String() string {
+	return "s3://" + r.Bucket + "/" + r.Key
+}
+
+// storedForms returns every string r may be stored as. Rows written before
+// `tubely migrate-video-urls` was run hold "bucket,key" instead, so matching
+// a reference against the database has to look for both.
+func (r storageRef) storedForms() []string {
+	return []string{r.String(), r.Bucket + "," + r.Key}
+}
+
+// objectRef returns the reference to store for key in the app's bucket.
+func (cfg *apiConfig) objectRef(key string) string {
+	return storageRef{cfg.s3Bucket, key}.String()
+}
+
+// parseStorageRef reads a reference stored in the database. Every stored
+// reference is read through here. The older "bucket,key" form is still
+// accepted for rows that haven't been migrated.
+func parseStorageRef(s string) (storageRef, error) {
+	var ref storageRef
+	if rest, ok := strings.CutPrefix(s, "s3://"); ok {
+		ref.Bucket, ref.Key, _ = strings.Cut(rest, "/")
+	} else if bucket, key, found := strings.Cut(s, ","); found && !strings.Contains(key, ",") {
+		ref = storageRef{bucket, key}
+	}
+	if ref.Bucket == "" || ref.Key == "" || strings.Contains(ref.Bucket, "/") {
+		return storageRef{}, fmt.Errorf("malformed storage reference %q", s)
+	}
+	return ref, nil
+}
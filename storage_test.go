@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStorageBackend runs the StorageBackend contract against an empty
+// backend.
+func testStorageBackend(t *testing.T, storage StorageBackend) {
+	t.Helper()
+	ctx := t.Context()
+
+	if _, _, err := storage.Get(ctx, "landscape/missing.mp4"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Get of a missing key: err = %v, want errObjectNotFound", err)
+	}
+
+	keys := []string{"landscape/a.mp4", "landscape/b.mp4", "portrait/c.mp4"}
+	for _, key := range keys {
+		if err := storage.Put(ctx, key, strings.NewReader("data for "+key), putOptions{contentType: "video/mp4"}); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	body, contentType, err := storage.Get(ctx, "landscape/a.mp4")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data for landscape/a.mp4" {
+		t.Errorf("Get returned %q", data)
+	}
+	if contentType != "video/mp4" {
+		t.Errorf("content type = %q, want video/mp4", contentType)
+	}
+
+	if signed, err := storage.PresignedGetURL("landscape/a.mp4", time.Hour); err != nil || signed == "" {
+		t.Errorf("PresignedGetURL = %q, %v", signed, err)
+	}
+
+	if checker, ok := storage.(objectChecker); ok {
+		for key, want := range map[string]bool{"landscape/a.mp4": true, "landscape/missing.mp4": false} {
+			if exists, err := checker.Exists(ctx, key); err != nil || exists != want {
+				t.Errorf("Exists(%s) = %v, %v, want %v", key, exists, err, want)
+			}
+		}
+	}
+
+	if lister, ok := storage.(objectLister); ok {
+		objects, err := lister.List(ctx, "landscape/")
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		var listed []string
+		for _, obj := range objects {
+			listed = append(listed, obj.key)
+			if obj.lastModified.IsZero() {
+				t.Errorf("%s has no modification time", obj.key)
+			}
+		}
+		slices.Sort(listed)
+		if want := keys[:2]; !slices.Equal(listed, want) {
+			t.Errorf("List(landscape/) = %q, want %q", listed, want)
+		}
+	}
+
+	if err := storage.Delete(ctx, "landscape/a.mp4"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := storage.Get(ctx, "landscape/a.mp4"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Get after Delete: err = %v, want errObjectNotFound", err)
+	}
+	// Deleting twice isn't an error, so cleanups can be retried
+	if err := storage.Delete(ctx, "landscape/a.mp4"); err != nil {
+		t.Errorf("second Delete: %v", err)
+	}
+}
+
+func TestMemBackend(t *testing.T) {
+	testStorageBackend(t, newMemBackend())
+}
+
+func TestMemBackendPresignedGetURL(t *testing.T) {
+	storage := newMemBackend()
+	if err := storage.Put(t.Context(), "portrait/a b.mp4", strings.NewReader("x"), putOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := storage.PresignedGetURL("portrait/a b.mp4", 90*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "mem://portrait%2Fa%20b.mp4?expires=90"; got != want {
+		t.Errorf("PresignedGetURL = %q, want %q", got, want)
+	}
+	if _, err := storage.PresignedGetURL("portrait/missing.mp4", time.Minute); err == nil {
+		t.Error("expected an error signing a missing object")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"golang.org/x/image/draw"
+)
+
+// maxThumbnailPixels caps the size of uploaded thumbnails. A small file can
+// declare huge dimensions, and decoding allocates memory for every pixel.
+const maxThumbnailPixels = 50_000_000
+
+// thumbnailSizes are the widths of the scaled down copies saved alongside
+// every thumbnail, so list views don't have to load the full image.
+var thumbnailSizes = []struct {
+	name  string
+	width int
+}{
+	{"small", 320},
+	{"medium", 640},
+	{"large", 1280},
+}
+
+// scaleToWidth resizes img to width, keeping its aspect ratio. Images that
+// are already narrower are returned as is rather than scaled up.
+func scaleToWidth(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return img
+	}
+	height := max(1, int(math.Round(float64(bounds.Dy())*float64(width)/float64(bounds.Dx()))))
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// cropToAspectRatio center-crops img to the aspect ratio of width:height,
+// keeping its full height when it's too wide and its full width when it's too
+// tall.
+func cropToAspectRatio(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	if width <= 0 || height <= 0 || b.Dx() == 0 || b.Dy() == 0 {
+		return img
+	}
+	cropW, cropH := b.Dx(), b.Dy()
+	if b.Dx()*height > b.Dy()*width {
+		cropW = max(1, int(math.Round(float64(b.Dy())*float64(width)/float64(height))))
+	} else {
+		cropH = max(1, int(math.Round(float64(b.Dx())*float64(height)/float64(width))))
+	}
+	if cropW == b.Dx() && cropH == b.Dy() {
+		return img
+	}
+
+	src := image.Pt(b.Min.X+(b.Dx()-cropW)/2, b.Min.Y+(b.Dy()-cropH)/2)
+	dst := image.NewRGBA(image.Rect(0, 0, cropW, cropH))
+	draw.Draw(dst, dst.Bounds(), img, src, draw.Src)
+	return dst
+}
+
+// dominantColor returns the most common color of img as a hex string such as
+// "#1a2b3c". Colors are grouped into coarse buckets so near identical shades
+// count together, and the average of the largest bucket is returned.
+func dominantColor(img image.Image) string {
+	img = scaleToWidth(img, 64)
+	b := img.Bounds()
+
+	type bucket struct {
+		count   int
+		r, g, b uint32
+	}
+	buckets := map[uint32]*bucket{}
+	var top *bucket
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			r, g, bl = r>>8, g>>8, bl>>8
+			key := r>>4<<8 | g>>4<<4 | bl>>4
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.count++
+			bk.r += r
+			bk.g += g
+			bk.b += bl
+			if top == nil || bk.count > top.count {
+				top = bk
+			}
+		}
+	}
+	if top == nil {
+		return ""
+	}
+	n := uint32(top.count)
+	return fmt.Sprintf("#%02x%02x%02x", top.r/n, top.g/n, top.b/n)
+}
+
+// encodeImage writes img in the format of mediaType.
+func encodeImage(w io.Writer, img image.Image, mediaType string) error {
+	switch mediaType {
+	case "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "image/png":
+		return png.Encode(w, img)
+	default:
+		return fmt.Errorf("unsupported thumbnail type %s", mediaType)
+	}
+}
+
+// thumbnailFormats maps the ?format= values accepted for thumbnails to the
+// media type they're stored as.
+var thumbnailFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+// writeAsset encodes img to name under assetsRoot and returns its URL.
+func (cfg *apiConfig) writeAsset(ctx context.Context, name string, img image.Image, mediaType string) (string, error) {
+	assetPath := filepath.Join(cfg.assetsRoot, name)
+	if mediaType == "image/webp" {
+		encodeCtx, cancel := cfg.ffmpegContext(ctx)
+		defer cancel()
+		if err := encodeWebP(encodeCtx, cfg.ffmpegPath, img, assetPath); err != nil {
+			return "", err
+		}
+		return cfg.getAssetURL(name), nil
+	}
+
+	f, err := os.Create(assetPath)
+	if err != nil {
+		return "", err
+	}
+	if err := encodeImage(f, img, mediaType); err != nil {
+		f.Close()
+		// Don't leave a truncated image behind
+		os.Remove(assetPath)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(assetPath)
+		return "", err
+	}
+	return cfg.getAssetURL(name), nil
+}
+
+// saveThumbnail stores img as the video's thumbnail along with a copy for
+// each of thumbnailSizes, sets the URLs on video and saves them to the DB.
+// mediaType is the format to store them in. The previous thumbnail files
+// are only removed once the DB points at the new ones. Errors are
+// pipelineErrors.
+//
+// Every save uses new file names, so a URL always refers to the same image
+// and browsers can cache thumbnails for good.
+func (cfg *apiConfig) saveThumbnail(ctx context.Context, video *database.Video, img image.Image, mediaType string) error {
+	previous := *video
+	if err := cfg.writeThumbnailFiles(ctx, video, img, mediaType); err != nil {
+		return &pipelineError{http.StatusInternalServerError, "Unable to write thumbnail file", err}
+	}
+	if err := cfg.db.UpdateVideoThumbnail(*video); err != nil {
+		// The row still points at the old files, so the new ones go instead
+		cfg.deleteThumbnailFiles(ctx, *video)
+		*video = previous
+		return &pipelineError{http.StatusInternalServerError, "Unable to update video", err}
+	}
+	cfg.deleteThumbnailFiles(ctx, previous)
+	return nil
+}
+
+// writeThumbnailFiles writes img and its sized copies under new names and
+// sets their URLs on video, leaving any previous files alone.
+func (cfg *apiConfig) writeThumbnailFiles(ctx context.Context, video *database.Video, img image.Image, mediaType string) error {
+	version := make([]byte, 6)
+	if _, err := rand.Read(version); err != nil {
+		return err
+	}
+	base := video.ID.String() + "-" + base64.RawURLEncoding.EncodeToString(version)
+	ext := mediaTypeExtension(mediaType)
+
+	// Nothing points at the new files until video is saved, so if one of
+	// them can't be written the ones already written are removed again
+	var written []string
+	removeWritten := func() {
+		for _, name := range written {
+			os.Remove(filepath.Join(cfg.assetsRoot, name))
+		}
+	}
+
+	thumbnailURL, err := cfg.writeAsset(ctx, base+ext, img, mediaType)
+	if err != nil {
+		return err
+	}
+	written = append(written, base+ext)
+
+	variants := database.ThumbnailVariants{}
+	for _, size := range thumbnailSizes {
+		name := fmt.Sprintf("%s-%s%s", base, size.name, ext)
+		variantURL, err := cfg.writeAsset(ctx, name, scaleToWidth(img, size.width), mediaType)
+		if err != nil {
+			removeWritten()
+			return err
+		}
+		written = append(written, name)
+		variants[size.name] = variantURL
+	}
+
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailVariants = variants
+	video.BlurHash = blurHash(img)
+	video.DominantColor = dominantColor(img)
+	return nil
+}
+
+// deleteThumbnailFiles removes the video's thumbnail and its sized copies.
+// Failures are only logged since a leftover file does no harm.
+func (cfg *apiConfig) deleteThumbnailFiles(ctx context.Context, video database.Video) {
+	urls := []string{}
+	if video.ThumbnailURL != nil {
+		urls = append(urls, *video.ThumbnailURL)
+	}
+	for _, variantURL := range video.ThumbnailVariants {
+		urls = append(urls, variantURL)
+	}
+	for _, thumbnailURL := range urls {
+		if err := cfg.deleteThumbnailFile(thumbnailURL); err != nil {
+			slog.ErrorContext(ctx, "couldn't delete thumbnail", "video_id", video.ID, "url", thumbnailURL, "error", err.Error())
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDominantColor(t *testing.T) {
+	// Shades close enough to land in the same bucket are averaged
+	shades := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for y := range 16 {
+		for x := range 16 {
+			shades.Set(x, y, color.RGBA{uint8(0x40 + x), 0x80, 0xc0, 255})
+		}
+	}
+	// A gradient across the top quarter doesn't outweigh the rest
+	banner := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := range 100 {
+		for x := range 200 {
+			c := color.RGBA{0x10, 0x20, 0x30, 255}
+			if y < 25 {
+				c = color.RGBA{uint8(x), uint8(y * 10), 0xff, 255}
+			}
+			banner.Set(x, y, c)
+		}
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+		want string
+	}{
+		{"solid", solidImage(100, 50, color.RGBA{0xab, 0xcd, 0xef, 255}), "#abcdef"},
+		{"black", solidImage(10, 10, color.Black), "#000000"},
+		{"shades", shades, "#4780c0"},
+		{"gradient banner", banner, "#102030"},
+		{"empty", image.NewRGBA(image.Rect(0, 0, 0, 0)), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dominantColor(tt.img); got != tt.want {
+				t.Errorf("dominantColor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadThumbnailDominantColor(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Thumbnail")
+
+	var data bytes.Buffer
+	if err := png.Encode(&data, solidImage(64, 36, color.RGBA{0x12, 0x34, 0x56, 255})); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(rec, newThumbnailRequest(t, video.ID, token, "image/png", data.Bytes()))
+	decodeResponse(t, rec, http.StatusOK, nil)
+
+	if got := getTestVideo(t, cfg, video.ID); got.DominantColor != "#123456" {
+		t.Errorf("dominant color = %q, want #123456", got.DominantColor)
+	}
+}
+
+func TestCropToAspectRatio(t *testing.T) {
+	wide, _, err := image.Decode(bytes.NewReader(testImage(t, 1600, 900, "image/png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tall, _, err := image.Decode(bytes.NewReader(testImage(t, 900, 1600, "image/png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		img           image.Image
+		ratioW        int
+		ratioH        int
+		width, height int
+		// the source pixel that should end up in the top left corner
+		srcX, srcY int
+	}{
+		{"16:9 to 9:16", wide, 9, 16, 506, 900, 547, 0},
+		{"9:16 to 16:9", tall, 1920, 1080, 900, 506, 0, 547},
+		{"same ratio", wide, 1920, 1080, 1600, 900, 0, 0},
+		{"unknown ratio", wide, 0, 0, 1600, 900, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cropToAspectRatio(tt.img, tt.ratioW, tt.ratioH)
+			if b := got.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Fatalf("cropped to %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+			b := got.Bounds()
+			if c, want := color.RGBAModel.Convert(got.At(b.Min.X, b.Min.Y)), color.RGBAModel.Convert(tt.img.At(tt.srcX, tt.srcY)); c != want {
+				t.Errorf("top left pixel = %v, want %v from %d,%d", c, want, tt.srcX, tt.srcY)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadThumbnailCrop(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Portrait")
+	video.Width, video.Height = 1080, 1920
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	data := testImage(t, 1600, 900, "image/png")
+
+	tests := []struct {
+		name          string
+		query         string
+		width, height int
+	}{
+		{"not asked to", "", 1600, 900},
+		{"cropped", "crop=true", 506, 900},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newThumbnailRequest(t, video.ID, token, "image/png", data)
+			req.URL.RawQuery = tt.query
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(rec, req)
+			decodeResponse(t, rec, http.StatusOK, nil)
+
+			got := getTestVideo(t, cfg, video.ID)
+			if w, h := assetSize(t, cfg, *got.ThumbnailURL); w != tt.width || h != tt.height {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", w, h, tt.width, tt.height)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// runEvery calls fn every interval until ctx is done.
+func runEvery(ctx context.Context, interval time.Duration, fn func(context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn(ctx)
+		}
+	}
+}
+
+// purgeDeletedVideos permanently removes the videos that have been in the
+// trash for longer than the retention period, along with their files.
+func (cfg *apiConfig) purgeDeletedVideos(ctx context.Context) {
+	videos, err := cfg.db.GetVideosDeletedBefore(time.Now().Add(-cfg.trashRetention))
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't list deleted videos", "error", err.Error())
+		return
+	}
+	for _, video := range videos {
+		if err := cfg.purgeVideo(ctx, video); err != nil {
+			slog.ErrorContext(ctx, "couldn't purge video", "video_id", video.ID, "error", err.Error())
+		}
+	}
+	if len(videos) > 0 {
+		slog.InfoContext(ctx, "purged deleted videos", "count", len(videos))
+	}
+}
+
+// purgeVideo deletes a video and its files for good.
+func (cfg *apiConfig) purgeVideo(ctx context.Context, video database.Video) error {
+	// A missing or undeletable object shouldn't block removing the video
+	// itself, so storage failures are only logged. Deduplicated videos share
+	// their objects, which are kept until the last of them is deleted.
+	if video.VideoURL != nil {
+		if ref, err := parseStorageRef(*video.VideoURL); err != nil {
+			slog.ErrorContext(ctx, "couldn't parse video URL", "video_id", video.ID, "error", err.Error())
+		} else if shared, err := cfg.db.CountVideosWithURL(ref.storedForms(), video.ID); err != nil {
+			slog.ErrorContext(ctx, "couldn't check whether video is shared", "video_id", video.ID, "error", err.Error())
+		} else if shared == 0 {
+			if err := cfg.storage.Delete(ctx, ref.Key); err != nil {
+				slog.ErrorContext(ctx, "couldn't delete video object", "video_id", video.ID, "key", ref.Key, "error", err.Error())
+			}
+		}
+	}
+	if video.HLSURL != nil && !isAbsoluteURL(*video.HLSURL) {
+		if err := cfg.deleteUnreferencedHLS(ctx, *video.HLSURL, video.ID); err != nil {
+			slog.ErrorContext(ctx, "couldn't delete HLS package", "video_id", video.ID, "error", err.Error())
+		}
+	}
+	cfg.deleteThumbnailFiles(ctx, video)
+
+	return cfg.db.DeleteVideo(video.ID)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// allowedVideoTypes are the upload media types the pipeline accepts.
+// Anything that isn't MP4 is transcoded before it's stored.
+var allowedVideoTypes = map[string]bool{
+	"video/mp4":       true,
+	"video/quicktime": true,
+	"video/webm":      true,
+}
+
+// pipelineError is returned by processVideo. It carries the status code and
+// message to respond with, while err keeps the underlying cause for logging.
+type pipelineError struct {
+	code int
+	msg  string
+	err  error
+}
+
+func (e *pipelineError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+func (e *pipelineError) Unwrap() error {
+	return e.err
+}
+
+func respondWithPipelineError(w http.ResponseWriter, err error) {
+	var pErr *pipelineError
+	if errors.As(err, &pErr) {
+		respondWithError(w, pErr.code, pErr.msg, pErr.err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Unable to process video", err)
+}
+
+type processOptions struct {
+	// autoThumbnail generates a poster frame when the video has no thumbnail
+	autoThumbnail bool
+	// storageClass is the S3 storage class for the video and its renditions
+	storageClass string
+	// skipFastStart stores the video as is, without moving the moov atom to
+	// the front
+	skipFastStart bool
+}
+
+// aspectRatioPrefixes maps aspect ratio categories to the key prefix videos
+// are stored under.
+var aspectRatioPrefixes = map[string]string{
+	"16:9":  "landscape",
+	"9:16":  "portrait",
+	"4:3":   "standard",
+	"21:9":  "ultrawide",
+	"other": "other",
+}
+
+// processVideo runs an uploaded video at tmpPath through probing,
+// transcoding, faststart and storage, then saves the result on video.
+// The caller owns tmpPath and is responsible for removing it.
+func (cfg *apiConfig) processVideo(ctx context.Context, video database.Video, tmpPath, mediaType string, opts processOptions) (database.Video, error) {
+	// Everything about the upload comes from this one probe
+	probeCtx, cancel := cfg.ffmpegContext(ctx)
+	source, probeErr := probeVideo(probeCtx, cfg.ffprobePath, tmpPath)
+	cancel()
+
+	// Don't trust the declared Content-Type; make sure the bytes agree
+	matches, err := videoMatchesMediaType(tmpPath, mediaType, source.Format.FormatName)
+	if err != nil {
+		return video, &pipelineError{http.StatusInternalServerError, "Unable to inspect video", err}
+	}
+	if !matches {
+		return video, &pipelineError{http.StatusBadRequest, "File contents don't match the declared Content-Type", nil}
+	}
+	if probeErr != nil {
+		return video, &pipelineError{http.StatusInternalServerError, "Unable to inspect video", probeErr}
+	}
+
+	aspectRatio, width, height, err := source.aspectRatio()
+	if err != nil {
+		if errors.Is(err, errNoVideoStream) {
+			return video, &pipelineError{http.StatusBadRequest, "file contains no video stream", err}
+		}
+		if errors.Is(err, errInvalidDimensions) {
+			return video, &pipelineError{http.StatusBadRequest, "Video has invalid dimensions", err}
+		}
+		return video, &pipelineError{http.StatusInternalServerError, "Unable to determine aspect ratio", err}
+	}
+
+	duration, err := source.duration()
+	if err != nil {
+		return video, &pipelineError{http.StatusInternalServerError, "Unable to determine duration", err}
+	}
+	if cfg.maxDurationSeconds > 0 && duration > float64(cfg.maxDurationSeconds) {
+		return video, &pipelineError{
+			http.StatusBadRequest,
+			fmt.Sprintf("Video is %.0f seconds long, the limit is %d seconds", duration, cfg.maxDurationSeconds),
+			nil,
+		}
+	}
+
+	// Everything is stored as MP4, whatever container it was uploaded in
+	const storedMediaType = "video/mp4"
+	key, err := getUniqueKey(ctx, cfg.storage, func() (string, error) {
+		name, err := randomName()
+		if err != nil {
+			return "", err
+		}
+		return cfg.keyTemplate.expand(keyVars{
+			aspect:  aspectRatioPrefixes[aspectRatio],
+			userID:  video.UserID,
+			videoID: video.ID,
+			time:    time.Now(),
+			rand:    name,
+			ext:     strings.TrimPrefix(mediaTypeExtension(storedMediaType), "."),
+		}), nil
+	})
+	if err != nil {
+		return video, &pipelineError{http.StatusInternalServerError, "Unable to generate file name", err}
+	}
+
+	// Other containers are always transcoded. MP4s are too when their video
+	// isn't H.264, unless the policy is to reject them.
+	needsTranscode := mediaType != storedMediaType
+	if !needsTranscode {
+		if codec := source.mediaInfo().videoCodec; codec != "h264" {
+			if cfg.codecPolicy == codecPolicyReject {
+				return video, &pipelineError{
+					http.StatusBadRequest,
+					fmt.Sprintf("Video codec %q isn't supported, please upload H.264", codec),
+					nil,
+				}
+			}
+			needsTranscode = true
+		}
+	}
+
+	// Rewriting the file is skipped when the caller opts out or the moov
+	// atom is already at the front. Transcoded output never has it there.
+	needsFastStart := !opts.skipFastStart
+	if needsFastStart && !needsTranscode {
+		fastStart, err := hasFastStart(tmpPath)
+		if err != nil {
+			return video, &pipelineError{http.StatusInternalServerError, "Unable to inspect video", err}
+		}
+		needsFastStart = !fastStart
+	}
+
+	// Transcoding re-encodes every frame, so it dominates the progress;
+	// the other steps only copy streams
+	const transcodeWeight, copyWeight = 8, 1
+	totalWeight := 0
+	if needsTranscode {
+		totalWeight += transcodeWeight
+	}
+	if needsFastStart {
+		totalWeight += copyWeight
+	}
+	if cfg.hlsSegmentSeconds > 0 {
+		totalWeight += copyWeight
+	}
+	progress := newProgressTracker(duration, float64(totalWeight), func(percent float64) {
+		if err := cfg.db.UpdateVideoProgress(video.ID, percent); err != nil {
+			slog.ErrorContext(ctx, "couldn't save progress", "video_id", video.ID, "error", err.Error())
+		}
+	})
+
+	sourcePath := tmpPath
+	if needsTranscode {
+		transcodeCtx, cancel := cfg.ffmpegContext(ctx)
+		transcodedPath, err := transcodeToMP4(transcodeCtx, cfg.ffmpegPath, sourcePath, progress.step(transcodeWeight))
+		cancel()
+		if err != nil {
+			return video, &pipelineError{http.StatusInternalServerError, "Unable to transcode video", err}
+		}
+		defer os.Remove(transcodedPath)
+		sourcePath = transcodedPath
+	}
+
+	processedPath := sourcePath
+	if needsFastStart {
+		fastStartCtx, cancel := cfg.ffmpegContext(ctx)
+		processedPath, err = processVideoForFastStart(fastStartCtx, cfg.ffmpegPath, sourcePath, progress.step(copyWeight))
+		cancel()
+		if err != nil {
+			return video, &pipelineError{http.StatusInternalServerError, "Unable to process video", err}
+		}
+		defer os.Remove(processedPath)
+	}
+
+	processedInfo, err := os.Stat(processedPath)
+	if err != nil {
+		return video, &pipelineError{http.StatusInternalServerError, "Unable to read processed video", err}
+	}
+	if err := cfg.checkStorageQuota(video.UserID, video.ID, processedInfo.Size()); err != nil {
+		return video, err
+	}
+
+	// Moving the moov atom keeps the streams as they were, but a transcoded
+	// file has new codecs, so that's probed again to describe what's stored
+	media := source.mediaInfo()
+	if needsTranscode {
+		probeCtx, cancel := cfg.ffmpegContext(ctx)
+		media, err = getMediaInfo(probeCtx, cfg.ffprobePath, processedPath)
+		cancel()
+		if err != nil {
+			return video, &pipelineError{http.StatusInternalServerError, "Unable to inspect video", err}
+		}
+	}
+
+	storeOpts := putOptions{
+		contentType:  storedMediaType,
+		storageClass: opts.storageClass,
+		tags: map[string]string{
+			"user_id":      video.UserID.String(),
+			"video_id":     video.ID.String(),
+			"aspect_ratio": aspectRatio,
+		},
+	}
+	if err := cfg.uploadFile(ctx, processedPath, key, storeOpts); err != nil {
+		return video, &pipelineError{http.StatusInternalServerError, "Unable to upload video", err}
+	}
+	// Nothing references the new objects until the video is saved, so
+	// they're removed again if a later step fails
+	uploadedKeys := []string{key}
+
+	if cfg.hlsSegmentSeconds > 0 {
+		hlsPrefix := strings.TrimSuffix(key, path.Ext(key)) + "-hls"
+		manifestKey, hlsKeys, hlsSize, err := cfg.uploadHLS(ctx, processedPath, hlsPrefix, storeOpts, progress.step(copyWeight))
+		uploadedKeys = append(uploadedKeys, hlsKeys...)
+		if err != nil {
+			cfg.deleteObjects(ctx, uploadedKeys)
+			return video, &pipelineError{http.StatusInternalServerError, "Unable to package video for streaming", err}
+		}
+		hlsURL := cfg.objectRef(manifestKey)
+		video.HLSURL = &hlsURL
+		video.HLSSizeBytes = hlsSize
+	} else {
+		video.HLSURL = nil
+		video.HLSSizeBytes = 0
+	}
+
+	// Store a reference so a fresh presigned URL can be generated on read
+	videoURL := cfg.objectRef(key)
+	video.VideoURL = &videoURL
+	video.Width = width
+	video.Height = height
+	video.AspectRatio = exactAspectRatio(width, height)
+	video.Duration = duration
+	video.SizeBytes = processedInfo.Size()
+	video.VideoCodec = media.videoCodec
+	video.AudioCodec = media.audioCodec
+	video.Container = media.container
+	video.Status = database.VideoStatusReady
+	video.Progress = 100
+	video.ProcessingError = nil
+	if err := cfg.db.UpdateVideoProcessingResult(video); err != nil {
+		cfg.deleteObjects(ctx, uploadedKeys)
+		return video, &pipelineError{http.StatusInternalServerError, "Unable to update video", err}
+	}
+	// Pick up anything the owner changed while the video was processing
+	if current, err := cfg.db.GetVideo(video.ID); err != nil {
+		slog.ErrorContext(ctx, "couldn't reload video", "video_id", video.ID, "error", err.Error())
+	} else if current.ID != uuid.Nil {
+		video = current
+	}
+
+	// The video itself is stored at this point, so a failed poster is only
+	// logged rather than failing the whole upload
+	if video.ThumbnailURL == nil && opts.autoThumbnail {
+		if err := cfg.generatePosterThumbnail(ctx, &video, tmpPath, duration); err != nil {
+			slog.ErrorContext(ctx, "couldn't generate poster", "video_id", video.ID, "error", err.Error())
+		}
+	}
+
+	return video, nil
+}
+
+// ffmpegContext bounds a single ffmpeg or ffprobe run, so a malformed file
+// can't hang processing forever. Every run gets the full FFMPEG_TIMEOUT
+// rather than sharing one budget with the rest of the pipeline.
+func (cfg *apiConfig) ffmpegContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cfg.ffmpegTimeout)
+}
+
+// deleteObjects removes stored objects that turned out not to be needed.
+// Failures are only logged; the orphan cleanup catches anything left over.
+func (cfg *apiConfig) deleteObjects(ctx context.Context, keys []string) {
+	// Clean up even if the request that uploaded them was cancelled
+	ctx = context.WithoutCancel(ctx)
+	for _, key := range keys {
+		if err := cfg.storage.Delete(ctx, key); err != nil {
+			slog.ErrorContext(ctx, "couldn't delete object", "key", key, "error", err.Error())
+		}
+	}
+}
+
+// deleteUnreferencedObject removes the stored object key unless a video
+// still points at it, which deduplicated uploads can do after the video it
+// was stored for has moved on to a new file.
+func (cfg *apiConfig) deleteUnreferencedObject(ctx context.Context, key string) error {
+	refs, err := cfg.db.CountVideosWithURL(storageRef{cfg.s3Bucket, key}.storedForms(), uuid.Nil)
+	if err != nil {
+		return err
+	}
+	if refs > 0 {
+		return nil
+	}
+	return cfg.storage.Delete(ctx, key)
+}
+
+// deleteUnreferencedHLS removes every object of the HLS package whose master
+// playlist is stored at hlsURL, unless a video other than exclude still
+// points at it.
+func (cfg *apiConfig) deleteUnreferencedHLS(ctx context.Context, hlsURL string, exclude uuid.UUID) error {
+	manifest, err := parseStorageRef(hlsURL)
+	if err != nil {
+		return err
+	}
+	refs, err := cfg.db.CountVideosWithHLSURL(manifest.storedForms(), exclude)
+	if err != nil {
+		return err
+	}
+	if refs > 0 {
+		return nil
+	}
+	manifestKey := manifest.Key
+	lister, ok := cfg.storage.(objectLister)
+	if !ok {
+		return cfg.storage.Delete(ctx, manifestKey)
+	}
+	// The segments and playlists are the only objects under the package's
+	// prefix
+	objects, err := lister.List(ctx, path.Dir(manifestKey)+"/")
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := cfg.storage.Delete(ctx, obj.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generatePosterThumbnail extracts a frame from the video at videoPath, which
+// is duration seconds long, saves it as the video's thumbnail and persists
+// the new ThumbnailURL.
+func (cfg *apiConfig) generatePosterThumbnail(ctx context.Context, video *database.Video, videoPath string, duration float64) error {
+	// Take the frame at 1s, or earlier for very short clips
+	atSeconds := math.Min(1.0, duration*0.1)
+	return cfg.saveFrameAsThumbnail(ctx, video, videoPath, atSeconds)
+}
+
+// saveFrameAsThumbnail extracts the frame at atSeconds from the video at
+// videoPath, saves it as the video's thumbnail and persists the new
+// ThumbnailURL.
+func (cfg *apiConfig) saveFrameAsThumbnail(ctx context.Context, video *database.Video, videoPath string, atSeconds float64) error {
+	frameCtx, cancel := cfg.ffmpegContext(ctx)
+	posterPath, err := extractPosterFrame(frameCtx, cfg.ffmpegPath, videoPath, atSeconds)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(posterPath)
+
+	poster, err := os.Open(posterPath)
+	if err != nil {
+		return err
+	}
+	defer poster.Close()
+
+	img, err := jpeg.Decode(poster)
+	if err != nil {
+		return err
+	}
+	return cfg.saveThumbnail(ctx, video, img, "image/jpeg")
+}
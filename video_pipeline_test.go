@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestProcessVideoTimesOutEachFFmpegRun(t *testing.T) {
+	cfg := newTestConfig(t)
+	// A transcoded upload is probed before and after, and each probe fits
+	// in the timeout but both together don't
+	cfg.ffmpegTimeout = time.Second
+	writeTestFile(t, filepath.Join(filepath.Dir(cfg.ffprobePath), "probe.delay"), "0.6", 0o644)
+
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Slow probes")
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/quicktime", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+}
+
+func TestProcessVideoFFmpegTimeout(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.ffmpegTimeout = 200 * time.Millisecond
+	writeTestFile(t, filepath.Join(filepath.Dir(cfg.ffprobePath), "probe.delay"), "1", 0o644)
+
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Stuck probe")
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	waitForStatus(t, cfg, video.ID, database.VideoStatusFailed)
+}
+
+// The upload is probed once and everything about it comes from that; only
+// a transcoded file has to be probed again.
+func TestProcessVideoProbesOnce(t *testing.T) {
+	tests := []struct {
+		name       string
+		mediaType  string
+		data       []byte
+		wantProbes int
+	}{
+		{"stored as is", "video/mp4", testMP4(0), 1},
+		{"faststart", "video/mp4", testMP4MoovLast(0), 1},
+		{"transcoded", "video/quicktime", testMP4(0), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Probed")
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, tt.mediaType, tt.data))
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+			ready := waitForStatus(t, cfg, video.ID, database.VideoStatusReady)
+			drainProcessing(t, cfg)
+
+			if runs := ffprobeRuns(t, cfg); len(runs) != tt.wantProbes {
+				t.Errorf("ffprobe ran %d times, want %d: %q", len(runs), tt.wantProbes, runs)
+			}
+			if ready.Width != 1920 || ready.Height != 1080 || ready.Duration != 5 || ready.VideoCodec != "h264" || ready.AudioCodec != "aac" {
+				t.Errorf("video = %dx%d %.1fs %s/%s, want 1920x1080 5.0s h264/aac",
+					ready.Width, ready.Height, ready.Duration, ready.VideoCodec, ready.AudioCodec)
+			}
+		})
+	}
+}
+
+// failingPutBackend can't store anything, like an S3 bucket the app has
+// lost write access to.
+type failingPutBackend struct {
+	*memBackend
+}
+
+func (b failingPutBackend) Put(ctx context.Context, key string, body io.Reader, opts putOptions) error {
+	return errors.New("put failed")
+}
+
+// A failed upload to storage leaves the video pointing at whatever it
+// pointed at before, never at the object that wasn't stored.
+func TestProcessVideoStorageFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+	}{
+		{"first upload", false},
+		{"replacing a stored video", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID, "Unstored")
+			if tt.existing {
+				video = storeTestVideo(t, cfg, video, "landscape/old.mp4", testMP4(0))
+			}
+			mem := cfg.storage.(*memBackend)
+			cfg.storage = failingPutBackend{mem}
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+			decodeResponse(t, rec, http.StatusAccepted, nil)
+			failed := waitForStatus(t, cfg, video.ID, database.VideoStatusFailed)
+			drainProcessing(t, cfg)
+
+			if failed.ProcessingError == nil || *failed.ProcessingError != "Unable to upload video" {
+				t.Errorf("processing error = %v, want Unable to upload video", deref(failed.ProcessingError))
+			}
+			if deref(failed.VideoURL) != deref(video.VideoURL) {
+				t.Errorf("video URL = %q, want %q", deref(failed.VideoURL), deref(video.VideoURL))
+			}
+			if failed.VideoURL != nil {
+				ref, err := parseStorageRef(*failed.VideoURL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				key := ref.Key
+				if exists, _ := mem.Exists(t.Context(), key); !exists {
+					t.Errorf("video points at %s, which isn't stored", key)
+				}
+			}
+		})
+	}
+}
+
+// recordingDeleteBackend remembers the keys it was asked to delete.
+type recordingDeleteBackend struct {
+	*memBackend
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (b *recordingDeleteBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	b.deleted = append(b.deleted, key)
+	b.mu.Unlock()
+	return b.memBackend.Delete(ctx, key)
+}
+
+// Objects stored for a video that then can't be saved are removed again,
+// since nothing references them.
+func TestProcessVideoDBFailureDeletesObjects(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Unsaved")
+	backend := &recordingDeleteBackend{memBackend: cfg.storage.(*memBackend)}
+	cfg.storage = backend
+	// Only saving the finished video fails, so it can still be marked failed
+	failDBUpdates(t, cfg, "status", "NEW.status = 'ready'")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+	failed := waitForStatus(t, cfg, video.ID, database.VideoStatusFailed)
+	drainProcessing(t, cfg)
+
+	if failed.VideoURL != nil {
+		t.Errorf("video URL = %q, want none", *failed.VideoURL)
+	}
+	backend.mu.Lock()
+	deleted := backend.deleted
+	backend.mu.Unlock()
+	if len(deleted) != 1 || !strings.HasPrefix(deleted[0], "landscape/") {
+		t.Errorf("deleted %q, want the uploaded video", deleted)
+	}
+	if keys := storedKeys(t, cfg); len(keys) > 0 {
+		t.Errorf("objects left in storage: %v", keys)
+	}
+}
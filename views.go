@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// viewTracker remembers who has viewed which video recently, so reloading a
+// video doesn't count as another view.
+type viewTracker struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newViewTracker(window time.Duration) *viewTracker {
+	return &viewTracker{
+		window: window,
+		seen:   map[string]time.Time{},
+	}
+}
+
+// firstView records a view of videoID by session and reports whether it's
+// the first one within the window.
+func (t *viewTracker) firstView(videoID uuid.UUID, session string) bool {
+	now := time.Now()
+	key := videoID.String() + "|" + session
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.lastPrune) > t.window {
+		for k, at := range t.seen {
+			if now.Sub(at) >= t.window {
+				delete(t.seen, k)
+			}
+		}
+		t.lastPrune = now
+	}
+
+	if at, ok := t.seen[key]; ok && now.Sub(at) < t.window {
+		return false
+	}
+	t.seen[key] = now
+	return true
+}
+
+// viewSession identifies who is watching: the user if there is one,
+// otherwise the client's address and user agent.
+func viewSession(r *http.Request, userID uuid.UUID) string {
+	if userID != uuid.Nil {
+		return "user:" + userID.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host + "|" + r.UserAgent()
+}
+
+// countView increments the video's view count if this is a new view. Owners
+// previewing their own videos pass ?preview=true to skip it; anyone else
+// passing it is counted as usual. Failing to count a view isn't worth
+// failing playback over, so errors are only logged.
+func (cfg *apiConfig) countView(r *http.Request, video *database.Video, userID uuid.UUID) {
+	if video.VideoURL == nil || cfg.isPreview(r, *video) {
+		return
+	}
+	if !cfg.views.firstView(video.ID, viewSession(r, userID)) {
+		return
+	}
+	if err := cfg.db.IncrementVideoViews(video.ID); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't count view", "video_id", video.ID, "error", err.Error())
+		return
+	}
+	video.Views++
+}
+
+// isPreview reports whether the request asks for ?preview=true and comes
+// from someone who can manage the video.
+func (cfg *apiConfig) isPreview(r *http.Request, video database.Video) bool {
+	if r.URL.Query().Get("preview") != "true" {
+		return false
+	}
+	claims, err := cfg.authenticate(r)
+	return err == nil && canManageVideo(claims, video)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestViewTrackerFirstView(t *testing.T) {
+	tracker := newViewTracker(time.Hour)
+	video := uuid.New()
+
+	if !tracker.firstView(video, "a") {
+		t.Error("first view wasn't counted")
+	}
+	if tracker.firstView(video, "a") {
+		t.Error("repeat view within the window was counted")
+	}
+	if !tracker.firstView(video, "b") {
+		t.Error("another session's view wasn't counted")
+	}
+	if !tracker.firstView(uuid.New(), "a") {
+		t.Error("a view of another video wasn't counted")
+	}
+}
+
+func TestCountViewPreview(t *testing.T) {
+	cfg := newTestConfig(t)
+	video, ownerToken := readyPublicVideo(t, cfg)
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+
+	tests := []struct {
+		name      string
+		token     string
+		query     string
+		wantCount bool
+	}{
+		{"anonymous", "", "", true},
+		{"anonymous preview", "", "?preview=true", true},
+		{"other user preview", otherToken, "?preview=true", true},
+		{"owner preview", ownerToken, "?preview=true", false},
+		{"owner", ownerToken, "", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := getTestVideo(t, cfg, video.ID).Views
+
+			req := newJSONRequest(t, http.MethodGet, "/api/public/videos/"+video.ID.String()+tt.query, tt.token, nil)
+			req.SetPathValue("videoID", video.ID.String())
+			// A new address for every case so none of them is deduplicated
+			req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i+1)
+			rec := httptest.NewRecorder()
+			cfg.handlerPublicVideoGet(rec, req)
+			decodeResponse(t, rec, http.StatusOK, nil)
+
+			counted := getTestVideo(t, cfg, video.ID).Views > before
+			if counted != tt.wantCount {
+				t.Errorf("counted = %v, want %v", counted, tt.wantCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	webhookMaxAttempts = 5
+	webhookTimeout     = 10 * time.Second
+	// webhookSignatureHeader carries "sha256=" plus the hex HMAC-SHA256 of
+	// the request body, keyed with the shared secret
+	webhookSignatureHeader = "X-Tubely-Signature"
+)
+
+// webhookNotifier tells an integrator's endpoint when a video has finished
+// processing, so they don't have to poll.
+type webhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func newWebhookNotifier(url, secret string) *webhookNotifier {
+	return &webhookNotifier{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+type videoWebhookPayload struct {
+	VideoID  uuid.UUID `json:"video_id"`
+	Status   string    `json:"status"`
+	Error    *string   `json:"error,omitempty"`
+	Duration float64   `json:"duration"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	VideoURL *string   `json:"video_url"`
+	HLSURL   *string   `json:"hls_url"`
+}
+
+// signWebhookBody returns the value of webhookSignatureHeader for body.
+func signWebhookBody(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// send POSTs payload, retrying with backoff on network errors, 5xx and 429
+// responses.
+func (n *webhookNotifier) send(ctx context.Context, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	signature := signWebhookBody(n.secret, body)
+
+	return retryWithBackoff(ctx, webhookMaxAttempts, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+		if err != nil {
+			return permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookSignatureHeader, signature)
+
+		resp, err := n.client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			return fmt.Errorf("webhook responded with %s", resp.Status)
+		default:
+			return permanent(fmt.Errorf("webhook responded with %s", resp.Status))
+		}
+	})
+}
+
+// notifyVideoProcessed sends the video's final status to the webhook, if
+// one is configured. Delivery happens in the background so a slow endpoint
+// doesn't hold up a processing worker.
+func (cfg *apiConfig) notifyVideoProcessed(ctx context.Context, video database.Video) {
+	if cfg.webhook == nil {
+		return
+	}
+
+	payload := videoWebhookPayload{
+		VideoID:  video.ID,
+		Status:   video.Status,
+		Error:    video.ProcessingError,
+		Duration: video.Duration,
+		Width:    video.Width,
+		Height:   video.Height,
+	}
+	if video.Status == database.VideoStatusReady {
+		signed, err := cfg.dbVideoToSignedVideo(video)
+		if err != nil {
+			slog.ErrorContext(ctx, "couldn't sign URLs for webhook", "video_id", video.ID, "error", err.Error())
+		} else {
+			payload.VideoURL = signed.VideoURL
+			payload.HLSURL = signed.HLSURL
+		}
+	}
+
+	// Delivery outlives the job or request that triggered it
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := cfg.webhook.send(ctx, payload); err != nil {
+			slog.ErrorContext(ctx, "couldn't deliver webhook", "video_id", video.ID, "error", err.Error())
+		}
+	}()
+}
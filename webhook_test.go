@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type webhookDelivery struct {
+	signature string
+	body      []byte
+}
+
+// newWebhookServer records every delivery it receives and responds with the
+// statuses in order, then 200 once they run out.
+func newWebhookServer(t *testing.T, statuses ...int) (*httptest.Server, chan webhookDelivery) {
+	t.Helper()
+	deliveries := make(chan webhookDelivery, 10)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- webhookDelivery{signature: r.Header.Get(webhookSignatureHeader), body: body}
+		if i := int(calls.Add(1)) - 1; i < len(statuses) {
+			w.WriteHeader(statuses[i])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, deliveries
+}
+
+func receiveWebhook(t *testing.T, deliveries chan webhookDelivery) webhookDelivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(10 * time.Second):
+		t.Fatal("no webhook was delivered")
+		return webhookDelivery{}
+	}
+}
+
+func TestSignWebhookBody(t *testing.T) {
+	// echo -n '{"a":1}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=aa9e2e3575f5d7098b6caccd790888c36d5fdb63342a73bada2d6a51747a8494"
+	if got := signWebhookBody([]byte("secret"), []byte(`{"a":1}`)); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if signWebhookBody([]byte("other"), []byte(`{"a":1}`)) == want {
+		t.Error("signature doesn't depend on the secret")
+	}
+}
+
+func TestWebhookReadyVideo(t *testing.T) {
+	server, deliveries := newWebhookServer(t)
+	cfg := newTestConfig(t)
+	cfg.webhook = newWebhookNotifier(server.URL, "secret")
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Webhook")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+
+	d := receiveWebhook(t, deliveries)
+	if want := signWebhookBody([]byte("secret"), d.body); d.signature != want {
+		t.Errorf("signature = %q, want %q", d.signature, want)
+	}
+	var payload videoWebhookPayload
+	if err := json.Unmarshal(d.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.VideoID != video.ID || payload.Status != database.VideoStatusReady {
+		t.Errorf("payload is for %s with status %q, want %s ready", payload.VideoID, payload.Status, video.ID)
+	}
+	if payload.Width != 1920 || payload.Height != 1080 || payload.Duration != 5 {
+		t.Errorf("payload has %dx%d, %vs; want 1920x1080, 5s", payload.Width, payload.Height, payload.Duration)
+	}
+	if payload.VideoURL == nil || !strings.HasPrefix(*payload.VideoURL, "mem://") {
+		t.Errorf("video_url = %v, want a signed URL", payload.VideoURL)
+	}
+	if payload.Error != nil {
+		t.Errorf("error = %q, want none", *payload.Error)
+	}
+}
+
+func TestWebhookFailedVideo(t *testing.T) {
+	server, deliveries := newWebhookServer(t)
+	cfg := newTestConfig(t)
+	cfg.webhook = newWebhookNotifier(server.URL, "secret")
+	setProbeOutput(t, cfg, `{"streams": [{"codec_type": "audio"}], "format": {"format_name": "mov,mp4", "duration": "1"}}`)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID, "Webhook")
+
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, newUploadRequest(t, video.ID, token, "video/mp4", testMP4(0)))
+	decodeResponse(t, rec, http.StatusAccepted, nil)
+
+	var payload map[string]any
+	if err := json.Unmarshal(receiveWebhook(t, deliveries).body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["status"] != database.VideoStatusFailed || payload["error"] == nil {
+		t.Errorf("payload = %v, want a failed status with an error", payload)
+	}
+	if payload["video_url"] != nil {
+		t.Errorf("failed payload has video_url %v", payload["video_url"])
+	}
+}
+
+func TestWebhookSendRetries(t *testing.T) {
+	server, deliveries := newWebhookServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	n := newWebhookNotifier(server.URL, "secret")
+	if err := n.send(t.Context(), map[string]string{"id": uuid.NewString()}); err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 {
+		t.Errorf("got %d attempts, want 3", len(deliveries))
+	}
+}
+
+func TestWebhookSendGivesUpOnClientErrors(t *testing.T) {
+	server, deliveries := newWebhookServer(t, http.StatusBadRequest)
+	n := newWebhookNotifier(server.URL, "secret")
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	if err := n.send(ctx, map[string]string{}); err == nil {
+		t.Error("expected an error for a 400 response")
+	}
+	if len(deliveries) != 1 {
+		t.Errorf("got %d attempts, want 1", len(deliveries))
+	}
+}